@@ -1,26 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/cover"
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/directory"
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/forwarder"
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/middleware"
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/mtls"
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/onion"
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/swarm"
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/udp"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/yaml.v3"
 )
@@ -31,15 +39,32 @@ var (
 )
 
 type Server struct {
-	config     *common.Config
-	router     *onion.Router
-	swarm      *swarm.Store
-	directory  *directory.Service
-	httpServer *http.Server
-	mtlsClient *mtls.Client
+	config      *common.Config
+	privateKey  ed25519.PrivateKey
+	keyRing     *onion.KeyRing
+	router      *onion.Router
+	batcher     *onion.Batcher // Batches packets from UDP and peer links
+	swarm       *swarm.Store
+	reassembler *swarm.Reassembler
+	directory   *directory.Service
+	httpServer  *http.Server
+	mtlsClient  *mtls.Client
+	linkServer  *mtls.LinkServer
+	swarmAPI    *mux.Router // Swarm API routes reachable through onion requests
+	requests    forwarder.RequestSender
+	udpSender   *udp.Sender
+	udpListener *udp.Listener
+	padder      *forwarder.Padder
+	forwarder   *forwarder.Forwarder
+	mixer       *onion.Mixer
+	cover       *cover.Generator
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "packet" {
+		os.Exit(runPacketCommand(os.Args[2:]))
+	}
+	
 	configFile := flag.String("config", "config.yaml", "Configuration file path")
 	version := flag.Bool("version", false, "Show version")
 	flag.Parse()
@@ -61,9 +86,6 @@ func main() {
 		log.Fatalf("Failed to load private key: %v", err)
 	}
 
-	// Initialize components
-	onionRouter := onion.NewRouter(privateKey)
-	
 	// Initialize storage backend based on config
 	var storage swarm.Storage
 	switch config.Storage.Backend {
@@ -79,14 +101,97 @@ func main() {
 		log.Println("Using in-memory storage (not suitable for production)")
 	}
 	
+	// Initialize replay protection (persisted in the storage backend)
+	replayFilter, err := onion.NewReplayFilter(storage, &onion.ReplayConfig{
+		Epoch:             time.Duration(config.Replay.EpochMinutes) * time.Minute,
+		MaxPacketLifetime: time.Duration(config.Replay.MaxPacketLifetimeMinutes) * time.Minute,
+		Capacity:          config.Replay.Capacity,
+		FalsePositiveRate: config.Replay.FalsePositiveRate,
+		FlushInterval:     time.Duration(config.Replay.FlushIntervalSeconds) * time.Second,
+		MaxFilters:        config.Replay.MaxFiltersPerEpoch,
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize replay filter: %v", err)
+	}
+	registerReplayMetrics(replayFilter)
+	
+	// Initialize rotating onion keys
+	keyRing, err := onion.NewKeyRing(privateKey, time.Duration(config.OnionKeys.EpochMinutes)*time.Minute)
+	if err != nil {
+		log.Fatalf("Failed to initialize onion keys: %v", err)
+	}
+	if replayFilter.MaxPacketLifetime() > keyRing.EpochLength() {
+		log.Printf("WARNING: max packet lifetime %v exceeds onion key epoch %v; long-lived packets may outlive their key",
+			replayFilter.MaxPacketLifetime(), keyRing.EpochLength())
+	}
+	
+	// The directory also resolves next hops addressed by node ID
+	directoryService := directory.NewService(privateKey)
+	
+	// Version 1 packets are accepted until the end of the transition period
+	var v1Until time.Time
+	if config.PacketFormat.AcceptV1Until != "" {
+		v1Until, err = time.Parse(time.RFC3339, config.PacketFormat.AcceptV1Until)
+		if err != nil {
+			log.Fatalf("Invalid packet_format.accept_v1_until: %v", err)
+		}
+		log.Printf("Accepting version 1 onion packets until %s", v1Until.Format(time.RFC3339))
+	}
+	
+	// Per-hop delays chosen by senders are clamped into the delay policy
+	if config.DelayPolicy.MaxMs > 0 && config.DelayPolicy.MinMs > config.DelayPolicy.MaxMs {
+		log.Fatalf("Invalid delay_policy: min_ms %d exceeds max_ms %d", config.DelayPolicy.MinMs, config.DelayPolicy.MaxMs)
+	}
+	
+	// Circuit mode keeps per-circuit symmetric keys for low-latency cells
+	var circuits *onion.CircuitTable
+	if config.Circuits.Enabled {
+		circuits = onion.NewCircuitTable(&onion.CircuitConfig{
+			IdleTimeout: time.Duration(config.Circuits.IdleTimeoutSeconds) * time.Second,
+			MaxCircuits: config.Circuits.MaxCircuits,
+		})
+		registerCircuitMetrics(circuits)
+		log.Println("Circuit mode enabled")
+	}
+	
+	onionRouter := onion.NewRouterWithConfig(privateKey, &onion.RouterConfig{
+		Keys:     keyRing,
+		Replay:   replayFilter,
+		V1Until:  v1Until,
+		Resolver: directoryService,
+		Workers:  config.Processing.Workers,
+		MinDelay: time.Duration(config.DelayPolicy.MinMs) * time.Millisecond,
+		MaxDelay: time.Duration(config.DelayPolicy.MaxMs) * time.Millisecond,
+		Circuits: circuits,
+	})
+	registerRouterMetrics(onionRouter)
+	batcher := onion.NewBatcher(onionRouter, config.Processing.QueueSize)
+	registerBatcherMetrics(batcher)
+	
 	swarmStore := swarm.NewStore(
 		storage,
 		config.BootstrapNodes,
 		config.Swarm.ReplicationFactor,
 		config.Swarm.TTLDays,
 	)
-	
-	directoryService := directory.NewService(privateKey)
+	if len(config.Swarm.PaddingBuckets) > 0 {
+		if err := swarmStore.SetPaddingBuckets(config.Swarm.PaddingBuckets); err != nil {
+			log.Fatalf("Invalid padding buckets: %v", err)
+		}
+	}
+	if config.PoW.Enabled {
+		if err := swarmStore.SetPoWDifficulty(config.PoW.Difficulty); err != nil {
+			log.Fatalf("Invalid proof-of-work difficulty: %v", err)
+		}
+		log.Printf("Proof of work required for submitted messages (%d bits base)", config.PoW.Difficulty)
+	}
+	registerSwarmMetrics(swarmStore)
+	reassembler := swarm.NewReassembler(swarmStore, &swarm.ReassemblyConfig{
+		Timeout:      time.Duration(config.Reassembly.TimeoutSeconds) * time.Second,
+		MaxBytes:     config.Reassembly.MaxBytes,
+		MaxFragments: config.Reassembly.MaxFragments,
+	})
+	registerReassemblyMetrics(reassembler)
 
 	// Initialize mTLS client if enabled
 	var mtlsClient *mtls.Client
@@ -97,20 +202,115 @@ func main() {
 			KeyFile:  config.MTLS.KeyFile,
 			Timeout:  30 * time.Second,
 		}
+		if config.MTLS.Link.Enabled {
+			mtlsConfig.Link = linkConfig(config)
+		}
 		var err error
 		mtlsClient, err = mtls.NewClient(mtlsConfig)
 		if err != nil {
 			log.Fatalf("Failed to initialize mTLS client: %v", err)
 		}
 		log.Println("mTLS enabled for inter-node communication")
+		
+		// Replicate over the same links as forwarded packets
+		swarmStore.SetReplicator(mtlsClient)
+		if links := mtlsClient.Links(); links != nil {
+			registerLinkMetrics(links)
+		}
+	}
+
+	// Initialize packet forwarding queue
+	var sender forwarder.Sender
+	var requestSender forwarder.RequestSender
+	if mtlsClient != nil {
+		sender = mtlsClient
+		requestSender = mtlsClient
+	} else {
+		scheme := "http"
+		if config.TLS.CertFile != "" && config.TLS.KeyFile != "" {
+			scheme = "https"
+		}
+		httpSender := forwarder.NewHTTPSender(scheme, 30*time.Second)
+		sender = httpSender
+		requestSender = httpSender
+		log.Printf("mTLS disabled, forwarding packets over plain %s", scheme)
+	}
+	
+	// Forward to nodes with a UDP port over UDP, and to the rest as before
+	var udpSender *udp.Sender
+	if config.UDP.Enabled {
+		udpSender, err = udp.NewSender(privateKey, directoryService, sender)
+		if err != nil {
+			log.Fatalf("Failed to initialize UDP sender: %v", err)
+		}
+		sender = udpSender
+	}
+	
+	// Pad links to active neighbors to a constant packet rate
+	var padder *forwarder.Padder
+	if config.LinkPadding.Enabled {
+		padder, err = forwarder.NewPadder(sender, func(nodeAddress string) ([]byte, error) {
+			node, err := directoryService.ResolveAddress(nodeAddress)
+			if err != nil {
+				return nil, err
+			}
+			return onion.BuildDummyPacket(*node)
+		}, &forwarder.PaddingConfig{
+			Rate:         config.LinkPadding.Rate,
+			MaxBandwidth: config.LinkPadding.MaxBandwidthKBps * 1024,
+			QueueSize:    config.LinkPadding.QueueSize,
+			IdleTimeout:  time.Duration(config.LinkPadding.IdleTimeoutSeconds) * time.Second,
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize link padding: %v", err)
+		}
+		registerPaddingMetrics(padder)
+		log.Printf("Link padding enabled (%.1f packets/s per neighbor)", config.LinkPadding.Rate)
+		sender = padder
+	}
+	packetForwarder := forwarder.NewForwarder(sender, &forwarder.Config{
+		QueueSize:    config.Forwarding.QueueSize,
+		Workers:      config.Forwarding.Workers,
+		MaxAttempts:  config.Forwarding.MaxAttempts,
+		RetryBackoff: time.Duration(config.Forwarding.RetryBackoffMs) * time.Millisecond,
+	})
+	registerForwarderMetrics(packetForwarder)
+
+	// Initialize packet mixing in front of the forwarding queue
+	mixStrategy, err := onion.NewMixStrategy(&onion.MixConfig{
+		Strategy:  config.Mixing.Strategy,
+		Interval:  time.Duration(config.Mixing.IntervalMs) * time.Millisecond,
+		Retain:    config.Mixing.Retain,
+		MeanDelay: time.Duration(config.Mixing.MeanDelayMs) * time.Millisecond,
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize mixing: %v", err)
+	}
+	var mixer *onion.Mixer
+	if mixStrategy != nil {
+		mixer = onion.NewMixer(mixStrategy, config.Forwarding.QueueSize, func(decision *onion.RoutingDecision) {
+			// Queue-full drops are counted by the forwarder
+			packetForwarder.Enqueue(decision.NextAddress, decision.NextPacket, decision.Delay)
+		})
+		registerMixerMetrics(mixer)
+		log.Printf("Packet mixing enabled (%s)", config.Mixing.Strategy)
 	}
 
 	server := &Server{
-		config:     config,
-		router:     onionRouter,
-		swarm:      swarmStore,
-		directory:  directoryService,
-		mtlsClient: mtlsClient,
+		config:      config,
+		privateKey:  privateKey,
+		keyRing:     keyRing,
+		router:      onionRouter,
+		batcher:     batcher,
+		swarm:       swarmStore,
+		reassembler: reassembler,
+		directory:   directoryService,
+		mtlsClient:  mtlsClient,
+		requests:    requestSender,
+		udpSender:   udpSender,
+		padder:      padder,
+		forwarder:   packetForwarder,
+		mixer:       mixer,
 	}
 
 	// Start HTTP server
@@ -121,6 +321,47 @@ func main() {
 	// Wait for shutdown signal
 	server.WaitForShutdown()
 	
+	// Close links from peers; the HTTP server does not track them
+	if server.linkServer != nil {
+		if err := server.linkServer.Close(); err != nil {
+			log.Printf("Error closing peer links: %v", err)
+		}
+	}
+	
+	// Stop receiving datagrams
+	if server.udpListener != nil {
+		if err := server.udpListener.Close(); err != nil {
+			log.Printf("Error closing UDP listener: %v", err)
+		}
+	}
+	
+	// Both ingress paths are closed; fail what is still waiting for a batch
+	server.batcher.Close()
+	
+	// Stop cover traffic before the queues it feeds
+	if server.cover != nil {
+		server.cover.Close()
+	}
+	
+	// Stop mixing and forwarding (pending packets are dropped)
+	if server.mixer != nil {
+		if err := server.mixer.Close(); err != nil {
+			log.Printf("Error closing mixer: %v", err)
+		}
+	}
+	if err := server.forwarder.Close(); err != nil {
+		log.Printf("Error closing forwarder: %v", err)
+	}
+	if server.padder != nil {
+		server.padder.Close()
+	}
+	
+	if server.udpSender != nil {
+		if err := server.udpSender.Close(); err != nil {
+			log.Printf("Error closing UDP sender: %v", err)
+		}
+	}
+	
 	// Cleanup mTLS client
 	if server.mtlsClient != nil {
 		if err := server.mtlsClient.Close(); err != nil {
@@ -128,6 +369,16 @@ func main() {
 		}
 	}
 	
+	reassembler.Close()
+	if circuits != nil {
+		circuits.Close()
+	}
+	
+	// Persist replay filters before closing storage
+	if err := replayFilter.Close(); err != nil {
+		log.Printf("Error closing replay filter: %v", err)
+	}
+	
 	// Cleanup storage
 	if err := storage.Close(); err != nil {
 		log.Printf("Error closing storage: %v", err)
@@ -157,11 +408,28 @@ func (s *Server) Start() error {
 	
 	// Onion routing
 	api.HandleFunc("/onion", s.handleOnionPacket).Methods("POST")
+	api.HandleFunc("/onion/request", s.handleOnionRequest).Methods("POST")
+	api.HandleFunc("/onion/circuit", s.handleOnionCell).Methods("POST")
 	
-	// Swarm store-and-forward
-	api.HandleFunc("/swarm/messages/{sessionID}", s.handleRetrieveMessages).Methods("GET")
-	api.HandleFunc("/swarm/messages", s.handleStoreMessage).Methods("POST")
-	api.HandleFunc("/swarm/messages/{sessionID}/{messageID}", s.handleDeleteMessage).Methods("DELETE")
+	// Swarm store-and-forward, directly and through onion requests
+	s.swarmRoutes(api)
+	s.swarmAPI = mux.NewRouter()
+	s.swarmRoutes(s.swarmAPI.PathPrefix("/v1").Subrouter())
+	
+	// Replication and persistent links (packets, replication and pings)
+	// are for peers only: they need mTLS, and a client certificate valid
+	// for a node in the directory
+	if s.config.MTLS.Enabled {
+		peerOnly := func(h http.Handler) http.Handler {
+			return mtls.RequirePeer(s.directory, h)
+		}
+		api.Handle("/swarm/replicate", peerOnly(http.HandlerFunc(s.handleReplicateMessage))).Methods("POST")
+		api.Handle("/swarm/replicate/{sessionID}/{messageID}", peerOnly(http.HandlerFunc(s.handleDeleteReplica))).Methods("DELETE")
+		
+		s.linkServer = mtls.NewLinkServer(s, linkConfig(s.config))
+		api.Handle("/link", peerOnly(s.linkServer)).Methods("GET")
+		registerLinkServerMetrics(s.linkServer)
+	}
 	
 	// Directory service
 	api.HandleFunc("/nodes/bootstrap", s.handleGetBootstrap).Methods("GET")
@@ -172,7 +440,7 @@ func (s *Server) Start() error {
 	r.HandleFunc("/health", s.handleHealth).Methods("GET")
 	r.HandleFunc("/metrics", promhttp.Handler().ServeHTTP).Methods("GET")
 
-	// Configure TLS
+	// Configure TLS; with mTLS, peers present certificates from the node CA
 	tlsConfig := &tls.Config{
 		MinVersion: tls.VersionTLS13,
 		CipherSuites: []uint16{
@@ -181,6 +449,12 @@ func (s *Server) Start() error {
 			tls.TLS_AES_128_GCM_SHA256,
 		},
 	}
+	if s.config.MTLS.Enabled {
+		var err error
+		if tlsConfig, err = mtls.ServerTLSConfig(s.config.MTLS.CAFile); err != nil {
+			return fmt.Errorf("mTLS: %w", err)
+		}
+	}
 
 	s.httpServer = &http.Server{
 		Addr:         s.config.ListenAddress,
@@ -200,6 +474,9 @@ func (s *Server) Start() error {
 			err = s.httpServer.ListenAndServeTLS(s.config.TLS.CertFile, s.config.TLS.KeyFile)
 		} else {
 			log.Println("WARNING: Running without TLS (use for testing only)")
+			if s.config.MTLS.Enabled {
+				log.Println("WARNING: Peer-only routes refuse every request without TLS")
+			}
 			err = s.httpServer.ListenAndServe()
 		}
 		if err != nil && err != http.ErrServerClosed {
@@ -207,6 +484,47 @@ func (s *Server) Start() error {
 		}
 	}()
 
+	// Accept onion packets from other nodes over UDP
+	if s.config.UDP.Enabled {
+		host, _, err := net.SplitHostPort(s.config.ListenAddress)
+		if err != nil {
+			return fmt.Errorf("invalid listen address: %w", err)
+		}
+		s.udpListener, err = udp.Listen(
+			net.JoinHostPort(host, strconv.Itoa(s.config.UDP.Port)),
+			s.privateKey,
+			s.directory,
+			s.handleDatagram,
+			&udp.ListenerConfig{Readers: s.config.UDP.Readers},
+		)
+		if err != nil {
+			return fmt.Errorf("UDP listener: %w", err)
+		}
+		registerUDPMetrics(s.udpListener, s.udpSender)
+		log.Printf("Accepting node-to-node packets on UDP %s", s.udpListener.Addr())
+	}
+	
+	// Publish this node and its onion key, then keep both fresh
+	if err := s.publishNodeInfo(); err != nil {
+		log.Printf("Failed to publish node info: %v", err)
+	}
+	go s.publishLoop()
+	
+	// Generate cover traffic through the directory's nodes
+	s.cover = cover.NewGenerator(
+		s.privateKey.Public().(ed25519.PublicKey),
+		s.directory,
+		s.sendCover,
+		&cover.Config{
+			LoopRate:    s.config.Cover.LoopRate,
+			DropRate:    s.config.Cover.DropRate,
+			PathLength:  s.config.Cover.PathLength,
+			LoopTimeout: time.Duration(s.config.Cover.LoopTimeoutSeconds) * time.Second,
+			MeanDelay:   time.Duration(s.config.DelayPolicy.MeanMs) * time.Millisecond,
+		},
+	)
+	registerCoverMetrics(s.cover)
+	
 	// Start cleanup goroutine
 	go s.cleanupLoop()
 
@@ -245,41 +563,157 @@ func (s *Server) handleOnionPacket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Apply delay (timing obfuscation)
-	if decision.Delay > 0 {
-		time.Sleep(decision.Delay)
+	status, err := s.routeDecision(decision)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// handleOnionRequest processes an onion request and answers with the
+// response, relayed back from the final hop
+func (s *Server) handleOnionRequest(w http.ResponseWriter, r *http.Request) {
+	packet, err := io.ReadAll(http.MaxBytesReader(w, r.Body, mtls.MaxFramePayload))
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	response, err := s.HandleRequest(packet)
+	if err != nil {
+		log.Printf("Onion request error: %v", err)
+		if errors.Is(err, errRelayFailed) {
+			http.Error(w, "Next hop unreachable", http.StatusBadGateway)
+			return
+		}
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
 	}
 
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(response)
+}
+
+// handleOnionCell processes a circuit cell and answers with the answer
+// relayed back along the circuit
+func (s *Server) handleOnionCell(w http.ResponseWriter, r *http.Request) {
+	cell, err := io.ReadAll(http.MaxBytesReader(w, r.Body, mtls.MaxFramePayload))
+	if err != nil {
+		http.Error(w, "Failed to read cell", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	answer, err := s.HandleCell(mtls.RemoteHost(r.RemoteAddr), cell)
+	if err != nil {
+		log.Printf("Circuit cell error: %v", err)
+		if errors.Is(err, errRelayFailed) {
+			http.Error(w, "Next hop unreachable", http.StatusBadGateway)
+			return
+		}
+		http.Error(w, "Invalid cell", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(answer)
+}
+
+// handleDatagram queues an onion packet received from a peer over UDP for
+// batch processing. There is no one to report failures to, so they are
+// only logged.
+func (s *Server) handleDatagram(packet []byte, peer *common.NodeInfo) {
+	err := s.batcher.Submit(packet, func(decision *onion.RoutingDecision, err error) {
+		if err != nil {
+			log.Printf("Packet processing error: %v", err)
+			return
+		}
+		if _, err := s.routeDecision(decision); err != nil {
+			log.Printf("Packet from %s not routed: %v", peer.ID, err)
+		}
+	})
+	if err != nil {
+		log.Printf("Packet from %s dropped: %v", peer.ID, err)
+	}
+}
+
+// sendCover sends a cover packet the way forwarded packets leave the node
+func (s *Server) sendCover(nodeAddress string, packet []byte) error {
+	if s.mixer != nil {
+		return s.mixer.Submit(&onion.RoutingDecision{
+			Action:      onion.ActionForward,
+			NextAddress: nodeAddress,
+			NextPacket:  packet,
+		})
+	}
+	return s.forwarder.Enqueue(nodeAddress, packet, 0)
+}
+
+// routeDecision forwards, delivers or stores a processed packet and
+// returns the HTTP status reporting the outcome
+func (s *Server) routeDecision(decision *onion.RoutingDecision) (int, error) {
 	switch decision.Action {
 	case onion.ActionForward:
-		// Forward to next hop
-		if s.mtlsClient != nil {
-			// Use mTLS for forwarding
-			if err := s.mtlsClient.ForwardPacket(decision.NextAddress, decision.Payload); err != nil {
-				log.Printf("Failed to forward packet: %v", err)
-				http.Error(w, "Failed to forward packet", http.StatusBadGateway)
-				return
+		if s.mixer != nil {
+			// Mix with other traffic; released packets go to the forwarder
+			if err := s.mixer.Submit(decision); err != nil {
+				return http.StatusServiceUnavailable, errors.New("Mix pool full")
 			}
-		} else {
-			log.Printf("mTLS not enabled, packet forwarding skipped to %s", decision.NextAddress)
+			return http.StatusAccepted, nil
+		}
+
+		// Queue for the next hop; the forwarder applies the delay (timing obfuscation)
+		if err := s.forwarder.Enqueue(decision.NextAddress, decision.NextPacket, decision.Delay); err != nil {
+			return http.StatusServiceUnavailable, errors.New("Forwarding queue full")
 		}
-		w.WriteHeader(http.StatusAccepted)
+		return http.StatusAccepted, nil
 		
 	case onion.ActionDeliver:
 		// Deliver to swarm
-		var msg common.Message
-		if err := json.Unmarshal(decision.Payload, &msg); err != nil {
-			http.Error(w, "Invalid payload", http.StatusBadRequest)
-			return
+		fragment, err := common.DecodeFragment(decision.Payload)
+		if err != nil {
+			return http.StatusBadRequest, errors.New("Invalid payload")
 		}
 		
-		if err := s.swarm.StoreMessage(&msg); err != nil {
-			http.Error(w, "Failed to store message", http.StatusInternalServerError)
-			return
+		// Cover traffic ends here and is never stored
+		if cover.IsCover(fragment.Message) {
+			if s.cover != nil {
+				s.cover.HandleDelivery(fragment.Message)
+			}
+			return http.StatusOK, nil
 		}
 		
-		w.WriteHeader(http.StatusOK)
+		// Fragments are buffered until the whole message arrived
+		if _, err := s.reassembler.Add(fragment); err != nil {
+			if errors.Is(err, common.ErrUnpaddedContent) || errors.Is(err, common.ErrInsufficientPoW) || errors.Is(err, swarm.ErrReservedForReplies) {
+				return http.StatusBadRequest, err
+			}
+			return http.StatusInternalServerError, errors.New("Failed to store message")
+		}
+		return http.StatusOK, nil
+		
+	case onion.ActionDeliverReply:
+		// Hold the layered reply until the SURB's originator collects it
+		if err := s.swarm.StoreReply(onion.ReplyMessage(decision)); err != nil {
+			return http.StatusInternalServerError, errors.New("Failed to store reply")
+		}
+		return http.StatusOK, nil
+		
+	case onion.ActionDrop:
+		// Link padding from a neighbor
+		return http.StatusOK, nil
 	}
+	
+	return http.StatusInternalServerError, fmt.Errorf("unknown action: %d", decision.Action)
+}
+
+// swarmRoutes registers the client swarm API on r
+func (s *Server) swarmRoutes(r *mux.Router) {
+	r.HandleFunc("/swarm/messages/{sessionID}", s.handleRetrieveMessages).Methods("GET")
+	r.HandleFunc("/swarm/messages", s.handleStoreMessage).Methods("POST")
+	r.HandleFunc("/swarm/messages/{sessionID}/{messageID}", s.handleDeleteMessage).Methods("DELETE")
 }
 
 func (s *Server) handleStoreMessage(w http.ResponseWriter, r *http.Request) {
@@ -291,6 +725,10 @@ func (s *Server) handleStoreMessage(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	if err := s.swarm.StoreMessage(&msg); err != nil {
+		if errors.Is(err, common.ErrUnpaddedContent) || errors.Is(err, common.ErrInsufficientPoW) || errors.Is(err, swarm.ErrReservedForReplies) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, "Failed to store message", http.StatusInternalServerError)
 		return
 	}
@@ -299,6 +737,160 @@ func (s *Server) handleStoreMessage(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "stored"})
 }
 
+func (s *Server) handleReplicateMessage(w http.ResponseWriter, r *http.Request) {
+	var msg common.Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := s.swarm.StoreReplica(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "stored"})
+}
+
+func (s *Server) handleDeleteReplica(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if err := s.HandleDelete(vars["sessionID"], vars["messageID"]); err != nil {
+		http.Error(w, "Failed to delete message", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandlePacket processes an onion packet received on a peer link. Link
+// frames are handled concurrently, so packets from busy links are batched.
+func (s *Server) HandlePacket(packet []byte) error {
+	decision, err := s.batcher.Process(packet)
+	if err != nil {
+		return fmt.Errorf("invalid packet: %w", err)
+	}
+	_, err = s.routeDecision(decision)
+	return err
+}
+
+// errRelayFailed is returned when an onion request could not be relayed to its next hop
+var errRelayFailed = errors.New("relay failed")
+
+// HandleRequest processes an onion request, received over HTTP or on a
+// peer link, and returns the response for the previous hop. Requests are
+// relayed at once: the response must come back on the same connection,
+// so they skip the mixer, per-hop delays and link padding.
+func (s *Server) HandleRequest(packet []byte) ([]byte, error) {
+	decision, err := s.router.ProcessRequest(packet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	
+	switch decision.Action {
+	case onion.ActionForward:
+		response, err := s.requests.SendRequest(decision.NextAddress, decision.NextPacket)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errRelayFailed, err)
+		}
+		return onion.WrapResponse(decision, response)
+		
+	case onion.ActionRequest:
+		return onion.SealResponse(decision, s.executeRequest(decision.Request))
+	}
+	
+	return nil, fmt.Errorf("unexpected action for a request: %d", decision.Action)
+}
+
+// HandleCell processes a circuit cell, received over HTTP or on a peer
+// link from host from, and returns the answer for the previous hop. Like
+// onion requests, cells are relayed at once and skip the mixer and
+// per-hop delays.
+func (s *Server) HandleCell(from string, cell []byte) ([]byte, error) {
+	decision, err := s.router.ProcessCell(from, cell)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cell: %w", err)
+	}
+	
+	switch decision.Action {
+	case onion.CellReply:
+		return decision.Reply, nil
+		
+	case onion.CellForward:
+		answer, err := s.requests.SendCell(decision.NextAddress, decision.NextCell)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errRelayFailed, err)
+		}
+		return decision.Wrap(answer)
+		
+	case onion.CellExtend:
+		created, err := s.requests.SendCell(decision.NextAddress, decision.NextCell)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errRelayFailed, err)
+		}
+		return decision.Extended(created)
+		
+	case onion.CellRequest:
+		return decision.Respond(s.executeRequest(decision.Request))
+	}
+	
+	return nil, fmt.Errorf("unexpected action for a cell: %d", decision.Action)
+}
+
+// executeRequest runs a swarm API call carried by an onion request.
+// Only the client swarm routes are reachable this way.
+func (s *Server) executeRequest(req *onion.Request) *onion.Response {
+	httpReq, err := http.NewRequest(req.Method, req.Path, bytes.NewReader(req.Body))
+	if err != nil {
+		return &onion.Response{Status: http.StatusBadRequest, Body: []byte("Invalid request")}
+	}
+	
+	recorder := &responseRecorder{header: make(http.Header)}
+	s.swarmAPI.ServeHTTP(recorder, httpReq)
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return &onion.Response{Status: recorder.status, Body: recorder.body.Bytes()}
+}
+
+// responseRecorder captures the response of a swarm API call made through an onion request
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(data)
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// HandleReplicate stores a message replicated by a peer
+func (s *Server) HandleReplicate(messageData []byte) error {
+	var msg common.Message
+	if err := json.Unmarshal(messageData, &msg); err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
+	return s.swarm.StoreReplica(&msg)
+}
+
+// HandleDelete deletes a replica at the request of the peer that replicated it
+func (s *Server) HandleDelete(sessionID, messageID string) error {
+	return s.swarm.DeleteReplica(sessionID, messageID)
+}
+
 func (s *Server) handleRetrieveMessages(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sessionID := vars["sessionID"]
@@ -362,8 +954,9 @@ func (s *Server) handleRegisterNode(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
+	// Every refusal is a registration that failed verification
 	if err := s.directory.RegisterNode(&node); err != nil {
-		http.Error(w, "Failed to register node", http.StatusInternalServerError)
+		http.Error(w, "Failed to register node", http.StatusForbidden)
 		return
 	}
 
@@ -380,6 +973,55 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// publishNodeInfo registers this node, with its current signed onion key, in the directory
+func (s *Server) publishNodeInfo() error {
+	host, portStr, err := net.SplitHostPort(s.config.PublicAddress)
+	if err != nil {
+		return fmt.Errorf("invalid public address: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid public port: %w", err)
+	}
+
+	node := &common.NodeInfo{
+		ID:        s.config.NodeID,
+		PublicKey: s.privateKey.Public().(ed25519.PublicKey),
+		Address:   host,
+		Port:      uint16(port),
+		Version:   Version,
+	}
+	if s.config.UDP.Enabled {
+		node.UDPPort = uint16(s.config.UDP.Port)
+	}
+	s.keyRing.Publish(node)
+	common.SignRegistration(s.privateKey, node)
+
+	return s.directory.RegisterNode(node)
+}
+
+// publishLoop rotates onion keys at epoch boundaries and re-publishes this
+// node, which also keeps it marked healthy in the directory
+func (s *Server) publishLoop() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rotated, err := s.keyRing.Rotate(time.Now())
+		if err != nil {
+			log.Printf("Onion key rotation failed: %v", err)
+			continue
+		}
+		if rotated {
+			log.Printf("Rotated onion key for epoch %d", s.keyRing.Epoch(time.Now()))
+		}
+
+		if err := s.publishNodeInfo(); err != nil {
+			log.Printf("Failed to publish node info: %v", err)
+		}
+	}
+}
+
 func (s *Server) cleanupLoop() {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
@@ -397,6 +1039,381 @@ func (s *Server) cleanupLoop() {
 	}
 }
 
+// registerForwarderMetrics exposes forwarding queue statistics on /metrics
+func registerForwarderMetrics(f *forwarder.Forwarder) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_forward_queue_depth",
+			Help: "Onion packets waiting to be forwarded or in flight",
+		}, func() float64 { return float64(f.GetStats().QueueDepth) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_forward_delayed",
+			Help: "Onion packets waiting for their per-hop delay or a retry",
+		}, func() float64 { return float64(f.GetStats().Delayed) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_forward_delayed_total",
+			Help: "Onion packets queued with a per-hop delay",
+		}, func() float64 { return float64(f.GetStats().PacketsDelayed) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_forward_packets_total",
+			Help: "Onion packets forwarded to the next hop",
+		}, func() float64 { return float64(f.GetStats().PacketsForwarded) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_forward_retries_total",
+			Help: "Forwarding attempts retried after a failure",
+		}, func() float64 { return float64(f.GetStats().Retries) }),
+	)
+
+	for _, reason := range []string{forwarder.DropQueueFull, forwarder.DropSendFailed, forwarder.DropRejected, forwarder.DropShutdown} {
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "ghostnodes_forward_dropped_total",
+			Help:        "Onion packets dropped by the forwarder",
+			ConstLabels: prometheus.Labels{"reason": reason},
+		}, func() float64 { return float64(f.GetStats().Dropped[reason]) }))
+	}
+}
+
+// registerRouterMetrics exposes onion router statistics on /metrics
+func registerRouterMetrics(r *onion.Router) {
+	prometheus.MustRegister(
+		// Neighbors may pad their links whether or not this node does
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_padding_received_total",
+			Help: "Dummy packets from neighbors discarded here",
+		}, func() float64 { return float64(r.GetStats().PacketsDummy) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_delay_clamped_total",
+			Help: "Requested per-hop delays raised or cut to the delay policy",
+		}, func() float64 { return float64(r.GetStats().DelaysClamped) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_packets_pq_total",
+			Help: "Version 3 packets processed with the X25519 + ML-KEM-768 hybrid",
+		}, func() float64 { return float64(r.GetStats().PacketsV3) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_onion_requests_total",
+			Help: "Onion requests relayed or executed",
+		}, func() float64 { return float64(r.GetStats().Requests) }),
+	)
+}
+
+// registerCircuitMetrics exposes circuit table statistics on /metrics
+func registerCircuitMetrics(t *onion.CircuitTable) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_circuits_open",
+			Help: "Circuits open at this node",
+		}, func() float64 { return float64(t.GetStats().Open) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_circuits_created_total",
+			Help: "Circuit handshakes completed",
+		}, func() float64 { return float64(t.GetStats().Created) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_circuits_refused_total",
+			Help: "Circuit handshakes refused because the table was full",
+		}, func() float64 { return float64(t.GetStats().Refused) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_circuits_expired_total",
+			Help: "Circuits closed after the idle timeout",
+		}, func() float64 { return float64(t.GetStats().Expired) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_circuits_destroyed_total",
+			Help: "Circuits closed by the client or after an invalid cell",
+		}, func() float64 { return float64(t.GetStats().Destroyed) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_circuit_cells_total",
+			Help: "Relay cells processed on circuits",
+		}, func() float64 { return float64(t.GetStats().Cells) }),
+	)
+}
+
+// registerBatcherMetrics exposes ingress batching statistics on /metrics
+func registerBatcherMetrics(b *onion.Batcher) {
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_ingress_batches_total",
+			Help: "Batches of UDP and peer link packets processed",
+		}, func() float64 { return float64(b.GetStats().Batches) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_ingress_batched_packets_total",
+			Help: "UDP and peer link packets processed in batches",
+		}, func() float64 { return float64(b.GetStats().Packets) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_ingress_dropped_total",
+			Help: "UDP and peer link packets dropped because the batch queue was full",
+		}, func() float64 { return float64(b.GetStats().Dropped) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_ingress_queued",
+			Help: "UDP and peer link packets waiting for a batch",
+		}, func() float64 { return float64(b.GetStats().Queued) }),
+	)
+}
+
+// registerReplayMetrics exposes replay filter statistics on /metrics
+func registerReplayMetrics(f *onion.ReplayFilter) {
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_replay_checks_total",
+			Help: "Authenticated onion packets checked for replay",
+		}, func() float64 { return float64(f.GetStats().Checks) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_replay_hits_total",
+			Help: "Onion packets rejected as replays",
+		}, func() float64 { return float64(f.GetStats().Hits) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_replay_hit_ratio",
+			Help: "Fraction of checked packets rejected as replays",
+		}, func() float64 {
+			stats := f.GetStats()
+			if stats.Checks == 0 {
+				return 0
+			}
+			return float64(stats.Hits) / float64(stats.Checks)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_replay_tags",
+			Help: "Packet tags held in the replay window",
+		}, func() float64 { return float64(f.GetStats().Tags) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_replay_overflows_total",
+			Help: "Replay filters added because an epoch's filter reached capacity",
+		}, func() float64 { return float64(f.GetStats().Overflows) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_replay_saturated_total",
+			Help: "Packet tags added past capacity because an epoch had max_filters_per_epoch filters",
+		}, func() float64 { return float64(f.GetStats().Saturated) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_replay_memory_bytes",
+			Help: "Memory used by replay filters",
+		}, func() float64 { return float64(f.GetStats().MemoryBytes) }),
+	)
+}
+
+// registerSwarmMetrics exposes message padding and proof-of-work statistics on /metrics
+func registerSwarmMetrics(st *swarm.Store) {
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "ghostnodes_swarm_unpadded_rejected_total",
+		Help: "Messages rejected because their content size is not a padding bucket",
+	}, func() float64 { return float64(st.GetStats().RejectedUnpadded) }))
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "ghostnodes_swarm_pow_rejected_total",
+		Help: "Messages rejected for a missing or insufficient proof-of-work stamp",
+	}, func() float64 { return float64(st.GetStats().RejectedPoW) }))
+
+	for _, size := range st.PaddingBuckets() {
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "ghostnodes_swarm_messages_stored_total",
+			Help:        "Messages stored, by padding bucket",
+			ConstLabels: prometheus.Labels{"bucket": strconv.Itoa(size)},
+		}, func() float64 { return float64(st.GetStats().Buckets[size]) }))
+	}
+}
+
+// registerReassemblyMetrics exposes fragment reassembly statistics on /metrics
+func registerReassemblyMetrics(r *swarm.Reassembler) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_reassembly_pending",
+			Help: "Fragmented messages waiting for their remaining fragments",
+		}, func() float64 { return float64(r.GetStats().Pending) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_reassembly_buffered_bytes",
+			Help: "Fragment content held in the reassembly buffer",
+		}, func() float64 { return float64(r.GetStats().BufferedBytes) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_reassembly_completed_total",
+			Help: "Fragmented messages reassembled and stored",
+		}, func() float64 { return float64(r.GetStats().Completed) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_reassembly_expired_total",
+			Help: "Incomplete messages dropped after the reassembly timeout",
+		}, func() float64 { return float64(r.GetStats().Expired) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_reassembly_evicted_total",
+			Help: "Incomplete messages evicted to stay under the memory cap",
+		}, func() float64 { return float64(r.GetStats().Evicted) }),
+	)
+}
+
+// linkConfig returns persistent link settings from the node configuration
+func linkConfig(config *common.Config) *mtls.LinkConfig {
+	return &mtls.LinkConfig{
+		QueueSize:        config.MTLS.Link.QueueSize,
+		MaxInFlight:      config.MTLS.Link.MaxInFlight,
+		PingInterval:     time.Duration(config.MTLS.Link.PingIntervalSeconds) * time.Second,
+		MaxLinks:         config.MTLS.Link.MaxLinks,
+		MaxLinksPerPeer:  config.MTLS.Link.MaxLinksPerPeer,
+		MaxBufferedBytes: config.MTLS.Link.MaxBufferedBytes,
+	}
+}
+
+// registerLinkMetrics exposes outgoing peer link statistics on /metrics
+func registerLinkMetrics(links *mtls.Links) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_link_open",
+			Help: "Links to peers currently open",
+		}, func() float64 { return float64(links.GetStats().Open) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_link_dials_total",
+			Help: "Link connection attempts, including reconnections",
+		}, func() float64 { return float64(links.GetStats().Dials) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_link_dial_failures_total",
+			Help: "Link connection attempts that failed",
+		}, func() float64 { return float64(links.GetStats().DialFailures) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_link_requests_total",
+			Help: "Packets, replications, deletes and pings sent over links",
+		}, func() float64 { return float64(links.GetStats().Requests) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_link_request_failures_total",
+			Help: "Link requests that failed",
+		}, func() float64 { return float64(links.GetStats().Failed) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_link_backpressure_total",
+			Help: "Link requests refused because the peer's send queue stayed full",
+		}, func() float64 { return float64(links.GetStats().Backpressure) }),
+	)
+}
+
+// registerLinkServerMetrics exposes incoming peer link statistics on /metrics
+func registerLinkServerMetrics(server *mtls.LinkServer) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_link_accepted_open",
+			Help: "Links from peers currently open",
+		}, func() float64 { return float64(server.GetStats().Open) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_link_accepted_total",
+			Help: "Links accepted from peers",
+		}, func() float64 { return float64(server.GetStats().Accepted) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_link_refused_total",
+			Help: "Link upgrades refused at the total or per-peer link limit",
+		}, func() float64 { return float64(server.GetStats().Refused) }),
+	)
+}
+
+// registerCoverMetrics exposes cover traffic statistics on /metrics
+func registerCoverMetrics(g *cover.Generator) {
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "ghostnodes_cover_sent_total",
+			Help:        "Cover packets sent",
+			ConstLabels: prometheus.Labels{"kind": "loop"},
+		}, func() float64 { return float64(g.GetStats().LoopsSent) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "ghostnodes_cover_sent_total",
+			Help:        "Cover packets sent",
+			ConstLabels: prometheus.Labels{"kind": "drop"},
+		}, func() float64 { return float64(g.GetStats().DropsSent) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_cover_loops_returned_total",
+			Help: "Loop packets that came back within the timeout",
+		}, func() float64 { return float64(g.GetStats().LoopsReturned) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_cover_loops_lost_total",
+			Help: "Loop packets that did not come back within the timeout",
+		}, func() float64 { return float64(g.GetStats().LoopsLost) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_cover_loops_pending",
+			Help: "Loop packets still expected back",
+		}, func() float64 { return float64(g.GetStats().LoopsPending) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_cover_drops_received_total",
+			Help: "Drop packets from other nodes discarded here",
+		}, func() float64 { return float64(g.GetStats().DropsReceived) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_cover_failed_total",
+			Help: "Cover packets that could not be built or sent",
+		}, func() float64 { return float64(g.GetStats().Failed) }),
+	)
+}
+
+// registerPaddingMetrics exposes link padding statistics on /metrics
+func registerPaddingMetrics(p *forwarder.Padder) {
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "ghostnodes_padding_packets_total",
+			Help:        "Packets sent in padded link slots",
+			ConstLabels: prometheus.Labels{"kind": "real"},
+		}, func() float64 { return float64(p.GetStats().RealSent) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "ghostnodes_padding_packets_total",
+			Help:        "Packets sent in padded link slots",
+			ConstLabels: prometheus.Labels{"kind": "dummy"},
+		}, func() float64 { return float64(p.GetStats().DummySent) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_padding_ratio",
+			Help: "Fraction of padded link slots filled with dummy packets",
+		}, func() float64 { return p.GetStats().PaddingRatio() }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_padding_links",
+			Help: "Neighbors whose links are currently padded",
+		}, func() float64 { return float64(p.GetStats().Links) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_padding_bandwidth_bytes_per_second",
+			Help: "Bandwidth the padded links currently use",
+		}, func() float64 { return p.GetStats().Bandwidth }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_padding_unpadded_total",
+			Help: "Packets sent unpadded because the bandwidth budget was used up",
+		}, func() float64 { return float64(p.GetStats().Unpadded) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_padding_queue_full_total",
+			Help: "Packets refused because a padded link's queue was full",
+		}, func() float64 { return float64(p.GetStats().QueueFull) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_padding_failed_total",
+			Help: "Padded link slots whose packet could not be built or sent",
+		}, func() float64 { return float64(p.GetStats().Failed) }),
+	)
+}
+
+// registerUDPMetrics exposes node-to-node datagram statistics on /metrics
+func registerUDPMetrics(l *udp.Listener, sender *udp.Sender) {
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_udp_received_total",
+			Help: "Onion packets received from peers over UDP",
+		}, func() float64 { return float64(l.GetStats().Received) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_udp_rejected_total",
+			Help: "Datagrams dropped as malformed, from unknown senders or failing authentication",
+		}, func() float64 { return float64(l.GetStats().Rejected) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_udp_sent_total",
+			Help: "Onion packets sent to peers over UDP",
+		}, func() float64 { return float64(sender.GetStats().Sent) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_udp_fallback_total",
+			Help: "Onion packets sent over HTTPS because the next hop has no UDP port",
+		}, func() float64 { return float64(sender.GetStats().Fallbacks) }),
+	)
+}
+
+// registerMixerMetrics exposes packet mixing statistics on /metrics
+func registerMixerMetrics(m *onion.Mixer) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ghostnodes_mix_pool_size",
+			Help: "Onion packets held in the mix",
+		}, func() float64 { return float64(m.GetStats().PoolSize) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_mix_packets_total",
+			Help: "Onion packets accepted into the mix",
+		}, func() float64 { return float64(m.GetStats().PacketsMixed) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_mix_released_total",
+			Help: "Onion packets released from the mix to the forwarder",
+		}, func() float64 { return float64(m.GetStats().PacketsReleased) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ghostnodes_mix_dropped_total",
+			Help: "Onion packets rejected because the mix was full",
+		}, func() float64 { return float64(m.GetStats().PacketsDropped) }),
+	)
+}
+
 func loadConfig(filename string) (*common.Config, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
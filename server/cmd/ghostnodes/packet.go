@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/mlkem"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/onion"
+)
+
+// packetUsage explains the packet subcommand
+const packetUsage = `Usage: ghostnodes packet [flags] <packet file, or - for stdin>
+
+Walks an onion packet through the hops whose keys are given, the way
+their routers would, and prints each layer: header, routing info,
+expiry, delay, the key the header HMAC verified under, and the final
+payload. Keys are matched to hops by trying each.
+
+Flags:
+`
+
+// listFlag collects a repeatable string flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// runPacketCommand runs "ghostnodes packet" and returns the exit code:
+// 0 if the packet reached its final hop cleanly, 1 if a hop failed or
+// would refuse it, 2 on usage errors
+func runPacketCommand(args []string) int {
+	fs := flag.NewFlagSet("packet", flag.ContinueOnError)
+	var keyFiles, onionKeys listFlag
+	fs.Var(&keyFiles, "key", "Node identity key file, as private_key_file (repeatable); covers nodes without key rotation")
+	fs.Var(&onionKeys, "onion-key", "X25519 onion private key in hex, optionally followed by :<ML-KEM-768 seed in hex> (repeatable)")
+	hexInput := fs.Bool("hex", false, "The packet file holds hex instead of raw bytes")
+	request := fs.Bool("request", false, "Inspect an onion request (as posted to /v1/onion/request)")
+	at := fs.String("at", "", "Check expiry at this RFC 3339 time instead of now")
+	maxLifetime := fs.Duration("max-lifetime", onion.DefaultMaxPacketLifetime, "Replay window of the nodes (replay.max_packet_lifetime_minutes)")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), packetUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	keys, err := loadInspectKeys(keyFiles, onionKeys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	packet, err := readPacket(fs.Arg(0), *hexInput)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+
+	opts := &onion.InspectOptions{
+		Now:               time.Now(),
+		MaxPacketLifetime: *maxLifetime,
+		Request:           *request,
+	}
+	if *at != "" {
+		if opts.Now, err = time.Parse(time.RFC3339, *at); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -at: %v\n", err)
+			return 2
+		}
+	}
+
+	traces := onion.InspectPacket(packet, keys, opts)
+	status := 0
+	for i, trace := range traces {
+		printHopTrace(os.Stdout, i+1, trace, opts.Now)
+		if trace.Err != nil || len(trace.Problems) > 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+// loadInspectKeys loads identity key files and parses raw onion keys
+func loadInspectKeys(keyFiles, onionKeys []string) ([]onion.InspectKey, error) {
+	var keys []onion.InspectKey
+	for _, file := range keyFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("%s: invalid private key size: %d", file, len(data))
+		}
+		keys = append(keys, onion.IdentityInspectKey(file, ed25519.PrivateKey(data)))
+	}
+
+	for i, value := range onionKeys {
+		x25519Hex, seedHex, _ := strings.Cut(value, ":")
+		privateKey, err := hex.DecodeString(x25519Hex)
+		if err != nil || len(privateKey) != 32 {
+			return nil, fmt.Errorf("onion key %d: want 32 bytes of hex", i+1)
+		}
+		key := onion.InspectKey{
+			Name:       fmt.Sprintf("onion key %d", i+1),
+			PrivateKey: privateKey,
+		}
+		if seedHex != "" {
+			seed, err := hex.DecodeString(seedHex)
+			if err != nil {
+				return nil, fmt.Errorf("onion key %d: invalid ML-KEM seed: %v", i+1, err)
+			}
+			if key.KEMKey, err = mlkem.NewDecapsulationKey768(seed); err != nil {
+				return nil, fmt.Errorf("onion key %d: %v", i+1, err)
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no keys given; use -key or -onion-key")
+	}
+	return keys, nil
+}
+
+// readPacket reads a packet from a file or stdin, decoding hex if asked
+func readPacket(name string, hexInput bool) ([]byte, error) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !hexInput {
+		return data, nil
+	}
+	packet, err := hex.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %w", err)
+	}
+	return packet, nil
+}
+
+// printHopTrace prints what one hop learned from the packet
+func printHopTrace(w io.Writer, hop int, trace *onion.HopTrace, now time.Time) {
+	fmt.Fprintf(w, "Hop %d\n", hop)
+	fmt.Fprintf(w, "  Packet:         %d bytes, version 0x%02x\n", trace.Size, trace.Version)
+	if trace.EphemeralKey != nil {
+		fmt.Fprintf(w, "  Ephemeral key:  %x\n", trace.EphemeralKey)
+		fmt.Fprintf(w, "  Header HMAC:    %x\n", trace.HeaderHMAC)
+	}
+	if trace.KEMCiphertextSize > 0 {
+		fmt.Fprintf(w, "  KEM ciphertext: %d bytes\n", trace.KEMCiphertextSize)
+	}
+	if trace.Key != "" {
+		fmt.Fprintf(w, "  HMAC:           verified with %s\n", trace.Key)
+	} else if trace.EphemeralKey != nil {
+		fmt.Fprintf(w, "  HMAC:           not verified with any key\n")
+	}
+
+	if routing := trace.Routing; routing != nil {
+		fmt.Fprintf(w, "  Address type:   0x%02x\n", routing.AddressType)
+		fmt.Fprintf(w, "  Expiry:         %s (%s)\n", routing.Expiry.UTC().Format(time.RFC3339), relativeTime(routing.Expiry, now))
+		fmt.Fprintf(w, "  Delay:          %d ms requested\n", routing.Delay)
+		fmt.Fprintf(w, "  Flags:          0x%02x%s\n", routing.Flags, routingFlagNames(routing.Flags))
+	}
+	for _, problem := range trace.Problems {
+		fmt.Fprintf(w, "  Refused:        %s\n", problem)
+	}
+
+	if trace.Err != nil {
+		fmt.Fprintf(w, "  Error:          %v\n", trace.Err)
+		return
+	}
+
+	switch trace.Action {
+	case onion.ActionForward:
+		fmt.Fprintf(w, "  Action:         forward to %s\n", trace.NextHop)
+	case onion.ActionDrop:
+		fmt.Fprintf(w, "  Action:         drop (link padding)\n")
+	case onion.ActionDeliverReply:
+		fmt.Fprintf(w, "  Action:         deliver reply\n")
+		fmt.Fprintf(w, "  SURB ID:        %x\n", trace.Routing.SURBID)
+		fmt.Fprintf(w, "  Payload:        %d bytes, layered for the SURB's originator\n", len(trace.Payload))
+	case onion.ActionRequest:
+		fmt.Fprintf(w, "  Action:         execute request\n")
+		fmt.Fprintf(w, "  Request:        %s %s, %d byte body\n", trace.Request.Method, trace.Request.Path, len(trace.Request.Body))
+	case onion.ActionDeliver:
+		fmt.Fprintf(w, "  Action:         deliver\n")
+		printPayload(w, trace.Payload)
+	}
+}
+
+// printPayload decodes a delivered payload as a message or fragment
+func printPayload(w io.Writer, payload []byte) {
+	fragment, err := common.DecodeFragment(payload)
+	if err != nil {
+		fmt.Fprintf(w, "  Payload:        %d bytes, not a message payload: %v\n", len(payload), err)
+		return
+	}
+
+	msg := fragment.Message
+	fmt.Fprintf(w, "  Message ID:     %s\n", msg.ID)
+	fmt.Fprintf(w, "  Destination:    %s\n", msg.DestinationID)
+	fmt.Fprintf(w, "  Type:           0x%02x\n", msg.MessageType)
+	fmt.Fprintf(w, "  Timestamp:      %s\n", msg.Timestamp.UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "  Fragment:       %d of %d\n", fragment.Index+1, fragment.Total)
+	fmt.Fprintf(w, "  Content:        %d bytes\n", len(msg.EncryptedContent))
+	if msg.PoW != nil {
+		fmt.Fprintf(w, "  Stamp:          %d bits claimed\n", msg.PoW.Bits)
+	}
+}
+
+// relativeTime describes t relative to now
+func relativeTime(t, now time.Time) string {
+	if t.Before(now) {
+		return fmt.Sprintf("%v ago", now.Sub(t).Round(time.Second))
+	}
+	return fmt.Sprintf("in %v", t.Sub(now).Round(time.Second))
+}
+
+// routingFlagNames lists the names of the routing flags set in flags
+func routingFlagNames(flags byte) string {
+	var names []string
+	for _, flag := range []struct {
+		bit  byte
+		name string
+	}{
+		{common.RoutingFlagReply, "reply"},
+		{common.RoutingFlagDummy, "dummy"},
+		{common.RoutingFlagRequest, "request"},
+	} {
+		if flags&flag.bit != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(names, ", ") + ")"
+}
@@ -5,9 +5,15 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"time"
 
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/hkdf"
 )
@@ -67,6 +73,23 @@ func DeriveKeys(sharedSecret []byte, salt string) (encKey, hmacKey, blindingFact
 	return encKey, hmacKey, blindingFactor, nil
 }
 
+// hybridContext separates hybrid secrets from other uses of SHA-256
+const hybridContext = "GhostTalk-hybrid-v1"
+
+// HybridSecret combines an X25519 shared secret with an ML-KEM shared
+// secret into the input for DeriveKeys. The keys derived from it stay
+// secret as long as either key agreement does. Hashing in the KEM
+// ciphertext and ephemeral key binds the result to this exchange.
+func HybridSecret(ecdhSecret, kemSecret, kemCiphertext, ephemeralKey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(hybridContext))
+	h.Write(kemSecret)
+	h.Write(ecdhSecret)
+	h.Write(kemCiphertext)
+	h.Write(ephemeralKey)
+	return h.Sum(nil)
+}
+
 // ComputeHMAC computes HMAC-SHA256
 func ComputeHMAC(key, message []byte) []byte {
 	mac := hmac.New(sha256.New, key)
@@ -79,47 +102,164 @@ func VerifyHMAC(expected, computed []byte) bool {
 	return hmac.Equal(expected, computed)
 }
 
-// BlindPrivateKey blinds a Curve25519 private key with a blinding factor
+// Ed25519PrivateKeyToCurve25519 converts an Ed25519 private key to the X25519
+// private key for the same identity: the clamped first half of SHA-512(seed),
+// which is the scalar Ed25519 itself signs with.
+func Ed25519PrivateKeyToCurve25519(privateKey ed25519.PrivateKey) []byte {
+	digest := sha512.Sum512(privateKey.Seed())
+	
+	curvePrivate := make([]byte, 32)
+	copy(curvePrivate, digest[:32])
+	curvePrivate[0] &= 248
+	curvePrivate[31] &= 127
+	curvePrivate[31] |= 64
+	
+	return curvePrivate
+}
+
+// Ed25519PublicKeyToCurve25519 converts an Ed25519 public key to the matching
+// X25519 public key using the Edwards-to-Montgomery map u = (1 + y) / (1 - y)
+func Ed25519PublicKeyToCurve25519(publicKey ed25519.PublicKey) ([]byte, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid key length")
+	}
+	
+	point, err := new(edwards25519.Point).SetBytes(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Ed25519 public key: %w", err)
+	}
+	
+	return point.BytesMontgomery(), nil
+}
+
+// X25519PrivateKeyToScalar converts an X25519 private key into the scalar it
+// represents (clamped, then reduced mod the group order). Blinded ephemeral
+// keys are kept in this form so they can be multiplied by blinding factors.
+func X25519PrivateKeyToScalar(privateKey []byte) ([]byte, error) {
+	if len(privateKey) != 32 {
+		return nil, errors.New("invalid key length")
+	}
+	
+	scalar, err := edwards25519.NewScalar().SetBytesWithClamping(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	
+	return scalar.Bytes(), nil
+}
+
+// BlindPrivateKey blinds an ephemeral scalar with a blinding factor:
+// scalar * clamp(blindingFactor) mod l. The scalar must be canonical, as
+// returned by X25519PrivateKeyToScalar or a previous BlindPrivateKey call.
 func BlindPrivateKey(privateKey, blindingFactor []byte) ([]byte, error) {
 	if len(privateKey) != 32 || len(blindingFactor) != 32 {
 		return nil, errors.New("invalid key length")
 	}
 	
-	// Scalar multiplication modulo the curve order
-	// For simplicity, we use multiplication in the field
-	// In production, use proper scalar multiplication
-	blinded := make([]byte, 32)
-	copy(blinded, privateKey)
+	scalar, err := edwards25519.NewScalar().SetCanonicalBytes(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scalar: %w", err)
+	}
 	
-	// XOR for simplicity (replace with proper scalar mult in production)
-	for i := 0; i < 32; i++ {
-		blinded[i] ^= blindingFactor[i]
+	blinding, err := edwards25519.NewScalar().SetBytesWithClamping(blindingFactor)
+	if err != nil {
+		return nil, err
 	}
 	
-	return blinded, nil
+	return edwards25519.NewScalar().Multiply(scalar, blinding).Bytes(), nil
 }
 
-// BlindPublicKey blinds a Curve25519 public key
+// BlindPublicKey blinds a Curve25519 public key: clamp(blindingFactor) * publicKey.
+// This matches BlindPrivateKey, so the sender can predict every hop's ephemeral key.
 func BlindPublicKey(publicKey, blindingFactor []byte) ([]byte, error) {
 	if len(publicKey) != 32 || len(blindingFactor) != 32 {
 		return nil, errors.New("invalid key length")
 	}
 	
-	// Compute basepoint * blinding_factor
-	blindedBase, err := curve25519.X25519(blindingFactor, curve25519.Basepoint)
+	// X25519 clamps the blinding factor exactly as BlindPrivateKey does
+	return curve25519.X25519(blindingFactor, publicKey)
+}
+
+// ScalarBaseMult returns the X25519 public key for a canonical scalar
+func ScalarBaseMult(scalar []byte) ([]byte, error) {
+	s, err := edwards25519.NewScalar().SetCanonicalBytes(scalar)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scalar: %w", err)
+	}
+	
+	return new(edwards25519.Point).ScalarBaseMult(s).BytesMontgomery(), nil
+}
+
+// ScalarMult performs ECDH between a canonical scalar and an X25519 public key.
+// Unlike X25519ECDH it does not clamp the scalar, so it works with blinded keys.
+func ScalarMult(scalar, publicKey []byte) ([]byte, error) {
+	if len(scalar) != 32 || len(publicKey) != 32 {
+		return nil, errors.New("invalid key length")
+	}
+	
+	s, err := edwards25519.NewScalar().SetCanonicalBytes(scalar)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scalar: %w", err)
+	}
+	
+	point, err := montgomeryToEdwards(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	
+	shared := new(edwards25519.Point).ScalarMult(s, point)
+	if shared.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, errors.New("low order point")
+	}
+	
+	return shared.BytesMontgomery(), nil
+}
+
+// montgomeryToEdwards lifts an X25519 public key to an Edwards point in the
+// prime-order subgroup. The sign of x is lost in the Montgomery form, which is
+// fine because scalar multiples of either lift share the same u-coordinate.
+func montgomeryToEdwards(publicKey []byte) (*edwards25519.Point, error) {
+	u, err := new(field.Element).SetBytes(publicKey)
 	if err != nil {
 		return nil, err
 	}
 	
-	// Add to public key (simplified, replace with proper EC addition)
-	blinded := make([]byte, 32)
-	for i := 0; i < 32; i++ {
-		blinded[i] = publicKey[i] ^ blindedBase[i]
+	// y = (u - 1) / (u + 1)
+	one := new(field.Element).One()
+	denominator := new(field.Element).Add(u, one)
+	if denominator.Equal(new(field.Element).Zero()) == 1 {
+		return nil, errors.New("invalid public key")
+	}
+	y := new(field.Element).Subtract(u, one)
+	y.Multiply(y, new(field.Element).Invert(denominator))
+	
+	point, err := new(edwards25519.Point).SetBytes(y.Bytes())
+	if err != nil {
+		return nil, errors.New("public key is not on the curve")
+	}
+	
+	// Reject points with a small-order component: 8 * (8^-1 * P) == P only
+	// holds when P has no torsion
+	torsionFree := new(edwards25519.Point).ScalarMult(inverseCofactor, point)
+	torsionFree.MultByCofactor(torsionFree)
+	if torsionFree.Equal(point) != 1 {
+		return nil, errors.New("public key is not in the prime-order subgroup")
 	}
 	
-	return blinded, nil
+	return point, nil
 }
 
+// inverseCofactor is 8^-1 mod l
+var inverseCofactor = func() *edwards25519.Scalar {
+	eight := make([]byte, 32)
+	eight[0] = 8
+	s, err := edwards25519.NewScalar().SetCanonicalBytes(eight)
+	if err != nil {
+		panic(err)
+	}
+	return s.Invert(s)
+}()
+
 // RandomBytes generates cryptographically secure random bytes
 func RandomBytes(n int) ([]byte, error) {
 	b := make([]byte, n)
@@ -134,3 +274,122 @@ func Hash256(data []byte) []byte {
 	hash := sha256.Sum256(data)
 	return hash[:]
 }
+
+// onionKeyContext separates onion key signatures from other identity key uses
+const onionKeyContext = "GhostTalk-onion-key-v2"
+
+// keyMessage returns the bytes an identity key signs to publish an epoch key
+func keyMessage(context string, epoch uint64, key []byte) []byte {
+	msg := make([]byte, 0, len(context)+8+len(key))
+	msg = append(msg, context...)
+	msg = binary.BigEndian.AppendUint64(msg, epoch)
+	return append(msg, key...)
+}
+
+// onionKeyMessage returns the bytes an identity key signs to publish an
+// onion key. The epoch length is signed too, so the epoch cannot be
+// reinterpreted to make an old key look current.
+func onionKeyMessage(epoch, epochSecs uint64, onionKey []byte) []byte {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], epochSecs)
+	return keyMessage(onionKeyContext, epoch, append(length[:], onionKey...))
+}
+
+// SignOnionKey signs an epoch onion key with the node's identity key
+func SignOnionKey(identity ed25519.PrivateKey, epoch, epochSecs uint64, onionKey []byte) []byte {
+	return ed25519.Sign(identity, onionKeyMessage(epoch, epochSecs, onionKey))
+}
+
+// VerifyOnionKey checks that node's onion key is signed by its identity key
+func VerifyOnionKey(node *NodeInfo) error {
+	if len(node.OnionKey) != 32 {
+		return fmt.Errorf("invalid onion key length: %d", len(node.OnionKey))
+	}
+	if len(node.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("invalid identity key")
+	}
+	if node.OnionKeyEpochSecs == 0 {
+		return errors.New("onion key has no epoch length")
+	}
+	if !ed25519.Verify(node.PublicKey, onionKeyMessage(node.OnionKeyEpoch, node.OnionKeyEpochSecs, node.OnionKey), node.OnionKeySignature) {
+		return errors.New("invalid onion key signature")
+	}
+	return nil
+}
+
+// CheckOnionKeyEpoch checks that node's onion key epoch is within one
+// epoch of now. Nodes only hold keys for their current and previous
+// epoch; the next is allowed for clock skew.
+func CheckOnionKeyEpoch(node *NodeInfo, now time.Time) error {
+	if node.OnionKeyEpochSecs == 0 {
+		return errors.New("onion key has no epoch length")
+	}
+	current := uint64(now.Unix()) / node.OnionKeyEpochSecs
+	if node.OnionKeyEpoch+1 < current || node.OnionKeyEpoch > current+1 {
+		return fmt.Errorf("onion key epoch %d is not current (now %d)", node.OnionKeyEpoch, current)
+	}
+	return nil
+}
+
+// registrationContext separates registration signatures from other identity key uses
+const registrationContext = "GhostTalk-node-registration-v1"
+
+// registrationMessage returns the bytes an identity key signs to register
+// node: its ID, identity key, endpoints and signing time. Onion and KEM
+// keys carry their own signatures.
+func registrationMessage(node *NodeInfo) []byte {
+	msg := make([]byte, 0, len(registrationContext)+2+len(node.ID)+len(node.PublicKey)+2+len(node.Address)+12)
+	msg = append(msg, registrationContext...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(node.ID)))
+	msg = append(msg, node.ID...)
+	msg = append(msg, node.PublicKey...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(node.Address)))
+	msg = append(msg, node.Address...)
+	msg = binary.BigEndian.AppendUint16(msg, node.Port)
+	msg = binary.BigEndian.AppendUint16(msg, node.UDPPort)
+	return binary.BigEndian.AppendUint64(msg, uint64(node.RegisteredAt.Unix()))
+}
+
+// SignRegistration stamps node with the current time and signs its
+// registration with the node's identity key, proving the registrant holds it
+func SignRegistration(identity ed25519.PrivateKey, node *NodeInfo) {
+	node.RegisteredAt = time.Now().Truncate(time.Second)
+	node.Signature = ed25519.Sign(identity, registrationMessage(node))
+}
+
+// VerifyRegistration checks that node's registration is signed by its identity key
+func VerifyRegistration(node *NodeInfo) error {
+	if len(node.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("invalid identity key")
+	}
+	if len(node.ID) > 0xffff || len(node.Address) > 0xffff {
+		return errors.New("registration fields too long")
+	}
+	if !ed25519.Verify(node.PublicKey, registrationMessage(node), node.Signature) {
+		return errors.New("invalid registration signature")
+	}
+	return nil
+}
+
+// kemKeyContext separates KEM key signatures from other identity key uses
+const kemKeyContext = "GhostTalk-kem-key-v1"
+
+// SignKEMKey signs an epoch ML-KEM encapsulation key with the node's identity key
+func SignKEMKey(identity ed25519.PrivateKey, epoch uint64, kemKey []byte) []byte {
+	return ed25519.Sign(identity, keyMessage(kemKeyContext, epoch, kemKey))
+}
+
+// VerifyKEMKey checks that node's KEM key is signed by its identity key
+// for the epoch of its onion key
+func VerifyKEMKey(node *NodeInfo) error {
+	if len(node.KEMKey) != KEMKeySize {
+		return fmt.Errorf("invalid KEM key length: %d", len(node.KEMKey))
+	}
+	if len(node.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("invalid identity key")
+	}
+	if !ed25519.Verify(node.PublicKey, keyMessage(kemKeyContext, node.OnionKeyEpoch, node.KEMKey), node.KEMKeySignature) {
+		return errors.New("invalid KEM key signature")
+	}
+	return nil
+}
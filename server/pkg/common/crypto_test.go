@@ -2,7 +2,12 @@ package common
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
 )
 
 func TestGenerateKeypair(t *testing.T) {
@@ -170,3 +175,397 @@ func TestHash256(t *testing.T) {
 		t.Error("Different data produced same hash")
 	}
 }
+
+// Blinding test vectors, cross-checked against an independent Montgomery
+// ladder with unclamped scalars (RFC 7748 arithmetic)
+const (
+	vectorPrivateKey     = "a546e36bf0527c9d3b16154b82465edd62144c0ac1fc5a18506a2244ba449ac4"
+	vectorBlindingFactor = "4b66e9d4d1b4673c5ad22691957d6af5c11b6421e0ea01d42ca4169e7918ba0d"
+	vectorScalar         = "ecf60bf886c6323de2a236bf075fe28962144c0ac1fc5a18506a2244ba449a04"
+	vectorBlindedScalar  = "34ed782110db2b5a4c9ccab65bc76e60238522c803326aab70c4e83ad0e0eb0f"
+	vectorPublicKey      = "1c9fd88f45606d932a80c71824ae151d15d73e77de38e8e000852e614fae7019"
+	vectorBlindedPublic  = "739311d35d8d3c41da4062c799a6c748808a31343facaaa7aa7e311908c1846e"
+	vectorNodePrivateKey = "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"
+	vectorNodePublicKey  = "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+	vectorBlindedShared  = "7ef13633929ae2d6319c9379cf443d4f19216b56916704d5a21aee74f224c369"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Invalid hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestBlindingVectors(t *testing.T) {
+	scalar, err := X25519PrivateKeyToScalar(mustHex(t, vectorPrivateKey))
+	if err != nil {
+		t.Fatalf("X25519PrivateKeyToScalar failed: %v", err)
+	}
+	if hex.EncodeToString(scalar) != vectorScalar {
+		t.Errorf("Scalar = %x, want %s", scalar, vectorScalar)
+	}
+
+	blindedScalar, err := BlindPrivateKey(scalar, mustHex(t, vectorBlindingFactor))
+	if err != nil {
+		t.Fatalf("BlindPrivateKey failed: %v", err)
+	}
+	if hex.EncodeToString(blindedScalar) != vectorBlindedScalar {
+		t.Errorf("Blinded scalar = %x, want %s", blindedScalar, vectorBlindedScalar)
+	}
+
+	publicKey, err := ScalarBaseMult(scalar)
+	if err != nil {
+		t.Fatalf("ScalarBaseMult failed: %v", err)
+	}
+	if hex.EncodeToString(publicKey) != vectorPublicKey {
+		t.Errorf("Public key = %x, want %s", publicKey, vectorPublicKey)
+	}
+
+	blindedPublic, err := BlindPublicKey(publicKey, mustHex(t, vectorBlindingFactor))
+	if err != nil {
+		t.Fatalf("BlindPublicKey failed: %v", err)
+	}
+	if hex.EncodeToString(blindedPublic) != vectorBlindedPublic {
+		t.Errorf("Blinded public key = %x, want %s", blindedPublic, vectorBlindedPublic)
+	}
+
+	shared, err := ScalarMult(blindedScalar, mustHex(t, vectorNodePublicKey))
+	if err != nil {
+		t.Fatalf("ScalarMult failed: %v", err)
+	}
+	if hex.EncodeToString(shared) != vectorBlindedShared {
+		t.Errorf("Shared secret = %x, want %s", shared, vectorBlindedShared)
+	}
+
+	// The node reaches the same secret from the blinded public key
+	nodeShared, err := X25519ECDH(mustHex(t, vectorNodePrivateKey), blindedPublic)
+	if err != nil {
+		t.Fatalf("X25519ECDH failed: %v", err)
+	}
+	if !bytes.Equal(shared, nodeShared) {
+		t.Error("Sender and node shared secrets differ")
+	}
+}
+
+func TestEd25519ToCurve25519Vectors(t *testing.T) {
+	// RFC 8032 test 1 keypair; expected values computed independently via
+	// the Montgomery ladder and via the birational map u = (1 + y) / (1 - y)
+	seed := mustHex(t, "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+	edPublic := mustHex(t, "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a")
+	wantPrivate := "307c83864f2833cb427a2ef1c00a013cfdff2768d980c0a3a520f006904de94f"
+	wantPublic := "d85e07ec22b0ad881537c2f44d662d1a143cf830c57aca4305d85c7a90f6b62e"
+
+	edPrivate := ed25519.NewKeyFromSeed(seed)
+	if !bytes.Equal(edPrivate.Public().(ed25519.PublicKey), edPublic) {
+		t.Fatal("RFC 8032 public key mismatch")
+	}
+
+	curvePrivate := Ed25519PrivateKeyToCurve25519(edPrivate)
+	if hex.EncodeToString(curvePrivate) != wantPrivate {
+		t.Errorf("Curve25519 private key = %x, want %s", curvePrivate, wantPrivate)
+	}
+
+	curvePublic, err := Ed25519PublicKeyToCurve25519(edPublic)
+	if err != nil {
+		t.Fatalf("Ed25519PublicKeyToCurve25519 failed: %v", err)
+	}
+	if hex.EncodeToString(curvePublic) != wantPublic {
+		t.Errorf("Curve25519 public key = %x, want %s", curvePublic, wantPublic)
+	}
+
+	derivedPublic, err := curve25519.X25519(curvePrivate, curve25519.Basepoint)
+	if err != nil {
+		t.Fatalf("X25519 failed: %v", err)
+	}
+	if !bytes.Equal(derivedPublic, curvePublic) {
+		t.Error("Converted private and public keys do not match")
+	}
+}
+
+func TestEd25519ToCurve25519ECDH(t *testing.T) {
+	nodePublic, nodePrivate, err := GenerateKeypair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+
+	clientPublic, clientPrivate, err := X25519KeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+
+	onionKey, err := Ed25519PublicKeyToCurve25519(nodePublic)
+	if err != nil {
+		t.Fatalf("Ed25519PublicKeyToCurve25519 failed: %v", err)
+	}
+
+	clientShared, err := X25519ECDH(clientPrivate, onionKey)
+	if err != nil {
+		t.Fatalf("Client ECDH failed: %v", err)
+	}
+
+	nodeShared, err := X25519ECDH(Ed25519PrivateKeyToCurve25519(nodePrivate), clientPublic)
+	if err != nil {
+		t.Fatalf("Node ECDH failed: %v", err)
+	}
+
+	if !bytes.Equal(clientShared, nodeShared) {
+		t.Error("Shared secrets don't match")
+	}
+
+	if _, err := Ed25519PublicKeyToCurve25519(make([]byte, 31)); err == nil {
+		t.Error("Expected error for short public key, got nil")
+	}
+}
+
+func TestBlindingConsistency(t *testing.T) {
+	pub, priv, err := X25519KeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+
+	scalar, err := X25519PrivateKeyToScalar(priv)
+	if err != nil {
+		t.Fatalf("X25519PrivateKeyToScalar failed: %v", err)
+	}
+
+	// Blind three times, as a 3-hop path does
+	for hop := 0; hop < 3; hop++ {
+		blindingFactor, err := RandomBytes(32)
+		if err != nil {
+			t.Fatalf("Failed to generate blinding factor: %v", err)
+		}
+
+		if scalar, err = BlindPrivateKey(scalar, blindingFactor); err != nil {
+			t.Fatalf("BlindPrivateKey failed: %v", err)
+		}
+		nextPub, err := BlindPublicKey(pub, blindingFactor)
+		if err != nil {
+			t.Fatalf("BlindPublicKey failed: %v", err)
+		}
+		if bytes.Equal(nextPub, pub) {
+			t.Fatal("Blinding did not change the public key")
+		}
+		pub = nextPub
+
+		expected, err := ScalarBaseMult(scalar)
+		if err != nil {
+			t.Fatalf("ScalarBaseMult failed: %v", err)
+		}
+		if !bytes.Equal(expected, pub) {
+			t.Fatalf("Hop %d: blinded private and public keys disagree", hop)
+		}
+	}
+}
+
+func TestScalarMult_RejectsInvalidKeys(t *testing.T) {
+	scalar := mustHex(t, vectorScalar)
+
+	testCases := []struct {
+		name      string
+		publicKey []byte
+	}{
+		{"zero point", make([]byte, 32)},
+		{"wrong length", make([]byte, 31)},
+		// u = 1 has order 4 (x = 0, y = 0)
+		{"low order point", append([]byte{1}, make([]byte, 31)...)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ScalarMult(scalar, tc.publicKey); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+
+	// Non-canonical scalars are rejected
+	if _, err := BlindPrivateKey(bytes.Repeat([]byte{0xFF}, 32), mustHex(t, vectorBlindingFactor)); err == nil {
+		t.Error("Expected error for non-canonical scalar, got nil")
+	}
+}
+
+func TestSignOnionKey(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	if err != nil {
+		t.Fatalf("GenerateKeypair failed: %v", err)
+	}
+	onionKey, _, err := X25519KeyPair()
+	if err != nil {
+		t.Fatalf("X25519KeyPair failed: %v", err)
+	}
+
+	node := &NodeInfo{
+		ID:                "node1",
+		PublicKey:         pub,
+		OnionKey:          onionKey,
+		OnionKeyEpoch:     42,
+		OnionKeyEpochSecs: 3600,
+		OnionKeySignature: SignOnionKey(priv, 42, 3600, onionKey),
+	}
+	if err := VerifyOnionKey(node); err != nil {
+		t.Fatalf("VerifyOnionKey failed: %v", err)
+	}
+
+	otherPub, _, _ := GenerateKeypair()
+
+	testCases := []struct {
+		name   string
+		modify func(n *NodeInfo)
+	}{
+		{"wrong epoch", func(n *NodeInfo) { n.OnionKeyEpoch = 43 }},
+		{"wrong epoch length", func(n *NodeInfo) { n.OnionKeyEpochSecs = 60 }},
+		{"wrong key", func(n *NodeInfo) { n.OnionKey = bytes.Repeat([]byte{0x09}, 32) }},
+		{"wrong identity", func(n *NodeInfo) { n.PublicKey = otherPub }},
+		{"missing signature", func(n *NodeInfo) { n.OnionKeySignature = nil }},
+		{"short key", func(n *NodeInfo) { n.OnionKey = n.OnionKey[:31] }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tampered := *node
+			tc.modify(&tampered)
+			if err := VerifyOnionKey(&tampered); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestSignRegistration(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	if err != nil {
+		t.Fatalf("GenerateKeypair failed: %v", err)
+	}
+
+	node := &NodeInfo{ID: "node1", PublicKey: pub, Address: "10.0.0.1", Port: 9000}
+	SignRegistration(priv, node)
+	if err := VerifyRegistration(node); err != nil {
+		t.Fatalf("VerifyRegistration failed: %v", err)
+	}
+
+	otherPub, _, _ := GenerateKeypair()
+
+	testCases := []struct {
+		name   string
+		modify func(n *NodeInfo)
+	}{
+		{"wrong ID", func(n *NodeInfo) { n.ID = "node2" }},
+		{"wrong address", func(n *NodeInfo) { n.Address = "10.0.0.2" }},
+		{"wrong port", func(n *NodeInfo) { n.Port = 9001 }},
+		{"wrong UDP port", func(n *NodeInfo) { n.UDPPort = 9000 }},
+		{"wrong time", func(n *NodeInfo) { n.RegisteredAt = n.RegisteredAt.Add(time.Hour) }},
+		{"wrong identity", func(n *NodeInfo) { n.PublicKey = otherPub }},
+		{"missing signature", func(n *NodeInfo) { n.Signature = nil }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tampered := *node
+			tc.modify(&tampered)
+			if err := VerifyRegistration(&tampered); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestCheckOnionKeyEpoch(t *testing.T) {
+	node := &NodeInfo{OnionKeyEpoch: 100, OnionKeyEpochSecs: 3600}
+	epochStart := time.Unix(100*3600, 0)
+
+	testCases := []struct {
+		name    string
+		now     time.Time
+		wantErr bool
+	}{
+		{"current", epochStart.Add(30 * time.Minute), false},
+		{"previous", epochStart.Add(90 * time.Minute), false},
+		{"next", epochStart.Add(-30 * time.Minute), false},
+		{"stale", epochStart.Add(2 * time.Hour), true},
+		{"future", epochStart.Add(-90 * time.Minute), true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := CheckOnionKeyEpoch(node, tc.now); (err != nil) != tc.wantErr {
+				t.Errorf("Error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	if err := CheckOnionKeyEpoch(&NodeInfo{OnionKeyEpoch: 100}, epochStart); err == nil {
+		t.Error("Expected error without an epoch length, got nil")
+	}
+}
+
+func TestSignKEMKey(t *testing.T) {
+	pub, priv, err := GenerateKeypair()
+	if err != nil {
+		t.Fatalf("GenerateKeypair failed: %v", err)
+	}
+	kemKey := bytes.Repeat([]byte{0x07}, KEMKeySize)
+
+	node := &NodeInfo{
+		ID:              "node1",
+		PublicKey:       pub,
+		OnionKeyEpoch:   42,
+		KEMKey:          kemKey,
+		KEMKeySignature: SignKEMKey(priv, 42, kemKey),
+	}
+	if err := VerifyKEMKey(node); err != nil {
+		t.Fatalf("VerifyKEMKey failed: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(n *NodeInfo)
+	}{
+		{"wrong epoch", func(n *NodeInfo) { n.OnionKeyEpoch = 43 }},
+		{"wrong key", func(n *NodeInfo) { n.KEMKey = bytes.Repeat([]byte{0x09}, KEMKeySize) }},
+		{"onion key signature", func(n *NodeInfo) { n.KEMKeySignature = SignOnionKey(priv, 42, 3600, kemKey) }},
+		{"missing signature", func(n *NodeInfo) { n.KEMKeySignature = nil }},
+		{"short key", func(n *NodeInfo) { n.KEMKey = n.KEMKey[:KEMKeySize-1] }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tampered := *node
+			tc.modify(&tampered)
+			if err := VerifyKEMKey(&tampered); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestHybridSecret(t *testing.T) {
+	ecdh := bytes.Repeat([]byte{0x01}, 32)
+	kem := bytes.Repeat([]byte{0x02}, 32)
+	ct := bytes.Repeat([]byte{0x03}, KEMCiphertextSize)
+	eph := bytes.Repeat([]byte{0x04}, 32)
+
+	secret := HybridSecret(ecdh, kem, ct, eph)
+	if len(secret) != 32 {
+		t.Fatalf("Secret length = %d, want 32", len(secret))
+	}
+	if !bytes.Equal(secret, HybridSecret(ecdh, kem, ct, eph)) {
+		t.Error("HybridSecret is not deterministic")
+	}
+
+	// Every input changes the result
+	other := bytes.Repeat([]byte{0x05}, 32)
+	otherCT := bytes.Repeat([]byte{0x05}, KEMCiphertextSize)
+	for name, s := range map[string][]byte{
+		"ECDH secret":    HybridSecret(other, kem, ct, eph),
+		"KEM secret":     HybridSecret(ecdh, other, ct, eph),
+		"KEM ciphertext": HybridSecret(ecdh, kem, otherCT, eph),
+		"ephemeral key":  HybridSecret(ecdh, kem, ct, other),
+	} {
+		if bytes.Equal(s, secret) {
+			t.Errorf("Changing the %s did not change the secret", name)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// DefaultPaddingBuckets are the content sizes the swarm stores: message
+// content is padded up to one of them so replicas only learn the bucket,
+// not the exact length
+var DefaultPaddingBuckets = []int{512, 4 << 10, 64 << 10}
+
+// ErrUnpaddedContent is returned for content whose length is not a padding bucket
+var ErrUnpaddedContent = errors.New("content not padded to a size bucket")
+
+// paddingMarker starts the padding appended by PadToBucket (ISO/IEC 7816-4)
+const paddingMarker = 0x80
+
+// ValidatePaddingBuckets checks that buckets are positive and strictly increasing
+func ValidatePaddingBuckets(buckets []int) error {
+	if len(buckets) == 0 {
+		return errors.New("no padding buckets")
+	}
+	for i, size := range buckets {
+		if size <= 0 {
+			return fmt.Errorf("invalid padding bucket: %d", size)
+		}
+		if i > 0 && size <= buckets[i-1] {
+			return fmt.Errorf("padding buckets not increasing: %d after %d", size, buckets[i-1])
+		}
+	}
+	return nil
+}
+
+// PaddingBucket returns the smallest bucket that holds size bytes
+func PaddingBucket(size int, buckets []int) (int, error) {
+	i := sort.SearchInts(buckets, size)
+	if i == len(buckets) {
+		return 0, fmt.Errorf("content too large: %d > %d", size, buckets[len(buckets)-1])
+	}
+	return buckets[i], nil
+}
+
+// CheckPadding returns an error wrapping ErrUnpaddedContent unless size
+// is exactly one of buckets
+func CheckPadding(size int, buckets []int) error {
+	i := sort.SearchInts(buckets, size)
+	if i == len(buckets) || buckets[i] != size {
+		return fmt.Errorf("%w: %d bytes, want one of %v", ErrUnpaddedContent, size, buckets)
+	}
+	return nil
+}
+
+// PadToBucket pads content to the smallest bucket that holds it and a
+// one-byte marker. Clients pad sealed content before sending it; the
+// recipient removes the padding with UnpadBucket before opening it.
+func PadToBucket(content []byte, buckets []int) ([]byte, error) {
+	size, err := PaddingBucket(len(content)+1, buckets)
+	if err != nil {
+		return nil, err
+	}
+
+	padded := make([]byte, size)
+	copy(padded, content)
+	padded[len(content)] = paddingMarker
+
+	return padded, nil
+}
+
+// UnpadBucket removes the padding added by PadToBucket
+func UnpadBucket(padded []byte) ([]byte, error) {
+	for i := len(padded) - 1; i >= 0; i-- {
+		switch padded[i] {
+		case 0:
+			continue
+		case paddingMarker:
+			return padded[:i], nil
+		default:
+			return nil, errors.New("invalid padding")
+		}
+	}
+	return nil, errors.New("invalid padding")
+}
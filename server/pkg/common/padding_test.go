@@ -0,0 +1,70 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPadToBucket_RoundTrip(t *testing.T) {
+	testCases := []struct {
+		size   int
+		bucket int
+	}{
+		{0, 512},
+		{511, 512},
+		{512, 4096}, // No room for the marker
+		{4095, 4096},
+		{60000, 65536},
+	}
+
+	for _, tc := range testCases {
+		content := bytes.Repeat([]byte{0x80}, tc.size)
+
+		padded, err := PadToBucket(content, DefaultPaddingBuckets)
+		if err != nil {
+			t.Fatalf("Size %d: PadToBucket failed: %v", tc.size, err)
+		}
+		if len(padded) != tc.bucket {
+			t.Errorf("Size %d: padded to %d, want %d", tc.size, len(padded), tc.bucket)
+		}
+		if err := CheckPadding(len(padded), DefaultPaddingBuckets); err != nil {
+			t.Errorf("Size %d: CheckPadding failed: %v", tc.size, err)
+		}
+
+		unpadded, err := UnpadBucket(padded)
+		if err != nil {
+			t.Fatalf("Size %d: UnpadBucket failed: %v", tc.size, err)
+		}
+		if !bytes.Equal(unpadded, content) {
+			t.Errorf("Size %d: content changed across padding", tc.size)
+		}
+	}
+}
+
+func TestPadToBucket_TooLarge(t *testing.T) {
+	if _, err := PadToBucket(make([]byte, 64<<10), DefaultPaddingBuckets); err == nil {
+		t.Error("Expected error for content larger than the largest bucket, got nil")
+	}
+}
+
+func TestUnpadBucket_Invalid(t *testing.T) {
+	for _, padded := range [][]byte{nil, make([]byte, 512), {0x01, 0x00}} {
+		if _, err := UnpadBucket(padded); err == nil {
+			t.Errorf("UnpadBucket(%x) succeeded, want error", padded)
+		}
+	}
+}
+
+func TestCheckPadding(t *testing.T) {
+	for _, size := range DefaultPaddingBuckets {
+		if err := CheckPadding(size, DefaultPaddingBuckets); err != nil {
+			t.Errorf("CheckPadding(%d) failed: %v", size, err)
+		}
+	}
+	for _, size := range []int{0, 100, 513, 70000} {
+		if err := CheckPadding(size, DefaultPaddingBuckets); !errors.Is(err, ErrUnpaddedContent) {
+			t.Errorf("CheckPadding(%d) = %v, want ErrUnpaddedContent", size, err)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Innermost onion payload layout (see PACKET_FORMAT.md):
+//
+//	0:32    destination session ID
+//	32:64   message ID
+//	64:72   timestamp (Unix milliseconds)
+//	72      message type (high bit set for fragments, 0x40 for a stamp)
+//	73:75   content length
+//	75:     content, then random padding
+//
+// Fragments of a message too large for one payload insert a fragment
+// header (index and total, 2 bytes each) before the content. A message
+// with a proof-of-work stamp carries it (bits, then nonce) after those,
+// in its only payload or its first fragment.
+const (
+	// MessagePayloadSize is the plaintext left in a packet payload after
+	// the final hop's AEAD nonce (12 bytes) and tag (16 bytes)
+	MessagePayloadSize = PayloadSize - 28
+
+	// MessagePayloadHeaderSize is the fixed part of an encoded message
+	MessagePayloadHeaderSize = 75
+
+	// MaxMessageContentSize is the largest content an onion payload carries
+	MaxMessageContentSize = MessagePayloadSize - MessagePayloadHeaderSize
+
+	// PayloadIDSize is the length of the session and message IDs
+	PayloadIDSize = 32
+
+	// PayloadFlagFragment marks a payload carrying one fragment of a message
+	PayloadFlagFragment byte = 0x80
+
+	// PayloadFlagPoW marks a payload carrying the message's proof-of-work stamp
+	PayloadFlagPoW byte = 0x40
+
+	// PayloadPoWSize is the stamp's difficulty (1 byte) and nonce (8 bytes)
+	PayloadPoWSize = 9
+
+	// FragmentHeaderSize is the fragment index and total before fragment content
+	FragmentHeaderSize = 4
+
+	// MaxFragmentContentSize is the content each fragment carries
+	MaxFragmentContentSize = MaxMessageContentSize - FragmentHeaderSize
+
+	// MaxFragments is the most fragments a message can be split into
+	MaxFragments = 0xFFFF
+)
+
+// Fragment is a decoded onion payload: a whole message, or one part of a
+// message split across several payloads
+type Fragment struct {
+	Message *Message // EncryptedContent holds this fragment's part only
+	Index   int      // Position of this part, from 0
+	Total   int      // Number of parts; 1 for a whole message
+}
+
+// EncodeMessagePayload encodes msg into the fixed binary layout of an
+// innermost onion payload. DestinationID and ID must be hex encodings of
+// 32 bytes; the unused tail is filled with random padding. A stamp in
+// msg.PoW is carried along and takes PayloadPoWSize bytes of content
+// room; payloads carry no TTL, so it must be minted with TTL unset.
+func EncodeMessagePayload(msg *Message) ([]byte, error) {
+	if limit := MaxMessageContentSize - payloadPoWSize(msg); len(msg.EncryptedContent) > limit {
+		return nil, fmt.Errorf("content too large: %d > %d", len(msg.EncryptedContent), limit)
+	}
+	return encodePayload(msg, 0, 1, msg.EncryptedContent)
+}
+
+// EncodeMessageFragments encodes msg into as many onion payloads as its
+// content needs. Content that fits in one payload is encoded unfragmented;
+// anything larger is split into fragments of MaxFragmentContentSize, which
+// the destination reassembles before storing the message. The first
+// fragment carries the stamp, if any, and that much less content.
+func EncodeMessageFragments(msg *Message) ([][]byte, error) {
+	stampSize := payloadPoWSize(msg)
+	if len(msg.EncryptedContent) <= MaxMessageContentSize-stampSize {
+		payload, err := EncodeMessagePayload(msg)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{payload}, nil
+	}
+
+	first := MaxFragmentContentSize - stampSize
+	total := 1 + (len(msg.EncryptedContent)-first+MaxFragmentContentSize-1)/MaxFragmentContentSize
+	if total > MaxFragments {
+		return nil, fmt.Errorf("content too large: %d fragments > %d", total, MaxFragments)
+	}
+
+	payloads := make([][]byte, total)
+	for i := range payloads {
+		start, end := 0, first
+		if i > 0 {
+			start = first + (i-1)*MaxFragmentContentSize
+			end = min(start+MaxFragmentContentSize, len(msg.EncryptedContent))
+		}
+
+		payload, err := encodePayload(msg, i, total, msg.EncryptedContent[start:end])
+		if err != nil {
+			return nil, err
+		}
+		payloads[i] = payload
+	}
+
+	return payloads, nil
+}
+
+// payloadPoWSize returns the payload room msg's stamp takes
+func payloadPoWSize(msg *Message) int {
+	if msg.PoW == nil {
+		return 0
+	}
+	return PayloadPoWSize
+}
+
+// encodePayload encodes one payload holding content, fragment index of total
+func encodePayload(msg *Message, index, total int, content []byte) ([]byte, error) {
+	destination, err := decodePayloadID(msg.DestinationID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination ID: %w", err)
+	}
+	id, err := decodePayloadID(msg.ID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message ID: %w", err)
+	}
+	if !validPayloadMessageType(msg.MessageType) {
+		return nil, fmt.Errorf("invalid message type: 0x%02x", msg.MessageType)
+	}
+	stamped := msg.PoW != nil && index == 0
+	if stamped && (msg.PoW.Bits < 0 || msg.PoW.Bits > MaxPoWBits) {
+		return nil, fmt.Errorf("invalid stamp difficulty: %d", msg.PoW.Bits)
+	}
+	if stamped && !msg.TTL.IsZero() {
+		return nil, errors.New("stamp bound to a TTL, which payloads do not carry")
+	}
+
+	data := make([]byte, MessagePayloadSize)
+	copy(data[0:32], destination)
+	copy(data[32:64], id)
+	binary.BigEndian.PutUint64(data[64:72], uint64(msg.Timestamp.UnixMilli()))
+	data[72] = msg.MessageType
+	binary.BigEndian.PutUint16(data[73:75], uint16(len(content)))
+
+	offset := MessagePayloadHeaderSize
+	if total > 1 {
+		data[72] |= PayloadFlagFragment
+		binary.BigEndian.PutUint16(data[75:77], uint16(index))
+		binary.BigEndian.PutUint16(data[77:79], uint16(total))
+		offset += FragmentHeaderSize
+	}
+	if stamped {
+		data[72] |= PayloadFlagPoW
+		data[offset] = byte(msg.PoW.Bits)
+		binary.BigEndian.PutUint64(data[offset+1:offset+PayloadPoWSize], msg.PoW.Nonce)
+		offset += PayloadPoWSize
+	}
+	n := copy(data[offset:], content)
+
+	if _, err := rand.Read(data[offset+n:]); err != nil {
+		return nil, fmt.Errorf("padding generation failed: %w", err)
+	}
+
+	return data, nil
+}
+
+// DecodeMessagePayload decodes an unfragmented onion payload produced by
+// EncodeMessagePayload. IDs are returned hex encoded; TTL is left unset.
+func DecodeMessagePayload(data []byte) (*Message, error) {
+	fragment, err := DecodeFragment(data)
+	if err != nil {
+		return nil, err
+	}
+	if fragment.Total != 1 {
+		return nil, errors.New("payload is a message fragment")
+	}
+	return fragment.Message, nil
+}
+
+// DecodeFragment decodes any onion payload produced by EncodeMessagePayload
+// or EncodeMessageFragments
+func DecodeFragment(data []byte) (*Fragment, error) {
+	if len(data) != MessagePayloadSize {
+		return nil, fmt.Errorf("invalid payload size: %d", len(data))
+	}
+
+	messageType := data[72] &^ (PayloadFlagFragment | PayloadFlagPoW)
+	if !validPayloadMessageType(messageType) {
+		return nil, fmt.Errorf("invalid message type: 0x%02x", messageType)
+	}
+
+	millis := int64(binary.BigEndian.Uint64(data[64:72]))
+	if millis < 0 {
+		return nil, errors.New("invalid timestamp")
+	}
+
+	fragment := &Fragment{Index: 0, Total: 1}
+	offset, maxLength := MessagePayloadHeaderSize, MaxMessageContentSize
+	if data[72]&PayloadFlagFragment != 0 {
+		fragment.Index = int(binary.BigEndian.Uint16(data[75:77]))
+		fragment.Total = int(binary.BigEndian.Uint16(data[77:79]))
+		if fragment.Total < 2 || fragment.Index >= fragment.Total {
+			return nil, fmt.Errorf("invalid fragment %d of %d", fragment.Index, fragment.Total)
+		}
+		offset, maxLength = offset+FragmentHeaderSize, MaxFragmentContentSize
+	}
+
+	var stamp *PoWStamp
+	if data[72]&PayloadFlagPoW != 0 {
+		if fragment.Index != 0 {
+			return nil, fmt.Errorf("stamp in fragment %d", fragment.Index)
+		}
+		stamp = &PoWStamp{
+			Bits:  int(data[offset]),
+			Nonce: binary.BigEndian.Uint64(data[offset+1 : offset+PayloadPoWSize]),
+		}
+		if stamp.Bits > MaxPoWBits {
+			return nil, fmt.Errorf("invalid stamp difficulty: %d", stamp.Bits)
+		}
+		offset, maxLength = offset+PayloadPoWSize, maxLength-PayloadPoWSize
+	}
+
+	length := int(binary.BigEndian.Uint16(data[73:75]))
+	if length > maxLength {
+		return nil, fmt.Errorf("invalid content length: %d", length)
+	}
+
+	content := make([]byte, length)
+	copy(content, data[offset:])
+
+	fragment.Message = &Message{
+		ID:               hex.EncodeToString(data[32:64]),
+		DestinationID:    hex.EncodeToString(data[0:32]),
+		Timestamp:        time.UnixMilli(millis),
+		MessageType:      messageType,
+		EncryptedContent: content,
+		PoW:              stamp,
+	}
+
+	return fragment, nil
+}
+
+// decodePayloadID decodes a hex-encoded 32-byte session or message ID
+func decodePayloadID(id string) ([]byte, error) {
+	raw, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != PayloadIDSize {
+		return nil, fmt.Errorf("want %d bytes, got %d", PayloadIDSize, len(raw))
+	}
+	return raw, nil
+}
+
+// validPayloadMessageType reports whether t may be sent in an onion payload:
+// user messages and cover traffic, but not SURB replies
+func validPayloadMessageType(t byte) bool {
+	return (t >= MessageTypeText && t <= MessageTypeDeliveryReceipt) ||
+		t == MessageTypeLoop || t == MessageTypeDrop
+}
@@ -0,0 +1,353 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPayloadMessage returns a message that fits in an onion payload
+func testPayloadMessage() *Message {
+	return &Message{
+		ID:               strings.Repeat("ab", PayloadIDSize),
+		DestinationID:    strings.Repeat("05", PayloadIDSize),
+		Timestamp:        time.UnixMilli(1760000000123),
+		MessageType:      MessageTypeText,
+		EncryptedContent: []byte("sealed content"),
+	}
+}
+
+func TestMessagePayload_RoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, MaxMessageContentSize} {
+		msg := testPayloadMessage()
+		msg.EncryptedContent = bytes.Repeat([]byte{0xC3}, size)
+
+		data, err := EncodeMessagePayload(msg)
+		if err != nil {
+			t.Fatalf("Content %d: EncodeMessagePayload failed: %v", size, err)
+		}
+		if len(data) != MessagePayloadSize {
+			t.Fatalf("Content %d: encoded length = %d, want %d", size, len(data), MessagePayloadSize)
+		}
+
+		decoded, err := DecodeMessagePayload(data)
+		if err != nil {
+			t.Fatalf("Content %d: DecodeMessagePayload failed: %v", size, err)
+		}
+		if decoded.ID != msg.ID || decoded.DestinationID != msg.DestinationID {
+			t.Errorf("Content %d: IDs = %s, %s, want %s, %s", size, decoded.ID, decoded.DestinationID, msg.ID, msg.DestinationID)
+		}
+		if !decoded.Timestamp.Equal(msg.Timestamp) || decoded.MessageType != msg.MessageType {
+			t.Errorf("Content %d: timestamp, type = %v, %d, want %v, %d",
+				size, decoded.Timestamp, decoded.MessageType, msg.Timestamp, msg.MessageType)
+		}
+		if !bytes.Equal(decoded.EncryptedContent, msg.EncryptedContent) {
+			t.Errorf("Content %d: content changed across encode and decode", size)
+		}
+	}
+}
+
+func TestMessagePayload_RandomPadding(t *testing.T) {
+	msg := testPayloadMessage()
+
+	first, _ := EncodeMessagePayload(msg)
+	second, _ := EncodeMessagePayload(msg)
+
+	start := MessagePayloadHeaderSize + len(msg.EncryptedContent)
+	if bytes.Equal(first[start:], second[start:]) {
+		t.Error("Padding identical across encodings")
+	}
+	if bytes.Equal(first[start:], make([]byte, MessagePayloadSize-start)) {
+		t.Error("Padding is all zero")
+	}
+}
+
+func TestEncodeMessagePayload_Invalid(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(m *Message)
+	}{
+		{"content too large", func(m *Message) { m.EncryptedContent = make([]byte, MaxMessageContentSize+1) }},
+		{"short destination", func(m *Message) { m.DestinationID = "05abc" }},
+		{"non-hex destination", func(m *Message) { m.DestinationID = strings.Repeat("zz", PayloadIDSize) }},
+		{"long message ID", func(m *Message) { m.ID = strings.Repeat("ab", PayloadIDSize+1) }},
+		{"unknown type", func(m *Message) { m.MessageType = MessageTypeSURBReply }},
+		{"type past cover types", func(m *Message) { m.MessageType = MessageTypeDrop + 1 }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := testPayloadMessage()
+			tc.modify(msg)
+			if _, err := EncodeMessagePayload(msg); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestDecodeMessagePayload_Invalid(t *testing.T) {
+	valid, err := EncodeMessagePayload(testPayloadMessage())
+	if err != nil {
+		t.Fatalf("EncodeMessagePayload failed: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(data []byte) []byte
+	}{
+		{"truncated", func(d []byte) []byte { return d[:MessagePayloadSize-1] }},
+		{"extended", func(d []byte) []byte { return append(d, 0) }},
+		{"empty", func(d []byte) []byte { return nil }},
+		{"length past end", func(d []byte) []byte {
+			binary.BigEndian.PutUint16(d[73:75], MaxMessageContentSize+1)
+			return d
+		}},
+		{"maximum length field", func(d []byte) []byte {
+			binary.BigEndian.PutUint16(d[73:75], 0xFFFF)
+			return d
+		}},
+		{"zero type", func(d []byte) []byte { d[72] = 0; return d }},
+		{"negative timestamp", func(d []byte) []byte { d[64] = 0x80; return d }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tc.modify(append([]byte(nil), valid...))
+			if _, err := DecodeMessagePayload(data); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func FuzzDecodeMessagePayload(f *testing.F) {
+	valid, _ := EncodeMessagePayload(testPayloadMessage())
+	f.Add(valid)
+	f.Add(valid[:MessagePayloadHeaderSize])
+	f.Add(make([]byte, MessagePayloadSize))
+	overlong := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint16(overlong[73:75], 0xFFFF)
+	f.Add(overlong)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := DecodeMessagePayload(data)
+		if err != nil {
+			return
+		}
+		if len(msg.EncryptedContent) > MaxMessageContentSize {
+			t.Fatalf("Decoded content length %d exceeds %d", len(msg.EncryptedContent), MaxMessageContentSize)
+		}
+
+		// Anything that decodes re-encodes to the same fields
+		encoded, err := EncodeMessagePayload(msg)
+		if err != nil {
+			t.Fatalf("Re-encoding decoded message failed: %v", err)
+		}
+		end := MessagePayloadHeaderSize + len(msg.EncryptedContent)
+		if !bytes.Equal(encoded[:end], data[:end]) {
+			t.Fatal("Re-encoded payload differs from input")
+		}
+	})
+}
+
+func FuzzEncodeMessagePayload(f *testing.F) {
+	f.Add([]byte("content"), byte(MessageTypeText))
+	f.Add(make([]byte, MaxMessageContentSize), byte(MessageTypeDeliveryReceipt))
+	f.Add(make([]byte, MaxMessageContentSize+1), byte(MessageTypeText))
+	f.Add([]byte{}, byte(0xFF))
+
+	f.Fuzz(func(t *testing.T, content []byte, messageType byte) {
+		msg := testPayloadMessage()
+		msg.EncryptedContent = content
+		msg.MessageType = messageType
+
+		data, err := EncodeMessagePayload(msg)
+		if err != nil {
+			if len(content) <= MaxMessageContentSize && validPayloadMessageType(messageType) {
+				t.Fatalf("Valid message rejected: %v", err)
+			}
+			return
+		}
+		if len(data) != MessagePayloadSize {
+			t.Fatalf("Encoded length = %d, want %d", len(data), MessagePayloadSize)
+		}
+
+		decoded, err := DecodeMessagePayload(data)
+		if err != nil {
+			t.Fatalf("DecodeMessagePayload failed: %v", err)
+		}
+		if !bytes.Equal(decoded.EncryptedContent, content) {
+			t.Fatal("Content changed across encode and decode")
+		}
+	})
+}
+
+func TestEncodeMessageFragments(t *testing.T) {
+	msg := testPayloadMessage()
+	msg.EncryptedContent = make([]byte, 3*MaxFragmentContentSize+1)
+	for i := range msg.EncryptedContent {
+		msg.EncryptedContent[i] = byte(i)
+	}
+
+	payloads, err := EncodeMessageFragments(msg)
+	if err != nil {
+		t.Fatalf("EncodeMessageFragments failed: %v", err)
+	}
+	if len(payloads) != 4 {
+		t.Fatalf("Fragments = %d, want 4", len(payloads))
+	}
+
+	var content []byte
+	for i, payload := range payloads {
+		fragment, err := DecodeFragment(payload)
+		if err != nil {
+			t.Fatalf("Fragment %d: DecodeFragment failed: %v", i, err)
+		}
+		if fragment.Index != i || fragment.Total != 4 {
+			t.Errorf("Fragment %d: index %d of %d, want %d of 4", i, fragment.Index, fragment.Total, i)
+		}
+		if fragment.Message.ID != msg.ID || fragment.Message.MessageType != msg.MessageType {
+			t.Errorf("Fragment %d: header fields changed", i)
+		}
+		content = append(content, fragment.Message.EncryptedContent...)
+
+		if _, err := DecodeMessagePayload(payload); err == nil {
+			t.Errorf("Fragment %d: DecodeMessagePayload accepted a fragment", i)
+		}
+	}
+	if !bytes.Equal(content, msg.EncryptedContent) {
+		t.Error("Concatenated fragments differ from the original content")
+	}
+
+	// Content that fits stays unfragmented
+	msg.EncryptedContent = make([]byte, MaxMessageContentSize)
+	payloads, err = EncodeMessageFragments(msg)
+	if err != nil || len(payloads) != 1 {
+		t.Fatalf("EncodeMessageFragments = %d payloads, %v, want 1", len(payloads), err)
+	}
+	if _, err := DecodeMessagePayload(payloads[0]); err != nil {
+		t.Errorf("DecodeMessagePayload failed: %v", err)
+	}
+}
+
+func TestEncodeMessageFragments_PoW(t *testing.T) {
+	for _, size := range []int{MaxMessageContentSize - PayloadPoWSize, 3 * MaxFragmentContentSize} {
+		msg := testPayloadMessage()
+		msg.EncryptedContent = bytes.Repeat([]byte{0xC3}, size)
+		if err := MintPoW(msg, 8); err != nil {
+			t.Fatalf("MintPoW failed: %v", err)
+		}
+
+		payloads, err := EncodeMessageFragments(msg)
+		if err != nil {
+			t.Fatalf("Content %d: EncodeMessageFragments failed: %v", size, err)
+		}
+
+		// Only the first payload carries the stamp
+		var content []byte
+		for i, payload := range payloads {
+			fragment, err := DecodeFragment(payload)
+			if err != nil {
+				t.Fatalf("Content %d, fragment %d: DecodeFragment failed: %v", size, i, err)
+			}
+			if (fragment.Message.PoW != nil) != (i == 0) {
+				t.Errorf("Content %d, fragment %d: PoW = %+v", size, i, fragment.Message.PoW)
+			}
+			content = append(content, fragment.Message.EncryptedContent...)
+		}
+
+		delivered := *msg
+		delivered.EncryptedContent = content
+		if err := VerifyPoW(&delivered, 8); err != nil {
+			t.Errorf("Content %d: stamp does not verify after delivery: %v", size, err)
+		}
+	}
+
+	// The stamp takes content room
+	msg := testPayloadMessage()
+	msg.PoW = &PoWStamp{Bits: 8}
+	msg.EncryptedContent = make([]byte, MaxMessageContentSize)
+	if _, err := EncodeMessagePayload(msg); err == nil {
+		t.Error("EncodeMessagePayload accepted a full payload with a stamp")
+	}
+
+	// Payloads do not carry the TTL a stamp binds
+	msg.EncryptedContent = []byte("sealed content")
+	msg.TTL = time.Now().Add(time.Hour)
+	if _, err := EncodeMessagePayload(msg); err == nil {
+		t.Error("EncodeMessagePayload accepted a stamp bound to a TTL")
+	}
+
+	// Later fragments cannot carry one
+	msg = testPayloadMessage()
+	msg.EncryptedContent = make([]byte, 2*MaxFragmentContentSize)
+	payloads, err := EncodeMessageFragments(msg)
+	if err != nil {
+		t.Fatalf("EncodeMessageFragments failed: %v", err)
+	}
+	payloads[1][72] |= PayloadFlagPoW
+	if _, err := DecodeFragment(payloads[1]); err == nil {
+		t.Error("DecodeFragment accepted a stamp in fragment 1")
+	}
+}
+
+func TestDecodeFragment_Invalid(t *testing.T) {
+	msg := testPayloadMessage()
+	msg.EncryptedContent = make([]byte, MaxMessageContentSize+1)
+	payloads, err := EncodeMessageFragments(msg)
+	if err != nil {
+		t.Fatalf("EncodeMessageFragments failed: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(d []byte)
+	}{
+		{"index past total", func(d []byte) { binary.BigEndian.PutUint16(d[75:77], 2) }},
+		{"single fragment total", func(d []byte) { binary.BigEndian.PutUint16(d[77:79], 1) }},
+		{"zero total", func(d []byte) { binary.BigEndian.PutUint16(d[77:79], 0) }},
+		{"length past end", func(d []byte) { binary.BigEndian.PutUint16(d[73:75], MaxFragmentContentSize+1) }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := append([]byte(nil), payloads[0]...)
+			tc.modify(data)
+			if _, err := DecodeFragment(data); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func FuzzDecodeFragment(f *testing.F) {
+	msg := testPayloadMessage()
+	msg.EncryptedContent = make([]byte, 2*MaxFragmentContentSize)
+	payloads, _ := EncodeMessageFragments(msg)
+	for _, payload := range payloads {
+		f.Add(payload)
+	}
+	bad := append([]byte(nil), payloads[0]...)
+	binary.BigEndian.PutUint16(bad[75:79], 0xFFFF)
+	f.Add(bad)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fragment, err := DecodeFragment(data)
+		if err != nil {
+			return
+		}
+		if fragment.Index < 0 || fragment.Index >= fragment.Total || fragment.Total > MaxFragments {
+			t.Fatalf("Decoded invalid fragment %d of %d", fragment.Index, fragment.Total)
+		}
+		limit := MaxMessageContentSize
+		if fragment.Total > 1 {
+			limit = MaxFragmentContentSize
+		}
+		if len(fragment.Message.EncryptedContent) > limit {
+			t.Fatalf("Decoded content length %d exceeds %d", len(fragment.Message.EncryptedContent), limit)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"time"
+)
+
+// ErrInsufficientPoW is returned for a message without a valid proof-of-work
+// stamp of the required difficulty
+var ErrInsufficientPoW = errors.New("insufficient proof of work")
+
+// Proof-of-work difficulty scaling: the base difficulty covers content up
+// to PoWBaseSize kept up to PoWBaseLifetime. Each doubling of the lifetime
+// and each quadrupling of the size beyond these adds one bit.
+const (
+	PoWBaseLifetime = 24 * time.Hour
+	PoWBaseSize     = 512
+
+	// MaxPoWBits is the highest difficulty a stamp can claim
+	MaxPoWBits = 64
+)
+
+// powDomain separates stamp hashes from every other use of SHA-256
+const powDomain = "GhostTalk-PoW-v1"
+
+// PoWStamp is a hashcash stamp: the stamp hash of the message it is
+// attached to, which covers Nonce, starts with at least Bits zero bits
+type PoWStamp struct {
+	Bits  int    `json:"bits"`
+	Nonce uint64 `json:"nonce"`
+}
+
+// PoWDifficulty returns the stamp difficulty, in bits, required for content
+// of size bytes kept for lifetime, given the base difficulty
+func PoWDifficulty(base int, lifetime time.Duration, size int) int {
+	difficulty := base
+	for d := PoWBaseLifetime; d < lifetime; d *= 2 {
+		difficulty++
+	}
+	for s := PoWBaseSize; s < size; s *= 4 {
+		difficulty++
+	}
+	return min(difficulty, MaxPoWBits)
+}
+
+// MintPoW finds a stamp of difficulty bits for msg and attaches it. The
+// stamp binds the destination, message ID, TTL and content, so none of
+// them can change afterwards. Clients should set TTL before minting and
+// compute bits with PoWDifficulty; a zero TTL is priced at the storing
+// node's default TTL.
+func MintPoW(msg *Message, bits int) error {
+	if bits < 0 || bits > MaxPoWBits {
+		return fmt.Errorf("difficulty must be 0-%d bits, got %d", MaxPoWBits, bits)
+	}
+
+	input := powInput(msg, bits)
+	for nonce := uint64(0); ; nonce++ {
+		if powZeroBits(input, nonce) >= bits {
+			msg.PoW = &PoWStamp{Bits: bits, Nonce: nonce}
+			return nil
+		}
+		if nonce == ^uint64(0) {
+			return fmt.Errorf("no stamp of %d bits found", bits)
+		}
+	}
+}
+
+// VerifyPoW returns an error wrapping ErrInsufficientPoW unless msg
+// carries a valid stamp of at least bits difficulty
+func VerifyPoW(msg *Message, bits int) error {
+	if msg.PoW == nil {
+		return fmt.Errorf("%w: no stamp, want %d bits", ErrInsufficientPoW, bits)
+	}
+	if msg.PoW.Bits < bits || msg.PoW.Bits > MaxPoWBits {
+		return fmt.Errorf("%w: stamp of %d bits, want %d", ErrInsufficientPoW, msg.PoW.Bits, bits)
+	}
+	if powZeroBits(powInput(msg, msg.PoW.Bits), msg.PoW.Nonce) < msg.PoW.Bits {
+		return fmt.Errorf("%w: invalid stamp", ErrInsufficientPoW)
+	}
+	return nil
+}
+
+// powInput encodes what a stamp binds, leaving room for the nonce:
+// domain, claimed bits, destination ID, message ID, TTL and content hash
+func powInput(msg *Message, bits int) []byte {
+	contentHash := sha256.Sum256(msg.EncryptedContent)
+
+	input := make([]byte, 0, len(powDomain)+1+2+len(msg.DestinationID)+2+len(msg.ID)+8+len(contentHash)+8)
+	input = append(input, powDomain...)
+	input = append(input, byte(bits))
+	input = binary.BigEndian.AppendUint16(input, uint16(len(msg.DestinationID)))
+	input = append(input, msg.DestinationID...)
+	input = binary.BigEndian.AppendUint16(input, uint16(len(msg.ID)))
+	input = append(input, msg.ID...)
+	var ttl int64
+	if !msg.TTL.IsZero() {
+		ttl = msg.TTL.Unix()
+	}
+	input = binary.BigEndian.AppendUint64(input, uint64(ttl))
+	input = append(input, contentHash[:]...)
+	return append(input, make([]byte, 8)...)
+}
+
+// powZeroBits returns the number of leading zero bits of the stamp hash
+// for nonce. It writes the nonce into the tail of input.
+func powZeroBits(input []byte, nonce uint64) int {
+	binary.BigEndian.PutUint64(input[len(input)-8:], nonce)
+	hash := sha256.Sum256(input)
+
+	zeros := 0
+	for _, b := range hash {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPoWDifficulty(t *testing.T) {
+	testCases := []struct {
+		lifetime time.Duration
+		size     int
+		want     int
+	}{
+		{time.Hour, 512, 10},
+		{24 * time.Hour, 512, 10},
+		{25 * time.Hour, 512, 11},
+		{14 * 24 * time.Hour, 512, 14},
+		{time.Hour, 4 << 10, 12},
+		{time.Hour, 64 << 10, 14},
+		{14 * 24 * time.Hour, 64 << 10, 18},
+		{-time.Hour, 0, 10},
+	}
+
+	for _, tc := range testCases {
+		if got := PoWDifficulty(10, tc.lifetime, tc.size); got != tc.want {
+			t.Errorf("PoWDifficulty(10, %v, %d) = %d, want %d", tc.lifetime, tc.size, got, tc.want)
+		}
+	}
+}
+
+func TestMintPoW_Verifies(t *testing.T) {
+	msg := &Message{
+		ID:               "msg1",
+		DestinationID:    "session123",
+		TTL:              time.Now().Add(time.Hour),
+		EncryptedContent: make([]byte, 512),
+	}
+	if err := MintPoW(msg, 12); err != nil {
+		t.Fatalf("MintPoW failed: %v", err)
+	}
+	if msg.PoW == nil || msg.PoW.Bits != 12 {
+		t.Fatalf("Stamp = %+v, want 12 bits", msg.PoW)
+	}
+
+	if err := VerifyPoW(msg, 12); err != nil {
+		t.Errorf("VerifyPoW failed: %v", err)
+	}
+	if err := VerifyPoW(msg, 8); err != nil {
+		t.Errorf("VerifyPoW below the stamp's difficulty failed: %v", err)
+	}
+	if err := VerifyPoW(msg, 13); !errors.Is(err, ErrInsufficientPoW) {
+		t.Errorf("VerifyPoW above the stamp's difficulty = %v, want ErrInsufficientPoW", err)
+	}
+}
+
+func TestVerifyPoW_BindsMessage(t *testing.T) {
+	mint := func() *Message {
+		msg := &Message{
+			ID:               "msg1",
+			DestinationID:    "session123",
+			TTL:              time.Unix(1700000000, 0),
+			EncryptedContent: make([]byte, 512),
+		}
+		if err := MintPoW(msg, 12); err != nil {
+			t.Fatalf("MintPoW failed: %v", err)
+		}
+		return msg
+	}
+
+	testCases := map[string]func(*Message){
+		"destination":   func(m *Message) { m.DestinationID = "session456" },
+		"message ID":    func(m *Message) { m.ID = "msg2" },
+		"TTL":           func(m *Message) { m.TTL = m.TTL.Add(24 * time.Hour) },
+		"content":       func(m *Message) { m.EncryptedContent[0] ^= 1 },
+		"claimed bits":  func(m *Message) { m.PoW.Bits = 20 },
+		"missing stamp": func(m *Message) { m.PoW = nil },
+	}
+
+	for name, tamper := range testCases {
+		msg := mint()
+		tamper(msg)
+		if err := VerifyPoW(msg, 12); !errors.Is(err, ErrInsufficientPoW) {
+			t.Errorf("%s changed: VerifyPoW = %v, want ErrInsufficientPoW", name, err)
+		}
+	}
+}
+
+func TestMintPoW_InvalidDifficulty(t *testing.T) {
+	for _, bits := range []int{-1, MaxPoWBits + 1} {
+		if err := MintPoW(&Message{}, bits); err == nil {
+			t.Errorf("MintPoW(%d) succeeded, want error", bits)
+		}
+	}
+}
@@ -2,18 +2,28 @@ package common
 
 import (
 	"crypto/ed25519"
+	"fmt"
 	"time"
 )
 
 // NodeInfo represents information about a service node
 type NodeInfo struct {
-	ID         string           `json:"id"`
-	PublicKey  ed25519.PublicKey `json:"public_key"`
-	Address    string           `json:"address"`
-	Port       uint16           `json:"port"`
-	LastSeen   time.Time        `json:"last_seen"`
-	Version    string           `json:"version"`
-	Healthy    bool             `json:"healthy"`
+	ID                string            `json:"id"`
+	PublicKey         ed25519.PublicKey `json:"public_key"`
+	OnionKey          []byte            `json:"onion_key,omitempty"`            // X25519 key for onion ECDH
+	OnionKeyEpoch     uint64            `json:"onion_key_epoch,omitempty"`      // Epoch the onion key is current for
+	OnionKeyEpochSecs uint64            `json:"onion_key_epoch_secs,omitempty"` // Length of the node's key epochs
+	OnionKeySignature []byte            `json:"onion_key_signature,omitempty"`
+	KEMKey            []byte            `json:"kem_key,omitempty"` // ML-KEM-768 encapsulation key for version 3 packets
+	KEMKeySignature   []byte            `json:"kem_key_signature,omitempty"`
+	Address           string            `json:"address"`
+	Port              uint16            `json:"port"`
+	UDPPort           uint16            `json:"udp_port,omitempty"`  // Node-to-node datagrams; 0 when disabled
+	RegisteredAt      time.Time         `json:"registered_at"`       // When the node signed its registration
+	Signature         []byte            `json:"signature,omitempty"` // Identity key signature over the registration
+	LastSeen          time.Time         `json:"last_seen"`
+	Version           string            `json:"version"`
+	Healthy           bool              `json:"healthy"`
 }
 
 // OnionPacket represents a Sphinx-like onion packet
@@ -21,7 +31,8 @@ type OnionPacket struct {
 	Version        byte   `json:"version"`
 	EphemeralKey   []byte `json:"ephemeral_key"`   // 32 bytes
 	HeaderHMAC     []byte `json:"header_hmac"`     // 32 bytes
-	RoutingBlob    []byte `json:"routing_blob"`    // 615 bytes
+	KEMCiphertext  []byte `json:"kem_ciphertext,omitempty"` // 1088 bytes, version 3 only
+	RoutingBlob    []byte `json:"routing_blob"`    // 615 bytes (6055 in version 3)
 	EncryptedPayload []byte `json:"encrypted_payload"` // 600 bytes
 }
 
@@ -33,6 +44,9 @@ type RoutingInfo struct {
 	Expiry      time.Time `json:"expiry"`
 	Delay       uint16    `json:"delay"` // milliseconds
 	HMAC        []byte    `json:"hmac"`
+	Flags       byte      `json:"flags"`             // RoutingFlag* bits
+	SURBID      []byte    `json:"surb_id,omitempty"` // Final hop of a reply only
+	KEMCiphertext []byte  `json:"kem_ciphertext,omitempty"` // Next hop's ML-KEM ciphertext (version 3)
 }
 
 // Message represents an E2EE encrypted message
@@ -44,6 +58,7 @@ type Message struct {
 	EncryptedContent []byte   `json:"encrypted_content"`
 	TTL             time.Time `json:"ttl"`
 	ReplicaCount    int       `json:"replica_count"`
+	PoW             *PoWStamp `json:"pow,omitempty"` // Required by nodes that enforce proof of work
 }
 
 // MessageType constants
@@ -53,8 +68,15 @@ const (
 	MessageTypeTypingIndicator byte = 0x03
 	MessageTypeReadReceipt     byte = 0x04
 	MessageTypeDeliveryReceipt byte = 0x05
+	MessageTypeSURBReply       byte = 0x06 // Layered reply payload, stored under its SURB ID
+	MessageTypeLoop            byte = 0x07 // Cover traffic routed back to the node that built it
+	MessageTypeDrop            byte = 0x08 // Cover traffic the final hop discards
 )
 
+// SURBDestinationPrefix starts the swarm destination of every SURB reply.
+// Only the node that delivered a reply stores under it.
+const SURBDestinationPrefix = "surb-"
+
 // SwarmInfo represents information about a swarm
 type SwarmInfo struct {
 	SwarmID   string   `json:"swarm_id"`
@@ -91,19 +113,106 @@ type Config struct {
 		CAFile   string `yaml:"ca_file"`
 		CertFile string `yaml:"cert_file"`
 		KeyFile  string `yaml:"key_file"`
+		
+		// Persistent framed link per peer for packets and replication
+		Link struct {
+			Enabled             bool `yaml:"enabled"`
+			QueueSize           int  `yaml:"queue_size"`         // Frames waiting per peer before senders block
+			MaxInFlight         int  `yaml:"max_in_flight"`      // Requests from a peer handled concurrently
+			PingIntervalSeconds int  `yaml:"ping_interval_seconds"`
+			MaxLinks            int  `yaml:"max_links"`          // Links accepted from all peers at once
+			MaxLinksPerPeer     int  `yaml:"max_links_per_peer"` // Links accepted from one peer at once
+			MaxBufferedBytes    int  `yaml:"max_buffered_bytes"` // Request payload bytes held per accepted link
+		} `yaml:"link"`
 	} `yaml:"mtls"`
 	
+	UDP struct {
+		Enabled bool `yaml:"enabled"`
+		Port    int  `yaml:"port"`    // Published to the directory; listens on the listen_address host
+		Readers int  `yaml:"readers"` // Goroutines reading datagrams; 0 uses one per CPU
+	} `yaml:"udp"`
+	
 	Storage struct {
 		Backend   string `yaml:"backend"` // "rocksdb" or "postgres"
 		Path      string `yaml:"path"`
 		MaxSizeGB int    `yaml:"max_size_gb"`
 	} `yaml:"storage"`
 	
+	Forwarding struct {
+		QueueSize      int `yaml:"queue_size"`
+		Workers        int `yaml:"workers"`
+		MaxAttempts    int `yaml:"max_attempts"`
+		RetryBackoffMs int `yaml:"retry_backoff_ms"`
+	} `yaml:"forwarding"`
+	
+	Processing struct {
+		Workers   int `yaml:"workers"`    // Packets decrypted in parallel per batch; 0 uses one per CPU
+		QueueSize int `yaml:"queue_size"` // UDP and peer link packets waiting for a batch
+	} `yaml:"processing"`
+	
+	Mixing struct {
+		Strategy    string `yaml:"strategy"` // none, pool or poisson
+		IntervalMs  int    `yaml:"interval_ms"`
+		Retain      int    `yaml:"retain"`
+		MeanDelayMs int    `yaml:"mean_delay_ms"`
+	} `yaml:"mixing"`
+	
+	DelayPolicy struct {
+		MinMs  int `yaml:"min_ms"`  // Requested per-hop delays are raised to this
+		MaxMs  int `yaml:"max_ms"`  // and cut to this (0: no limit)
+		MeanMs int `yaml:"mean_ms"` // Mean exponential per-hop delay of packets this node builds
+	} `yaml:"delay_policy"`
+	
+	Cover struct {
+		LoopRate           float64 `yaml:"loop_rate"` // Loop packets per second (0 disables)
+		DropRate           float64 `yaml:"drop_rate"` // Drop packets per second (0 disables)
+		PathLength         int     `yaml:"path_length"`
+		LoopTimeoutSeconds int     `yaml:"loop_timeout_seconds"`
+	} `yaml:"cover"`
+	
+	LinkPadding struct {
+		Enabled            bool    `yaml:"enabled"`
+		Rate               float64 `yaml:"rate"`               // Packets per second to each active neighbor
+		MaxBandwidthKBps   int     `yaml:"max_bandwidth_kbps"` // Budget across padded links; 0 is unlimited
+		QueueSize          int     `yaml:"queue_size"`         // Real packets waiting per neighbor
+		IdleTimeoutSeconds int     `yaml:"idle_timeout_seconds"`
+	} `yaml:"link_padding"`
+	
+	PacketFormat struct {
+		AcceptV1Until string `yaml:"accept_v1_until"` // RFC 3339; empty rejects version 1 packets
+	} `yaml:"packet_format"`
+	
+	OnionKeys struct {
+		EpochMinutes int `yaml:"epoch_minutes"` // Onion key rotation period
+	} `yaml:"onion_keys"`
+	
+	Circuits struct {
+		Enabled            bool `yaml:"enabled"`
+		IdleTimeoutSeconds int  `yaml:"idle_timeout_seconds"` // Circuits without a cell for this long are closed
+		MaxCircuits        int  `yaml:"max_circuits"`         // Further create cells are refused
+	} `yaml:"circuits"`
+	
+	Replay struct {
+		EpochMinutes             int     `yaml:"epoch_minutes"`
+		MaxPacketLifetimeMinutes int     `yaml:"max_packet_lifetime_minutes"`
+		Capacity                 int     `yaml:"capacity"` // Expected packets per epoch
+		FalsePositiveRate        float64 `yaml:"false_positive_rate"`
+		FlushIntervalSeconds     int     `yaml:"flush_interval_seconds"`
+		MaxFiltersPerEpoch       int     `yaml:"max_filters_per_epoch"` // Memory cap; the last filter then fills past capacity
+	} `yaml:"replay"`
+	
 	Swarm struct {
-		ReplicationFactor int `yaml:"replication_factor"`
-		TTLDays           int `yaml:"ttl_days"`
+		ReplicationFactor int   `yaml:"replication_factor"`
+		TTLDays           int   `yaml:"ttl_days"`
+		PaddingBuckets    []int `yaml:"padding_buckets"` // Accepted content sizes; empty uses the defaults
 	} `yaml:"swarm"`
 	
+	Reassembly struct {
+		TimeoutSeconds int `yaml:"timeout_seconds"` // Incomplete messages are dropped after this
+		MaxBytes       int `yaml:"max_bytes"`       // Memory cap for buffered fragments
+		MaxFragments   int `yaml:"max_fragments"`
+	} `yaml:"reassembly"`
+	
 	RateLimit struct {
 		Enabled            bool `yaml:"enabled"`
 		RequestsPerSecond  int  `yaml:"requests_per_second"`
@@ -129,12 +238,49 @@ type Config struct {
 
 // Constants for packet format
 const (
-	PacketVersion       byte = 0x01
+	PacketVersion1      byte = 0x01 // Up to 3 hops with 205-byte routing info
+	PacketVersion2      byte = 0x02 // Up to 5 hops with 123-byte routing info
+	PacketVersion3      byte = 0x03 // Up to 5 hops, X25519 + ML-KEM-768 hybrid, large size class
+	PacketVersion            = PacketVersion2 // Version built by default
 	PacketSize               = 1280
 	HeaderSize               = 65
 	RoutingBlobSize          = 615
 	PayloadSize              = 600
 	EphemeralKeySize         = 32
 	HMACSize                 = 32
-	PerHopRoutingSize        = 205
+	PerHopRoutingSize        = 205 // Version 1
+	PerHopRoutingSizeV2      = 123 // Version 2
+	SURBIDSize               = 16
+)
+
+// Large size class for version 3 packets. Each header carries the current
+// hop's ML-KEM ciphertext, and each hop's routing info the next hop's.
+const (
+	KEMKeySize          = 1184 // ML-KEM-768 encapsulation key
+	KEMCiphertextSize   = 1088 // ML-KEM-768 ciphertext
+	PerHopRoutingSizeV3 = PerHopRoutingSizeV2 + KEMCiphertextSize
+	RoutingBlobSizeV3   = 5 * PerHopRoutingSizeV3
+	PacketSizeLarge     = HeaderSize + KEMCiphertextSize + RoutingBlobSizeV3 + PayloadSize // 7808
+)
+
+// Routing info flags
+const (
+	RoutingFlagReply   byte = 0x01 // Packet travels on a SURB; each hop re-encrypts the payload
+	RoutingFlagDummy   byte = 0x02 // Link padding; the receiving node discards the packet
+	RoutingFlagRequest byte = 0x04 // Onion request; the response returns along the path
 )
+
+// RejectedError is returned when the next node received a packet and
+// answered with an error. It has already recorded the packet's replay
+// tag, so sending the packet again cannot succeed.
+type RejectedError struct {
+	Status  int    // HTTP status of the answer; 0 for an error frame on a peer link
+	Message string // Error text from the node
+}
+
+func (e *RejectedError) Error() string {
+	if e.Status == 0 {
+		return fmt.Sprintf("peer: %s", e.Message)
+	}
+	return fmt.Sprintf("rejected with status %d: %s", e.Status, e.Message)
+}
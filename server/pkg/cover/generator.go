@@ -0,0 +1,338 @@
+// Package cover generates cover traffic so that a node's links carry
+// packets whether or not users are active. Loop packets travel a random
+// path back to the node that built them; drop packets end at a random
+// node, which discards them. Both are ordinary onion packets: only their
+// final hop, after removing every layer, can tell them from real traffic.
+package cover
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/onion"
+)
+
+// Directory lists the nodes cover packets are routed through.
+// directory.Service implements it.
+type Directory interface {
+	ListNodes() []*common.NodeInfo
+}
+
+// Sender sends a cover packet to its first hop. It should take the same
+// route as forwarded packets (mixer or forwarding queue), so cover and
+// real packets leave the node the same way.
+type Sender func(nodeAddress string, packet []byte) error
+
+// Config holds cover traffic settings
+type Config struct {
+	LoopRate    float64       // Loop packets per second (0 disables)
+	DropRate    float64       // Drop packets per second (0 disables)
+	PathLength  int           // Hops per packet, including the final one (default 3)
+	LoopTimeout time.Duration // Loops not back by then count as lost (default 1m)
+	MeanDelay   time.Duration // Mean exponential per-hop delay, as clients use (default none)
+}
+
+// Generator sends loop and drop packets at Poisson-distributed times and
+// tracks which loops come back
+type Generator struct {
+	self      ed25519.PublicKey
+	directory Directory
+	send      Sender
+	config    Config
+
+	pending map[string]time.Time // Loop message ID -> time sent
+	rng     *rand.Rand
+	mu      sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// Stats
+	loopsSent     atomic.Uint64
+	loopsReturned atomic.Uint64
+	loopsLost     atomic.Uint64
+	dropsSent     atomic.Uint64
+	dropsReceived atomic.Uint64
+	failed        atomic.Uint64
+}
+
+// NewGenerator starts generating cover traffic for the node with identity
+// key self. A generator with both rates zero sends nothing but still
+// recognizes cover packets delivered to the node.
+func NewGenerator(self ed25519.PublicKey, directory Directory, send Sender, config *Config) *Generator {
+	var cfg Config
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.PathLength <= 0 {
+		cfg.PathLength = 3
+	}
+	cfg.PathLength = min(cfg.PathLength, onion.MaxPathLength)
+	if cfg.LoopTimeout <= 0 {
+		cfg.LoopTimeout = time.Minute
+	}
+
+	var seed [32]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+
+	g := &Generator{
+		self:      self,
+		directory: directory,
+		send:      send,
+		config:    cfg,
+		pending:   make(map[string]time.Time),
+		rng:       rand.New(rand.NewChaCha8(seed)),
+		done:      make(chan struct{}),
+	}
+
+	if cfg.LoopRate > 0 {
+		g.wg.Add(2)
+		go g.run(cfg.LoopRate, g.sendLoop)
+		go g.expireLoop()
+	}
+	if cfg.DropRate > 0 {
+		g.wg.Add(1)
+		go g.run(cfg.DropRate, g.sendDrop)
+	}
+
+	return g
+}
+
+// Close stops generating cover traffic
+func (g *Generator) Close() error {
+	select {
+	case <-g.done:
+	default:
+		close(g.done)
+	}
+	g.wg.Wait()
+	return nil
+}
+
+// IsCover reports whether msg is cover traffic rather than a message to store
+func IsCover(msg *common.Message) bool {
+	return msg.MessageType == common.MessageTypeLoop || msg.MessageType == common.MessageTypeDrop
+}
+
+// HandleDelivery consumes a cover message delivered to this node and
+// reports whether msg was cover traffic. Returning loops are matched
+// against those sent; drops are discarded.
+func (g *Generator) HandleDelivery(msg *common.Message) bool {
+	switch msg.MessageType {
+	case common.MessageTypeLoop:
+		g.mu.Lock()
+		_, ok := g.pending[msg.ID]
+		delete(g.pending, msg.ID)
+		g.mu.Unlock()
+
+		// Loops back after their timeout were already counted as lost
+		if ok {
+			g.loopsReturned.Add(1)
+		}
+		return true
+
+	case common.MessageTypeDrop:
+		g.dropsReceived.Add(1)
+		return true
+	}
+	return false
+}
+
+// run calls send at the times of a Poisson process with the given rate
+func (g *Generator) run(rate float64, send func() error) {
+	defer g.wg.Done()
+
+	for {
+		g.mu.Lock()
+		wait := time.Duration(g.rng.ExpFloat64() / rate * float64(time.Second))
+		g.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-g.done:
+			timer.Stop()
+			return
+		}
+
+		if err := send(); err != nil {
+			g.failed.Add(1)
+		}
+	}
+}
+
+// sendLoop sends a packet along a random path ending at this node
+func (g *Generator) sendLoop() error {
+	self, others := g.candidates()
+	if self == nil {
+		return fmt.Errorf("node not in directory")
+	}
+
+	path := append(g.choose(others, g.config.PathLength-1), *self)
+	msg, err := g.coverMessage(common.MessageTypeLoop)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	g.pending[msg.ID] = time.Now()
+	g.mu.Unlock()
+
+	if err := g.sendPacket(path, msg); err != nil {
+		g.mu.Lock()
+		delete(g.pending, msg.ID)
+		g.mu.Unlock()
+		return err
+	}
+	g.loopsSent.Add(1)
+	return nil
+}
+
+// sendDrop sends a packet along a random path ending at another node
+func (g *Generator) sendDrop() error {
+	_, others := g.candidates()
+	path := g.choose(others, g.config.PathLength)
+	if len(path) == 0 {
+		return fmt.Errorf("no other nodes in directory")
+	}
+
+	msg, err := g.coverMessage(common.MessageTypeDrop)
+	if err != nil {
+		return err
+	}
+	if err := g.sendPacket(path, msg); err != nil {
+		return err
+	}
+	g.dropsSent.Add(1)
+	return nil
+}
+
+// candidates returns this node and the other healthy nodes from the directory
+func (g *Generator) candidates() (*common.NodeInfo, []*common.NodeInfo) {
+	var self *common.NodeInfo
+	var others []*common.NodeInfo
+	for _, node := range g.directory.ListNodes() {
+		if !node.Healthy {
+			continue
+		}
+		if bytes.Equal(node.PublicKey, g.self) {
+			self = node
+		} else {
+			others = append(others, node)
+		}
+	}
+	return self, others
+}
+
+// choose returns up to n distinct random nodes; fewer if the directory is small
+func (g *Generator) choose(nodes []*common.NodeInfo, n int) []common.NodeInfo {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.rng.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	path := make([]common.NodeInfo, 0, n)
+	for _, node := range nodes[:min(n, len(nodes))] {
+		path = append(path, *node)
+	}
+	return path
+}
+
+// coverMessage creates a message of the given cover type with random IDs
+func (g *Generator) coverMessage(messageType byte) (*common.Message, error) {
+	ids := make([]byte, 2*common.PayloadIDSize)
+	if _, err := crand.Read(ids); err != nil {
+		return nil, fmt.Errorf("ID generation failed: %w", err)
+	}
+
+	return &common.Message{
+		ID:            hex.EncodeToString(ids[:common.PayloadIDSize]),
+		DestinationID: hex.EncodeToString(ids[common.PayloadIDSize:]),
+		Timestamp:     time.Now(),
+		MessageType:   messageType,
+	}, nil
+}
+
+// sendPacket builds a packet carrying msg along path and sends it to the first hop
+func (g *Generator) sendPacket(path []common.NodeInfo, msg *common.Message) error {
+	payload, err := common.EncodeMessagePayload(msg)
+	if err != nil {
+		return err
+	}
+	packet, err := onion.BuildPacket(path, payload, &onion.BuildOptions{MeanDelay: g.config.MeanDelay})
+	if err != nil {
+		return fmt.Errorf("packet build failed: %w", err)
+	}
+
+	first := path[0]
+	return g.send(net.JoinHostPort(first.Address, strconv.Itoa(int(first.Port))), packet)
+}
+
+// expireLoop counts loops that did not return within the timeout as lost
+func (g *Generator) expireLoop() {
+	defer g.wg.Done()
+
+	ticker := time.NewTicker(max(g.config.LoopTimeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			g.expire(now)
+		case <-g.done:
+			return
+		}
+	}
+}
+
+// expire removes loops sent more than LoopTimeout before now
+func (g *Generator) expire(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for id, sent := range g.pending {
+		if now.Sub(sent) > g.config.LoopTimeout {
+			delete(g.pending, id)
+			g.loopsLost.Add(1)
+		}
+	}
+}
+
+// GetStats returns cover traffic statistics
+func (g *Generator) GetStats() Stats {
+	g.mu.Lock()
+	pending := len(g.pending)
+	g.mu.Unlock()
+
+	return Stats{
+		LoopsSent:     g.loopsSent.Load(),
+		LoopsReturned: g.loopsReturned.Load(),
+		LoopsLost:     g.loopsLost.Load(),
+		LoopsPending:  pending,
+		DropsSent:     g.dropsSent.Load(),
+		DropsReceived: g.dropsReceived.Load(),
+		Failed:        g.failed.Load(),
+	}
+}
+
+// Stats contains cover traffic statistics
+type Stats struct {
+	LoopsSent     uint64 // Loop packets sent
+	LoopsReturned uint64 // Loop packets that came back within the timeout
+	LoopsLost     uint64 // Loop packets that did not come back within the timeout
+	LoopsPending  int    // Loop packets still expected back
+	DropsSent     uint64 // Drop packets sent
+	DropsReceived uint64 // Drop packets from other nodes discarded here
+	Failed        uint64 // Cover packets that could not be built or sent
+}
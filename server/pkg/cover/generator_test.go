@@ -0,0 +1,245 @@
+package cover
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/onion"
+)
+
+// fakeDirectory lists a fixed set of nodes
+type fakeDirectory []*common.NodeInfo
+
+func (d fakeDirectory) ListNodes() []*common.NodeInfo {
+	return append([]*common.NodeInfo(nil), d...)
+}
+
+// testNetwork routes packets between in-process routers and hands
+// delivered payloads to the final node's generator
+type testNetwork struct {
+	nodes      fakeDirectory
+	routers    map[string]*onion.Router
+	generators map[string]*Generator
+	delivered  map[string]int // Final hop address -> cover packets consumed
+	mu         sync.Mutex
+}
+
+func newTestNetwork(t *testing.T, size int) *testNetwork {
+	t.Helper()
+
+	n := &testNetwork{
+		routers:    make(map[string]*onion.Router),
+		generators: make(map[string]*Generator),
+		delivered:  make(map[string]int),
+	}
+	for i := 0; i < size; i++ {
+		pub, priv, err := common.GenerateKeypair()
+		if err != nil {
+			t.Fatalf("Failed to generate keypair: %v", err)
+		}
+		router := onion.NewRouter(priv)
+		node := &common.NodeInfo{
+			ID:        fmt.Sprintf("node%d", i),
+			PublicKey: pub,
+			Address:   "10.0.0.1",
+			Port:      uint16(9000 + i),
+			Healthy:   true,
+		}
+		n.routers[address(node)] = router
+		n.nodes = append(n.nodes, node)
+	}
+	return n
+}
+
+// start creates a generator for every node; node 0 uses config, the
+// others only receive cover traffic
+func (n *testNetwork) start(t *testing.T, config *Config, send Sender) *Generator {
+	t.Helper()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, node := range n.nodes {
+		var generator *Generator
+		if i == 0 {
+			generator = NewGenerator(node.PublicKey, n.nodes, send, config)
+		} else {
+			generator = NewGenerator(node.PublicKey, n.nodes, nil, nil)
+		}
+		n.generators[address(node)] = generator
+		t.Cleanup(func() { generator.Close() })
+	}
+	return n.generators[address(n.nodes[0])]
+}
+
+func address(node *common.NodeInfo) string {
+	return fmt.Sprintf("%s:%d", node.Address, node.Port)
+}
+
+// send carries a packet hop by hop and delivers it at its final node
+func (n *testNetwork) send(nodeAddress string, packet []byte) error {
+	if len(packet) != common.PacketSize {
+		return fmt.Errorf("cover packet of %d bytes", len(packet))
+	}
+
+	hops := 0
+	for {
+		decision, err := n.routers[nodeAddress].ProcessPacket(packet)
+		if err != nil {
+			return err
+		}
+		hops++
+		if decision.Action != onion.ActionForward {
+			if decision.Action != onion.ActionDeliver {
+				return fmt.Errorf("unexpected action %d", decision.Action)
+			}
+			packet = decision.Payload
+			break
+		}
+		nodeAddress, packet = decision.NextAddress, decision.NextPacket
+	}
+	if hops != 3 {
+		return fmt.Errorf("cover packet took %d hops, want 3", hops)
+	}
+
+	fragment, err := common.DecodeFragment(packet)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	generator := n.generators[nodeAddress]
+	n.mu.Unlock()
+	if !generator.HandleDelivery(fragment.Message) {
+		return errors.New("cover message not recognized")
+	}
+
+	n.mu.Lock()
+	n.delivered[nodeAddress]++
+	n.mu.Unlock()
+	return nil
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGenerator_LoopsReturn(t *testing.T) {
+	n := newTestNetwork(t, 4)
+	generator := n.start(t, &Config{LoopRate: 500}, n.send)
+
+	waitFor(t, "loops to return", func() bool {
+		return generator.GetStats().LoopsReturned >= 10
+	})
+	generator.Close()
+
+	stats := generator.GetStats()
+	if stats.Failed != 0 {
+		t.Errorf("Expected no failures, got %d", stats.Failed)
+	}
+	if stats.LoopsSent != stats.LoopsReturned || stats.LoopsPending != 0 || stats.LoopsLost != 0 {
+		t.Errorf("Unexpected loop stats: %+v", stats)
+	}
+
+	// Every loop ended at the node that sent it
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	self := address(n.nodes[0])
+	if uint64(n.delivered[self]) != stats.LoopsSent || len(n.delivered) != 1 {
+		t.Errorf("Loops delivered at %v, want only %s", n.delivered, self)
+	}
+}
+
+func TestGenerator_LostLoops(t *testing.T) {
+	n := newTestNetwork(t, 4)
+
+	// A path that silently discards everything
+	generator := n.start(t, &Config{LoopRate: 500, LoopTimeout: 20 * time.Millisecond},
+		func(string, []byte) error { return nil })
+
+	waitFor(t, "loops to be counted lost", func() bool {
+		return generator.GetStats().LoopsLost >= 5
+	})
+	if returned := generator.GetStats().LoopsReturned; returned != 0 {
+		t.Errorf("Expected no returned loops, got %d", returned)
+	}
+}
+
+func TestGenerator_Drops(t *testing.T) {
+	n := newTestNetwork(t, 4)
+	generator := n.start(t, &Config{DropRate: 500}, n.send)
+
+	waitFor(t, "drops to be sent", func() bool {
+		return generator.GetStats().DropsSent >= 10
+	})
+	generator.Close()
+
+	if failed := generator.GetStats().Failed; failed != 0 {
+		t.Errorf("Expected no failures, got %d", failed)
+	}
+
+	// Drops end at other nodes, which discard them
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.delivered[address(n.nodes[0])] != 0 {
+		t.Error("Drop packet delivered to its sender")
+	}
+	var received uint64
+	for _, node := range n.nodes[1:] {
+		received += n.generators[address(node)].GetStats().DropsReceived
+	}
+	if received != generator.GetStats().DropsSent {
+		t.Errorf("Expected %d drops received, got %d", generator.GetStats().DropsSent, received)
+	}
+}
+
+func TestGenerator_NotInDirectory(t *testing.T) {
+	n := newTestNetwork(t, 3)
+
+	// Without its own entry a node cannot route loops back to itself
+	pub, _, err := common.GenerateKeypair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+	generator := NewGenerator(pub, n.nodes, n.send, &Config{LoopRate: 500})
+	defer generator.Close()
+
+	waitFor(t, "failed loops", func() bool {
+		return generator.GetStats().Failed >= 3
+	})
+	if sent := generator.GetStats().LoopsSent; sent != 0 {
+		t.Errorf("Expected no loops sent, got %d", sent)
+	}
+}
+
+func TestHandleDelivery_NotCover(t *testing.T) {
+	generator := NewGenerator(nil, fakeDirectory{}, nil, nil)
+	defer generator.Close()
+
+	msg := &common.Message{ID: "1", MessageType: common.MessageTypeText}
+	if IsCover(msg) || generator.HandleDelivery(msg) {
+		t.Error("Text message treated as cover traffic")
+	}
+	if !IsCover(&common.Message{MessageType: common.MessageTypeDrop}) {
+		t.Error("Drop message not treated as cover traffic")
+	}
+
+	// Unknown loops are consumed without being counted
+	if !generator.HandleDelivery(&common.Message{ID: "unknown", MessageType: common.MessageTypeLoop}) {
+		t.Error("Loop message not consumed")
+	}
+	if returned := generator.GetStats().LoopsReturned; returned != 0 {
+		t.Errorf("Unknown loop counted as returned: %d", returned)
+	}
+}
@@ -1,11 +1,15 @@
 package directory
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"hash/crc32"
+	"net"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -20,6 +24,10 @@ type Service struct {
 	mu         sync.RWMutex
 }
 
+// maxRegistrationAge is how far a registration's signing time may lie
+// from now; older registrations could be replays of a node's past entry
+const maxRegistrationAge = 10 * time.Minute
+
 // NewService creates a new directory service
 func NewService(signingKey ed25519.PrivateKey) *Service {
 	return &Service{
@@ -29,12 +37,49 @@ func NewService(signingKey ed25519.PrivateKey) *Service {
 	}
 }
 
-// RegisterNode registers a node in the directory
+// RegisterNode registers a node in the directory.
+// The registration must be signed by the node's identity key, recently
+// and no earlier than the entry it replaces, and published onion and KEM
+// keys must carry a valid identity key signature. A node ID stays bound
+// to the identity key it was first registered with, and an identity key
+// to one node ID, so nodes cannot take over each other's entries.
 func (s *Service) RegisterNode(node *common.NodeInfo) error {
+	if err := common.VerifyRegistration(node); err != nil {
+		return fmt.Errorf("node %s: %w", node.ID, err)
+	}
+	now := time.Now()
+	if age := now.Sub(node.RegisteredAt); age > maxRegistrationAge || age < -maxRegistrationAge {
+		return fmt.Errorf("node %s: registration signed at %v is not current", node.ID, node.RegisteredAt)
+	}
+	if len(node.OnionKey) > 0 {
+		if err := common.VerifyOnionKey(node); err != nil {
+			return fmt.Errorf("node %s: %w", node.ID, err)
+		}
+	}
+	if len(node.KEMKey) > 0 {
+		if err := common.VerifyKEMKey(node); err != nil {
+			return fmt.Errorf("node %s: %w", node.ID, err)
+		}
+	}
+	
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	
-	node.LastSeen = time.Now()
+	for id, existing := range s.nodes {
+		if id != node.ID && bytes.Equal(existing.PublicKey, node.PublicKey) {
+			return fmt.Errorf("node %s: identity key already registered to node %s", node.ID, id)
+		}
+	}
+	if existing, ok := s.nodes[node.ID]; ok {
+		if !bytes.Equal(existing.PublicKey, node.PublicKey) {
+			return fmt.Errorf("node %s is registered with another identity key", node.ID)
+		}
+		if node.RegisteredAt.Before(existing.RegisteredAt) {
+			return fmt.Errorf("node %s: registration older than the current entry", node.ID)
+		}
+	}
+	
+	node.LastSeen = now
 	node.Healthy = true
 	
 	s.nodes[node.ID] = node
@@ -67,6 +112,55 @@ func (s *Service) GetNode(nodeID string) (*common.NodeInfo, error) {
 	return node, nil
 }
 
+// ResolveNode returns the node whose identity key is publicKey.
+// Unknown and unhealthy nodes are refused, so packets are never forwarded to them.
+func (s *Service) ResolveNode(publicKey []byte) (*common.NodeInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	
+	for _, node := range s.nodes {
+		if bytes.Equal(node.PublicKey, publicKey) {
+			if !node.Healthy {
+				return nil, fmt.Errorf("node %s is unhealthy", node.ID)
+			}
+			return node, nil
+		}
+	}
+	
+	return nil, errors.New("node not found")
+}
+
+// ResolveAddress returns the healthy node whose HTTPS endpoint is address (host:port)
+func (s *Service) ResolveAddress(address string) (*common.NodeInfo, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+	ip := net.ParseIP(host)
+	
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	
+	for _, node := range s.nodes {
+		if node.Port != uint16(port) {
+			continue
+		}
+		// IP addresses match in any notation
+		if node.Address == host || (ip != nil && ip.Equal(net.ParseIP(node.Address))) {
+			if !node.Healthy {
+				return nil, fmt.Errorf("node %s is unhealthy", node.ID)
+			}
+			return node, nil
+		}
+	}
+	
+	return nil, errors.New("node not found")
+}
+
 // ListNodes returns all registered nodes
 func (s *Service) ListNodes() []*common.NodeInfo {
 	s.mu.RLock()
@@ -0,0 +1,351 @@
+package forwarder
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// Drop reasons reported in Stats.Dropped
+const (
+	DropQueueFull  = "queue_full"  // Queue was at capacity when the packet arrived
+	DropSendFailed = "send_failed" // All delivery attempts failed
+	DropRejected   = "rejected"    // The next hop answered with an error; retrying cannot help
+	DropShutdown   = "shutdown"    // Forwarder closed before the packet was sent
+)
+
+// ErrQueueFull is returned by Enqueue when the forwarding queue is at capacity
+var ErrQueueFull = errors.New("forwarding queue full")
+
+// Sender delivers an onion packet to the node at nodeAddress.
+// *mtls.Client implements this interface. It returns a
+// *common.RejectedError when the node answered with an error, which is
+// not retried.
+type Sender interface {
+	ForwardPacket(nodeAddress string, packet []byte) error
+}
+
+// RequestSender relays an onion request or circuit cell to the node at
+// nodeAddress and returns its answer. Requests are synchronous and bypass
+// the queue. *mtls.Client and *HTTPSender implement this interface.
+type RequestSender interface {
+	SendRequest(nodeAddress string, packet []byte) ([]byte, error)
+	SendCell(nodeAddress string, cell []byte) ([]byte, error)
+}
+
+// Config holds forwarding queue configuration
+type Config struct {
+	QueueSize    int           // Maximum packets waiting or in flight (default 10000)
+	Workers      int           // Concurrent senders (default 16)
+	MaxAttempts  int           // Delivery attempts per packet (default 3)
+	RetryBackoff time.Duration // Delay before the first retry, doubled per attempt (default 200ms)
+	MaxBackoff   time.Duration // Upper bound on retry delay (default 5s)
+	Tick         time.Duration // Resolution of per-hop delays and retries (default 10ms)
+}
+
+// Forwarder sends onion packets to their next hop asynchronously.
+// Packets are held on a timer wheel until their per-hop delay has elapsed
+// (rounded up to the tick) and retried with exponential backoff when the
+// next hop cannot be reached.
+type Forwarder struct {
+	sender Sender
+	config Config
+
+	wheel *timerWheel     // Packets waiting for their send time
+	due   []*queuedPacket // Packets whose send time has come, oldest first
+	wake  chan struct{}
+	ready chan *queuedPacket
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	// Stats
+	packetsQueued    uint64
+	packetsDelayed   uint64
+	packetsForwarded uint64
+	retries          uint64
+	dropped          map[string]uint64
+	inFlight         int
+
+	closed bool
+	mu     sync.Mutex
+}
+
+// queuedPacket is a packet waiting for its send time
+type queuedPacket struct {
+	address  string
+	packet   []byte
+	sendAt   time.Time
+	tick     int64 // Timer wheel tick it is due at
+	attempts int
+}
+
+// NewForwarder creates a forwarder and starts its workers
+func NewForwarder(sender Sender, config *Config) *Forwarder {
+	cfg := Config{}
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 10000
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 16
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 3
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 200 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Second
+	}
+	if cfg.Tick <= 0 {
+		cfg.Tick = 10 * time.Millisecond
+	}
+
+	f := &Forwarder{
+		sender:  sender,
+		config:  cfg,
+		wheel:   newTimerWheel(cfg.Tick, time.Now()),
+		wake:    make(chan struct{}, 1),
+		ready:   make(chan *queuedPacket),
+		done:    make(chan struct{}),
+		dropped: make(map[string]uint64),
+	}
+
+	f.wg.Add(1 + cfg.Workers)
+	go f.dispatch()
+	for i := 0; i < cfg.Workers; i++ {
+		go f.work()
+	}
+
+	return f
+}
+
+// Enqueue schedules packet to be sent to address once delay has elapsed.
+// It never blocks; ErrQueueFull is returned when the queue is at capacity.
+func (f *Forwarder) Enqueue(address string, packet []byte, delay time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		f.dropped[DropShutdown]++
+		return errors.New("forwarder closed")
+	}
+
+	if f.depth() >= f.config.QueueSize {
+		f.dropped[DropQueueFull]++
+		return ErrQueueFull
+	}
+
+	now := time.Now()
+	pkt := &queuedPacket{
+		address: address,
+		packet:  packet,
+		sendAt:  now.Add(delay),
+	}
+	if delay > 0 {
+		f.wheel.add(pkt, now)
+		f.packetsDelayed++
+	} else {
+		f.due = append(f.due, pkt)
+	}
+	f.packetsQueued++
+	f.signal()
+
+	return nil
+}
+
+// Close stops the workers. Packets still queued are dropped.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	close(f.done)
+	f.mu.Unlock()
+
+	f.wg.Wait()
+
+	f.mu.Lock()
+	f.dropped[DropShutdown] += uint64(f.wheel.len() + len(f.due))
+	f.wheel = newTimerWheel(f.config.Tick, time.Now())
+	f.due = nil
+	f.mu.Unlock()
+
+	return nil
+}
+
+// GetStats returns forwarding statistics
+func (f *Forwarder) GetStats() Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dropped := make(map[string]uint64, len(f.dropped))
+	for reason, count := range f.dropped {
+		dropped[reason] = count
+	}
+
+	return Stats{
+		QueueDepth:       f.depth(),
+		Delayed:          f.wheel.len(),
+		PacketsQueued:    f.packetsQueued,
+		PacketsDelayed:   f.packetsDelayed,
+		PacketsForwarded: f.packetsForwarded,
+		Retries:          f.retries,
+		Dropped:          dropped,
+	}
+}
+
+// depth returns the packets waiting or in flight; callers must hold f.mu
+func (f *Forwarder) depth() int {
+	return f.wheel.len() + len(f.due) + f.inFlight
+}
+
+// signal wakes the dispatcher; callers must hold f.mu
+func (f *Forwarder) signal() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands packets to workers as their send time arrives
+func (f *Forwarder) dispatch() {
+	defer f.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		f.mu.Lock()
+		var next *queuedPacket
+		wait := time.Hour
+		if f.wheel.len() > 0 {
+			now := time.Now()
+			f.due = f.wheel.advance(now, f.due)
+			if f.wheel.len() > 0 {
+				wait = f.wheel.nextTick().Sub(now)
+			}
+		}
+		if len(f.due) > 0 {
+			next = f.due[0]
+			f.due[0] = nil
+			f.due = f.due[1:]
+			f.inFlight++
+		}
+		f.mu.Unlock()
+
+		if next != nil {
+			select {
+			case f.ready <- next:
+			case <-f.done:
+				f.finish(next, DropShutdown)
+				return
+			}
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-f.wake:
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// work sends packets, rescheduling failed attempts with backoff
+func (f *Forwarder) work() {
+	defer f.wg.Done()
+
+	for {
+		select {
+		case pkt := <-f.ready:
+			f.send(pkt)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// send makes one delivery attempt for pkt
+func (f *Forwarder) send(pkt *queuedPacket) {
+	pkt.attempts++
+	err := f.sender.ForwardPacket(pkt.address, pkt.packet)
+	if err == nil {
+		f.finish(pkt, "")
+		return
+	}
+
+	// The next hop saw the packet; a resend would be refused as a replay
+	var rejected *common.RejectedError
+	if errors.As(err, &rejected) {
+		log.Printf("Dropping packet rejected by the next hop: %v", err)
+		f.finish(pkt, DropRejected)
+		return
+	}
+
+	if pkt.attempts >= f.config.MaxAttempts {
+		log.Printf("Dropping packet after %d forwarding attempts: %v", pkt.attempts, err)
+		f.finish(pkt, DropSendFailed)
+		return
+	}
+
+	backoff := f.config.RetryBackoff << (pkt.attempts - 1)
+	if backoff > f.config.MaxBackoff || backoff <= 0 {
+		backoff = f.config.MaxBackoff
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.inFlight--
+	f.retries++
+	if f.closed {
+		f.dropped[DropShutdown]++
+		return
+	}
+	now := time.Now()
+	pkt.sendAt = now.Add(backoff)
+	f.wheel.add(pkt, now)
+	f.signal()
+}
+
+// finish records the outcome of a packet that left the queue
+func (f *Forwarder) finish(pkt *queuedPacket, dropReason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.inFlight--
+	if dropReason == "" {
+		f.packetsForwarded++
+	} else {
+		f.dropped[dropReason]++
+	}
+}
+
+// Stats contains forwarding statistics
+type Stats struct {
+	QueueDepth       int // Packets waiting or in flight
+	Delayed          int // Packets waiting for their per-hop delay or a retry
+	PacketsQueued    uint64
+	PacketsDelayed   uint64 // Packets queued with a per-hop delay
+	PacketsForwarded uint64
+	Retries          uint64
+	Dropped          map[string]uint64 // By drop reason
+}
@@ -0,0 +1,247 @@
+package forwarder
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// fakeSender records forwarded packets and fails the first failures
+// calls, with err if set
+type fakeSender struct {
+	mu       sync.Mutex
+	sent     []string
+	calls    int
+	failures int
+	err      error
+}
+
+func (s *fakeSender) ForwardPacket(nodeAddress string, packet []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	if s.calls <= s.failures {
+		if s.err != nil {
+			return s.err
+		}
+		return errors.New("connection refused")
+	}
+	s.sent = append(s.sent, string(packet))
+	return nil
+}
+
+func (s *fakeSender) Sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.sent...)
+}
+
+// waitFor polls cond until it holds or the timeout elapses
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for condition")
+}
+
+func TestForwarder_SendsAfterDelay(t *testing.T) {
+	sender := &fakeSender{}
+	f := NewForwarder(sender, &Config{Workers: 1})
+	defer f.Close()
+
+	start := time.Now()
+	if err := f.Enqueue("10.0.0.2:9000", []byte("packet"), 50*time.Millisecond); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	waitFor(t, time.Second, func() bool { return len(sender.Sent()) == 1 })
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Packet sent after %v, want at least 50ms", elapsed)
+	}
+
+	stats := f.GetStats()
+	if stats.PacketsQueued != 1 || stats.PacketsForwarded != 1 {
+		t.Errorf("Queued = %d, forwarded = %d, want 1 and 1", stats.PacketsQueued, stats.PacketsForwarded)
+	}
+	if stats.QueueDepth != 0 {
+		t.Errorf("Queue depth = %d, want 0", stats.QueueDepth)
+	}
+}
+
+func TestForwarder_OrdersByDelay(t *testing.T) {
+	sender := &fakeSender{}
+	f := NewForwarder(sender, &Config{Workers: 1})
+	defer f.Close()
+
+	f.Enqueue("a", []byte("slow"), 80*time.Millisecond)
+	f.Enqueue("b", []byte("fast"), 10*time.Millisecond)
+
+	waitFor(t, time.Second, func() bool { return len(sender.Sent()) == 2 })
+
+	sent := sender.Sent()
+	if sent[0] != "fast" || sent[1] != "slow" {
+		t.Errorf("Send order = %v, want [fast slow]", sent)
+	}
+}
+
+func TestForwarder_RetriesThenSucceeds(t *testing.T) {
+	sender := &fakeSender{failures: 2}
+	f := NewForwarder(sender, &Config{Workers: 1, MaxAttempts: 3, RetryBackoff: time.Millisecond})
+	defer f.Close()
+
+	f.Enqueue("10.0.0.2:9000", []byte("packet"), 0)
+
+	waitFor(t, time.Second, func() bool { return f.GetStats().PacketsForwarded == 1 })
+
+	stats := f.GetStats()
+	if stats.Retries != 2 {
+		t.Errorf("Retries = %d, want 2", stats.Retries)
+	}
+	if len(stats.Dropped) != 0 {
+		t.Errorf("Dropped = %v, want none", stats.Dropped)
+	}
+}
+
+func TestForwarder_DropsAfterMaxAttempts(t *testing.T) {
+	sender := &fakeSender{failures: 10}
+	f := NewForwarder(sender, &Config{Workers: 1, MaxAttempts: 3, RetryBackoff: time.Millisecond})
+	defer f.Close()
+
+	f.Enqueue("10.0.0.2:9000", []byte("packet"), 0)
+
+	waitFor(t, time.Second, func() bool { return f.GetStats().Dropped[DropSendFailed] == 1 })
+
+	stats := f.GetStats()
+	if stats.Retries != 2 {
+		t.Errorf("Retries = %d, want 2", stats.Retries)
+	}
+	if stats.QueueDepth != 0 {
+		t.Errorf("Queue depth = %d, want 0", stats.QueueDepth)
+	}
+}
+
+func TestForwarder_DropsRejectedWithoutRetry(t *testing.T) {
+	sender := &fakeSender{failures: 10, err: &common.RejectedError{Status: http.StatusBadRequest, Message: "replay detected"}}
+	f := NewForwarder(sender, &Config{Workers: 1, MaxAttempts: 3, RetryBackoff: time.Millisecond})
+	defer f.Close()
+
+	f.Enqueue("10.0.0.2:9000", []byte("packet"), 0)
+
+	waitFor(t, time.Second, func() bool { return f.GetStats().Dropped[DropRejected] == 1 })
+
+	stats := f.GetStats()
+	if stats.Retries != 0 || stats.Dropped[DropSendFailed] != 0 {
+		t.Errorf("Retries = %d, send failures = %d, want 0, 0", stats.Retries, stats.Dropped[DropSendFailed])
+	}
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	if sender.calls != 1 {
+		t.Errorf("Attempts = %d, want 1", sender.calls)
+	}
+}
+
+func TestForwarder_QueueFull(t *testing.T) {
+	sender := &fakeSender{}
+	f := NewForwarder(sender, &Config{QueueSize: 2})
+	defer f.Close()
+
+	f.Enqueue("a", []byte("1"), time.Hour)
+	f.Enqueue("a", []byte("2"), time.Hour)
+
+	if err := f.Enqueue("a", []byte("3"), time.Hour); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Enqueue error = %v, want ErrQueueFull", err)
+	}
+
+	stats := f.GetStats()
+	if stats.QueueDepth != 2 {
+		t.Errorf("Queue depth = %d, want 2", stats.QueueDepth)
+	}
+	if stats.Dropped[DropQueueFull] != 1 {
+		t.Errorf("Queue-full drops = %d, want 1", stats.Dropped[DropQueueFull])
+	}
+}
+
+func TestForwarder_CloseDropsPending(t *testing.T) {
+	sender := &fakeSender{}
+	f := NewForwarder(sender, nil)
+
+	f.Enqueue("a", []byte("1"), time.Hour)
+	f.Enqueue("a", []byte("2"), time.Hour)
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if dropped := f.GetStats().Dropped[DropShutdown]; dropped != 2 {
+		t.Errorf("Shutdown drops = %d, want 2", dropped)
+	}
+
+	if err := f.Enqueue("a", []byte("3"), 0); err == nil {
+		t.Error("Expected error enqueueing after Close, got nil")
+	}
+}
+
+func TestHTTPSender(t *testing.T) {
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/onion" {
+			http.NotFound(w, r)
+			return
+		}
+		received, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	sender := NewHTTPSender("http", time.Second)
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	if err := sender.ForwardPacket(address, []byte("packet")); err != nil {
+		t.Fatalf("ForwardPacket failed: %v", err)
+	}
+	if string(received) != "packet" {
+		t.Errorf("Received %q, want %q", received, "packet")
+	}
+
+	// An answer from the node is a rejection, not a transport failure
+	var rejected *common.RejectedError
+	if err := sender.ForwardPacket(address+"/missing", []byte("packet")); !errors.As(err, &rejected) || rejected.Status != http.StatusNotFound {
+		t.Errorf("Expected RejectedError with status 404, got %v", err)
+	}
+}
+
+func TestForwarder_DelayBeyondWheelTurn(t *testing.T) {
+	sender := &fakeSender{}
+
+	// One turn of the wheel is about 50ms
+	f := NewForwarder(sender, &Config{Tick: 50 * time.Microsecond})
+	defer f.Close()
+
+	start := time.Now()
+	f.Enqueue("a", []byte("packet"), 120*time.Millisecond)
+	if stats := f.GetStats(); stats.Delayed != 1 || stats.PacketsDelayed != 1 {
+		t.Errorf("Delayed = %d, packets delayed = %d, want 1 and 1", stats.Delayed, stats.PacketsDelayed)
+	}
+
+	waitFor(t, time.Second, func() bool { return len(sender.Sent()) == 1 })
+	if elapsed := time.Since(start); elapsed < 120*time.Millisecond {
+		t.Errorf("Packet sent after %v, want at least 120ms", elapsed)
+	}
+	if delayed := f.GetStats().Delayed; delayed != 0 {
+		t.Errorf("Delayed = %d, want 0", delayed)
+	}
+}
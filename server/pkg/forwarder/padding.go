@@ -0,0 +1,229 @@
+package forwarder
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// DummyBuilder builds a link padding packet for the node at nodeAddress.
+// onion.BuildDummyPacket builds one for a known node.
+type DummyBuilder func(nodeAddress string) ([]byte, error)
+
+// PaddingConfig holds link padding settings
+type PaddingConfig struct {
+	Rate         float64       // Packets per second sent to each active neighbor
+	MaxBandwidth int           // Bytes per second across all padded links (0: unlimited)
+	QueueSize    int           // Real packets waiting per neighbor (default 64)
+	IdleTimeout  time.Duration // Padding stops this long after a neighbor's last real packet (default 1m)
+}
+
+// Padder sends packets to each active neighbor at a constant rate,
+// filling slots without a real packet with dummy packets, so the volume
+// on a link does not show how much traffic it carries. Real packets wait
+// for the next slot. A neighbor becomes active with its first real packet
+// and inactive after IdleTimeout without one. Neighbors beyond the
+// bandwidth budget are sent to directly, without padding.
+//
+// Padder implements Sender. Packets are sent asynchronously, so send
+// failures are counted rather than returned and not retried.
+type Padder struct {
+	sender   Sender
+	dummy    DummyBuilder
+	config   PaddingConfig
+	interval time.Duration
+	maxLinks int // 0: unlimited
+
+	links map[string]*paddedLink
+	mu    sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// Stats
+	realSent  atomic.Uint64
+	dummySent atomic.Uint64
+	failed    atomic.Uint64
+	unpadded  atomic.Uint64
+	queueFull atomic.Uint64
+}
+
+// paddedLink is the queue of real packets for one neighbor
+type paddedLink struct {
+	queue    chan []byte
+	lastReal time.Time // Guarded by Padder.mu
+}
+
+// NewPadder creates a padder that sends through sender and builds dummy packets with dummy
+func NewPadder(sender Sender, dummy DummyBuilder, config *PaddingConfig) (*Padder, error) {
+	if config == nil || config.Rate <= 0 {
+		return nil, errors.New("padding rate must be positive")
+	}
+	cfg := *config
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 64
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = time.Minute
+	}
+
+	maxLinks := 0
+	if cfg.MaxBandwidth > 0 {
+		maxLinks = max(int(float64(cfg.MaxBandwidth)/(cfg.Rate*common.PacketSize)), 1)
+	}
+
+	return &Padder{
+		sender:   sender,
+		dummy:    dummy,
+		config:   cfg,
+		interval: time.Duration(float64(time.Second) / cfg.Rate),
+		maxLinks: maxLinks,
+		links:    make(map[string]*paddedLink),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// ForwardPacket queues packet for the next slot on the link to nodeAddress.
+// It returns ErrQueueFull if the link has QueueSize packets waiting.
+func (p *Padder) ForwardPacket(nodeAddress string, packet []byte) error {
+	p.mu.Lock()
+	link, ok := p.links[nodeAddress]
+	if !ok {
+		if p.closed() || (p.maxLinks > 0 && len(p.links) >= p.maxLinks) {
+			p.mu.Unlock()
+			p.unpadded.Add(1)
+			return p.sender.ForwardPacket(nodeAddress, packet)
+		}
+		link = &paddedLink{queue: make(chan []byte, p.config.QueueSize)}
+		p.links[nodeAddress] = link
+		p.wg.Add(1)
+		go p.run(nodeAddress, link)
+	}
+	link.lastReal = time.Now()
+
+	// Queued under the lock, so an idle link cannot retire with the packet
+	select {
+	case link.queue <- packet:
+		p.mu.Unlock()
+		return nil
+	default:
+		p.mu.Unlock()
+		p.queueFull.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// run sends one packet per interval to nodeAddress until the link goes idle
+func (p *Padder) run(nodeAddress string, link *paddedLink) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		select {
+		case packet := <-link.queue:
+			if err := p.sender.ForwardPacket(nodeAddress, packet); err != nil {
+				p.failed.Add(1)
+				continue
+			}
+			p.realSent.Add(1)
+			continue
+		default:
+		}
+
+		if p.retire(nodeAddress, link) {
+			return
+		}
+
+		packet, err := p.dummy(nodeAddress)
+		if err == nil {
+			err = p.sender.ForwardPacket(nodeAddress, packet)
+		}
+		if err != nil {
+			p.failed.Add(1)
+			continue
+		}
+		p.dummySent.Add(1)
+	}
+}
+
+// retire removes a link that has been idle for IdleTimeout with nothing queued
+func (p *Padder) retire(nodeAddress string, link *paddedLink) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(link.lastReal) < p.config.IdleTimeout || len(link.queue) > 0 {
+		return false
+	}
+	delete(p.links, nodeAddress)
+	return true
+}
+
+// closed reports whether Close has been called
+func (p *Padder) closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops padding; packets still queued are dropped
+func (p *Padder) Close() error {
+	p.mu.Lock()
+	if !p.closed() {
+		close(p.done)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return nil
+}
+
+// GetStats returns link padding statistics
+func (p *Padder) GetStats() PaddingStats {
+	p.mu.Lock()
+	links := len(p.links)
+	p.mu.Unlock()
+
+	return PaddingStats{
+		Links:     links,
+		Bandwidth: float64(links) * p.config.Rate * common.PacketSize,
+		RealSent:  p.realSent.Load(),
+		DummySent: p.dummySent.Load(),
+		Failed:    p.failed.Load(),
+		Unpadded:  p.unpadded.Load(),
+		QueueFull: p.queueFull.Load(),
+	}
+}
+
+// PaddingStats contains link padding statistics
+type PaddingStats struct {
+	Links     int     // Neighbors currently padded
+	Bandwidth float64 // Bytes per second the padded links currently use
+	RealSent  uint64  // Real packets sent in padded slots
+	DummySent uint64  // Dummy packets sent in empty slots
+	Failed    uint64  // Slots whose packet could not be built or sent
+	Unpadded  uint64  // Real packets sent directly, beyond the bandwidth budget
+	QueueFull uint64  // Real packets refused because the link's queue was full
+}
+
+// PaddingRatio returns the fraction of padded-slot packets that were dummies
+func (s PaddingStats) PaddingRatio() float64 {
+	total := s.RealSent + s.DummySent
+	if total == 0 {
+		return 0
+	}
+	return float64(s.DummySent) / float64(total)
+}
@@ -0,0 +1,150 @@
+package forwarder
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func dummyPacket(string) ([]byte, error) {
+	return []byte("dummy"), nil
+}
+
+// count returns how many of the sent packets equal packet
+func count(sent []string, packet string) int {
+	n := 0
+	for _, s := range sent {
+		if s == packet {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPadder_FillsEmptySlots(t *testing.T) {
+	sender := &fakeSender{}
+	p, err := NewPadder(sender, dummyPacket, &PaddingConfig{Rate: 200})
+	if err != nil {
+		t.Fatalf("NewPadder failed: %v", err)
+	}
+	defer p.Close()
+
+	if err := p.ForwardPacket("a", []byte("real")); err != nil {
+		t.Fatalf("ForwardPacket failed: %v", err)
+	}
+	waitFor(t, time.Second, func() bool {
+		return count(sender.Sent(), "dummy") >= 5
+	})
+
+	// The real packet went out in the first slot, before any dummy
+	sent := sender.Sent()
+	if sent[0] != "real" || count(sent, "real") != 1 {
+		t.Errorf("Unexpected packet order: %q", sent)
+	}
+
+	stats := p.GetStats()
+	if stats.Links != 1 || stats.RealSent != 1 || stats.DummySent < 5 {
+		t.Errorf("Unexpected padding stats: %+v", stats)
+	}
+	if ratio := stats.PaddingRatio(); ratio <= 0.5 || ratio >= 1 {
+		t.Errorf("Padding ratio = %v, want between 0.5 and 1", ratio)
+	}
+	if stats.Bandwidth != 200*1280 {
+		t.Errorf("Bandwidth = %v, want %v", stats.Bandwidth, 200*1280)
+	}
+}
+
+func TestPadder_StopsWhenIdle(t *testing.T) {
+	sender := &fakeSender{}
+	p, err := NewPadder(sender, dummyPacket, &PaddingConfig{Rate: 200, IdleTimeout: 30 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewPadder failed: %v", err)
+	}
+	defer p.Close()
+
+	p.ForwardPacket("a", []byte("real"))
+	waitFor(t, time.Second, func() bool {
+		return p.GetStats().Links == 0
+	})
+
+	// Nothing is sent on a retired link
+	sent := len(sender.Sent())
+	time.Sleep(30 * time.Millisecond)
+	if len(sender.Sent()) != sent {
+		t.Error("Packets sent after the link went idle")
+	}
+
+	// A new real packet starts padding again
+	p.ForwardPacket("a", []byte("real"))
+	if links := p.GetStats().Links; links != 1 {
+		t.Errorf("Links = %d, want 1", links)
+	}
+}
+
+func TestPadder_BandwidthBudget(t *testing.T) {
+	sender := &fakeSender{}
+
+	// Room for exactly one padded link
+	p, err := NewPadder(sender, dummyPacket, &PaddingConfig{Rate: 10, MaxBandwidth: 10 * 1280})
+	if err != nil {
+		t.Fatalf("NewPadder failed: %v", err)
+	}
+	defer p.Close()
+
+	p.ForwardPacket("a", []byte("padded"))
+	if err := p.ForwardPacket("b", []byte("unpadded")); err != nil {
+		t.Fatalf("ForwardPacket failed: %v", err)
+	}
+
+	// The second neighbor's packet is sent at once, outside any slot
+	if sent := sender.Sent(); len(sent) != 1 || sent[0] != "unpadded" {
+		t.Errorf("Sent %q, want only the unpadded packet", sent)
+	}
+	stats := p.GetStats()
+	if stats.Links != 1 || stats.Unpadded != 1 {
+		t.Errorf("Unexpected padding stats: %+v", stats)
+	}
+}
+
+func TestPadder_QueueFull(t *testing.T) {
+	sender := &fakeSender{}
+	p, err := NewPadder(sender, dummyPacket, &PaddingConfig{Rate: 0.1, QueueSize: 2})
+	if err != nil {
+		t.Fatalf("NewPadder failed: %v", err)
+	}
+	defer p.Close()
+
+	p.ForwardPacket("a", []byte("1"))
+	p.ForwardPacket("a", []byte("2"))
+	if err := p.ForwardPacket("a", []byte("3")); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("ForwardPacket error = %v, want ErrQueueFull", err)
+	}
+	if full := p.GetStats().QueueFull; full != 1 {
+		t.Errorf("Queue-full count = %d, want 1", full)
+	}
+}
+
+func TestPadder_DummyFailures(t *testing.T) {
+	sender := &fakeSender{}
+	p, err := NewPadder(sender, func(string) ([]byte, error) {
+		return nil, errors.New("node not in directory")
+	}, &PaddingConfig{Rate: 200})
+	if err != nil {
+		t.Fatalf("NewPadder failed: %v", err)
+	}
+	defer p.Close()
+
+	p.ForwardPacket("a", []byte("real"))
+	waitFor(t, time.Second, func() bool {
+		return p.GetStats().Failed >= 3
+	})
+	if sent := sender.Sent(); len(sent) != 1 {
+		t.Errorf("Sent %q, want only the real packet", sent)
+	}
+}
+
+func TestNewPadder_RequiresRate(t *testing.T) {
+	if _, err := NewPadder(&fakeSender{}, dummyPacket, &PaddingConfig{}); err == nil {
+		t.Error("Expected error for zero rate, got nil")
+	}
+}
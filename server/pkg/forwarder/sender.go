@@ -0,0 +1,89 @@
+package forwarder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// maxResponseSize bounds the onion request responses and cell answers
+// read from a node
+const maxResponseSize = 1 << 20
+
+// HTTPSender forwards packets with a plain HTTP client.
+// It is used between nodes when mTLS is disabled (development and testing).
+type HTTPSender struct {
+	client *http.Client
+	scheme string
+}
+
+// NewHTTPSender creates a sender that posts packets to scheme://address/v1/onion
+func NewHTTPSender(scheme string, timeout time.Duration) *HTTPSender {
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	return &HTTPSender{
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 10,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		scheme: scheme,
+	}
+}
+
+// ForwardPacket forwards an onion packet to another node
+func (s *HTTPSender) ForwardPacket(nodeAddress string, packet []byte) error {
+	url := fmt.Sprintf("%s://%s/v1/onion", s.scheme, nodeAddress)
+
+	resp, err := s.client.Post(url, "application/octet-stream", bytes.NewReader(packet))
+	if err != nil {
+		return fmt.Errorf("failed to forward packet: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+		return &common.RejectedError{Status: resp.StatusCode, Message: string(body)}
+	}
+
+	return nil
+}
+
+// SendRequest relays an onion request to another node and returns its response
+func (s *HTTPSender) SendRequest(nodeAddress string, packet []byte) ([]byte, error) {
+	return s.post(fmt.Sprintf("%s://%s/v1/onion/request", s.scheme, nodeAddress), packet)
+}
+
+// SendCell relays a circuit cell to another node and returns its answer
+func (s *HTTPSender) SendCell(nodeAddress string, cell []byte) ([]byte, error) {
+	return s.post(fmt.Sprintf("%s://%s/v1/onion/circuit", s.scheme, nodeAddress), cell)
+}
+
+// post sends body to url and returns the response body
+func (s *HTTPSender) post(url string, body []byte) ([]byte, error) {
+	resp, err := s.client.Post(url, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to relay request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed with status %d: %s",
+			resp.StatusCode, string(answer))
+	}
+
+	return answer, nil
+}
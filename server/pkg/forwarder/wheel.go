@@ -0,0 +1,68 @@
+package forwarder
+
+import "time"
+
+// wheelSlots is the number of ticks a timer wheel covers in one turn.
+// Packets due further out stay in their slot for extra turns.
+const wheelSlots = 1024
+
+// timerWheel is a hashed timing wheel holding packets until their send
+// time. Adding a packet is O(1) whatever the number waiting, and packets
+// are never released before their send time: tick n is only expired once
+// start + n*tick has passed.
+type timerWheel struct {
+	tick    time.Duration
+	start   time.Time
+	current int64 // Next tick to expire
+	slots   [wheelSlots][]*queuedPacket
+	count   int
+}
+
+func newTimerWheel(tick time.Duration, start time.Time) *timerWheel {
+	return &timerWheel{tick: tick, start: start}
+}
+
+// add schedules pkt for the first tick at or after pkt.sendAt
+func (w *timerWheel) add(pkt *queuedPacket, now time.Time) {
+	// An empty wheel skips the ticks that passed while it was idle
+	if w.count == 0 {
+		w.current = max(w.current, int64(now.Sub(w.start)/w.tick)+1)
+	}
+
+	due := int64((pkt.sendAt.Sub(w.start) + w.tick - 1) / w.tick)
+	pkt.tick = max(due, w.current)
+	slot := pkt.tick % wheelSlots
+	w.slots[slot] = append(w.slots[slot], pkt)
+	w.count++
+}
+
+// advance appends the packets due by now to expired, tick by tick, and
+// returns it
+func (w *timerWheel) advance(now time.Time, expired []*queuedPacket) []*queuedPacket {
+	last := int64(now.Sub(w.start) / w.tick)
+	for ; w.current <= last && w.count > 0; w.current++ {
+		slot := w.current % wheelSlots
+		waiting := w.slots[slot][:0]
+		for _, pkt := range w.slots[slot] {
+			if pkt.tick <= w.current {
+				expired = append(expired, pkt)
+				w.count--
+			} else {
+				waiting = append(waiting, pkt)
+			}
+		}
+		clear(w.slots[slot][len(waiting):])
+		w.slots[slot] = waiting
+	}
+	return expired
+}
+
+// nextTick returns when the next tick expires
+func (w *timerWheel) nextTick() time.Time {
+	return w.start.Add(time.Duration(w.current) * w.tick)
+}
+
+// len returns the number of packets waiting
+func (w *timerWheel) len() int {
+	return w.count
+}
@@ -0,0 +1,63 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerWheel_ReleasesOnTime(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	w := newTimerWheel(10*time.Millisecond, start)
+
+	// Due mid-tick, at a tick boundary, and several turns of the wheel away
+	for _, delay := range []time.Duration{15 * time.Millisecond, 30 * time.Millisecond, 25 * time.Second} {
+		w.add(&queuedPacket{address: delay.String(), sendAt: start.Add(delay)}, start)
+	}
+
+	// Nothing is released early, not even when its slot comes round
+	for _, step := range []struct {
+		now  time.Duration
+		want []string
+	}{
+		{14 * time.Millisecond, nil},
+		{20 * time.Millisecond, []string{"15ms"}},
+		{29 * time.Millisecond, nil},
+		{30 * time.Millisecond, []string{"30ms"}},
+		{15 * time.Second, nil},
+		{25 * time.Second, []string{"25s"}},
+	} {
+		expired := w.advance(start.Add(step.now), nil)
+		if len(expired) != len(step.want) {
+			t.Fatalf("At %v: released %d packets, want %v", step.now, len(expired), step.want)
+		}
+		for i, pkt := range expired {
+			if pkt.address != step.want[i] {
+				t.Errorf("At %v: released %s, want %s", step.now, pkt.address, step.want[i])
+			}
+			if pkt.sendAt.After(start.Add(step.now)) {
+				t.Errorf("At %v: released %s before its send time", step.now, pkt.address)
+			}
+		}
+	}
+	if w.len() != 0 {
+		t.Errorf("Wheel holds %d packets, want 0", w.len())
+	}
+}
+
+func TestTimerWheel_SkipsIdleTicks(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	w := newTimerWheel(10*time.Millisecond, start)
+
+	// After an hour idle, a new packet is released by its own delay
+	now := start.Add(time.Hour)
+	w.add(&queuedPacket{sendAt: now.Add(20 * time.Millisecond)}, now)
+	if next := w.nextTick(); next.Before(now) {
+		t.Errorf("Next tick %v is before now", next.Sub(start))
+	}
+	if expired := w.advance(now.Add(10*time.Millisecond), nil); len(expired) != 0 {
+		t.Errorf("Released %d packets early", len(expired))
+	}
+	if expired := w.advance(now.Add(20*time.Millisecond), nil); len(expired) != 1 {
+		t.Errorf("Released %d packets, want 1", len(expired))
+	}
+}
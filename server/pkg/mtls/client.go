@@ -2,17 +2,20 @@ package mtls
 
 import (
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"net/url"
 	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
 )
 
 // Client provides mutual TLS communication between nodes
 type Client struct {
 	httpClient *http.Client
+	links      *Links // nil without Config.Link
 	config     *Config
 }
 
@@ -22,6 +25,7 @@ type Config struct {
 	CertFile string // Path to client certificate
 	KeyFile  string // Path to client private key
 	Timeout  time.Duration
+	Link     *LinkConfig // Persistent link settings; nil sends every request separately
 }
 
 // NewClient creates a new mTLS client for inter-node communication
@@ -31,14 +35,9 @@ func NewClient(config *Config) (*Client, error) {
 	}
 
 	// Load CA certificate
-	caCert, err := os.ReadFile(config.CAFile)
+	caCertPool, err := loadCAPool(config.CAFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
-	}
-
-	caCertPool := x509.NewCertPool()
-	if !caCertPool.AppendCertsFromPEM(caCert) {
-		return nil, fmt.Errorf("failed to append CA certificate")
+		return nil, err
 	}
 
 	// Load client certificate and key
@@ -76,14 +75,37 @@ func NewClient(config *Config) (*Client, error) {
 		},
 	}
 
+	var links *Links
+	if config.Link != nil {
+		links = NewLinks(tlsConfig, config.Link)
+	}
+
 	return &Client{
 		httpClient: httpClient,
+		links:      links,
 		config:     config,
 	}, nil
 }
 
+// Links returns the client's persistent links, or nil if they are disabled
+func (c *Client) Links() *Links {
+	return c.links
+}
+
+// useLink reports whether a link request's outcome is final. Requests go
+// over HTTPS instead when links are disabled or the peer has none.
+func (c *Client) useLink(err error) bool {
+	return c.links != nil && !errors.Is(err, ErrLinkUnavailable)
+}
+
 // ForwardPacket forwards an onion packet to another node
 func (c *Client) ForwardPacket(nodeAddress string, packet []byte) error {
+	if c.links != nil {
+		if err := c.links.ForwardPacket(nodeAddress, packet); c.useLink(err) {
+			return err
+		}
+	}
+
 	url := fmt.Sprintf("https://%s/v1/onion", nodeAddress)
 	
 	resp, err := c.httpClient.Post(url, "application/octet-stream", 
@@ -95,15 +117,63 @@ func (c *Client) ForwardPacket(nodeAddress string, packet []byte) error {
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("forwarding failed with status %d: %s", 
-			resp.StatusCode, string(body))
+		return &common.RejectedError{Status: resp.StatusCode, Message: string(body)}
 	}
 
 	return nil
 }
 
+// SendRequest relays an onion request to another node and returns its response
+func (c *Client) SendRequest(nodeAddress string, packet []byte) ([]byte, error) {
+	if c.links != nil {
+		if response, err := c.links.SendRequest(nodeAddress, packet); c.useLink(err) {
+			return response, err
+		}
+	}
+
+	return c.relay(fmt.Sprintf("https://%s/v1/onion/request", nodeAddress), packet)
+}
+
+// SendCell relays a circuit cell to another node and returns its answer
+func (c *Client) SendCell(nodeAddress string, cell []byte) ([]byte, error) {
+	if c.links != nil {
+		if answer, err := c.links.SendCell(nodeAddress, cell); c.useLink(err) {
+			return answer, err
+		}
+	}
+
+	return c.relay(fmt.Sprintf("https://%s/v1/onion/circuit", nodeAddress), cell)
+}
+
+// relay posts an onion request or cell over HTTPS and returns the answer
+func (c *Client) relay(url string, payload []byte) ([]byte, error) {
+	resp, err := c.httpClient.Post(url, "application/octet-stream", 
+		&byteReader{data: payload})
+	if err != nil {
+		return nil, fmt.Errorf("failed to relay request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxFramePayload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed with status %d: %s", 
+			resp.StatusCode, string(body))
+	}
+
+	return body, nil
+}
+
 // ReplicateMessage sends a message to another node for replication
 func (c *Client) ReplicateMessage(nodeAddress string, messageData []byte) error {
+	if c.links != nil {
+		if err := c.links.ReplicateMessage(nodeAddress, messageData); c.useLink(err) {
+			return err
+		}
+	}
+
 	url := fmt.Sprintf("https://%s/v1/swarm/replicate", nodeAddress)
 	
 	resp, err := c.httpClient.Post(url, "application/json", 
@@ -122,6 +192,37 @@ func (c *Client) ReplicateMessage(nodeAddress string, messageData []byte) error
 	return nil
 }
 
+// DeleteMessage deletes a replicated message from another node
+func (c *Client) DeleteMessage(nodeAddress, sessionID, messageID string) error {
+	if c.links != nil {
+		if err := c.links.DeleteMessage(nodeAddress, sessionID, messageID); c.useLink(err) {
+			return err
+		}
+	}
+
+	endpoint := fmt.Sprintf("https://%s/v1/swarm/replicate/%s/%s", nodeAddress, 
+		url.PathEscape(sessionID), url.PathEscape(messageID))
+	
+	req, err := http.NewRequest(http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete replica: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// A replica that is already gone counts as deleted
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("replica deletion failed with status %d: %s", 
+			resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
 // HealthCheck checks if a node is healthy
 func (c *Client) HealthCheck(nodeAddress string) error {
 	url := fmt.Sprintf("https://%s/health", nodeAddress)
@@ -141,6 +242,9 @@ func (c *Client) HealthCheck(nodeAddress string) error {
 
 // Close closes the client and cleans up resources
 func (c *Client) Close() error {
+	if c.links != nil {
+		c.links.Close()
+	}
 	c.httpClient.CloseIdleConnections()
 	return nil
 }
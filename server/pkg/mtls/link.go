@@ -0,0 +1,483 @@
+package mtls
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// Frame types carried on a link. Every request frame is answered by an
+// ack or error frame with the same ID; requests with ID 0 (keepalive
+// pings) are answered but nobody waits for the answer. Only the acks of
+// FrameRequest and FrameCell have a payload.
+const (
+	FramePacket    byte = 0x01 // Onion packet to process
+	FrameReplicate byte = 0x02 // JSON-encoded message to store as a replica
+	FrameDelete    byte = 0x03 // Replica to delete: session ID length (2), session ID, message ID
+	FramePing      byte = 0x04 // Health check, empty payload
+	FrameAck       byte = 0x05 // Request succeeded
+	FrameError     byte = 0x06 // Request failed; payload is the error text
+	FrameRequest   byte = 0x07 // Onion request; the ack carries the response
+	FrameCell      byte = 0x08 // Circuit cell; the ack carries the answer
+)
+
+// Frame layout:
+//
+//	0     type
+//	1:5   request ID (big endian)
+//	5:9   payload length (big endian)
+//	9:    payload
+const frameHeaderSize = 9
+
+// MaxFramePayload bounds frame payloads; a replicated 64 KiB message
+// encodes to well under this, and so does the largest onion request
+const MaxFramePayload = 1 << 20
+
+var (
+	// ErrLinkClosed is returned for requests on a link that closed before they completed
+	ErrLinkClosed = errors.New("link closed")
+
+	// ErrBackpressure is returned when a peer's send queue stayed full for the request timeout
+	ErrBackpressure = errors.New("link send queue full")
+)
+
+// LinkHandler executes requests received on a link
+type LinkHandler interface {
+	HandlePacket(packet []byte) error
+	HandleReplicate(messageData []byte) error
+	HandleDelete(sessionID, messageID string) error
+	HandleRequest(packet []byte) ([]byte, error)
+	HandleCell(from string, cell []byte) ([]byte, error) // from is the peer's host
+}
+
+// LinkConfig holds persistent link settings
+type LinkConfig struct {
+	QueueSize      int           // Frames waiting to be written per peer (default 256)
+	MaxInFlight    int           // Requests from a peer handled concurrently (default 64)
+	PingInterval   time.Duration // Keepalive interval; a link silent for 3 intervals is closed (default 15s)
+	RequestTimeout time.Duration // Time to queue a request and get its answer (default 10s)
+	DialTimeout    time.Duration // Connection and upgrade timeout (default 5s)
+	MaxBackoff     time.Duration // Upper bound on the delay between reconnection attempts (default 30s)
+
+	// Limits on links accepted by a LinkServer
+	MaxLinks         int // Links from all peers open at once (default 256)
+	MaxLinksPerPeer  int // Links from one peer open at once (default 4)
+	MaxBufferedBytes int // Payload bytes of a peer's requests held at once per link (default 8 MiB, at least MaxFramePayload)
+}
+
+// withDefaults returns a copy of config with zero fields set to their defaults
+func (c *LinkConfig) withDefaults() LinkConfig {
+	var config LinkConfig
+	if c != nil {
+		config = *c
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 256
+	}
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = 64
+	}
+	if config.PingInterval <= 0 {
+		config.PingInterval = 15 * time.Second
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = 10 * time.Second
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = 30 * time.Second
+	}
+	if config.MaxLinks <= 0 {
+		config.MaxLinks = 256
+	}
+	if config.MaxLinksPerPeer <= 0 {
+		config.MaxLinksPerPeer = 4
+	}
+	if config.MaxBufferedBytes <= 0 {
+		config.MaxBufferedBytes = 8 << 20
+	}
+	if config.MaxBufferedBytes < MaxFramePayload {
+		config.MaxBufferedBytes = MaxFramePayload
+	}
+	return config
+}
+
+// frame is one unit of the link protocol
+type frame struct {
+	typ     byte
+	id      uint32
+	payload []byte
+}
+
+// writeFrame writes f to w
+func writeFrame(w io.Writer, f frame) error {
+	var header [frameHeaderSize]byte
+	header[0] = f.typ
+	binary.BigEndian.PutUint32(header[1:5], f.id)
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(f.payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.payload)
+	return err
+}
+
+// readFrame reads the next frame from r
+func readFrame(r io.Reader) (frame, error) {
+	f, size, err := readFrameHeader(r)
+	if err != nil {
+		return frame{}, err
+	}
+	if err := readFramePayload(r, &f, size); err != nil {
+		return frame{}, err
+	}
+	return f, nil
+}
+
+// readFrameHeader reads the header of the next frame from r and returns
+// the frame without its payload, and the payload size
+func readFrameHeader(r io.Reader) (frame, int, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[5:9])
+	if size > MaxFramePayload {
+		return frame{}, 0, fmt.Errorf("frame too large: %d bytes", size)
+	}
+
+	f := frame{
+		typ: header[0],
+		id:  binary.BigEndian.Uint32(header[1:5]),
+	}
+	return f, int(size), nil
+}
+
+// readFramePayload reads the size byte payload of f from r
+func readFramePayload(r io.Reader, f *frame, size int) error {
+	f.payload = make([]byte, size)
+	_, err := io.ReadFull(r, f.payload)
+	return err
+}
+
+// encodeDelete builds a FrameDelete payload
+func encodeDelete(sessionID, messageID string) ([]byte, error) {
+	if len(sessionID) > 0xffff {
+		return nil, errors.New("session ID too long")
+	}
+	payload := make([]byte, 2, 2+len(sessionID)+len(messageID))
+	binary.BigEndian.PutUint16(payload, uint16(len(sessionID)))
+	payload = append(payload, sessionID...)
+	return append(payload, messageID...), nil
+}
+
+// decodeDelete parses a FrameDelete payload
+func decodeDelete(payload []byte) (sessionID, messageID string, err error) {
+	if len(payload) < 2 {
+		return "", "", errors.New("delete frame too short")
+	}
+	n := int(binary.BigEndian.Uint16(payload))
+	if len(payload) < 2+n {
+		return "", "", errors.New("delete frame too short")
+	}
+	return string(payload[2 : 2+n]), string(payload[2+n:]), nil
+}
+
+// Link multiplexes requests to a peer over one connection. Frames are
+// queued per link and written by a single goroutine; when the queue is
+// full, requests wait (backpressure) up to the request timeout. Requests
+// from the peer run concurrently up to MaxInFlight, after which the link
+// stops reading and TCP flow control slows the peer down. The same
+// happens while the payloads of the peer's requests being handled add up
+// to MaxBufferedBytes.
+type Link struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	handler LinkHandler
+	config  LinkConfig
+
+	out      chan frame
+	inFlight chan struct{}
+
+	// Payload bytes held by running handlers; released is signalled as
+	// they finish. Only readLoop adds to buffered.
+	buffered atomic.Int64
+	released chan struct{}
+
+	pending map[uint32]chan frame
+	nextID  atomic.Uint32
+	mu      sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// newLink starts serving a connection whose upgrade has completed.
+// reader holds any bytes already buffered from conn. handler may be nil
+// for links that only send requests.
+func newLink(conn net.Conn, reader *bufio.Reader, handler LinkHandler, config LinkConfig) *Link {
+	l := &Link{
+		conn:     conn,
+		reader:   reader,
+		handler:  handler,
+		config:   config,
+		out:      make(chan frame, config.QueueSize),
+		inFlight: make(chan struct{}, config.MaxInFlight),
+		released: make(chan struct{}, 1),
+		pending:  make(map[uint32]chan frame),
+		done:     make(chan struct{}),
+	}
+
+	l.wg.Add(2)
+	go l.readLoop()
+	go l.writeLoop()
+
+	return l
+}
+
+// Done is closed when the link has failed or been closed
+func (l *Link) Done() <-chan struct{} {
+	return l.done
+}
+
+// Close closes the link, failing requests in flight, and waits for its goroutines
+func (l *Link) Close() error {
+	l.shutdown()
+	l.wg.Wait()
+	return nil
+}
+
+// shutdown closes the connection once; safe to call from the link's own goroutines
+func (l *Link) shutdown() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+}
+
+// request sends a request frame and waits for the peer's answer. It
+// returns the payload of the ack.
+func (l *Link) request(typ byte, payload []byte) ([]byte, error) {
+	id := l.nextID.Add(1)
+	if id == 0 {
+		id = l.nextID.Add(1)
+	}
+	answer := make(chan frame, 1)
+
+	l.mu.Lock()
+	l.pending[id] = answer
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.pending, id)
+		l.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(l.config.RequestTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.out <- frame{typ: typ, id: id, payload: payload}:
+	case <-l.done:
+		return nil, ErrLinkClosed
+	case <-timer.C:
+		return nil, ErrBackpressure
+	}
+
+	select {
+	case f := <-answer:
+		if f.typ == FrameError {
+			return nil, &common.RejectedError{Message: string(f.payload)}
+		}
+		return f.payload, nil
+	case <-l.done:
+		return nil, ErrLinkClosed
+	case <-timer.C:
+		return nil, errors.New("link request timed out")
+	}
+}
+
+// send queues a frame without waiting for an answer. It gives up if the
+// link closes while the queue is full.
+func (l *Link) send(f frame) {
+	select {
+	case l.out <- f:
+	case <-l.done:
+	}
+}
+
+// writeLoop writes queued frames and keepalive pings until the link closes.
+// Frames are buffered and flushed once the queue drains.
+func (l *Link) writeLoop() {
+	defer l.wg.Done()
+	defer l.shutdown()
+
+	w := bufio.NewWriter(l.conn)
+	ping := time.NewTicker(l.config.PingInterval)
+	defer ping.Stop()
+
+	for {
+		var f frame
+		select {
+		case f = <-l.out:
+		case <-ping.C:
+			f = frame{typ: FramePing}
+		case <-l.done:
+			return
+		}
+
+		l.conn.SetWriteDeadline(time.Now().Add(l.config.RequestTimeout))
+		if err := writeFrame(w, f); err != nil {
+			return
+		}
+		if len(l.out) == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLoop reads frames until the link fails or closes
+func (l *Link) readLoop() {
+	defer l.wg.Done()
+
+	// Handlers still running answer into the closed link and return
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	defer l.shutdown()
+
+	for {
+		// The peer pings every interval, so silence means it is gone
+		l.conn.SetReadDeadline(time.Now().Add(3 * l.config.PingInterval))
+		f, size, err := readFrameHeader(l.reader)
+		if err != nil {
+			return
+		}
+
+		switch f.typ {
+		case FrameAck, FrameError:
+			if readFramePayload(l.reader, &f, size) != nil {
+				return
+			}
+			l.answer(f)
+
+		case FramePing:
+			if readFramePayload(l.reader, &f, size) != nil {
+				return
+			}
+			l.send(frame{typ: FrameAck, id: f.id})
+
+		case FramePacket, FrameReplicate, FrameDelete, FrameRequest, FrameCell:
+			// Wait for a handler slot and room for the payload before
+			// reading it, so a peer cannot make the link buffer more
+			if !l.reserve(size) {
+				return
+			}
+			if readFramePayload(l.reader, &f, size) != nil {
+				l.release(size)
+				return
+			}
+			handlers.Add(1)
+			go func() {
+				defer handlers.Done()
+				defer l.release(size)
+				payload, err := l.handle(f)
+				l.reply(f.id, payload, err)
+			}()
+
+		default:
+			// A peer speaking another protocol version; nothing more can be parsed
+			return
+		}
+	}
+}
+
+// reserve waits for a handler slot and for size bytes of the buffer
+// budget. It returns false if the link closed first.
+func (l *Link) reserve(size int) bool {
+	select {
+	case l.inFlight <- struct{}{}:
+	case <-l.done:
+		return false
+	}
+
+	for l.buffered.Load()+int64(size) > int64(l.config.MaxBufferedBytes) {
+		select {
+		case <-l.released:
+		case <-l.done:
+			<-l.inFlight
+			return false
+		}
+	}
+	l.buffered.Add(int64(size))
+	return true
+}
+
+// release returns a handler slot and size bytes of the buffer budget
+func (l *Link) release(size int) {
+	l.buffered.Add(-int64(size))
+	<-l.inFlight
+	select {
+	case l.released <- struct{}{}:
+	default:
+	}
+}
+
+// answer passes an ack or error to the request waiting for it
+func (l *Link) answer(f frame) {
+	l.mu.Lock()
+	waiting, ok := l.pending[f.id]
+	l.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case waiting <- f:
+	default: // Duplicate answer
+	}
+}
+
+// handle executes a request from the peer and returns the ack payload
+func (l *Link) handle(f frame) ([]byte, error) {
+	if l.handler == nil {
+		return nil, errors.New("requests not accepted on this link")
+	}
+
+	switch f.typ {
+	case FramePacket:
+		return nil, l.handler.HandlePacket(f.payload)
+	case FrameReplicate:
+		return nil, l.handler.HandleReplicate(f.payload)
+	case FrameRequest:
+		return l.handler.HandleRequest(f.payload)
+	case FrameCell:
+		return l.handler.HandleCell(RemoteHost(l.conn.RemoteAddr().String()), f.payload)
+	default:
+		sessionID, messageID, err := decodeDelete(f.payload)
+		if err != nil {
+			return nil, err
+		}
+		return nil, l.handler.HandleDelete(sessionID, messageID)
+	}
+}
+
+// reply answers request id with an ack carrying payload, or the error text
+func (l *Link) reply(id uint32, payload []byte, err error) {
+	if err != nil {
+		l.send(frame{typ: FrameError, id: id, payload: []byte(err.Error())})
+		return
+	}
+	l.send(frame{typ: FrameAck, id: id, payload: payload})
+}
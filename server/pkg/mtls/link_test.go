@@ -0,0 +1,437 @@
+package mtls
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingHandler records link requests and fails them with err
+type recordingHandler struct {
+	packets    [][]byte
+	replicated [][]byte
+	deleted    []string
+	requests   [][]byte
+	cells      [][]byte
+	cellsFrom  []string
+	err        error
+	mu         sync.Mutex
+}
+
+func (h *recordingHandler) HandlePacket(packet []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.packets = append(h.packets, packet)
+	return h.err
+}
+
+func (h *recordingHandler) HandleReplicate(messageData []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.replicated = append(h.replicated, messageData)
+	return h.err
+}
+
+func (h *recordingHandler) HandleDelete(sessionID, messageID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deleted = append(h.deleted, sessionID+"/"+messageID)
+	return h.err
+}
+
+// HandleRequest answers with the request prefixed by "response to "
+func (h *recordingHandler) HandleRequest(packet []byte) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests = append(h.requests, packet)
+	if h.err != nil {
+		return nil, h.err
+	}
+	return append([]byte("response to "), packet...), nil
+}
+
+// HandleCell answers with the cell prefixed by "answer to "
+func (h *recordingHandler) HandleCell(from string, cell []byte) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cells = append(h.cells, cell)
+	h.cellsFrom = append(h.cellsFrom, from)
+	if h.err != nil {
+		return nil, h.err
+	}
+	return append([]byte("answer to "), cell...), nil
+}
+
+// startLinkServer serves links on a plain HTTP test server
+func startLinkServer(t *testing.T, handler LinkHandler, config *LinkConfig) (*httptest.Server, *LinkServer) {
+	t.Helper()
+	linkServer := NewLinkServer(handler, config)
+	mux := http.NewServeMux()
+	mux.Handle(LinkPath, linkServer)
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		linkServer.Close()
+		server.Close()
+	})
+	return server, linkServer
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	sent := frame{typ: FrameReplicate, id: 42, payload: []byte("message")}
+	if err := writeFrame(&buf, sent); err != nil {
+		t.Fatalf("writeFrame failed: %v", err)
+	}
+
+	received, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame failed: %v", err)
+	}
+	if received.typ != sent.typ || received.id != sent.id || !bytes.Equal(received.payload, sent.payload) {
+		t.Errorf("Frame changed in transit: %+v", received)
+	}
+
+	// Oversized frames are refused before their payload is read
+	buf.Reset()
+	buf.Write([]byte{FramePacket, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff})
+	if _, err := readFrame(&buf); err == nil {
+		t.Error("Expected error for oversized frame")
+	}
+}
+
+func TestDeletePayload(t *testing.T) {
+	payload, err := encodeDelete("session/1", "message-1")
+	if err != nil {
+		t.Fatalf("encodeDelete failed: %v", err)
+	}
+	sessionID, messageID, err := decodeDelete(payload)
+	if err != nil {
+		t.Fatalf("decodeDelete failed: %v", err)
+	}
+	if sessionID != "session/1" || messageID != "message-1" {
+		t.Errorf("Got %q/%q", sessionID, messageID)
+	}
+
+	if _, _, err := decodeDelete([]byte{0, 5, 'a'}); err == nil {
+		t.Error("Expected error for truncated delete frame")
+	}
+}
+
+func TestLinks_Requests(t *testing.T) {
+	handler := &recordingHandler{}
+	server, linkServer := startLinkServer(t, handler, nil)
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	links := NewLinks(nil, nil)
+	defer links.Close()
+
+	if err := links.ForwardPacket(address, []byte("packet")); err != nil {
+		t.Fatalf("ForwardPacket failed: %v", err)
+	}
+	if err := links.ReplicateMessage(address, []byte(`{"id":"1"}`)); err != nil {
+		t.Fatalf("ReplicateMessage failed: %v", err)
+	}
+	if err := links.DeleteMessage(address, "session", "1"); err != nil {
+		t.Fatalf("DeleteMessage failed: %v", err)
+	}
+	if _, err := links.Ping(address); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	response, err := links.SendRequest(address, []byte("request"))
+	if err != nil {
+		t.Fatalf("SendRequest failed: %v", err)
+	}
+	if string(response) != "response to request" {
+		t.Errorf("Response = %q, want %q", response, "response to request")
+	}
+	answer, err := links.SendCell(address, []byte("cell"))
+	if err != nil {
+		t.Fatalf("SendCell failed: %v", err)
+	}
+	if string(answer) != "answer to cell" {
+		t.Errorf("Answer = %q, want %q", answer, "answer to cell")
+	}
+
+	handler.mu.Lock()
+	if len(handler.packets) != 1 || string(handler.packets[0]) != "packet" {
+		t.Errorf("Unexpected packets: %q", handler.packets)
+	}
+	if len(handler.replicated) != 1 || string(handler.replicated[0]) != `{"id":"1"}` {
+		t.Errorf("Unexpected replications: %q", handler.replicated)
+	}
+	if len(handler.deleted) != 1 || handler.deleted[0] != "session/1" {
+		t.Errorf("Unexpected deletions: %q", handler.deleted)
+	}
+	if len(handler.requests) != 1 || string(handler.requests[0]) != "request" {
+		t.Errorf("Unexpected requests: %q", handler.requests)
+	}
+	if len(handler.cells) != 1 || string(handler.cells[0]) != "cell" {
+		t.Errorf("Unexpected cells: %q", handler.cells)
+	}
+	if len(handler.cellsFrom) != 1 || handler.cellsFrom[0] != "127.0.0.1" {
+		t.Errorf("Cells from %q, want the peer's host", handler.cellsFrom)
+	}
+	handler.mu.Unlock()
+
+	// All requests share one connection
+	stats := links.GetStats()
+	if stats.Dials != 1 || stats.Open != 1 || stats.Requests != 6 {
+		t.Errorf("Unexpected link stats: %+v", stats)
+	}
+	if accepted := linkServer.GetStats().Accepted; accepted != 1 {
+		t.Errorf("Expected 1 accepted link, got %d", accepted)
+	}
+}
+
+func TestLinks_PeerError(t *testing.T) {
+	handler := &recordingHandler{err: errors.New("content not padded")}
+	server, _ := startLinkServer(t, handler, nil)
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	links := NewLinks(nil, nil)
+	defer links.Close()
+
+	err := links.ReplicateMessage(address, []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "content not padded") {
+		t.Fatalf("Expected the peer's error, got %v", err)
+	}
+
+	// An error answer does not break the link
+	if _, err := links.Ping(address); err != nil {
+		t.Errorf("Ping after error failed: %v", err)
+	}
+	if stats := links.GetStats(); stats.Failed != 1 || stats.Dials != 1 {
+		t.Errorf("Unexpected link stats: %+v", stats)
+	}
+}
+
+func TestLinks_Reconnect(t *testing.T) {
+	server, _ := startLinkServer(t, &recordingHandler{}, nil)
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	links := NewLinks(nil, nil)
+	defer links.Close()
+
+	if _, err := links.Ping(address); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	// Break the link; the next request dials a new one
+	links.peers[address].link.Close()
+	if err := links.ForwardPacket(address, []byte("packet")); err != nil {
+		t.Fatalf("ForwardPacket after reconnect failed: %v", err)
+	}
+	if dials := links.GetStats().Dials; dials != 2 {
+		t.Errorf("Expected 2 dials, got %d", dials)
+	}
+}
+
+func TestLinks_Unavailable(t *testing.T) {
+	// A node without link support
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	links := NewLinks(nil, nil)
+	defer links.Close()
+
+	if err := links.ForwardPacket(address, []byte("packet")); !errors.Is(err, ErrLinkUnavailable) {
+		t.Fatalf("Expected ErrLinkUnavailable, got %v", err)
+	}
+
+	// Within the backoff the peer is not dialed again
+	if err := links.ForwardPacket(address, []byte("packet")); !errors.Is(err, ErrLinkUnavailable) {
+		t.Fatalf("Expected ErrLinkUnavailable, got %v", err)
+	}
+	if stats := links.GetStats(); stats.Dials != 1 || stats.DialFailures != 1 {
+		t.Errorf("Unexpected link stats: %+v", stats)
+	}
+}
+
+// blockingHandler holds packets until release is closed and tracks concurrency
+type blockingHandler struct {
+	recordingHandler
+	release chan struct{}
+	active  atomic.Int32
+	peak    atomic.Int32
+}
+
+func (h *blockingHandler) HandlePacket(packet []byte) error {
+	n := h.active.Add(1)
+	defer h.active.Add(-1)
+	for {
+		peak := h.peak.Load()
+		if n <= peak || h.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	<-h.release
+	return nil
+}
+
+func TestLinkServer_MaxInFlight(t *testing.T) {
+	handler := &blockingHandler{release: make(chan struct{})}
+	server, _ := startLinkServer(t, handler, &LinkConfig{MaxInFlight: 2})
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	links := NewLinks(nil, nil)
+	defer links.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- links.ForwardPacket(address, []byte("packet"))
+		}()
+	}
+
+	// Give the requests time to pile up behind the two running handlers
+	deadline := time.Now().Add(2 * time.Second)
+	for handler.active.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(handler.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("ForwardPacket failed: %v", err)
+		}
+	}
+	if peak := handler.peak.Load(); peak != 2 {
+		t.Errorf("Expected at most 2 concurrent handlers, peak was %d", peak)
+	}
+}
+
+func TestLinkServer_MaxBufferedBytes(t *testing.T) {
+	handler := &blockingHandler{release: make(chan struct{})}
+	server, _ := startLinkServer(t, handler, &LinkConfig{MaxBufferedBytes: MaxFramePayload})
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	links := NewLinks(nil, nil)
+	defer links.Close()
+
+	// Two of these do not fit in the budget together
+	packet := make([]byte, MaxFramePayload/2+1)
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- links.ForwardPacket(address, packet)
+		}()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for handler.active.Load() < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(handler.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("ForwardPacket failed: %v", err)
+		}
+	}
+	if peak := handler.peak.Load(); peak != 1 {
+		t.Errorf("Expected 1 handler at a time within the byte budget, peak was %d", peak)
+	}
+}
+
+func TestLinkServer_MaxLinksPerPeer(t *testing.T) {
+	server, linkServer := startLinkServer(t, &recordingHandler{}, &LinkConfig{MaxLinksPerPeer: 1})
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	dial := func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := upgrade(conn, address, time.Second); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	first, err := dial()
+	if err != nil {
+		t.Fatalf("First upgrade failed: %v", err)
+	}
+	if _, err := dial(); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("Expected the second link from the peer to be refused with 503, got %v", err)
+	}
+	if stats := linkServer.GetStats(); stats.Open != 1 || stats.Refused != 1 {
+		t.Errorf("Unexpected link server stats: %+v", stats)
+	}
+
+	// Closing the link frees the peer's slot
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for linkServer.GetStats().Open > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err := dial()
+	if err != nil {
+		t.Fatalf("Upgrade after the first link closed failed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestLinks_TLS(t *testing.T) {
+	handler := &recordingHandler{}
+	linkServer := NewLinkServer(handler, nil)
+	defer linkServer.Close()
+	server := httptest.NewTLSServer(linkServer)
+	defer server.Close()
+
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig
+	links := NewLinks(tlsConfig, nil)
+	defer links.Close()
+
+	if err := links.ForwardPacket(strings.TrimPrefix(server.URL, "https://"), []byte("packet")); err != nil {
+		t.Fatalf("ForwardPacket over TLS failed: %v", err)
+	}
+}
+
+func TestClient_FallsBackWithoutLink(t *testing.T) {
+	// A node that only accepts packets over HTTPS
+	var posted atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/onion" {
+			posted.Add(1)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	client := &Client{
+		httpClient: server.Client(),
+		links:      NewLinks(server.Client().Transport.(*http.Transport).TLSClientConfig, nil),
+	}
+	defer client.Close()
+
+	if err := client.ForwardPacket(strings.TrimPrefix(server.URL, "https://"), []byte("packet")); err != nil {
+		t.Fatalf("ForwardPacket failed: %v", err)
+	}
+	if posted.Load() != 1 {
+		t.Errorf("Expected the packet over HTTPS, got %d posts", posted.Load())
+	}
+}
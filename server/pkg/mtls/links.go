@@ -0,0 +1,289 @@
+package mtls
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LinkPath is the HTTP endpoint upgraded to a link
+const LinkPath = "/v1/link"
+
+// LinkProtocol is the Upgrade token of the link protocol
+const LinkProtocol = "ghosttalk-link/1"
+
+// ErrLinkUnavailable is returned when no link to a peer could be opened
+// recently; callers fall back to one request per connection
+var ErrLinkUnavailable = errors.New("link unavailable")
+
+// initialBackoff is the delay before redialing a peer after the first failure
+const initialBackoff = time.Second
+
+// Links keeps one persistent link per peer, opened on first use and
+// reopened after it fails. A peer that cannot be reached, or does not
+// speak the link protocol, is retried with exponential backoff and
+// reported as ErrLinkUnavailable in between.
+type Links struct {
+	tlsConfig *tls.Config // nil dials plain TCP (development and testing)
+	config    LinkConfig
+
+	peers  map[string]*peerLink
+	closed bool
+	mu     sync.Mutex
+
+	// Stats
+	dials        atomic.Uint64
+	dialFailures atomic.Uint64
+	requests     atomic.Uint64
+	failed       atomic.Uint64
+	backpressure atomic.Uint64
+}
+
+// peerLink is the link state for one peer address
+type peerLink struct {
+	link    *Link
+	retryAt time.Time
+	backoff time.Duration
+	mu      sync.Mutex
+}
+
+// NewLinks creates a link pool. Connections use tlsConfig, or plain TCP if it is nil.
+func NewLinks(tlsConfig *tls.Config, config *LinkConfig) *Links {
+	if tlsConfig != nil {
+		// Upgrades are an HTTP/1.1 mechanism
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+
+	return &Links{
+		tlsConfig: tlsConfig,
+		config:    config.withDefaults(),
+		peers:     make(map[string]*peerLink),
+	}
+}
+
+// ForwardPacket sends an onion packet to the node at nodeAddress
+func (ls *Links) ForwardPacket(nodeAddress string, packet []byte) error {
+	_, err := ls.request(nodeAddress, FramePacket, packet)
+	return err
+}
+
+// ReplicateMessage sends a JSON-encoded message to store as a replica
+func (ls *Links) ReplicateMessage(nodeAddress string, messageData []byte) error {
+	_, err := ls.request(nodeAddress, FrameReplicate, messageData)
+	return err
+}
+
+// DeleteMessage deletes a replica from the node at nodeAddress
+func (ls *Links) DeleteMessage(nodeAddress, sessionID, messageID string) error {
+	payload, err := encodeDelete(sessionID, messageID)
+	if err != nil {
+		return err
+	}
+	_, err = ls.request(nodeAddress, FrameDelete, payload)
+	return err
+}
+
+// SendRequest sends an onion request to the node at nodeAddress and
+// returns its response
+func (ls *Links) SendRequest(nodeAddress string, packet []byte) ([]byte, error) {
+	return ls.request(nodeAddress, FrameRequest, packet)
+}
+
+// SendCell sends a circuit cell to the node at nodeAddress and returns
+// its answer
+func (ls *Links) SendCell(nodeAddress string, cell []byte) ([]byte, error) {
+	return ls.request(nodeAddress, FrameCell, cell)
+}
+
+// Ping checks the link to nodeAddress and returns the round-trip time
+func (ls *Links) Ping(nodeAddress string) (time.Duration, error) {
+	start := time.Now()
+	if _, err := ls.request(nodeAddress, FramePing, nil); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Close closes all links
+func (ls *Links) Close() error {
+	ls.mu.Lock()
+	ls.closed = true
+	peers := ls.peers
+	ls.peers = make(map[string]*peerLink)
+	ls.mu.Unlock()
+
+	for _, peer := range peers {
+		peer.mu.Lock()
+		if peer.link != nil {
+			peer.link.Close()
+		}
+		peer.mu.Unlock()
+	}
+	return nil
+}
+
+// GetStats returns link pool statistics
+func (ls *Links) GetStats() LinkStats {
+	ls.mu.Lock()
+	peers := make([]*peerLink, 0, len(ls.peers))
+	for _, peer := range ls.peers {
+		peers = append(peers, peer)
+	}
+	ls.mu.Unlock()
+
+	open := 0
+	for _, peer := range peers {
+		peer.mu.Lock()
+		if peer.link != nil && !isDone(peer.link) {
+			open++
+		}
+		peer.mu.Unlock()
+	}
+
+	return LinkStats{
+		Open:         open,
+		Dials:        ls.dials.Load(),
+		DialFailures: ls.dialFailures.Load(),
+		Requests:     ls.requests.Load(),
+		Failed:       ls.failed.Load(),
+		Backpressure: ls.backpressure.Load(),
+	}
+}
+
+// LinkStats contains link pool statistics
+type LinkStats struct {
+	Open         int    // Links currently open
+	Dials        uint64 // Connection attempts, including reconnections
+	DialFailures uint64 // Connection attempts that failed
+	Requests     uint64 // Requests sent over links
+	Failed       uint64 // Requests that failed (peer error, timeout or closed link)
+	Backpressure uint64 // Requests refused because the peer's send queue stayed full
+}
+
+// request sends one request to nodeAddress over its link and returns the ack payload
+func (ls *Links) request(nodeAddress string, typ byte, payload []byte) ([]byte, error) {
+	link, err := ls.get(nodeAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	ls.requests.Add(1)
+	answer, err := link.request(typ, payload)
+	if err != nil {
+		ls.failed.Add(1)
+		if errors.Is(err, ErrBackpressure) {
+			ls.backpressure.Add(1)
+		}
+		return nil, err
+	}
+	return answer, nil
+}
+
+// get returns the open link to nodeAddress, dialing it if needed
+func (ls *Links) get(nodeAddress string) (*Link, error) {
+	ls.mu.Lock()
+	if ls.closed {
+		ls.mu.Unlock()
+		return nil, ErrLinkClosed
+	}
+	peer, ok := ls.peers[nodeAddress]
+	if !ok {
+		peer = &peerLink{}
+		ls.peers[nodeAddress] = peer
+	}
+	ls.mu.Unlock()
+
+	// Concurrent requests to a peer wait for a single dial
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if peer.link != nil && !isDone(peer.link) {
+		return peer.link, nil
+	}
+	if time.Now().Before(peer.retryAt) {
+		return nil, ErrLinkUnavailable
+	}
+
+	ls.dials.Add(1)
+	link, err := ls.dial(nodeAddress)
+	if err != nil {
+		ls.dialFailures.Add(1)
+		peer.backoff = min(max(2*peer.backoff, initialBackoff), ls.config.MaxBackoff)
+		peer.retryAt = time.Now().Add(peer.backoff)
+		return nil, fmt.Errorf("%w: %v", ErrLinkUnavailable, err)
+	}
+
+	peer.link = link
+	peer.backoff = 0
+	peer.retryAt = time.Time{}
+	return link, nil
+}
+
+// dial connects to nodeAddress and upgrades the connection to a link
+func (ls *Links) dial(nodeAddress string) (*Link, error) {
+	dialer := &net.Dialer{Timeout: ls.config.DialTimeout}
+
+	var conn net.Conn
+	var err error
+	if ls.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", nodeAddress, ls.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", nodeAddress)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := upgrade(conn, nodeAddress, ls.config.DialTimeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newLink(conn, reader, nil, ls.config), nil
+}
+
+// upgrade asks the server at nodeAddress to switch conn to the link protocol
+func upgrade(conn net.Conn, nodeAddress string, timeout time.Duration) (*bufio.Reader, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+nodeAddress+LinkPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", LinkProtocol)
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != LinkProtocol {
+		return nil, fmt.Errorf("upgrade refused with status %d", resp.StatusCode)
+	}
+
+	return reader, nil
+}
+
+// isDone reports whether a link has closed
+func isDone(link *Link) bool {
+	select {
+	case <-link.Done():
+		return true
+	default:
+		return false
+	}
+}
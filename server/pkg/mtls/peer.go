@@ -0,0 +1,95 @@
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// PeerDirectory lists the registered nodes peer certificates are checked against.
+// directory.Service implements this interface.
+type PeerDirectory interface {
+	ListNodes() []*common.NodeInfo
+}
+
+// peerContextKey is the context key RequirePeer stores the peer node under
+type peerContextKey struct{}
+
+// ServerTLSConfig returns TLS settings for a node's listener that ask
+// clients for a certificate signed by the CA in caFile. Clients without
+// one, such as messaging clients, are still served; RequirePeer guards the
+// routes only peers may use.
+func ServerTLSConfig(caFile string) (*tls.Config, error) {
+	pool, err := loadCAPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS13,
+		CipherSuites: []uint16{
+			tls.TLS_CHACHA20_POLY1305_SHA256,
+			tls.TLS_AES_256_GCM_SHA384,
+			tls.TLS_AES_128_GCM_SHA256,
+		},
+	}, nil
+}
+
+// RequirePeer serves next only to requests whose client certificate
+// verified against the listener's CA and is valid for the address of a
+// registered, healthy node. The node is available to next through
+// PeerFromContext.
+func RequirePeer(peers PeerDirectory, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "Peer certificate required", http.StatusForbidden)
+			return
+		}
+
+		node, err := peerNode(r.TLS.VerifiedChains[0][0], peers)
+		if err != nil {
+			http.Error(w, "Unknown peer", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerContextKey{}, node)))
+	})
+}
+
+// PeerFromContext returns the node RequirePeer authenticated the request as
+func PeerFromContext(ctx context.Context) (*common.NodeInfo, bool) {
+	node, ok := ctx.Value(peerContextKey{}).(*common.NodeInfo)
+	return node, ok
+}
+
+// peerNode returns the registered node cert was issued for
+func peerNode(cert *x509.Certificate, peers PeerDirectory) (*common.NodeInfo, error) {
+	for _, node := range peers.ListNodes() {
+		if node.Healthy && cert.VerifyHostname(node.Address) == nil {
+			return node, nil
+		}
+	}
+	return nil, errors.New("certificate is not valid for any registered node")
+}
+
+// loadCAPool reads the CA certificates in file
+func loadCAPool(file string) (*x509.CertPool, error) {
+	caCert, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("failed to append CA certificate")
+	}
+	return pool, nil
+}
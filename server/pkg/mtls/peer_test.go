@@ -0,0 +1,113 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// staticDirectory is a fixed list of registered nodes
+type staticDirectory []*common.NodeInfo
+
+func (d staticDirectory) ListNodes() []*common.NodeInfo { return d }
+
+// startPeerServer serves RequirePeer(peers) over TLS, asking for client
+// certificates from a fresh CA, and returns a certificate from that CA
+// valid for 127.0.0.1
+func startPeerServer(t *testing.T, peers PeerDirectory) (*httptest.Server, tls.Certificate) {
+	t.Helper()
+
+	caCert, caKey, err := GenerateCA(&CertConfig{Organization: "Test", CommonName: "Test CA", ValidFor: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to generate CA: %v", err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := SaveCertificate(caCert, caFile); err != nil {
+		t.Fatalf("Failed to save CA: %v", err)
+	}
+	nodeCert, nodeKey, err := GenerateNodeCert(caCert, caKey, &CertConfig{
+		Organization: "Test",
+		CommonName:   "node1",
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ValidFor:     time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate node cert: %v", err)
+	}
+
+	tlsConfig, err := ServerTLSConfig(caFile)
+	if err != nil {
+		t.Fatalf("ServerTLSConfig failed: %v", err)
+	}
+	server := httptest.NewUnstartedServer(RequirePeer(peers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node, ok := PeerFromContext(r.Context())
+		if !ok {
+			http.Error(w, "no peer", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(node.ID))
+	})))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server, tls.Certificate{Certificate: [][]byte{nodeCert.Raw}, PrivateKey: nodeKey}
+}
+
+// peerClient returns a client for server presenting certs
+func peerClient(server *httptest.Server, certs ...tls.Certificate) *http.Client {
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.Certificates = certs
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+}
+
+func TestRequirePeer(t *testing.T) {
+	registered := staticDirectory{{ID: "node1", Address: "127.0.0.1", Port: 9000, Healthy: true}}
+	server, cert := startPeerServer(t, registered)
+
+	resp, err := peerClient(server, cert).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request with a peer certificate failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Status with a peer certificate = %d, want 200", resp.StatusCode)
+	}
+
+	resp, err = peerClient(server).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request without a certificate failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Status without a certificate = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestRequirePeer_UnregisteredNode(t *testing.T) {
+	testCases := map[string]staticDirectory{
+		"not registered": {{ID: "node2", Address: "10.0.0.2", Port: 9000, Healthy: true}},
+		"unhealthy":      {{ID: "node1", Address: "127.0.0.1", Port: 9000}},
+	}
+
+	for name, peers := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server, cert := startPeerServer(t, peers)
+
+			resp, err := peerClient(server, cert).Get(server.URL)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("Status = %d, want 403", resp.StatusCode)
+			}
+		})
+	}
+}
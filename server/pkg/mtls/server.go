@@ -0,0 +1,180 @@
+package mtls
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LinkServer accepts links from peer nodes on LinkPath and executes their
+// requests with a LinkHandler. It holds at most MaxLinks links, and at
+// most MaxLinksPerPeer from any one peer; upgrades past either limit are
+// refused.
+type LinkServer struct {
+	handler LinkHandler
+	config  LinkConfig
+
+	links  map[*Link]struct{}
+	open   int            // Links accepted or being upgraded
+	peers  map[string]int // Open links by peer
+	closed bool
+	mu     sync.Mutex
+
+	// Stats
+	accepted atomic.Uint64
+	refused  atomic.Uint64
+}
+
+// NewLinkServer creates a link server
+func NewLinkServer(handler LinkHandler, config *LinkConfig) *LinkServer {
+	return &LinkServer{
+		handler: handler,
+		config:  config.withDefaults(),
+		links:   make(map[*Link]struct{}),
+		peers:   make(map[string]int),
+	}
+}
+
+// ServeHTTP upgrades the request's connection to a link. The connection
+// is taken over from the HTTP server, so it is not affected by the
+// server's timeouts or Shutdown; call Close to close accepted links.
+func (s *LinkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), LinkProtocol) {
+		w.Header().Set("Upgrade", LinkProtocol)
+		http.Error(w, "Link upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		// HTTP/2 connections cannot be taken over
+		http.Error(w, "Link requires HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	peer := linkPeer(r)
+	if !s.acquire(peer) {
+		s.refused.Add(1)
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Too many links", http.StatusServiceUnavailable)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		s.releasePeer(peer)
+		return
+	}
+
+	// Clear the HTTP server's deadlines; the link sets its own
+	conn.SetDeadline(time.Time{})
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: " + LinkProtocol + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		s.releasePeer(peer)
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		s.releasePeer(peer)
+		return
+	}
+	link := newLink(conn, rw.Reader, s.handler, s.config)
+	s.links[link] = struct{}{}
+	s.mu.Unlock()
+	s.accepted.Add(1)
+
+	go func() {
+		<-link.Done()
+		s.releasePeer(peer)
+		s.mu.Lock()
+		delete(s.links, link)
+		s.mu.Unlock()
+	}()
+}
+
+// acquire counts a link from peer if neither link limit is reached
+func (s *LinkServer) acquire(peer string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.open >= s.config.MaxLinks || s.peers[peer] >= s.config.MaxLinksPerPeer {
+		return false
+	}
+	s.open++
+	s.peers[peer]++
+	return true
+}
+
+// releasePeer uncounts a link from peer
+func (s *LinkServer) releasePeer(peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.open--
+	if s.peers[peer]--; s.peers[peer] <= 0 {
+		delete(s.peers, peer)
+	}
+}
+
+// linkPeer names the peer a link request comes from: the node RequirePeer
+// authenticated, or the remote host when the route is not guarded
+func linkPeer(r *http.Request) string {
+	if node, ok := PeerFromContext(r.Context()); ok {
+		return "node:" + node.ID
+	}
+	return RemoteHost(r.RemoteAddr)
+}
+
+// RemoteHost returns the host of a remote address, or the address itself
+// if it has no port
+func RemoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Close closes all accepted links and refuses new ones
+func (s *LinkServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	links := make([]*Link, 0, len(s.links))
+	for link := range s.links {
+		links = append(links, link)
+	}
+	s.mu.Unlock()
+
+	for _, link := range links {
+		link.Close()
+	}
+	return nil
+}
+
+// GetStats returns link server statistics
+func (s *LinkServer) GetStats() LinkServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return LinkServerStats{
+		Open:     len(s.links),
+		Accepted: s.accepted.Load(),
+		Refused:  s.refused.Load(),
+	}
+}
+
+// LinkServerStats contains link server statistics
+type LinkServerStats struct {
+	Open     int    // Links from peers currently open
+	Accepted uint64 // Links accepted since start
+	Refused  uint64 // Upgrades refused at the link limits
+}
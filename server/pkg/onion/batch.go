@@ -0,0 +1,267 @@
+package onion
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// routingBufferSize fits a routing blob extended by the largest per-hop block
+const routingBufferSize = common.RoutingBlobSize + common.PerHopRoutingSize
+
+// routingBuffers recycles the buffers routing blobs are decrypted into
+var routingBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, routingBufferSize)
+		return &buf
+	},
+}
+
+// getRoutingBuffer returns a buffer of size bytes from the pool
+func getRoutingBuffer(size int) []byte {
+	if size > routingBufferSize {
+		return make([]byte, size)
+	}
+	buf := *routingBuffers.Get().(*[]byte)
+	return buf[:size]
+}
+
+// putRoutingBuffer returns a buffer from getRoutingBuffer to the pool.
+// The caller must not use it, or anything aliasing it, afterwards.
+func putRoutingBuffer(buf []byte) {
+	if cap(buf) != routingBufferSize {
+		return
+	}
+	buf = buf[:routingBufferSize]
+	routingBuffers.Put(&buf)
+}
+
+// BatchResult is the outcome of processing one packet of a batch
+type BatchResult struct {
+	Decision *RoutingDecision
+	Err      error
+}
+
+// ProcessBatch processes packets concurrently on up to Workers goroutines
+// and returns one result per packet, in the same order. Each packet is
+// handled exactly as ProcessPacket would, including replay checks.
+func (r *Router) ProcessBatch(packets [][]byte) []BatchResult {
+	results := make([]BatchResult, len(packets))
+
+	workers := min(r.workers, len(packets))
+	if workers <= 1 {
+		for i, packet := range packets {
+			results[i].Decision, results[i].Err = r.ProcessPacket(packet)
+		}
+		return results
+	}
+
+	// Workers claim packets one at a time, so a slow packet does not hold
+	// up a fixed share of the batch
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(packets) {
+					return
+				}
+				results[i].Decision, results[i].Err = r.ProcessPacket(packets[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Workers returns the number of goroutines ProcessBatch uses
+func (r *Router) Workers() int {
+	return r.workers
+}
+
+// Ingress batching defaults
+const (
+	DefaultBatchQueueSize = 1024
+	batchSizePerWorker    = 4 // Largest batch, per ProcessBatch worker
+)
+
+// Batcher errors
+var (
+	ErrBatcherFull   = errors.New("ingress queue full")
+	ErrBatcherClosed = errors.New("ingress batcher closed")
+)
+
+// BatchHandler receives the outcome of a packet submitted to a Batcher
+type BatchHandler func(decision *RoutingDecision, err error)
+
+// Batcher gathers packets that arrive one at a time, from UDP readers and
+// peer link handlers, into batches for ProcessBatch. It never waits for a
+// batch to fill: whatever queued up while the previous batch was processed
+// goes next, so batches grow with load and an idle node adds no latency.
+type Batcher struct {
+	router   *Router
+	maxBatch int
+	queue    chan batchItem
+
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// Stats
+	batches atomic.Uint64
+	packets atomic.Uint64
+	dropped atomic.Uint64
+
+	mu sync.RWMutex
+}
+
+// batchItem is a packet waiting for the next batch
+type batchItem struct {
+	packet []byte
+	handle BatchHandler
+}
+
+// NewBatcher creates a batcher queueing at most queueSize packets
+// (default DefaultBatchQueueSize) and starts its processing loop
+func NewBatcher(router *Router, queueSize int) *Batcher {
+	if queueSize <= 0 {
+		queueSize = DefaultBatchQueueSize
+	}
+
+	b := &Batcher{
+		router:   router,
+		maxBatch: max(router.Workers(), 1) * batchSizePerWorker,
+		queue:    make(chan batchItem, queueSize),
+		done:     make(chan struct{}),
+	}
+
+	b.wg.Add(1)
+	go b.run()
+
+	return b
+}
+
+// Submit queues packet for the next batch; handle is called with its
+// outcome from the processing loop, so it must not block for long.
+// Submit never blocks; ErrBatcherFull is returned when the queue is full.
+func (b *Batcher) Submit(packet []byte, handle BatchHandler) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrBatcherClosed
+	}
+	select {
+	case b.queue <- batchItem{packet: packet, handle: handle}:
+		return nil
+	default:
+		b.dropped.Add(1)
+		return ErrBatcherFull
+	}
+}
+
+// Process submits packet and waits for its outcome
+func (b *Batcher) Process(packet []byte) (*RoutingDecision, error) {
+	result := make(chan BatchResult, 1)
+	err := b.Submit(packet, func(decision *RoutingDecision, err error) {
+		result <- BatchResult{Decision: decision, Err: err}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := <-result
+	return r.Decision, r.Err
+}
+
+// Close stops the processing loop. Packets still queued fail with
+// ErrBatcherClosed.
+func (b *Batcher) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.done)
+	b.mu.Unlock()
+
+	b.wg.Wait()
+}
+
+// GetStats returns batching statistics
+func (b *Batcher) GetStats() BatcherStats {
+	return BatcherStats{
+		Batches: b.batches.Load(),
+		Packets: b.packets.Load(),
+		Dropped: b.dropped.Load(),
+		Queued:  len(b.queue),
+	}
+}
+
+// run processes queued packets in batches until Close
+func (b *Batcher) run() {
+	defer b.wg.Done()
+
+	items := make([]batchItem, 0, b.maxBatch)
+	packets := make([][]byte, 0, b.maxBatch)
+	for {
+		select {
+		case item := <-b.queue:
+			items = append(items[:0], item)
+		case <-b.done:
+			b.failQueued()
+			return
+		}
+
+	fill:
+		for len(items) < b.maxBatch {
+			select {
+			case item := <-b.queue:
+				items = append(items, item)
+			default:
+				break fill
+			}
+		}
+
+		packets = packets[:0]
+		for _, item := range items {
+			packets = append(packets, item.packet)
+		}
+		results := b.router.ProcessBatch(packets)
+		b.batches.Add(1)
+		b.packets.Add(uint64(len(items)))
+
+		for i, item := range items {
+			item.handle(results[i].Decision, results[i].Err)
+			items[i] = batchItem{}
+		}
+	}
+}
+
+// failQueued fails the packets left in the queue after Close; Submit
+// cannot add more once closed is set
+func (b *Batcher) failQueued() {
+	for {
+		select {
+		case item := <-b.queue:
+			item.handle(nil, ErrBatcherClosed)
+		default:
+			return
+		}
+	}
+}
+
+// BatcherStats contains ingress batching statistics
+type BatcherStats struct {
+	Batches uint64 // ProcessBatch calls
+	Packets uint64 // Packets processed in batches
+	Dropped uint64 // Rejected because the queue was full
+	Queued  int    // Packets waiting for a batch
+}
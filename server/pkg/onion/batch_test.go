@@ -0,0 +1,143 @@
+package onion
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+func TestProcessBatch(t *testing.T) {
+	router, entry := newTestHop(t, "node1", "10.0.0.1", 9000)
+	router.workers = 4
+	_, exit := newTestHop(t, "node2", "10.0.0.2", 9001)
+	path := []common.NodeInfo{entry, exit}
+
+	packets := make([][]byte, 32)
+	for i := range packets {
+		packet, err := BuildPacket(path, []byte(fmt.Sprintf("packet %d", i)), nil)
+		if err != nil {
+			t.Fatalf("BuildPacket failed: %v", err)
+		}
+		packets[i] = packet
+	}
+
+	// A replay in the same batch, and a malformed packet
+	batch := append(packets, packets[7], make([]byte, 100))
+
+	results := router.ProcessBatch(batch)
+	if len(results) != len(batch) {
+		t.Fatalf("Results = %d, want %d", len(results), len(batch))
+	}
+
+	// Either copy of packet 7 may win the race
+	replays := 0
+	for i, result := range results[:len(packets)+1] {
+		if result.Err != nil {
+			replays++
+			continue
+		}
+		if result.Decision.Action != ActionForward || result.Decision.NextAddress != "10.0.0.2:9001" {
+			t.Errorf("Packet %d: Action = %v to %q, want ActionForward to 10.0.0.2:9001",
+				i, result.Decision.Action, result.Decision.NextAddress)
+		}
+	}
+	if replays != 1 {
+		t.Errorf("Rejected packets = %d, want exactly the one replay", replays)
+	}
+	if results[len(batch)-1].Err == nil {
+		t.Error("Malformed packet accepted")
+	}
+
+	stats := router.GetStats()
+	if stats.PacketsForwarded != uint64(len(packets)) || stats.PacketsDropped != 1 {
+		t.Errorf("Forwarded = %d, dropped = %d, want %d and 1", stats.PacketsForwarded, stats.PacketsDropped, len(packets))
+	}
+}
+
+func TestProcessBatch_MatchesProcessPacket(t *testing.T) {
+	routers, path := newTestPath(t, 2)
+	routers[0].workers = 8
+
+	packets := make([][]byte, 16)
+	for i := range packets {
+		packet, err := BuildPacket(path, []byte(fmt.Sprintf("payload %d", i)), nil)
+		if err != nil {
+			t.Fatalf("BuildPacket failed: %v", err)
+		}
+		packets[i] = packet
+	}
+
+	// Results keep the batch order and forward packets the exit can open
+	for i, result := range routers[0].ProcessBatch(packets) {
+		if result.Err != nil {
+			t.Fatalf("Packet %d: %v", i, result.Err)
+		}
+		decision, err := routers[1].ProcessPacket(result.Decision.NextPacket)
+		if err != nil {
+			t.Fatalf("Packet %d at exit: %v", i, err)
+		}
+		if !bytes.HasPrefix(decision.Payload, []byte(fmt.Sprintf("payload %d", i))) {
+			t.Errorf("Packet %d: delivered %q", i, decision.Payload[:12])
+		}
+	}
+}
+
+func TestBatcher_ConcurrentSubmitters(t *testing.T) {
+	routers, path := newTestPath(t, 2)
+	routers[0].workers = 4
+	batcher := NewBatcher(routers[0], 0)
+	defer batcher.Close()
+
+	packets := make([][]byte, 64)
+	for i := range packets {
+		packet, err := BuildPacket(path, []byte(fmt.Sprintf("payload %d", i)), nil)
+		if err != nil {
+			t.Fatalf("BuildPacket failed: %v", err)
+		}
+		packets[i] = packet
+	}
+
+	// Each submitter gets the decision for its own packet
+	var wg sync.WaitGroup
+	errs := make(chan error, len(packets))
+	for i, packet := range packets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			decision, err := batcher.Process(packet)
+			if err != nil {
+				errs <- fmt.Errorf("packet %d: %w", i, err)
+				return
+			}
+			delivered, err := routers[1].ProcessPacket(decision.NextPacket)
+			if err != nil || !bytes.HasPrefix(delivered.Payload, []byte(fmt.Sprintf("payload %d", i))) {
+				errs <- fmt.Errorf("packet %d: exit got another packet: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	stats := batcher.GetStats()
+	if stats.Packets != uint64(len(packets)) || stats.Batches == 0 || stats.Batches > stats.Packets {
+		t.Errorf("Packets = %d, batches = %d, want %d packets", stats.Packets, stats.Batches, len(packets))
+	}
+}
+
+func TestBatcher_Close(t *testing.T) {
+	routers, _ := newTestPath(t, 1)
+	batcher := NewBatcher(routers[0], 1)
+	batcher.Close()
+
+	if _, err := batcher.Process(make([]byte, 100)); !errors.Is(err, ErrBatcherClosed) {
+		t.Errorf("Process after Close = %v, want ErrBatcherClosed", err)
+	}
+	batcher.Close()
+}
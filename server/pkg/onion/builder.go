@@ -0,0 +1,443 @@
+package onion
+
+import (
+	"crypto/mlkem"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// MaxPathLength is the number of hops that fit in a version 2 routing blob
+	MaxPathLength = common.RoutingBlobSize / common.PerHopRoutingSizeV2
+
+	// MaxPathLengthV1 is the number of hops that fit in a version 1 routing blob
+	MaxPathLengthV1 = common.RoutingBlobSize / common.PerHopRoutingSize
+
+	// MaxPathLengthV3 is the number of hops that fit in a version 3 routing blob
+	MaxPathLengthV3 = common.RoutingBlobSizeV3 / common.PerHopRoutingSizeV3
+
+	// MaxPayloadSize is the largest plaintext payload a packet can carry
+	MaxPayloadSize = common.PayloadSize - chacha20poly1305.NonceSize - chacha20poly1305.Overhead
+
+	// DefaultPacketTTL is how long a built packet stays valid at each hop
+	DefaultPacketTTL = 5 * time.Minute
+
+	// MaxHopDelay is the longest per-hop delay the routing info can carry
+	MaxHopDelay = 65535 * time.Millisecond
+)
+
+// BuildOptions controls how BuildPacket constructs a packet
+type BuildOptions struct {
+	TTL     time.Duration   // Packet lifetime (default DefaultPacketTTL)
+	Delays  []time.Duration // Per-hop delay applied by path[i] (default none)
+	Version byte            // Packet version (default common.PacketVersion); version 3 needs nodes' KEM keys
+
+	// MeanDelay, when Delays is empty, samples the delay of every hop
+	// but the last from an exponential distribution with this mean (see
+	// ExponentialDelays). Nodes clamp delays into their delay policy.
+	MeanDelay time.Duration
+
+	// RouteByNodeID addresses next hops by identity key (address type
+	// 0x20) instead of IP, so paths survive address changes. Each hop
+	// resolves the next through its directory. Requires version 2 or later.
+	RouteByNodeID bool
+}
+
+// ExponentialDelays samples n per-hop delays from an exponential
+// distribution with the given mean, capped at maxDelay. Exponential
+// delays are memoryless: how long a packet has already waited at a hop
+// says nothing about when it will leave, which makes packets harder to
+// match across a mixing node.
+func ExponentialDelays(n int, mean, maxDelay time.Duration) []time.Duration {
+	rng := newMixRand()
+	delays := make([]time.Duration, n)
+	for i := range delays {
+		delays[i] = min(time.Duration(rng.ExpFloat64()*float64(mean)), maxDelay)
+	}
+	return delays
+}
+
+// hopState holds what the sender shares with one hop of the path
+type hopState struct {
+	ephemeralKey  []byte
+	kemCiphertext []byte // Version 3 only
+	encKey        []byte
+	hmacKey       []byte
+}
+
+// BuildPacket builds an onion packet that routes payload along path.
+// The last node in path delivers the payload; every other node forwards to
+// the next one. Payloads shorter than MaxPayloadSize are zero-padded.
+func BuildPacket(path []common.NodeInfo, payload []byte, opts *BuildOptions) ([]byte, error) {
+	if len(payload) > MaxPayloadSize {
+		return nil, fmt.Errorf("payload too large: %d > %d", len(payload), MaxPayloadSize)
+	}
+
+	header, hops, err := buildHeader(path, opts, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedPayload, err := encryptPayload(hops[len(hops)-1].encKey, payload)
+	if err != nil {
+		return nil, fmt.Errorf("payload encryption failed: %w", err)
+	}
+
+	// Add the layer each hop peels, so the payload differs on every link
+	format, _ := lookupFormat(header[0])
+	if format.layeredPayload {
+		for _, hop := range hops {
+			if err := xorPayloadStream(hop.encKey, encryptedPayload); err != nil {
+				return nil, fmt.Errorf("payload encryption failed: %w", err)
+			}
+		}
+	}
+
+	packet := make([]byte, format.packetSize)
+	copy(packet, header)
+	copy(packet[format.payloadOffset():], encryptedPayload)
+
+	return packet, nil
+}
+
+// BuildDummyPacket builds a link padding packet for neighbor. It is a
+// single-hop packet with a valid header, so only neighbor can tell it from
+// a forwarded packet, and it discards it.
+func BuildDummyPacket(neighbor common.NodeInfo) ([]byte, error) {
+	header, _, err := buildHeader([]common.NodeInfo{neighbor}, nil, common.RoutingFlagDummy, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	packet := make([]byte, common.PacketSize)
+	copy(packet, header)
+	if _, err := rand.Read(packet[680:]); err != nil {
+		return nil, fmt.Errorf("padding generation failed: %w", err)
+	}
+
+	return packet, nil
+}
+
+// buildHeader builds the packet header (version, ephemeral key, HMAC, KEM
+// ciphertext in version 3, and routing blob) for path. flags are set in
+// every hop's routing info and surbID, if any, in the final hop's.
+func buildHeader(path []common.NodeInfo, opts *BuildOptions, flags byte, surbID []byte) ([]byte, []hopState, error) {
+	if opts == nil {
+		opts = &BuildOptions{}
+	}
+	version := opts.Version
+	if version == 0 {
+		version = common.PacketVersion
+	}
+	format, err := lookupFormat(version)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(path) == 0 || len(path) > format.maxHops {
+		return nil, nil, fmt.Errorf("path length must be 1-%d, got %d", format.maxHops, len(path))
+	}
+	if opts.RouteByNodeID && format == formatV1 {
+		return nil, nil, errors.New("node ID addressing requires packet version 2 or later")
+	}
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = DefaultPacketTTL
+	}
+
+	hops, err := deriveHopStates(path, format)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	delays := opts.Delays
+	if len(delays) == 0 && opts.MeanDelay > 0 {
+		delays = ExponentialDelays(len(path)-1, opts.MeanDelay, MaxHopDelay)
+	}
+	for _, delay := range delays {
+		if delay < 0 || delay > MaxHopDelay {
+			return nil, nil, fmt.Errorf("hop delay must be 0-%v, got %v", MaxHopDelay, delay)
+		}
+	}
+
+	// Collect per-hop routing info
+	expiry := time.Now().Add(ttl)
+	routings := make([]*common.RoutingInfo, len(path))
+	for i := range path {
+		routing := &common.RoutingInfo{
+			AddressType: 0x00,
+			Expiry:      expiry,
+			Flags:       flags,
+		}
+		if i < len(delays) {
+			routing.Delay = uint16(delays[i] / time.Millisecond)
+		}
+		if i < len(path)-1 && opts.RouteByNodeID {
+			if err := setNextHopNodeID(routing, &path[i+1]); err != nil {
+				return nil, nil, err
+			}
+		} else if i < len(path)-1 {
+			if err := setNextHopAddress(routing, &path[i+1]); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			routing.SURBID = surbID
+		}
+		routings[i] = routing
+	}
+
+	routingBlob, headerHMAC, err := buildRoutingBlob(format, hops, routings)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, format.payloadOffset())
+	header[0] = format.version
+	copy(header[1:33], hops[0].ephemeralKey)
+	copy(header[33:65], headerHMAC)
+	copy(header[common.HeaderSize:], hops[0].kemCiphertext)
+	copy(header[format.blobOffset():], routingBlob)
+
+	return header, hops, nil
+}
+
+// deriveHopStates performs the per-hop ECDH and key derivation for path,
+// blinding the ephemeral key between hops the same way Router does. For
+// version 3 each hop's secret also includes an ML-KEM encapsulation to the
+// node's KEM key.
+func deriveHopStates(path []common.NodeInfo, format *headerFormat) ([]hopState, error) {
+	ephemeralPub, ephemeralPriv, err := common.X25519KeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("ephemeral key generation failed: %w", err)
+	}
+
+	// Work with the scalar so it can be blinded mod l between hops
+	ephemeralScalar, err := common.X25519PrivateKeyToScalar(ephemeralPriv)
+	if err != nil {
+		return nil, err
+	}
+
+	hops := make([]hopState, len(path))
+	for i := range path {
+		onionKey, err := nodeOnionKey(&path[i])
+		if err != nil {
+			return nil, err
+		}
+
+		sharedSecret, err := common.ScalarMult(ephemeralScalar, onionKey)
+		if err != nil {
+			return nil, fmt.Errorf("ECDH with node %s failed: %w", path[i].ID, err)
+		}
+
+		var kemCiphertext []byte
+		if format.kemSize > 0 {
+			kemKey, err := nodeKEMKey(&path[i])
+			if err != nil {
+				return nil, err
+			}
+			var kemSecret []byte
+			kemSecret, kemCiphertext = kemKey.Encapsulate()
+			sharedSecret = common.HybridSecret(sharedSecret, kemSecret, kemCiphertext, ephemeralPub)
+		}
+
+		encKey, hmacKey, blindingFactor, err := common.DeriveKeys(sharedSecret, format.keyInfo)
+		if err != nil {
+			return nil, fmt.Errorf("key derivation failed: %w", err)
+		}
+
+		hops[i] = hopState{
+			ephemeralKey:  ephemeralPub,
+			kemCiphertext: kemCiphertext,
+			encKey:        encKey,
+			hmacKey:       hmacKey,
+		}
+
+		if ephemeralScalar, err = common.BlindPrivateKey(ephemeralScalar, blindingFactor); err != nil {
+			return nil, fmt.Errorf("key blinding failed: %w", err)
+		}
+		if ephemeralPub, err = common.BlindPublicKey(ephemeralPub, blindingFactor); err != nil {
+			return nil, fmt.Errorf("key blinding failed: %w", err)
+		}
+	}
+
+	return hops, nil
+}
+
+// buildRoutingBlob nests the routing infos from the last hop outwards and
+// returns the outermost blob with the HMAC the first hop will verify
+func buildRoutingBlob(format *headerFormat, hops []hopState, routings []*common.RoutingInfo) ([]byte, []byte, error) {
+	blobSize := format.blobSize
+	hopSize := format.hopSize
+	n := len(hops)
+
+	// Keystreams cover the blob plus the zero bytes each hop appends
+	streams := make([][]byte, n)
+	for i, hop := range hops {
+		streams[i] = make([]byte, blobSize+hopSize)
+		if err := xorRoutingStream(hop.encKey, streams[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Filler reproduces the tail each hop generates when it shifts the blob
+	filler := make([]byte, 0, (n-1)*hopSize)
+	for i := 0; i < n-1; i++ {
+		filler = append(filler, make([]byte, hopSize)...)
+		stream := streams[i][blobSize+hopSize-len(filler):]
+		for j := range filler {
+			filler[j] ^= stream[j]
+		}
+	}
+
+	// Innermost layer: final routing info, random padding, then the filler.
+	// Random padding keeps the final hop from learning the path length.
+	blob := make([]byte, blobSize)
+	head := blobSize - len(filler)
+	if _, err := rand.Read(blob[:head]); err != nil {
+		return nil, nil, err
+	}
+	final := format.encode(routings[n-1])
+	for j := range final {
+		blob[j] = final[j] ^ streams[n-1][j]
+	}
+	copy(blob[head:], filler)
+	mac := headerMAC(hops[n-1].hmacKey, hops[n-1].ephemeralKey, hops[n-1].kemCiphertext, blob)
+
+	for i := n - 2; i >= 0; i-- {
+		// Embed the next hop's HMAC (and KEM ciphertext) so we can hand it
+		// on unchanged
+		routings[i].HMAC = mac
+		routings[i].KEMCiphertext = hops[i+1].kemCiphertext
+
+		next := make([]byte, blobSize)
+		copy(next, format.encode(routings[i]))
+		copy(next[hopSize:], blob[:blobSize-hopSize])
+		for j := range next {
+			next[j] ^= streams[i][j]
+		}
+		blob = next
+		mac = headerMAC(hops[i].hmacKey, hops[i].ephemeralKey, hops[i].kemCiphertext, blob)
+	}
+
+	return blob, mac, nil
+}
+
+// encodeRoutingInfo serializes routing info into a version 1 per-hop block, the inverse of parseRoutingInfo
+func encodeRoutingInfo(routing *common.RoutingInfo) []byte {
+	data := make([]byte, common.PerHopRoutingSize)
+	data[0] = routing.AddressType
+	copy(data[1:17], routing.Address)
+	binary.BigEndian.PutUint16(data[17:19], routing.Port)
+	binary.BigEndian.PutUint64(data[19:27], uint64(routing.Expiry.Unix()))
+	binary.BigEndian.PutUint16(data[27:29], routing.Delay)
+	copy(data[29:61], routing.HMAC)
+	data[61] = routing.Flags
+	copy(data[62:62+common.SURBIDSize], routing.SURBID)
+	return data
+}
+
+// setNextHopAddress fills in the address fields pointing at node
+func setNextHopAddress(routing *common.RoutingInfo, node *common.NodeInfo) error {
+	ip := net.ParseIP(node.Address)
+	if ip == nil {
+		return fmt.Errorf("node %s address %q is not an IP address", node.ID, node.Address)
+	}
+
+	if ipv4 := ip.To4(); ipv4 != nil {
+		routing.AddressType = 0x04
+		routing.Address = ipv4
+	} else {
+		routing.AddressType = 0x06
+		routing.Address = ip.To16()
+	}
+	routing.Port = node.Port
+
+	return nil
+}
+
+// setNextHopNodeID addresses the next hop by its identity key
+func setNextHopNodeID(routing *common.RoutingInfo, node *common.NodeInfo) error {
+	if len(node.PublicKey) != v2AddressSize {
+		return fmt.Errorf("node %s has no identity key", node.ID)
+	}
+
+	routing.AddressType = 0x20
+	routing.Address = node.PublicKey
+
+	return nil
+}
+
+// nodeOnionKey returns the X25519 key used to onion-encrypt to node.
+// A published onion key must be signed by the identity key for an epoch
+// within one of the current one; only without a published onion key is it
+// derived from the node's identity key.
+func nodeOnionKey(node *common.NodeInfo) ([]byte, error) {
+	if len(node.OnionKey) > 0 {
+		if err := common.VerifyOnionKey(node); err != nil {
+			return nil, fmt.Errorf("node %s: %w", node.ID, err)
+		}
+		if err := common.CheckOnionKeyEpoch(node, time.Now()); err != nil {
+			return nil, fmt.Errorf("node %s: %w", node.ID, err)
+		}
+		return node.OnionKey, nil
+	}
+	if len(node.PublicKey) == 0 {
+		return nil, fmt.Errorf("node %s has no onion key", node.ID)
+	}
+
+	onionKey, err := common.Ed25519PublicKeyToCurve25519(node.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("node %s: %w", node.ID, err)
+	}
+	return onionKey, nil
+}
+
+// nodeKEMKey returns the ML-KEM-768 key used to encapsulate to node in
+// version 3 packets. It must be signed by the identity key: an unsigned
+// key could be anyone's, and would void the post-quantum protection.
+func nodeKEMKey(node *common.NodeInfo) (*mlkem.EncapsulationKey768, error) {
+	if len(node.KEMKey) == 0 {
+		return nil, fmt.Errorf("node %s has no KEM key", node.ID)
+	}
+	if len(node.KEMKeySignature) == 0 {
+		return nil, fmt.Errorf("node %s: KEM key is not signed", node.ID)
+	}
+	if err := common.VerifyKEMKey(node); err != nil {
+		return nil, fmt.Errorf("node %s: %w", node.ID, err)
+	}
+
+	key, err := mlkem.NewEncapsulationKey768(node.KEMKey)
+	if err != nil {
+		return nil, fmt.Errorf("node %s: invalid KEM key: %w", node.ID, err)
+	}
+	return key, nil
+}
+
+// encryptPayload pads payload and seals it for the final hop
+func encryptPayload(key, payload []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, MaxPayloadSize)
+	copy(plaintext, payload)
+
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	if len(sealed) != common.PayloadSize {
+		return nil, errors.New("unexpected payload size")
+	}
+
+	return sealed, nil
+}
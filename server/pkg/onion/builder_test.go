@@ -0,0 +1,486 @@
+package onion
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// newTestHop creates a router and the directory entry senders would see for it
+func newTestHop(t testing.TB, id, address string, port uint16) (*Router, common.NodeInfo) {
+	t.Helper()
+
+	pub, priv, err := common.GenerateKeypair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+
+	router := NewRouter(priv)
+	node := common.NodeInfo{
+		ID:        id,
+		PublicKey: pub,
+		Address:   address,
+		Port:      port,
+	}
+	router.Publish(&node)
+
+	return router, node
+}
+
+func TestBuildPacket_SingleHop(t *testing.T) {
+	router, node := newTestHop(t, "node1", "10.0.0.1", 9000)
+
+	payload := []byte("hello through the onion")
+	packet, err := BuildPacket([]common.NodeInfo{node}, payload, &BuildOptions{
+		Delays: []time.Duration{250 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	if len(packet) != common.PacketSize {
+		t.Fatalf("Packet size = %d, want %d", len(packet), common.PacketSize)
+	}
+
+	decision, err := router.ProcessPacket(packet)
+	if err != nil {
+		t.Fatalf("ProcessPacket failed: %v", err)
+	}
+
+	if decision.Action != ActionDeliver {
+		t.Fatalf("Action = %v, want ActionDeliver", decision.Action)
+	}
+
+	if len(decision.Payload) != MaxPayloadSize {
+		t.Errorf("Payload length = %d, want %d", len(decision.Payload), MaxPayloadSize)
+	}
+
+	if !bytes.Equal(decision.Payload[:len(payload)], payload) {
+		t.Errorf("Payload = %q, want prefix %q", decision.Payload[:len(payload)], payload)
+	}
+
+	if decision.Delay != 250*time.Millisecond {
+		t.Errorf("Delay = %v, want 250ms", decision.Delay)
+	}
+}
+
+func TestBuildPacket_FirstHopForwards(t *testing.T) {
+	router1, node1 := newTestHop(t, "node1", "10.0.0.1", 9000)
+	_, node2 := newTestHop(t, "node2", "10.0.0.2", 9001)
+	_, node3 := newTestHop(t, "node3", "2001:db8::3", 9002)
+
+	packet, err := BuildPacket([]common.NodeInfo{node1, node2, node3}, []byte("payload"), &BuildOptions{
+		Delays: []time.Duration{100 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	decision, err := router1.ProcessPacket(packet)
+	if err != nil {
+		t.Fatalf("ProcessPacket failed: %v", err)
+	}
+
+	if decision.Action != ActionForward {
+		t.Fatalf("Action = %v, want ActionForward", decision.Action)
+	}
+
+	if decision.NextAddress != "10.0.0.2:9001" {
+		t.Errorf("NextAddress = %q, want %q", decision.NextAddress, "10.0.0.2:9001")
+	}
+
+	if decision.Delay != 100*time.Millisecond {
+		t.Errorf("Delay = %v, want 100ms", decision.Delay)
+	}
+
+	if len(decision.NextPacket) != common.PacketSize {
+		t.Fatalf("Next packet size = %d, want %d", len(decision.NextPacket), common.PacketSize)
+	}
+
+	// Each hop peels a payload layer, so the payload differs on every link
+	if bytes.Equal(decision.NextPacket[680:], packet[680:]) {
+		t.Error("Payload unchanged while forwarding")
+	}
+}
+
+func TestBuildPacket_ThreeHopRoundTrip(t *testing.T) {
+	router1, node1 := newTestHop(t, "node1", "10.0.0.1", 9000)
+	router2, node2 := newTestHop(t, "node2", "10.0.0.2", 9001)
+	router3, node3 := newTestHop(t, "node3", "10.0.0.3", 9002)
+
+	payload := []byte("three hops later")
+	packet, err := BuildPacket([]common.NodeInfo{node1, node2, node3}, payload, nil)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	hops := []struct {
+		router      *Router
+		nextAddress string
+	}{
+		{router1, "10.0.0.2:9001"},
+		{router2, "10.0.0.3:9002"},
+	}
+
+	seenKeys := map[string]bool{string(packet[1:33]): true}
+	for i, hop := range hops {
+		decision, err := hop.router.ProcessPacket(packet)
+		if err != nil {
+			t.Fatalf("Hop %d: ProcessPacket failed: %v", i+1, err)
+		}
+		if decision.Action != ActionForward {
+			t.Fatalf("Hop %d: Action = %v, want ActionForward", i+1, decision.Action)
+		}
+		if decision.NextAddress != hop.nextAddress {
+			t.Errorf("Hop %d: NextAddress = %q, want %q", i+1, decision.NextAddress, hop.nextAddress)
+		}
+
+		// Blinding must give every hop a fresh ephemeral key
+		packet = decision.NextPacket
+		key := string(packet[1:33])
+		if seenKeys[key] {
+			t.Errorf("Hop %d: ephemeral key reused", i+1)
+		}
+		seenKeys[key] = true
+	}
+
+	decision, err := router3.ProcessPacket(packet)
+	if err != nil {
+		t.Fatalf("Hop 3: ProcessPacket failed: %v", err)
+	}
+	if decision.Action != ActionDeliver {
+		t.Fatalf("Hop 3: Action = %v, want ActionDeliver", decision.Action)
+	}
+	if !bytes.Equal(decision.Payload[:len(payload)], payload) {
+		t.Errorf("Payload = %q, want prefix %q", decision.Payload[:len(payload)], payload)
+	}
+}
+
+func TestBuildPacket_IdentityKeyOnly(t *testing.T) {
+	router1, node1 := newTestHop(t, "node1", "10.0.0.1", 9000)
+	router2, node2 := newTestHop(t, "node2", "10.0.0.2", 9001)
+
+	// Directory entries only carry the Ed25519 identity key
+	node1.OnionKey = nil
+	node2.OnionKey = nil
+
+	packet, err := BuildPacket([]common.NodeInfo{node1, node2}, []byte("payload"), nil)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	decision, err := router1.ProcessPacket(packet)
+	if err != nil {
+		t.Fatalf("Hop 1: ProcessPacket failed: %v", err)
+	}
+
+	decision, err = router2.ProcessPacket(decision.NextPacket)
+	if err != nil {
+		t.Fatalf("Hop 2: ProcessPacket failed: %v", err)
+	}
+	if decision.Action != ActionDeliver {
+		t.Errorf("Hop 2: Action = %v, want ActionDeliver", decision.Action)
+	}
+}
+
+func TestBuildPacket_BadOnionKeySignature(t *testing.T) {
+	_, _, node := newKeyRingHop(t, time.Hour)
+
+	// A directory entry whose onion key was swapped after signing
+	node.OnionKey = bytes.Repeat([]byte{0x09}, 32)
+
+	if _, err := BuildPacket([]common.NodeInfo{node}, []byte("payload"), nil); err == nil {
+		t.Error("Expected error for onion key with bad signature, got nil")
+	}
+}
+
+func TestBuildPacket_UnsignedOnionKey(t *testing.T) {
+	_, _, node := newKeyRingHop(t, time.Hour)
+
+	// Without a signature the key could be anyone's
+	node.OnionKeySignature = nil
+
+	if _, err := BuildPacket([]common.NodeInfo{node}, []byte("payload"), nil); err == nil {
+		t.Error("Expected error for unsigned onion key, got nil")
+	}
+}
+
+func TestBuildPacket_StaleOnionKey(t *testing.T) {
+	pub, priv, _ := common.GenerateKeypair()
+	onionKey, _, err := common.X25519KeyPair()
+	if err != nil {
+		t.Fatalf("X25519KeyPair failed: %v", err)
+	}
+
+	// A validly signed key from two epochs ago, long wiped by the node
+	epoch := uint64(time.Now().Unix())/3600 - 2
+	node := common.NodeInfo{
+		ID:                "node1",
+		PublicKey:         pub,
+		OnionKey:          onionKey,
+		OnionKeyEpoch:     epoch,
+		OnionKeyEpochSecs: 3600,
+		OnionKeySignature: common.SignOnionKey(priv, epoch, 3600, onionKey),
+		Address:           "10.0.0.1",
+		Port:              9000,
+	}
+
+	if _, err := BuildPacket([]common.NodeInfo{node}, []byte("payload"), nil); err == nil {
+		t.Error("Expected error for stale onion key, got nil")
+	}
+}
+
+func TestBuildPacket_TamperedRoutingBlob(t *testing.T) {
+	router, node := newTestHop(t, "node1", "10.0.0.1", 9000)
+
+	packet, err := BuildPacket([]common.NodeInfo{node}, []byte("payload"), nil)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	packet[100] ^= 0x01
+
+	if _, err := router.ProcessPacket(packet); err == nil {
+		t.Error("Expected error for tampered routing blob, got nil")
+	}
+}
+
+func TestBuildPacket_Expiry(t *testing.T) {
+	router, node := newTestHop(t, "node1", "10.0.0.1", 9000)
+
+	packet, err := BuildPacket([]common.NodeInfo{node}, []byte("payload"), &BuildOptions{
+		TTL: -time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	if _, err := router.ProcessPacket(packet); err == nil {
+		t.Error("Expected error for expired packet, got nil")
+	}
+}
+
+func TestBuildPacket_InvalidInput(t *testing.T) {
+	_, node := newTestHop(t, "node1", "10.0.0.1", 9000)
+
+	noKey := node
+	noKey.OnionKey = nil
+	noKey.PublicKey = nil
+
+	badIdentity := node
+	badIdentity.OnionKey = nil
+	badIdentity.PublicKey = make([]byte, 31)
+
+	hostname := node
+	hostname.Address = "node1.ghostnodes.network"
+
+	testCases := []struct {
+		name    string
+		path    []common.NodeInfo
+		payload []byte
+	}{
+		{"empty path", nil, []byte("payload")},
+		{"path too long", []common.NodeInfo{node, node, node, node, node, node}, []byte("payload")},
+		{"payload too large", []common.NodeInfo{node}, make([]byte, MaxPayloadSize+1)},
+		{"missing onion key", []common.NodeInfo{noKey}, []byte("payload")},
+		{"invalid identity key", []common.NodeInfo{badIdentity}, []byte("payload")},
+		{"hostname next hop", []common.NodeInfo{node, hostname}, []byte("payload")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := BuildPacket(tc.path, tc.payload, nil); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestEncodeRoutingInfo(t *testing.T) {
+	router, _ := newTestHop(t, "node1", "10.0.0.1", 9000)
+
+	expiry := time.Now().Add(time.Minute).Truncate(time.Second)
+	original := &common.RoutingInfo{
+		AddressType: 0x04,
+		Address:     []byte{192, 168, 1, 1},
+		Port:        8080,
+		Expiry:      expiry,
+		Delay:       1500,
+		HMAC:        bytes.Repeat([]byte{0xAB}, 32),
+	}
+
+	encoded := encodeRoutingInfo(original)
+	if len(encoded) != common.PerHopRoutingSize {
+		t.Fatalf("Encoded length = %d, want %d", len(encoded), common.PerHopRoutingSize)
+	}
+
+	parsed, err := router.parseRoutingInfo(encoded)
+	if err != nil {
+		t.Fatalf("Failed to parse routing info: %v", err)
+	}
+
+	if !bytes.Equal(parsed.Address, original.Address) || parsed.Port != original.Port {
+		t.Errorf("Address = %v:%d, want %v:%d", parsed.Address, parsed.Port, original.Address, original.Port)
+	}
+
+	if !parsed.Expiry.Equal(expiry) {
+		t.Errorf("Expiry = %v, want %v", parsed.Expiry, expiry)
+	}
+
+	if parsed.Delay != original.Delay {
+		t.Errorf("Delay = %d, want %d", parsed.Delay, original.Delay)
+	}
+
+	if !bytes.Equal(parsed.HMAC, original.HMAC) {
+		t.Error("HMAC mismatch after round trip")
+	}
+}
+
+func TestBuildPacket_PayloadDiffersOnEveryLink(t *testing.T) {
+	routers, path := newTestPath(t, MaxPathLength)
+
+	packet, err := BuildPacket(path, []byte("unlinkable"), nil)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	seen := [][]byte{packet[680:]}
+	for i, router := range routers[:len(routers)-1] {
+		decision, err := router.ProcessPacket(packet)
+		if err != nil {
+			t.Fatalf("Hop %d: ProcessPacket failed: %v", i+1, err)
+		}
+		packet = decision.NextPacket
+
+		payload := packet[680:]
+		if len(payload) != common.PayloadSize {
+			t.Fatalf("Hop %d: payload length = %d, want %d", i+1, len(payload), common.PayloadSize)
+		}
+		for j, earlier := range seen {
+			if bytes.Equal(payload, earlier) {
+				t.Errorf("Payload after hop %d matches link %d", i+1, j)
+			}
+		}
+		seen = append(seen, payload)
+	}
+
+	decision, err := routers[len(routers)-1].ProcessPacket(packet)
+	if err != nil {
+		t.Fatalf("Final hop: ProcessPacket failed: %v", err)
+	}
+	if !bytes.HasPrefix(decision.Payload, []byte("unlinkable")) {
+		t.Errorf("Payload = %q, want prefix %q", decision.Payload[:10], "unlinkable")
+	}
+}
+
+func TestBuildPacket_TamperedPayloadLayer(t *testing.T) {
+	routers, path := newTestPath(t, 2)
+
+	packet, err := BuildPacket(path, []byte("payload"), nil)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	decision, err := routers[0].ProcessPacket(packet)
+	if err != nil {
+		t.Fatalf("Hop 1: ProcessPacket failed: %v", err)
+	}
+	decision.NextPacket[700] ^= 0x01
+
+	if _, err := routers[1].ProcessPacket(decision.NextPacket); err == nil {
+		t.Error("Expected error for payload tampered between hops, got nil")
+	}
+}
+
+func TestBuildDummyPacket(t *testing.T) {
+	router, node := newTestHop(t, "node1", "10.0.0.1", 9000)
+
+	packet, err := BuildDummyPacket(node)
+	if err != nil {
+		t.Fatalf("BuildDummyPacket failed: %v", err)
+	}
+	if len(packet) != common.PacketSize {
+		t.Fatalf("Packet size = %d, want %d", len(packet), common.PacketSize)
+	}
+
+	for i := 0; i < 2; i++ {
+		decision, err := router.ProcessPacket(packet)
+		if err != nil {
+			t.Fatalf("ProcessPacket failed: %v", err)
+		}
+		if decision.Action != ActionDrop {
+			t.Fatalf("Action = %v, want ActionDrop", decision.Action)
+		}
+	}
+
+	// Dummies are discarded before the replay check, so resending one is
+	// not a replay and the filter does not record it
+	if checks := router.ReplayStats().Checks; checks != 0 {
+		t.Errorf("Replay checks = %d, want 0", checks)
+	}
+	if dummies := router.GetStats().PacketsDummy; dummies != 2 {
+		t.Errorf("Dummy packets = %d, want 2", dummies)
+	}
+
+	// Any other node rejects it
+	other, _ := newTestHop(t, "node2", "10.0.0.2", 9000)
+	if _, err := other.ProcessPacket(packet); err == nil {
+		t.Error("Expected error for dummy packet at another node, got nil")
+	}
+}
+
+func TestExponentialDelays(t *testing.T) {
+	const n = 2000
+	delays := ExponentialDelays(n, 100*time.Millisecond, 300*time.Millisecond)
+	if len(delays) != n {
+		t.Fatalf("Delays = %d, want %d", len(delays), n)
+	}
+
+	var total time.Duration
+	capped := 0
+	for _, delay := range delays {
+		if delay < 0 || delay > 300*time.Millisecond {
+			t.Fatalf("Delay %v outside 0-300ms", delay)
+		}
+		if delay == 300*time.Millisecond {
+			capped++
+		}
+		total += delay
+	}
+
+	// About e^-3 of the samples exceed three means; the cap lowers the mean slightly
+	if mean := total / n; mean < 80*time.Millisecond || mean > 110*time.Millisecond {
+		t.Errorf("Mean delay = %v, want about 95ms", mean)
+	}
+	if capped == 0 || capped > n/10 {
+		t.Errorf("Capped delays = %d, want about %d", capped, n/20)
+	}
+}
+
+func TestBuildPacket_MeanDelay(t *testing.T) {
+	router1, node1 := newTestHop(t, "node1", "10.0.0.1", 9000)
+	_, node2 := newTestHop(t, "node2", "10.0.0.2", 9000)
+
+	packet, err := BuildPacket([]common.NodeInfo{node1, node2}, []byte("payload"), &BuildOptions{
+		MeanDelay: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+	decision, err := router1.ProcessPacket(packet)
+	if err != nil {
+		t.Fatalf("ProcessPacket failed: %v", err)
+	}
+	if decision.Delay > MaxHopDelay || decision.Delay%time.Millisecond != 0 {
+		t.Errorf("Delay = %v, want whole milliseconds up to %v", decision.Delay, MaxHopDelay)
+	}
+
+	// Delays the routing info cannot carry are refused
+	for _, delay := range []time.Duration{-time.Millisecond, MaxHopDelay + time.Millisecond} {
+		if _, err := BuildPacket([]common.NodeInfo{node1}, nil, &BuildOptions{Delays: []time.Duration{delay}}); err == nil {
+			t.Errorf("Delay %v: expected error, got nil", delay)
+		}
+	}
+}
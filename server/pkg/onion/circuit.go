@@ -0,0 +1,608 @@
+package onion
+
+import (
+	"crypto/ed25519"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Circuit mode trades some unlinkability for latency. A client builds a
+// circuit once, hop by hop (telescoping): the first hop with a create
+// cell, every further hop with an extend cell relayed through the hops
+// before it. Each handshake leaves the client and the hop with symmetric
+// keys, and the hop with an entry in its circuit table. Relay cells along
+// the circuit then cost every hop one ChaCha20 layer and one HMAC, with no
+// public-key operation.
+//
+// Cells are sent synchronously like onion requests: every hop relays a
+// cell and waits for the answer, which comes back layered the same way.
+//
+// A hop only accepts cells for a circuit from the previous hop that
+// created it, so anyone else who learns a circuit ID can neither destroy
+// the circuit nor desynchronize its counters with junk relay cells.
+
+// CircuitIDSize is the size of a circuit ID. IDs are chosen at random by
+// the previous hop (the client for the first hop) and differ on every link.
+const CircuitIDSize = 16
+
+// CircuitID identifies a circuit on one link
+type CircuitID [CircuitIDSize]byte
+
+// Cell commands
+const (
+	CellCreate  byte = 0x01 // Open a circuit: client ephemeral key (32), auth (32)
+	CellRelay   byte = 0x02 // Layered relay cell along an open circuit
+	CellDestroy byte = 0x03 // Close the circuit; passed on to the next hop
+)
+
+// Relay commands, readable only by the hop a relay cell is for
+const (
+	relayExtend   byte = 0x01 // Next hop identity key (32), create body
+	relayExtended byte = 0x02 // The next hop's created body
+	relayRequest  byte = 0x03 // Encoded Request
+	relayResponse byte = 0x04 // Encoded Response
+)
+
+// Cell layout:
+//
+//	0     command
+//	1:17  circuit ID
+//	17:   body
+const cellHeaderSize = 1 + CircuitIDSize
+
+const (
+	createSize     = 64 // Client ephemeral key and auth
+	createdSize    = 64 // Node ephemeral key and key confirmation
+	cellDigestSize = 16 // Truncated HMAC marking the hop a relay cell is for
+)
+
+// Circuit table defaults
+const (
+	DefaultCircuitIdleTimeout = 10 * time.Minute
+	DefaultMaxCircuits        = 10000
+)
+
+// CircuitConfig holds circuit table configuration
+type CircuitConfig struct {
+	IdleTimeout time.Duration // Circuits without a cell for this long are closed (default 10m)
+	MaxCircuits int           // Open circuits; further create cells are refused (default 10000)
+}
+
+// CircuitTable holds the circuits open at a node, by the previous hop and
+// the circuit ID of the link they arrive on. Circuits idle for
+// IdleTimeout are closed.
+type CircuitTable struct {
+	config   CircuitConfig
+	circuits map[circuitKey]*circuit
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// Stats
+	created   atomic.Uint64
+	refused   atomic.Uint64
+	expired   atomic.Uint64
+	destroyed atomic.Uint64
+	cells     atomic.Uint64
+
+	mu sync.Mutex
+}
+
+// circuitKey identifies a circuit by the previous hop it was created by
+// and its ID on that link
+type circuitKey struct {
+	from string
+	id   CircuitID
+}
+
+// circuit is one hop's state for a circuit
+type circuit struct {
+	keys     *circuitKeys
+	lastUsed time.Time // Guarded by CircuitTable.mu
+
+	counter uint64    // Relay cells seen, the nonce of the next one
+	next    string    // Next hop address; empty until the circuit is extended
+	nextID  CircuitID // Circuit ID on the link to the next hop
+	mu      sync.Mutex
+}
+
+// circuitKeys are the symmetric keys a client shares with one hop
+type circuitKeys struct {
+	forwardKey  []byte // Layer on cells towards the last hop
+	backwardKey []byte // Layer on answers towards the client
+	forwardMAC  []byte // Digest of relay cells for this hop
+	backwardMAC []byte // Digest of answers from this hop
+}
+
+// NewCircuitTable creates a circuit table and starts closing idle circuits
+func NewCircuitTable(config *CircuitConfig) *CircuitTable {
+	cfg := CircuitConfig{}
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultCircuitIdleTimeout
+	}
+	if cfg.MaxCircuits <= 0 {
+		cfg.MaxCircuits = DefaultMaxCircuits
+	}
+
+	t := &CircuitTable{
+		config:   cfg,
+		circuits: make(map[circuitKey]*circuit),
+		done:     make(chan struct{}),
+	}
+
+	t.wg.Add(1)
+	go t.expireLoop()
+
+	return t
+}
+
+// Close stops expiring circuits
+func (t *CircuitTable) Close() {
+	select {
+	case <-t.done:
+		return
+	default:
+		close(t.done)
+	}
+	t.wg.Wait()
+}
+
+// GetStats returns circuit table statistics
+func (t *CircuitTable) GetStats() CircuitStats {
+	t.mu.Lock()
+	open := len(t.circuits)
+	t.mu.Unlock()
+
+	return CircuitStats{
+		Open:      open,
+		Created:   t.created.Load(),
+		Refused:   t.refused.Load(),
+		Expired:   t.expired.Load(),
+		Destroyed: t.destroyed.Load(),
+		Cells:     t.cells.Load(),
+	}
+}
+
+// CircuitStats contains circuit table statistics
+type CircuitStats struct {
+	Open      int    // Circuits open
+	Created   uint64 // Circuits created
+	Refused   uint64 // Create cells refused because the table was full
+	Expired   uint64 // Circuits closed after the idle timeout
+	Destroyed uint64 // Circuits closed by a destroy cell or an error
+	Cells     uint64 // Relay cells processed
+}
+
+// add opens a circuit under key
+func (t *CircuitTable) add(key circuitKey, c *circuit, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.circuits[key]; ok {
+		return errors.New("circuit ID in use")
+	}
+	if len(t.circuits) >= t.config.MaxCircuits {
+		t.expire(now)
+		if len(t.circuits) >= t.config.MaxCircuits {
+			t.refused.Add(1)
+			return errors.New("circuit table full")
+		}
+	}
+
+	c.lastUsed = now
+	t.circuits[key] = c
+	t.created.Add(1)
+	return nil
+}
+
+// get returns the circuit under key, or nil, and marks it used
+func (t *CircuitTable) get(key circuitKey, now time.Time) *circuit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.circuits[key]
+	if !ok || now.Sub(c.lastUsed) >= t.config.IdleTimeout {
+		return nil
+	}
+	c.lastUsed = now
+	return c
+}
+
+// remove closes the circuit under key and returns it, or nil if there is none
+func (t *CircuitTable) remove(key circuitKey) *circuit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.circuits[key]
+	if !ok {
+		return nil
+	}
+	delete(t.circuits, key)
+	t.destroyed.Add(1)
+	return c
+}
+
+// expire closes circuits idle for IdleTimeout; callers must hold t.mu
+func (t *CircuitTable) expire(now time.Time) {
+	for key, c := range t.circuits {
+		if now.Sub(c.lastUsed) >= t.config.IdleTimeout {
+			delete(t.circuits, key)
+			t.expired.Add(1)
+		}
+	}
+}
+
+// expireLoop closes idle circuits until the table is closed
+func (t *CircuitTable) expireLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.config.IdleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.mu.Lock()
+			t.expire(time.Now())
+			t.mu.Unlock()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// CellDecision tells the caller of ProcessCell how to answer a cell
+type CellDecision struct {
+	Action      CellAction
+	Reply       []byte   // CellReply: the answer
+	NextAddress string   // CellForward and CellExtend: where to send NextCell
+	NextCell    []byte   // CellForward and CellExtend
+	Request     *Request // CellRequest: the request to execute
+
+	circuit *circuit  // nil for destroy cells
+	counter uint64    // Nonce of the relay cell
+	nextID  CircuitID // CellExtend: circuit ID towards NextAddress
+}
+
+// CellAction defines how to answer a cell
+type CellAction int
+
+const (
+	CellReply   CellAction = iota // Answer with Reply
+	CellForward                   // Send NextCell to NextAddress and answer with Wrap
+	CellExtend                    // Send the create cell NextCell to NextAddress and answer with Extended
+	CellRequest                   // Execute Request and answer with Respond
+)
+
+// ProcessCell processes a circuit cell received on the circuit endpoint
+// or a peer link from the previous hop from, such as its host. Circuits
+// are bound to the previous hop that created them; cells for them from
+// anyone else are refused. Relay cells are layered with a per-circuit
+// counter, so a client must wait for the answer to a cell before sending
+// the next on the same circuit.
+func (r *Router) ProcessCell(from string, cell []byte) (*CellDecision, error) {
+	if r.circuits == nil {
+		return nil, errors.New("circuits not enabled")
+	}
+	if len(cell) < cellHeaderSize {
+		return nil, fmt.Errorf("invalid cell size: %d", len(cell))
+	}
+
+	key := circuitKey{from: from}
+	copy(key.id[:], cell[1:cellHeaderSize])
+	body := cell[cellHeaderSize:]
+	now := time.Now()
+
+	switch cell[0] {
+	case CellCreate:
+		return r.createCircuit(key, body, now)
+	case CellRelay:
+		r.circuits.cells.Add(1)
+		return r.relayCell(key, body, now)
+	case CellDestroy:
+		return r.destroyCircuit(key), nil
+	}
+	return nil, fmt.Errorf("unknown cell command: 0x%02x", cell[0])
+}
+
+// createCircuit answers a create cell: an ECDH with the client's
+// ephemeral key and an onion key, authenticated by the client, and one
+// with a fresh ephemeral key of ours, so the circuit keys are forward
+// secret even within an onion key epoch
+func (r *Router) createCircuit(key circuitKey, body []byte, now time.Time) (*CellDecision, error) {
+	if len(body) != createSize {
+		return nil, fmt.Errorf("invalid create cell size: %d", len(body))
+	}
+	clientKey, auth := body[:32], body[32:]
+
+	var staticSecret []byte
+	try := func(privateKey []byte, _ *mlkem.DecapsulationKey768) bool {
+		secret, err := common.X25519ECDH(privateKey, clientKey)
+		if err != nil || !common.VerifyHMAC(auth, createAuth(secret, clientKey)) {
+			return false
+		}
+		staticSecret = secret
+		return true
+	}
+	if r.keys != nil {
+		if err := r.keys.forEachKey(now, try); err != nil {
+			return nil, err
+		}
+	} else {
+		try(r.onionKey, nil)
+	}
+	if staticSecret == nil {
+		return nil, errors.New("circuit handshake authentication failed")
+	}
+
+	nodeKey, nodePrivateKey, err := common.X25519KeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("ephemeral key generation failed: %w", err)
+	}
+	ephemeralSecret, err := common.X25519ECDH(nodePrivateKey, clientKey)
+	if err != nil {
+		return nil, fmt.Errorf("ECDH failed: %w", err)
+	}
+	keys, confirmation, err := deriveCircuitKeys(staticSecret, ephemeralSecret, clientKey, nodeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.circuits.add(key, &circuit{keys: keys}, now); err != nil {
+		return nil, err
+	}
+
+	return &CellDecision{
+		Action: CellReply,
+		Reply:  append(nodeKey, confirmation...),
+	}, nil
+}
+
+// relayCell peels this hop's layer off a relay cell. A cell whose digest
+// verifies is for this hop; any other is passed to the next hop.
+func (r *Router) relayCell(key circuitKey, body []byte, now time.Time) (*CellDecision, error) {
+	c := r.circuits.get(key, now)
+	if c == nil {
+		return nil, errors.New("unknown circuit")
+	}
+	if err := common.CheckPadding(len(body)-cellDigestSize, RequestBuckets); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	counter := c.counter
+	c.counter++
+	next, nextID := c.next, c.nextID
+	c.mu.Unlock()
+
+	payload := append([]byte(nil), body...)
+	if err := xorStream(c.keys.forwardKey, cellNonce(counter), payload); err != nil {
+		return nil, err
+	}
+	decision := &CellDecision{circuit: c, counter: counter}
+
+	cmd, data, ok, err := openRelay(c.keys.forwardMAC, counter, payload)
+	if err != nil {
+		r.circuits.remove(key)
+		return nil, err
+	}
+	if !ok {
+		if next == "" {
+			// Out of step with the client, or tampered with
+			r.circuits.remove(key)
+			return nil, errors.New("unrecognized relay cell at the last hop")
+		}
+		decision.Action = CellForward
+		decision.NextAddress = next
+		decision.NextCell = encodeCell(CellRelay, nextID, payload)
+		return decision, nil
+	}
+
+	switch cmd {
+	case relayExtend:
+		if next != "" {
+			return nil, errors.New("circuit already extended")
+		}
+		if len(data) != ed25519.PublicKeySize+createSize {
+			return nil, errors.New("invalid extend cell")
+		}
+		// Only nodes in the directory are reached, never an address
+		// chosen by the client
+		address, err := r.resolveAddress(data[:ed25519.PublicKeySize])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := rand.Read(decision.nextID[:]); err != nil {
+			return nil, err
+		}
+		decision.Action = CellExtend
+		decision.NextAddress = address
+		decision.NextCell = encodeCell(CellCreate, decision.nextID, data[ed25519.PublicKeySize:])
+		return decision, nil
+
+	case relayRequest:
+		req, err := decodeRequest(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request: %w", err)
+		}
+		decision.Action = CellRequest
+		decision.Request = req
+		return decision, nil
+	}
+
+	return nil, fmt.Errorf("unknown relay command: 0x%02x", cmd)
+}
+
+// destroyCircuit closes a circuit and passes the destroy cell on to the
+// next hop. Destroying an unknown circuit succeeds.
+func (r *Router) destroyCircuit(key circuitKey) *CellDecision {
+	c := r.circuits.remove(key)
+	if c == nil {
+		return &CellDecision{Action: CellReply}
+	}
+
+	c.mu.Lock()
+	next, nextID := c.next, c.nextID
+	c.mu.Unlock()
+	if next == "" {
+		return &CellDecision{Action: CellReply}
+	}
+
+	return &CellDecision{
+		Action:      CellForward,
+		NextAddress: next,
+		NextCell:    encodeCell(CellDestroy, nextID, nil),
+	}
+}
+
+// Wrap adds this hop's layer to the next hop's answer to a forwarded
+// cell. Answers to destroy cells are empty and passed on as they are.
+func (d *CellDecision) Wrap(answer []byte) ([]byte, error) {
+	if d.circuit == nil {
+		return answer, nil
+	}
+	if err := common.CheckPadding(len(answer)-cellDigestSize, RequestBuckets); err != nil {
+		return nil, fmt.Errorf("invalid answer from next hop: %w", err)
+	}
+
+	wrapped := append([]byte(nil), answer...)
+	if err := xorStream(d.circuit.keys.backwardKey, cellNonce(d.counter), wrapped); err != nil {
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// Extended records the next hop once it answered the create cell with
+// created, and returns the answer to the extend cell
+func (d *CellDecision) Extended(created []byte) ([]byte, error) {
+	if len(created) != createdSize {
+		return nil, fmt.Errorf("invalid created answer size: %d", len(created))
+	}
+
+	d.circuit.mu.Lock()
+	if d.circuit.next != "" {
+		d.circuit.mu.Unlock()
+		return nil, errors.New("circuit already extended")
+	}
+	d.circuit.next = d.NextAddress
+	d.circuit.nextID = d.nextID
+	d.circuit.mu.Unlock()
+
+	return d.seal(relayExtended, created)
+}
+
+// Respond returns the answer to a request cell
+func (d *CellDecision) Respond(resp *Response) ([]byte, error) {
+	body, err := encodeResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	return d.seal(relayResponse, body)
+}
+
+// seal builds an answer from this hop to the client
+func (d *CellDecision) seal(cmd byte, data []byte) ([]byte, error) {
+	answer, err := sealRelay(d.circuit.keys.backwardMAC, d.counter, cmd, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := xorStream(d.circuit.keys.backwardKey, cellNonce(d.counter), answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// encodeCell builds a cell
+func encodeCell(cmd byte, id CircuitID, body []byte) []byte {
+	cell := make([]byte, cellHeaderSize, cellHeaderSize+len(body))
+	cell[0] = cmd
+	copy(cell[1:], id[:])
+	return append(cell, body...)
+}
+
+// createAuth proves to the node that the client knows the secret shared
+// with one of its onion keys; the node finds the key it verifies under
+func createAuth(staticSecret, clientKey []byte) []byte {
+	return common.ComputeHMAC(staticSecret, append([]byte("GhostTalk-circuit-create"), clientKey...))
+}
+
+// deriveCircuitKeys derives the circuit keys and the key confirmation
+// the node sends back from both handshake secrets
+func deriveCircuitKeys(staticSecret, ephemeralSecret, clientKey, nodeKey []byte) (*circuitKeys, []byte, error) {
+	secret := append(append([]byte(nil), staticSecret...), ephemeralSecret...)
+	info := append(append([]byte("GhostTalk-circuit-keys"), clientKey...), nodeKey...)
+	reader := hkdf.New(sha256.New, secret, []byte("GhostTalk-circuit-v1"), info)
+
+	material := make([]byte, 5*32)
+	if _, err := io.ReadFull(reader, material); err != nil {
+		return nil, nil, fmt.Errorf("key derivation failed: %w", err)
+	}
+
+	keys := &circuitKeys{
+		forwardKey:  material[0:32],
+		backwardKey: material[32:64],
+		forwardMAC:  material[64:96],
+		backwardMAC: material[96:128],
+	}
+	return keys, common.ComputeHMAC(material[128:160], []byte("GhostTalk-circuit-created")), nil
+}
+
+// cellNonce is the ChaCha20 nonce of the relay cell with the given counter
+func cellNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// cellDigest marks a relay cell or answer as meant for the holder of macKey
+func cellDigest(macKey []byte, counter uint64, padded []byte) []byte {
+	message := binary.BigEndian.AppendUint64(nil, counter)
+	return common.ComputeHMAC(macKey, append(message, padded...))[:cellDigestSize]
+}
+
+// sealRelay builds the plaintext of a relay cell or answer: the digest,
+// then the command and data padded to one of RequestBuckets
+func sealRelay(macKey []byte, counter uint64, cmd byte, data []byte) ([]byte, error) {
+	padded, err := common.PadToBucket(append([]byte{cmd}, data...), RequestBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, 0, cellDigestSize+len(padded))
+	body = append(body, cellDigest(macKey, counter, padded)...)
+	return append(body, padded...), nil
+}
+
+// openRelay checks the digest of a relay plaintext. It reports ok false
+// for a cell meant for another hop, and returns the command and data of
+// one meant for the holder of macKey.
+func openRelay(macKey []byte, counter uint64, body []byte) (cmd byte, data []byte, ok bool, err error) {
+	if len(body) <= cellDigestSize {
+		return 0, nil, false, errors.New("relay cell too short")
+	}
+	padded := body[cellDigestSize:]
+	if !common.VerifyHMAC(body[:cellDigestSize], cellDigest(macKey, counter, padded)) {
+		return 0, nil, false, nil
+	}
+
+	plaintext, err := common.UnpadBucket(padded)
+	if err != nil || len(plaintext) == 0 {
+		return 0, nil, true, errors.New("invalid relay cell padding")
+	}
+	return plaintext[0], plaintext[1:], true, nil
+}
@@ -0,0 +1,300 @@
+package onion
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// MaxCircuitLength is the number of hops a circuit can be extended to
+const MaxCircuitLength = MaxPathLength
+
+// Circuit is the client end of a circuit. Cells it builds go to FirstHop;
+// the answer to each must be passed back (Complete or OpenResponse)
+// before the next cell is built. A cell without an answer leaves the
+// circuit out of step with its hops: destroy it and build another.
+type Circuit struct {
+	firstHop string
+	id       CircuitID
+	hops     []*clientHop
+	pending  *circuitHandshake // Create or extend waiting for its answer
+	sent     *sentCell         // Relay cell waiting for its answer
+}
+
+// clientHop is the client's state for one hop of a circuit
+type clientHop struct {
+	keys    *circuitKeys
+	counter uint64 // Relay cells sent through this hop
+}
+
+// sentCell records the relay cell whose answer the client is waiting for
+type sentCell struct {
+	target   int      // Hop the cell is for
+	counters []uint64 // Nonce each hop up to target used
+}
+
+// circuitHandshake is a create handshake in progress
+type circuitHandshake struct {
+	publicKey    []byte
+	privateKey   []byte
+	staticSecret []byte
+}
+
+// SendCellFunc sends a cell to the node at nodeAddress and returns its answer
+type SendCellFunc func(nodeAddress string, cell []byte) ([]byte, error)
+
+// BuildCircuit builds a circuit through path, sending the handshakes
+// with send. It destroys the partial circuit if a handshake fails.
+func BuildCircuit(path []common.NodeInfo, send SendCellFunc) (*Circuit, error) {
+	if len(path) == 0 || len(path) > MaxCircuitLength {
+		return nil, fmt.Errorf("path length must be 1-%d, got %d", MaxCircuitLength, len(path))
+	}
+
+	c, cell, err := NewCircuit(path[0])
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		answer, err := send(c.firstHop, cell)
+		if err == nil {
+			err = c.Complete(answer)
+		}
+		if err != nil {
+			if i > 0 {
+				send(c.firstHop, c.Destroy())
+			}
+			return nil, fmt.Errorf("hop %d: %w", i+1, err)
+		}
+
+		if i == len(path)-1 {
+			return c, nil
+		}
+		if cell, err = c.Extend(path[i+1]); err != nil {
+			send(c.firstHop, c.Destroy())
+			return nil, err
+		}
+	}
+}
+
+// NewCircuit starts a circuit at first. It returns the create cell to
+// send to FirstHop; pass the answer to Complete.
+func NewCircuit(first common.NodeInfo) (*Circuit, []byte, error) {
+	handshake, body, err := startHandshake(&first)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &Circuit{
+		firstHop: net.JoinHostPort(first.Address, strconv.Itoa(int(first.Port))),
+		pending:  handshake,
+	}
+	if _, err := rand.Read(c.id[:]); err != nil {
+		return nil, nil, err
+	}
+
+	return c, encodeCell(CellCreate, c.id, body), nil
+}
+
+// FirstHop returns the address every cell of the circuit is sent to
+func (c *Circuit) FirstHop() string {
+	return c.firstHop
+}
+
+// Len returns the number of hops the circuit reaches
+func (c *Circuit) Len() int {
+	return len(c.hops)
+}
+
+// Extend returns an extend cell that adds next to the end of the
+// circuit; pass the answer to Complete. The current last hop looks next
+// up by its identity key in its directory and refuses unknown or
+// unhealthy nodes.
+func (c *Circuit) Extend(next common.NodeInfo) ([]byte, error) {
+	if len(c.hops) == 0 || c.pending != nil {
+		return nil, errors.New("circuit handshake in progress")
+	}
+	if len(c.hops) >= MaxCircuitLength {
+		return nil, fmt.Errorf("circuit already has %d hops", len(c.hops))
+	}
+
+	if len(next.PublicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("node %s has no valid identity key", next.ID)
+	}
+	handshake, body, err := startHandshake(&next)
+	if err != nil {
+		return nil, err
+	}
+
+	data := append(append([]byte(nil), next.PublicKey...), body...)
+	cell, err := c.relayCell(len(c.hops)-1, relayExtend, data)
+	if err != nil {
+		return nil, err
+	}
+	c.pending = handshake
+	return cell, nil
+}
+
+// Complete finishes the handshake started by NewCircuit or Extend with
+// the answer to its cell
+func (c *Circuit) Complete(answer []byte) error {
+	if c.pending == nil {
+		return errors.New("no circuit handshake in progress")
+	}
+	handshake := c.pending
+	c.pending = nil
+
+	created := answer
+	if len(c.hops) > 0 {
+		cmd, data, err := c.openAnswer(answer)
+		if err != nil {
+			return err
+		}
+		if cmd != relayExtended {
+			return fmt.Errorf("unexpected answer to extend: 0x%02x", cmd)
+		}
+		created = data
+	}
+
+	keys, err := handshake.finish(created)
+	if err != nil {
+		return err
+	}
+	c.hops = append(c.hops, &clientHop{keys: keys})
+	return nil
+}
+
+// Request returns a relay cell carrying req to the last hop of the
+// circuit, which executes it like an onion request. Read the answer with
+// OpenResponse.
+func (c *Circuit) Request(req *Request) ([]byte, error) {
+	if len(c.hops) == 0 || c.pending != nil {
+		return nil, errors.New("circuit handshake in progress")
+	}
+	data, err := encodeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.relayCell(len(c.hops)-1, relayRequest, data)
+}
+
+// OpenResponse reads the answer to a request cell
+func (c *Circuit) OpenResponse(answer []byte) (*Response, error) {
+	cmd, data, err := c.openAnswer(answer)
+	if err != nil {
+		return nil, err
+	}
+	if cmd != relayResponse {
+		return nil, fmt.Errorf("unexpected answer to request: 0x%02x", cmd)
+	}
+	return decodeResponse(data)
+}
+
+// Destroy returns a cell that closes the circuit at every hop
+func (c *Circuit) Destroy() []byte {
+	return encodeCell(CellDestroy, c.id, nil)
+}
+
+// relayCell seals cmd and data for hop target and adds the layers of
+// every hop up to it
+func (c *Circuit) relayCell(target int, cmd byte, data []byte) ([]byte, error) {
+	if c.sent != nil {
+		return nil, errors.New("previous cell unanswered; destroy the circuit")
+	}
+
+	body, err := sealRelay(c.hops[target].keys.forwardMAC, c.hops[target].counter, cmd, data)
+	if err != nil {
+		return nil, err
+	}
+
+	sent := &sentCell{target: target, counters: make([]uint64, target+1)}
+	for i := target; i >= 0; i-- {
+		hop := c.hops[i]
+		if err := xorStream(hop.keys.forwardKey, cellNonce(hop.counter), body); err != nil {
+			return nil, err
+		}
+		sent.counters[i] = hop.counter
+		hop.counter++
+	}
+
+	c.sent = sent
+	return encodeCell(CellRelay, c.id, body), nil
+}
+
+// openAnswer removes the layers from the answer to the last relay cell
+// and checks it came from the hop the cell was for
+func (c *Circuit) openAnswer(answer []byte) (byte, []byte, error) {
+	sent := c.sent
+	if sent == nil {
+		return 0, nil, errors.New("no relay cell waiting for an answer")
+	}
+	c.sent = nil
+
+	body := append([]byte(nil), answer...)
+	for i := 0; i <= sent.target; i++ {
+		if err := xorStream(c.hops[i].keys.backwardKey, cellNonce(sent.counters[i]), body); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	cmd, data, ok, err := openRelay(c.hops[sent.target].keys.backwardMAC, sent.counters[sent.target], body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !ok {
+		return 0, nil, errors.New("answer authentication failed")
+	}
+	return cmd, data, nil
+}
+
+// startHandshake returns the create body opening a circuit at node
+func startHandshake(node *common.NodeInfo) (*circuitHandshake, []byte, error) {
+	onionKey, err := nodeOnionKey(node)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	publicKey, privateKey, err := common.X25519KeyPair()
+	if err != nil {
+		return nil, nil, fmt.Errorf("ephemeral key generation failed: %w", err)
+	}
+	staticSecret, err := common.X25519ECDH(privateKey, onionKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ECDH with node %s failed: %w", node.ID, err)
+	}
+
+	handshake := &circuitHandshake{
+		publicKey:    publicKey,
+		privateKey:   privateKey,
+		staticSecret: staticSecret,
+	}
+	body := append(append([]byte(nil), publicKey...), createAuth(staticSecret, publicKey)...)
+	return handshake, body, nil
+}
+
+// finish derives the circuit keys from the node's created answer and
+// checks its key confirmation, which only the holder of the onion key
+// can compute
+func (h *circuitHandshake) finish(created []byte) (*circuitKeys, error) {
+	if len(created) != createdSize {
+		return nil, fmt.Errorf("invalid created answer size: %d", len(created))
+	}
+	nodeKey := created[:32]
+
+	ephemeralSecret, err := common.X25519ECDH(h.privateKey, nodeKey)
+	if err != nil {
+		return nil, fmt.Errorf("ECDH failed: %w", err)
+	}
+	keys, confirmation, err := deriveCircuitKeys(h.staticSecret, ephemeralSecret, h.publicKey, nodeKey)
+	if err != nil {
+		return nil, err
+	}
+	if !common.VerifyHMAC(created[32:], confirmation) {
+		return nil, errors.New("circuit key confirmation failed")
+	}
+	return keys, nil
+}
@@ -0,0 +1,346 @@
+package onion
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// testClientHost is the host cells from the client come from
+const testClientHost = "192.0.2.1"
+
+// testCircuitNet routes cells between routers by address the way the
+// node's circuit endpoint does. Every router resolves extend cells
+// through the same directory.
+type testCircuitNet struct {
+	routers  map[string]*Router
+	resolver *fakeResolver
+}
+
+// newTestCircuitNet creates n routers with circuit tables, all healthy in
+// the directory
+func newTestCircuitNet(t *testing.T, n int, config *CircuitConfig) (testCircuitNet, []*CircuitTable, []common.NodeInfo) {
+	t.Helper()
+
+	network := testCircuitNet{routers: make(map[string]*Router), resolver: &fakeResolver{}}
+	tables := make([]*CircuitTable, n)
+	path := make([]common.NodeInfo, n)
+	for i := range path {
+		pub, priv, err := common.GenerateKeypair()
+		if err != nil {
+			t.Fatalf("Failed to generate keypair: %v", err)
+		}
+
+		tables[i] = NewCircuitTable(config)
+		t.Cleanup(tables[i].Close)
+		router := NewRouterWithConfig(priv, &RouterConfig{Circuits: tables[i], Resolver: network.resolver})
+		path[i] = common.NodeInfo{
+			ID:        fmt.Sprintf("node%d", i+1),
+			PublicKey: pub,
+			Address:   fmt.Sprintf("10.0.0.%d", i+1),
+			Port:      uint16(9000 + i),
+			Healthy:   true,
+		}
+		network.routers[net.JoinHostPort(path[i].Address, strconv.Itoa(int(path[i].Port)))] = router
+	}
+	network.resolver.nodes = append(network.resolver.nodes, path...)
+	return network, tables, path
+}
+
+// send delivers a cell from the client and returns the answer
+func (n testCircuitNet) send(address string, cell []byte) ([]byte, error) {
+	return n.sendFrom(testClientHost, address, cell)
+}
+
+// sendFrom delivers a cell from host from and returns the answer,
+// relaying it like a node
+func (n testCircuitNet) sendFrom(from, address string, cell []byte) ([]byte, error) {
+	router, ok := n.routers[address]
+	if !ok {
+		return nil, fmt.Errorf("unknown node %s", address)
+	}
+
+	decision, err := router.ProcessCell(from, cell)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+	switch decision.Action {
+	case CellForward:
+		answer, err := n.sendFrom(host, decision.NextAddress, decision.NextCell)
+		if err != nil {
+			return nil, err
+		}
+		return decision.Wrap(answer)
+	case CellExtend:
+		created, err := n.sendFrom(host, decision.NextAddress, decision.NextCell)
+		if err != nil {
+			return nil, err
+		}
+		return decision.Extended(created)
+	case CellRequest:
+		return decision.Respond(&Response{Status: 200, Body: []byte("echo " + decision.Request.Path)})
+	}
+	return decision.Reply, nil
+}
+
+// roundTrip sends a request along c and opens the response
+func (n testCircuitNet) roundTrip(c *Circuit, path string) (*Response, error) {
+	cell, err := c.Request(&Request{Method: "POST", Path: path})
+	if err != nil {
+		return nil, err
+	}
+	answer, err := n.send(c.FirstHop(), cell)
+	if err != nil {
+		return nil, err
+	}
+	return c.OpenResponse(answer)
+}
+
+func TestCircuit_ThreeHopRequests(t *testing.T) {
+	network, tables, path := newTestCircuitNet(t, 3, nil)
+
+	c, err := BuildCircuit(path, network.send)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+	if c.Len() != 3 {
+		t.Errorf("Len = %d, want 3", c.Len())
+	}
+
+	// Every cell advances the per-hop counters
+	for i := 0; i < 5; i++ {
+		target := fmt.Sprintf("/v1/typing/%d", i)
+		resp, err := network.roundTrip(c, target)
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		if resp.Status != 200 || string(resp.Body) != "echo "+target {
+			t.Errorf("Request %d: response = %d %q", i, resp.Status, resp.Body)
+		}
+	}
+
+	for i, table := range tables {
+		stats := table.GetStats()
+		if stats.Open != 1 || stats.Created != 1 {
+			t.Errorf("Hop %d: Open = %d, Created = %d, want 1, 1", i+1, stats.Open, stats.Created)
+		}
+	}
+	// The first hop relayed both extends and every request
+	if stats := tables[0].GetStats(); stats.Cells != 7 {
+		t.Errorf("Hop 1: Cells = %d, want 7", stats.Cells)
+	}
+}
+
+func TestCircuit_Destroy(t *testing.T) {
+	network, tables, path := newTestCircuitNet(t, 3, nil)
+
+	c, err := BuildCircuit(path, network.send)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+	if _, err := network.send(c.FirstHop(), c.Destroy()); err != nil {
+		t.Fatalf("Destroy failed: %v", err)
+	}
+
+	for i, table := range tables {
+		if stats := table.GetStats(); stats.Open != 0 || stats.Destroyed != 1 {
+			t.Errorf("Hop %d: Open = %d, Destroyed = %d, want 0, 1", i+1, stats.Open, stats.Destroyed)
+		}
+	}
+	if _, err := network.roundTrip(c, "/v1/typing"); err == nil {
+		t.Error("Request on a destroyed circuit succeeded")
+	}
+}
+
+func TestCircuit_BoundToPreviousHop(t *testing.T) {
+	network, tables, path := newTestCircuitNet(t, 3, nil)
+
+	c, err := BuildCircuit(path, network.send)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+
+	// Cells with the circuit's ID from another host reach no circuit
+	junk := encodeCell(CellRelay, c.id, make([]byte, cellDigestSize+RequestBuckets[0]))
+	if _, err := network.sendFrom("198.51.100.7", c.FirstHop(), junk); err == nil {
+		t.Error("Relay cell from another host accepted")
+	}
+	if _, err := network.sendFrom("198.51.100.7", c.FirstHop(), c.Destroy()); err != nil {
+		t.Fatalf("Destroy failed: %v", err)
+	}
+	for i, table := range tables {
+		if stats := table.GetStats(); stats.Open != 1 || stats.Destroyed != 0 {
+			t.Errorf("Hop %d: Open = %d, Destroyed = %d, want 1, 0", i+1, stats.Open, stats.Destroyed)
+		}
+	}
+
+	// The circuit is still in step with the client
+	resp, err := network.roundTrip(c, "/v1/typing")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if resp.Status != 200 {
+		t.Errorf("Status = %d, want 200", resp.Status)
+	}
+}
+
+func TestCircuit_ExtendToDirectoryNodesOnly(t *testing.T) {
+	testCases := map[string]func(directory *fakeResolver){
+		"unhealthy node": func(directory *fakeResolver) {
+			directory.nodes[1].Healthy = false
+		},
+		"unknown node": func(directory *fakeResolver) {
+			directory.nodes = directory.nodes[:1]
+		},
+	}
+	for name, change := range testCases {
+		t.Run(name, func(t *testing.T) {
+			network, tables, path := newTestCircuitNet(t, 2, nil)
+			change(network.resolver)
+
+			if _, err := BuildCircuit(path, network.send); err == nil {
+				t.Fatal("BuildCircuit succeeded")
+			}
+			if stats := tables[1].GetStats(); stats.Created != 0 {
+				t.Errorf("Created = %d at the second hop, want 0", stats.Created)
+			}
+		})
+	}
+}
+
+func TestCircuit_IdleExpiry(t *testing.T) {
+	network, tables, path := newTestCircuitNet(t, 1, &CircuitConfig{IdleTimeout: time.Hour})
+
+	c, err := BuildCircuit(path, network.send)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+
+	tables[0].mu.Lock()
+	tables[0].expire(time.Now().Add(time.Hour))
+	tables[0].mu.Unlock()
+
+	if stats := tables[0].GetStats(); stats.Open != 0 || stats.Expired != 1 {
+		t.Errorf("Open = %d, Expired = %d, want 0, 1", stats.Open, stats.Expired)
+	}
+	if _, err := network.roundTrip(c, "/v1/typing"); err == nil {
+		t.Error("Request on an expired circuit succeeded")
+	}
+}
+
+func TestCircuit_TamperedCell(t *testing.T) {
+	network, tables, path := newTestCircuitNet(t, 3, nil)
+
+	c, err := BuildCircuit(path, network.send)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+
+	cell, err := c.Request(&Request{Method: "POST", Path: "/v1/typing"})
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	cell[len(cell)-1] ^= 0x01
+	if _, err := network.send(c.FirstHop(), cell); err == nil {
+		t.Fatal("Tampered cell accepted")
+	}
+
+	// The last hop cannot tell the cell apart from one out of step and
+	// closes the circuit
+	if stats := tables[2].GetStats(); stats.Open != 0 {
+		t.Errorf("Last hop: Open = %d, want 0", stats.Open)
+	}
+}
+
+func TestCircuit_TamperedAnswer(t *testing.T) {
+	network, _, path := newTestCircuitNet(t, 2, nil)
+
+	c, err := BuildCircuit(path, network.send)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+
+	cell, err := c.Request(&Request{Method: "POST", Path: "/v1/typing"})
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	answer, err := network.send(c.FirstHop(), cell)
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	answer[0] ^= 0x01
+	if _, err := c.OpenResponse(answer); err == nil {
+		t.Error("OpenResponse accepted a tampered answer")
+	}
+}
+
+func TestCircuit_UnansweredCell(t *testing.T) {
+	network, _, path := newTestCircuitNet(t, 1, nil)
+
+	c, err := BuildCircuit(path, network.send)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+	if _, err := c.Request(&Request{Method: "POST", Path: "/v1/typing"}); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if _, err := c.Request(&Request{Method: "POST", Path: "/v1/typing"}); err == nil {
+		t.Error("Request succeeded with a cell unanswered")
+	}
+}
+
+func TestCircuit_WrongOnionKey(t *testing.T) {
+	network, tables, path := newTestCircuitNet(t, 2, nil)
+
+	// Node 1's key at node 2's address
+	path[0].Address, path[0].Port = path[1].Address, path[1].Port
+	if _, err := BuildCircuit(path[:1], network.send); err == nil {
+		t.Error("BuildCircuit succeeded with another node's onion key")
+	}
+	if stats := tables[1].GetStats(); stats.Open != 0 {
+		t.Errorf("Open = %d, want 0", stats.Open)
+	}
+}
+
+func TestCircuitTable_Full(t *testing.T) {
+	network, tables, path := newTestCircuitNet(t, 1, &CircuitConfig{MaxCircuits: 1})
+
+	if _, err := BuildCircuit(path, network.send); err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+	if _, err := BuildCircuit(path, network.send); err == nil {
+		t.Error("BuildCircuit succeeded with the table full")
+	}
+	if stats := tables[0].GetStats(); stats.Refused != 1 {
+		t.Errorf("Refused = %d, want 1", stats.Refused)
+	}
+}
+
+func TestProcessCell_Invalid(t *testing.T) {
+	network, _, path := newTestCircuitNet(t, 1, nil)
+	router := network.routers[net.JoinHostPort(path[0].Address, strconv.Itoa(int(path[0].Port)))]
+
+	var id CircuitID
+	testCases := map[string][]byte{
+		"short":           {CellRelay},
+		"unknown command": encodeCell(0x7f, id, nil),
+		"unknown circuit": encodeCell(CellRelay, id, make([]byte, cellDigestSize+RequestBuckets[0])),
+		"short create":    encodeCell(CellCreate, id, make([]byte, createSize-1)),
+	}
+	for name, cell := range testCases {
+		if _, err := router.ProcessCell(testClientHost, cell); err == nil {
+			t.Errorf("%s: ProcessCell succeeded, want error", name)
+		}
+	}
+
+	disabled, _ := newTestHop(t, "node2", "10.0.0.2", 9000)
+	if _, err := disabled.ProcessCell(testClientHost, encodeCell(CellDestroy, id, nil)); err == nil {
+		t.Error("ProcessCell succeeded without a circuit table")
+	}
+}
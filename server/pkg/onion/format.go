@@ -0,0 +1,192 @@
+package onion
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// headerFormat describes the routing blob layout of one packet version.
+// Every version shares the packet layout (version, ephemeral key, HMAC,
+// routing blob, 600-byte payload); they differ in how much routing info
+// each hop takes and therefore how many hops fit. Version 3 packets also
+// carry an ML-KEM ciphertext before the routing blob, in a larger size
+// class.
+type headerFormat struct {
+	version    byte
+	packetSize int    // Bytes in a packet of this version
+	blobSize   int    // Bytes in the routing blob
+	kemSize    int    // Bytes of ML-KEM ciphertext after the HMAC (0: X25519 only)
+	hopSize    int    // Bytes of routing info per hop
+	maxHops    int    // Hops that fit in the routing blob
+	keyInfo    string // Key derivation label, so versions never share keys
+
+	// Every hop peels a stream cipher layer off forward payloads
+	layeredPayload bool
+
+	encode func(routing *common.RoutingInfo) []byte
+	parse  func(r *Router, data []byte) (*common.RoutingInfo, error)
+}
+
+var (
+	formatV1 = &headerFormat{
+		version:    common.PacketVersion1,
+		packetSize: common.PacketSize,
+		blobSize:   common.RoutingBlobSize,
+		hopSize:    common.PerHopRoutingSize,
+		maxHops:    common.RoutingBlobSize / common.PerHopRoutingSize,
+		keyInfo:    "GhostTalk-v1",
+		encode:     encodeRoutingInfo,
+		parse:      (*Router).parseRoutingInfo,
+	}
+
+	formatV2 = &headerFormat{
+		version:    common.PacketVersion2,
+		packetSize: common.PacketSize,
+		blobSize:   common.RoutingBlobSize,
+		hopSize:    common.PerHopRoutingSizeV2,
+		maxHops:    common.RoutingBlobSize / common.PerHopRoutingSizeV2,
+		keyInfo:    "GhostTalk-v2",
+		encode:     encodeRoutingInfoV2,
+		parse:      (*Router).parseRoutingInfoV2,
+
+		layeredPayload: true,
+	}
+
+	formatV3 = &headerFormat{
+		version:    common.PacketVersion3,
+		packetSize: common.PacketSizeLarge,
+		blobSize:   common.RoutingBlobSizeV3,
+		kemSize:    common.KEMCiphertextSize,
+		hopSize:    common.PerHopRoutingSizeV3,
+		maxHops:    common.RoutingBlobSizeV3 / common.PerHopRoutingSizeV3,
+		keyInfo:    "GhostTalk-v3",
+		encode:     encodeRoutingInfoV3,
+		parse:      (*Router).parseRoutingInfoV3,
+
+		layeredPayload: true,
+	}
+)
+
+// blobOffset returns where the routing blob starts in a packet
+func (f *headerFormat) blobOffset() int {
+	return common.HeaderSize + f.kemSize
+}
+
+// payloadOffset returns where the payload starts in a packet
+func (f *headerFormat) payloadOffset() int {
+	return f.packetSize - common.PayloadSize
+}
+
+// lookupFormat returns the header format for a packet version
+func lookupFormat(version byte) (*headerFormat, error) {
+	switch version {
+	case common.PacketVersion1:
+		return formatV1, nil
+	case common.PacketVersion2:
+		return formatV2, nil
+	case common.PacketVersion3:
+		return formatV3, nil
+	default:
+		return nil, fmt.Errorf("unsupported version: 0x%02x", version)
+	}
+}
+
+// Version 2 routing info layout (PerHopRoutingSizeV2 bytes):
+//
+//	0       address type
+//	1:33    address (IPv4 and IPv6 left-aligned, or a node ID)
+//	33:35   port
+//	35:39   expiry (unix seconds)
+//	39:41   delay (milliseconds)
+//	41      flags
+//	42:74   next hop HMAC
+//	74:90   SURB ID (final hop of a reply only)
+//	90:123  reserved
+const (
+	v2AddressSize = 32
+	v2HMACOffset  = 42
+	v2SURBOffset  = 74
+)
+
+// encodeRoutingInfoV2 serializes routing info into a version 2 per-hop block
+func encodeRoutingInfoV2(routing *common.RoutingInfo) []byte {
+	data := make([]byte, common.PerHopRoutingSizeV2)
+	data[0] = routing.AddressType
+	copy(data[1:1+v2AddressSize], routing.Address)
+	binary.BigEndian.PutUint16(data[33:35], routing.Port)
+	binary.BigEndian.PutUint32(data[35:39], uint32(routing.Expiry.Unix()))
+	binary.BigEndian.PutUint16(data[39:41], routing.Delay)
+	data[41] = routing.Flags
+	copy(data[v2HMACOffset:v2HMACOffset+common.HMACSize], routing.HMAC)
+	copy(data[v2SURBOffset:v2SURBOffset+common.SURBIDSize], routing.SURBID)
+	return data
+}
+
+// parseRoutingInfoV2 parses a version 2 per-hop block
+func (r *Router) parseRoutingInfoV2(data []byte) (*common.RoutingInfo, error) {
+	if len(data) < common.PerHopRoutingSizeV2 {
+		return nil, errors.New("routing info too short")
+	}
+
+	info := &common.RoutingInfo{
+		AddressType: data[0],
+		Port:        binary.BigEndian.Uint16(data[33:35]),
+		Expiry:      time.Unix(int64(binary.BigEndian.Uint32(data[35:39])), 0),
+		Delay:       binary.BigEndian.Uint16(data[39:41]),
+		Flags:       data[41],
+		HMAC:        data[v2HMACOffset : v2HMACOffset+common.HMACSize],
+	}
+
+	switch info.AddressType {
+	case 0x04: // IPv4
+		info.Address = data[1:5]
+	case 0x06: // IPv6
+		info.Address = data[1:17]
+	case 0x20: // Node ID, resolved through the directory
+		info.Address = data[1:33]
+	case 0x00: // Final hop
+		if info.Flags&common.RoutingFlagReply != 0 {
+			info.SURBID = data[v2SURBOffset : v2SURBOffset+common.SURBIDSize]
+		}
+	default:
+		return nil, fmt.Errorf("unknown address type: 0x%02x", info.AddressType)
+	}
+
+	return info, nil
+}
+
+// Version 3 routing info is the version 2 block followed by the ML-KEM
+// ciphertext for the next hop, which it moves into the header it forwards
+// (PerHopRoutingSizeV3 bytes). The final hop's ciphertext slot is unused.
+//
+//	0:123     version 2 routing info
+//	123:1211  next hop KEM ciphertext
+
+// encodeRoutingInfoV3 serializes routing info into a version 3 per-hop block
+func encodeRoutingInfoV3(routing *common.RoutingInfo) []byte {
+	data := make([]byte, common.PerHopRoutingSizeV3)
+	copy(data, encodeRoutingInfoV2(routing))
+	copy(data[common.PerHopRoutingSizeV2:], routing.KEMCiphertext)
+	return data
+}
+
+// parseRoutingInfoV3 parses a version 3 per-hop block
+func (r *Router) parseRoutingInfoV3(data []byte) (*common.RoutingInfo, error) {
+	if len(data) < common.PerHopRoutingSizeV3 {
+		return nil, errors.New("routing info too short")
+	}
+
+	info, err := r.parseRoutingInfoV2(data)
+	if err != nil {
+		return nil, err
+	}
+	if info.AddressType != 0x00 {
+		info.KEMCiphertext = data[common.PerHopRoutingSizeV2:common.PerHopRoutingSizeV3]
+	}
+
+	return info, nil
+}
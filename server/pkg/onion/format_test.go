@@ -0,0 +1,406 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/mlkem"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// newTestPath creates n hops listening on consecutive addresses
+func newTestPath(t *testing.T, n int) ([]*Router, []common.NodeInfo) {
+	t.Helper()
+
+	routers := make([]*Router, n)
+	path := make([]common.NodeInfo, n)
+	for i := range path {
+		routers[i], path[i] = newTestHop(t, fmt.Sprintf("node%d", i+1), fmt.Sprintf("10.0.0.%d", i+1), uint16(9000+i))
+	}
+	return routers, path
+}
+
+func TestBuildPacketV2_PathLengths(t *testing.T) {
+	for n := 1; n <= MaxPathLength; n++ {
+		t.Run(fmt.Sprintf("%d hops", n), func(t *testing.T) {
+			routers, path := newTestPath(t, n)
+
+			payload := []byte("variable length path")
+			packet, err := BuildPacket(path, payload, nil)
+			if err != nil {
+				t.Fatalf("BuildPacket failed: %v", err)
+			}
+			if packet[0] != common.PacketVersion2 {
+				t.Fatalf("Version = 0x%02x, want 0x%02x", packet[0], common.PacketVersion2)
+			}
+
+			for i, router := range routers {
+				decision, err := router.ProcessPacket(packet)
+				if err != nil {
+					t.Fatalf("Hop %d: ProcessPacket failed: %v", i+1, err)
+				}
+
+				if i < n-1 {
+					want := fmt.Sprintf("10.0.0.%d:%d", i+2, 9001+i)
+					if decision.Action != ActionForward || decision.NextAddress != want {
+						t.Fatalf("Hop %d: Action = %v, NextAddress = %q, want ActionForward to %q",
+							i+1, decision.Action, decision.NextAddress, want)
+					}
+					if len(decision.NextPacket) != common.PacketSize || decision.NextPacket[0] != common.PacketVersion2 {
+						t.Fatalf("Hop %d: forwarded packet is not a full-size version 2 packet", i+1)
+					}
+					packet = decision.NextPacket
+					continue
+				}
+
+				if decision.Action != ActionDeliver {
+					t.Fatalf("Hop %d: Action = %v, want ActionDeliver", i+1, decision.Action)
+				}
+				if !bytes.Equal(decision.Payload[:len(payload)], payload) {
+					t.Errorf("Payload = %q, want prefix %q", decision.Payload[:len(payload)], payload)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildPacketV2_FinalHopSeesRandomPadding(t *testing.T) {
+	routers, path := newTestPath(t, 1)
+
+	packet, err := BuildPacket(path, []byte("payload"), nil)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	onionPkt, _ := routers[0].parsePacket(packet, formatV2)
+	keys, err := routers[0].openHeader(onionPkt, formatV2, time.Now())
+	if err != nil {
+		t.Fatalf("openHeader failed: %v", err)
+	}
+	plaintext, err := routers[0].decryptRoutingBlob(keys.encKey, onionPkt.RoutingBlob, formatV2)
+	if err != nil {
+		t.Fatalf("decryptRoutingBlob failed: %v", err)
+	}
+
+	// Zero padding would tell a one-hop final node how short the path was
+	padding := plaintext[common.PerHopRoutingSizeV2:common.RoutingBlobSize]
+	if bytes.Equal(padding, make([]byte, len(padding))) {
+		t.Error("Padding after the final routing info is all zero")
+	}
+}
+
+func TestRouter_V1Transition(t *testing.T) {
+	pub, priv, err := common.GenerateKeypair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+	node := common.NodeInfo{ID: "node1", PublicKey: pub, Address: "10.0.0.1", Port: 9000}
+
+	build := func() []byte {
+		packet, err := BuildPacket([]common.NodeInfo{node}, []byte("legacy"), &BuildOptions{Version: common.PacketVersion1})
+		if err != nil {
+			t.Fatalf("BuildPacket failed: %v", err)
+		}
+		if packet[0] != common.PacketVersion1 {
+			t.Fatalf("Version = 0x%02x, want 0x%02x", packet[0], common.PacketVersion1)
+		}
+		return packet
+	}
+
+	during := NewRouterWithConfig(priv, &RouterConfig{V1Until: time.Now().Add(time.Hour)})
+	decision, err := during.ProcessPacket(build())
+	if err != nil {
+		t.Fatalf("Version 1 packet rejected during transition: %v", err)
+	}
+	if decision.Action != ActionDeliver {
+		t.Errorf("Action = %v, want ActionDeliver", decision.Action)
+	}
+	if stats := during.GetStats(); stats.PacketsV1 != 1 {
+		t.Errorf("PacketsV1 = %d, want 1", stats.PacketsV1)
+	}
+
+	after := NewRouterWithConfig(priv, &RouterConfig{V1Until: time.Now().Add(-time.Hour)})
+	if _, err := after.ProcessPacket(build()); err == nil {
+		t.Error("Expected version 1 packet to be rejected after transition, got nil")
+	}
+}
+
+func TestBuildPacketV1_PathLimit(t *testing.T) {
+	_, path := newTestPath(t, MaxPathLengthV1+1)
+
+	if _, err := BuildPacket(path, []byte("payload"), &BuildOptions{Version: common.PacketVersion1}); err == nil {
+		t.Error("Expected error for version 1 path longer than 3 hops, got nil")
+	}
+	if _, err := BuildPacket(path[:1], []byte("payload"), &BuildOptions{Version: 0x7F}); err == nil {
+		t.Error("Expected error for unknown version, got nil")
+	}
+}
+
+func TestEncodeRoutingInfoV2(t *testing.T) {
+	router, _ := newTestHop(t, "node1", "10.0.0.1", 9000)
+
+	expiry := time.Now().Add(time.Minute).Truncate(time.Second)
+	original := &common.RoutingInfo{
+		AddressType: 0x06,
+		Address:     bytes.Repeat([]byte{0x20}, 16),
+		Port:        9001,
+		Expiry:      expiry,
+		Delay:       750,
+		HMAC:        bytes.Repeat([]byte{0xAB}, 32),
+	}
+
+	encoded := encodeRoutingInfoV2(original)
+	if len(encoded) != common.PerHopRoutingSizeV2 {
+		t.Fatalf("Encoded length = %d, want %d", len(encoded), common.PerHopRoutingSizeV2)
+	}
+
+	parsed, err := router.parseRoutingInfoV2(encoded)
+	if err != nil {
+		t.Fatalf("parseRoutingInfoV2 failed: %v", err)
+	}
+	if !bytes.Equal(parsed.Address, original.Address) || parsed.Port != original.Port {
+		t.Errorf("Address = %v:%d, want %v:%d", parsed.Address, parsed.Port, original.Address, original.Port)
+	}
+	if !parsed.Expiry.Equal(expiry) || parsed.Delay != original.Delay {
+		t.Errorf("Expiry, delay = %v, %d, want %v, %d", parsed.Expiry, parsed.Delay, expiry, original.Delay)
+	}
+	if !bytes.Equal(parsed.HMAC, original.HMAC) {
+		t.Error("HMAC changed across encode and parse")
+	}
+
+	// A reply's final hop carries the SURB ID
+	reply := &common.RoutingInfo{Flags: common.RoutingFlagReply, SURBID: bytes.Repeat([]byte{0x5A}, common.SURBIDSize)}
+	parsed, err = router.parseRoutingInfoV2(encodeRoutingInfoV2(reply))
+	if err != nil {
+		t.Fatalf("parseRoutingInfoV2 failed: %v", err)
+	}
+	if !bytes.Equal(parsed.SURBID, reply.SURBID) {
+		t.Errorf("SURBID = %x, want %x", parsed.SURBID, reply.SURBID)
+	}
+
+	if _, err := router.parseRoutingInfoV2(encoded[:common.PerHopRoutingSizeV2-1]); err == nil {
+		t.Error("Expected error for short routing info, got nil")
+	}
+}
+
+// fakeResolver resolves node IDs from a fixed set of directory entries
+type fakeResolver struct {
+	nodes []common.NodeInfo
+}
+
+func (f *fakeResolver) ResolveNode(publicKey []byte) (*common.NodeInfo, error) {
+	for i := range f.nodes {
+		if bytes.Equal(f.nodes[i].PublicKey, publicKey) {
+			if !f.nodes[i].Healthy {
+				return nil, fmt.Errorf("node %s is unhealthy", f.nodes[i].ID)
+			}
+			return &f.nodes[i], nil
+		}
+	}
+	return nil, errors.New("node not found")
+}
+
+func TestRouter_RouteByNodeID(t *testing.T) {
+	_, path := newTestPath(t, 3)
+	resolver := &fakeResolver{nodes: append([]common.NodeInfo(nil), path...)}
+	for i := range resolver.nodes {
+		resolver.nodes[i].Healthy = true
+	}
+
+	// The node moved since the sender fetched the bootstrap set
+	resolver.nodes[1].Address = "192.0.2.7"
+	resolver.nodes[1].Port = 9443
+
+	_, priv, _ := common.GenerateKeypair()
+	router := NewRouterWithConfig(priv, &RouterConfig{Resolver: resolver})
+	path[0].PublicKey = priv.Public().(ed25519.PublicKey)
+	path[0].OnionKey = nil
+
+	packet, err := BuildPacket(path, []byte("payload"), &BuildOptions{RouteByNodeID: true})
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	decision, err := router.ProcessPacket(packet)
+	if err != nil {
+		t.Fatalf("ProcessPacket failed: %v", err)
+	}
+	if decision.NextAddress != "192.0.2.7:9443" {
+		t.Errorf("NextAddress = %q, want the directory's current address %q", decision.NextAddress, "192.0.2.7:9443")
+	}
+}
+
+func TestRouter_RouteByNodeIDRefused(t *testing.T) {
+	_, path := newTestPath(t, 2)
+	pub, priv, _ := common.GenerateKeypair()
+	path[0] = common.NodeInfo{ID: "node0", PublicKey: pub, Address: "10.0.0.100", Port: 9000}
+
+	unhealthy := path[1]
+	unhealthy.Healthy = false
+
+	testCases := []struct {
+		name     string
+		resolver NodeResolver
+	}{
+		{"no resolver", nil},
+		{"unknown node", &fakeResolver{}},
+		{"unhealthy node", &fakeResolver{nodes: []common.NodeInfo{unhealthy}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			router := NewRouterWithConfig(priv, &RouterConfig{Resolver: tc.resolver})
+
+			packet, err := BuildPacket(path, []byte("payload"), &BuildOptions{RouteByNodeID: true})
+			if err != nil {
+				t.Fatalf("BuildPacket failed: %v", err)
+			}
+			if _, err := router.ProcessPacket(packet); err == nil {
+				t.Error("Expected error, got nil")
+			}
+			if dropped := router.GetStats().PacketsDropped; dropped != 1 {
+				t.Errorf("PacketsDropped = %d, want 1", dropped)
+			}
+		})
+	}
+}
+
+func TestBuildPacket_RouteByNodeIDRequiresV2(t *testing.T) {
+	_, path := newTestPath(t, 2)
+
+	_, err := BuildPacket(path, []byte("payload"), &BuildOptions{RouteByNodeID: true, Version: common.PacketVersion1})
+	if err == nil {
+		t.Error("Expected error for node ID addressing in a version 1 packet, got nil")
+	}
+
+	// Hostnames are fine when next hops are addressed by ID
+	path[1].Address = "node2.ghostnodes.network"
+	if _, err := BuildPacket(path, []byte("payload"), &BuildOptions{RouteByNodeID: true}); err != nil {
+		t.Errorf("BuildPacket with hostname next hop failed: %v", err)
+	}
+}
+
+func TestBuildPacketV3_PathLengths(t *testing.T) {
+	for n := 1; n <= MaxPathLengthV3; n++ {
+		t.Run(fmt.Sprintf("%d hops", n), func(t *testing.T) {
+			routers, path := newTestPath(t, n)
+
+			payload := []byte("post-quantum path")
+			packet, err := BuildPacket(path, payload, &BuildOptions{Version: common.PacketVersion3})
+			if err != nil {
+				t.Fatalf("BuildPacket failed: %v", err)
+			}
+			if len(packet) != common.PacketSizeLarge || packet[0] != common.PacketVersion3 {
+				t.Fatalf("Packet is %d bytes, version 0x%02x; want a %d-byte version 3 packet",
+					len(packet), packet[0], common.PacketSizeLarge)
+			}
+
+			for i, router := range routers {
+				decision, err := router.ProcessPacket(packet)
+				if err != nil {
+					t.Fatalf("Hop %d: ProcessPacket failed: %v", i+1, err)
+				}
+				if stats := router.GetStats(); stats.PacketsV3 != 1 {
+					t.Errorf("Hop %d: PacketsV3 = %d, want 1", i+1, stats.PacketsV3)
+				}
+
+				if i < n-1 {
+					if decision.Action != ActionForward {
+						t.Fatalf("Hop %d: Action = %v, want ActionForward", i+1, decision.Action)
+					}
+					if len(decision.NextPacket) != common.PacketSizeLarge || decision.NextPacket[0] != common.PacketVersion3 {
+						t.Fatalf("Hop %d: forwarded packet is not a full-size version 3 packet", i+1)
+					}
+					packet = decision.NextPacket
+					continue
+				}
+
+				if decision.Action != ActionDeliver {
+					t.Fatalf("Hop %d: Action = %v, want ActionDeliver", i+1, decision.Action)
+				}
+				if !bytes.Equal(decision.Payload[:len(payload)], payload) {
+					t.Errorf("Payload = %q, want prefix %q", decision.Payload[:len(payload)], payload)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildPacketV3_RequiresKEMKey(t *testing.T) {
+	_, path := newTestPath(t, 2)
+	path[1].KEMKey = nil
+
+	if _, err := BuildPacket(path, []byte("payload"), &BuildOptions{Version: common.PacketVersion3}); err == nil {
+		t.Error("Expected error for a hop without a KEM key, got nil")
+	}
+
+	// A KEM key must carry the node's signature
+	_, path = newTestPath(t, 1)
+	path[0].KEMKeySignature = bytes.Repeat([]byte{0x01}, 64)
+	if _, err := BuildPacket(path, []byte("payload"), &BuildOptions{Version: common.PacketVersion3}); err == nil {
+		t.Error("Expected error for an invalid KEM key signature, got nil")
+	}
+
+	// An unsigned key, e.g. swapped in by a tampered directory entry
+	_, path = newTestPath(t, 1)
+	kemKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatalf("GenerateKey768 failed: %v", err)
+	}
+	path[0].KEMKey = kemKey.EncapsulationKey().Bytes()
+	path[0].KEMKeySignature = nil
+	if _, err := BuildPacket(path, []byte("payload"), &BuildOptions{Version: common.PacketVersion3}); err == nil {
+		t.Error("Expected error for an unsigned KEM key, got nil")
+	}
+}
+
+func TestRouterV3_KEMCiphertextAuthenticated(t *testing.T) {
+	routers, path := newTestPath(t, 1)
+
+	packet, err := BuildPacket(path, []byte("payload"), &BuildOptions{Version: common.PacketVersion3})
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	// The X25519 half alone does not open the header
+	tampered := append([]byte(nil), packet...)
+	tampered[common.HeaderSize] ^= 0x01
+	if _, err := routers[0].ProcessPacket(tampered); err == nil {
+		t.Error("Expected error for a modified KEM ciphertext, got nil")
+	}
+
+	// Nor does a packet cut down to the standard size class
+	if _, err := routers[0].ProcessPacket(packet[:common.PacketSize]); err == nil {
+		t.Error("Expected error for a version 3 packet of standard size, got nil")
+	}
+
+	if _, err := routers[0].ProcessPacket(packet); err != nil {
+		t.Errorf("ProcessPacket failed: %v", err)
+	}
+}
+
+func TestRouterV3_KeyRing(t *testing.T) {
+	router, keys, node := newKeyRingHop(t, time.Hour)
+
+	packet, err := BuildPacket([]common.NodeInfo{node}, []byte("payload"), &BuildOptions{Version: common.PacketVersion3})
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	// The KEM key rotates with the onion key and stays valid one more epoch
+	keys.Rotate(time.Now().Add(time.Hour))
+	if bytes.Equal(keys.KEMPublicKey(), node.KEMKey) {
+		t.Error("KEM key unchanged after rotation")
+	}
+	decision, err := router.ProcessPacket(packet)
+	if err != nil {
+		t.Fatalf("Packet for the previous epoch rejected: %v", err)
+	}
+	if decision.Action != ActionDeliver {
+		t.Errorf("Action = %v, want ActionDeliver", decision.Action)
+	}
+}
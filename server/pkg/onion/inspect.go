@@ -0,0 +1,213 @@
+package onion
+
+import (
+	"crypto/ed25519"
+	"crypto/mlkem"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// InspectKey is a node's onion private key, used to walk packets offline
+type InspectKey struct {
+	Name       string                     // Shown in traces, e.g. the key file
+	PrivateKey []byte                     // X25519 onion private key
+	KEMKey     *mlkem.DecapsulationKey768 // ML-KEM key for version 3 packets; nil skips them
+}
+
+// IdentityInspectKey returns the static onion keys derived from a node's
+// identity key. Nodes use them when they run without a key ring; epoch
+// keys are generated at random and never leave the node.
+func IdentityInspectKey(name string, identity ed25519.PrivateKey) InspectKey {
+	return InspectKey{
+		Name:       name,
+		PrivateKey: common.Ed25519PrivateKeyToCurve25519(identity),
+		KEMKey:     staticKEMKey(identity),
+	}
+}
+
+// InspectOptions holds the checks InspectPacket reports on
+type InspectOptions struct {
+	Now               time.Time     // Time to check expiry at (default: now)
+	MaxPacketLifetime time.Duration // Replay window of the nodes (default: DefaultMaxPacketLifetime)
+	Request           bool          // The packet is an onion request
+}
+
+// HopTrace records what one hop learned from a packet
+type HopTrace struct {
+	Version           byte
+	Size              int
+	EphemeralKey      []byte
+	HeaderHMAC        []byte
+	KEMCiphertextSize int
+
+	Key     string              // Name of the key the header HMAC verified under; empty if none did
+	Routing *common.RoutingInfo // This hop's routing info; nil if the header did not open
+	NextHop string              // host:port, or the node ID for nodes addressed by ID
+
+	// Checks a node would refuse the packet on at Now. The walk goes on
+	// past them.
+	Problems []string
+
+	Action  Action   // What the hop does with the packet
+	Payload []byte   // Final hop: the decrypted payload, or the layered payload of a reply
+	Request *Request // Final hop of an onion request
+
+	Err error // Why the walk stopped at this hop
+}
+
+// InspectPacket walks packet through the hops whose onion keys are given,
+// with the same steps as ProcessPacket, and returns what each hop sees.
+// The walk stops at the final hop, or at the first hop whose header none
+// of the keys opens or whose layer fails to decode; that hop's Err says
+// why. Nothing is recorded in replay filters.
+func InspectPacket(packet []byte, keys []InspectKey, opts *InspectOptions) []*HopTrace {
+	var options InspectOptions
+	if opts != nil {
+		options = *opts
+	}
+	if options.Now.IsZero() {
+		options.Now = time.Now()
+	}
+	if options.MaxPacketLifetime <= 0 {
+		options.MaxPacketLifetime = DefaultMaxPacketLifetime
+	}
+
+	// A path never has more hops than the format's routing blob holds
+	var traces []*HopTrace
+	for len(traces) <= MaxPathLength {
+		trace, next := inspectHop(packet, keys, &options)
+		traces = append(traces, trace)
+		if next == nil {
+			break
+		}
+		packet = next
+	}
+	return traces
+}
+
+// inspectHop opens one layer of packet and returns its trace and, if the
+// hop forwards it, the packet for the next hop
+func inspectHop(packet []byte, keys []InspectKey, opts *InspectOptions) (*HopTrace, []byte) {
+	trace := &HopTrace{Size: len(packet)}
+	if len(packet) == 0 {
+		trace.Err = errors.New("empty packet")
+		return trace, nil
+	}
+	trace.Version = packet[0]
+
+	format, err := lookupFormat(packet[0])
+	if err != nil {
+		trace.Err = err
+		return trace, nil
+	}
+	if len(packet) >= format.payloadOffset() {
+		trace.EphemeralKey = packet[1:33]
+		trace.HeaderHMAC = packet[33:common.HeaderSize]
+		trace.KEMCiphertextSize = format.kemSize
+	}
+
+	// Every key gets the same treatment as the router's own
+	var l *layer
+	var r *Router
+	trace.Err = errors.New("no usable keys")
+	for _, key := range keys {
+		if format.kemSize > 0 && key.KEMKey == nil {
+			continue
+		}
+		r = &Router{onionKey: key.PrivateKey, kemKey: key.KEMKey}
+		l, err = r.openLayer(packet, format, opts.Request, opts.Now)
+		if err == nil {
+			trace.Key = key.Name
+			break
+		}
+		trace.Err = err
+	}
+	if l == nil {
+		return trace, nil
+	}
+	defer putRoutingBuffer(l.routingInfo)
+	trace.Err = nil
+
+	routing := l.routing
+	trace.Routing = copyRoutingInfo(routing)
+	trace.Problems = inspectProblems(format, routing, opts)
+
+	reply := routing.Flags&common.RoutingFlagReply != 0
+	layered := reply || format.layeredPayload
+
+	switch {
+	case routing.AddressType == 0x00 && routing.Flags&common.RoutingFlagDummy != 0:
+		trace.Action = ActionDrop
+		return trace, nil
+
+	case routing.AddressType == 0x00:
+		trace.Action = ActionDeliver
+		payload, err := l.peelPayload(layered)
+		if err != nil {
+			trace.Err = err
+			return trace, nil
+		}
+		if reply {
+			trace.Action = ActionDeliverReply
+			trace.Payload = payload
+			return trace, nil
+		}
+
+		if trace.Payload, err = r.decryptPayload(l.keys.encKey, payload); err != nil {
+			trace.Err = fmt.Errorf("payload decryption failed: %w", err)
+			return trace, nil
+		}
+		if opts.Request {
+			trace.Action = ActionRequest
+			trace.Request, trace.Err = openRequest(trace.Payload)
+		}
+		return trace, nil
+	}
+
+	trace.Action = ActionForward
+	if routing.AddressType == 0x20 {
+		trace.NextHop = hex.EncodeToString(routing.Address)
+	} else {
+		trace.NextHop = r.formatAddress(routing)
+	}
+
+	next, err := r.nextPacket(l, layered)
+	if err != nil {
+		trace.Err = err
+		return trace, nil
+	}
+	return trace, next
+}
+
+// inspectProblems lists the checks after the header HMAC that a node
+// would refuse routing on
+func inspectProblems(format *headerFormat, routing *common.RoutingInfo, opts *InspectOptions) []string {
+	var problems []string
+	if format == formatV1 {
+		problems = append(problems, "version 1 is only accepted during the transition period")
+	}
+	if (routing.Flags&common.RoutingFlagRequest != 0) != opts.Request {
+		problems = append(problems, "request flag does not match the transport")
+	}
+	if opts.Now.After(routing.Expiry) {
+		problems = append(problems, fmt.Sprintf("expired %v ago", opts.Now.Sub(routing.Expiry).Round(time.Second)))
+	}
+	if routing.Expiry.After(opts.Now.Add(opts.MaxPacketLifetime)) {
+		problems = append(problems, fmt.Sprintf("expiry exceeds the %v replay window", opts.MaxPacketLifetime))
+	}
+	return problems
+}
+
+// copyRoutingInfo copies routing info out of the routing buffer
+func copyRoutingInfo(routing *common.RoutingInfo) *common.RoutingInfo {
+	copied := *routing
+	copied.Address = append([]byte(nil), routing.Address...)
+	copied.HMAC = append([]byte(nil), routing.HMAC...)
+	copied.SURBID = append([]byte(nil), routing.SURBID...)
+	copied.KEMCiphertext = append([]byte(nil), routing.KEMCiphertext...)
+	return &copied
+}
@@ -0,0 +1,140 @@
+package onion
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// newInspectPath creates n nodes using the static onion keys derived
+// from their identity keys, and the matching inspection keys
+func newInspectPath(t *testing.T, n int) ([]common.NodeInfo, []InspectKey) {
+	t.Helper()
+
+	path := make([]common.NodeInfo, n)
+	keys := make([]InspectKey, n)
+	for i := range path {
+		pub, priv, err := common.GenerateKeypair()
+		if err != nil {
+			t.Fatalf("Failed to generate keypair: %v", err)
+		}
+		path[i] = common.NodeInfo{
+			ID:        fmt.Sprintf("node%d", i+1),
+			PublicKey: pub,
+			Address:   fmt.Sprintf("10.0.0.%d", i+1),
+			Port:      uint16(9000 + i),
+		}
+		keys[i] = IdentityInspectKey(path[i].ID, priv)
+	}
+	return path, keys
+}
+
+func TestInspectPacket_ThreeHops(t *testing.T) {
+	path, keys := newInspectPath(t, 3)
+
+	payload := []byte("inspect me")
+	packet, err := BuildPacket(path, payload, &BuildOptions{
+		Delays: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 0},
+	})
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	// Keys are matched to hops by trying each
+	shuffled := []InspectKey{keys[2], keys[0], keys[1]}
+	traces := InspectPacket(packet, shuffled, nil)
+	if len(traces) != 3 {
+		t.Fatalf("Traces = %d, want 3", len(traces))
+	}
+
+	for i, trace := range traces {
+		if trace.Err != nil {
+			t.Fatalf("Hop %d: %v", i+1, trace.Err)
+		}
+		if trace.Key != path[i].ID {
+			t.Errorf("Hop %d: Key = %q, want %q", i+1, trace.Key, path[i].ID)
+		}
+		if trace.Version != common.PacketVersion2 || len(trace.Problems) != 0 {
+			t.Errorf("Hop %d: Version = 0x%02x, Problems = %v", i+1, trace.Version, trace.Problems)
+		}
+	}
+
+	if traces[0].Action != ActionForward || traces[0].NextHop != "10.0.0.2:9001" {
+		t.Errorf("Hop 1: Action = %v, NextHop = %q", traces[0].Action, traces[0].NextHop)
+	}
+	if traces[1].Routing.Delay != 200 {
+		t.Errorf("Hop 2: Delay = %d, want 200", traces[1].Routing.Delay)
+	}
+	if traces[2].Action != ActionDeliver || !bytes.HasPrefix(traces[2].Payload, payload) {
+		t.Errorf("Hop 3: Action = %v, Payload = %q", traces[2].Action, traces[2].Payload)
+	}
+}
+
+func TestInspectPacket_MissingKey(t *testing.T) {
+	path, keys := newInspectPath(t, 3)
+
+	packet, err := BuildPacket(path, []byte("payload"), nil)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	traces := InspectPacket(packet, []InspectKey{keys[0], keys[2]}, nil)
+	if len(traces) != 2 {
+		t.Fatalf("Traces = %d, want 2", len(traces))
+	}
+	if traces[1].Key != "" || traces[1].Routing != nil {
+		t.Errorf("Hop 2 opened with %q", traces[1].Key)
+	}
+	if traces[1].Err == nil || !strings.Contains(traces[1].Err.Error(), "HMAC") {
+		t.Errorf("Hop 2: Err = %v, want HMAC failure", traces[1].Err)
+	}
+}
+
+func TestInspectPacket_Problems(t *testing.T) {
+	path, keys := newInspectPath(t, 1)
+
+	packet, err := BuildPacket(path, []byte("payload"), nil)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	// An expired packet is still decoded
+	traces := InspectPacket(packet, keys, &InspectOptions{Now: time.Now().Add(24 * time.Hour)})
+	if len(traces) != 1 || traces[0].Err != nil {
+		t.Fatalf("Unexpected traces: %+v", traces)
+	}
+	if len(traces[0].Problems) != 1 || !strings.HasPrefix(traces[0].Problems[0], "expired") {
+		t.Errorf("Problems = %v, want expired", traces[0].Problems)
+	}
+	if traces[0].Action != ActionDeliver {
+		t.Errorf("Action = %v, want ActionDeliver", traces[0].Action)
+	}
+
+	// Posted on the wrong endpoint
+	traces = InspectPacket(packet, keys, &InspectOptions{Request: true})
+	if traces[0].Err == nil {
+		t.Error("Packet inspected as a request")
+	}
+}
+
+func TestInspectPacket_Request(t *testing.T) {
+	path, keys := newInspectPath(t, 2)
+
+	req := &Request{Method: "GET", Path: "/v1/swarm/messages/session"}
+	packet, _, err := BuildRequest(path, req, nil)
+	if err != nil {
+		t.Fatalf("BuildRequest failed: %v", err)
+	}
+
+	traces := InspectPacket(packet, keys, &InspectOptions{Request: true})
+	if len(traces) != 2 || traces[1].Err != nil {
+		t.Fatalf("Unexpected traces: %+v", traces)
+	}
+	if traces[1].Action != ActionRequest || traces[1].Request.Path != req.Path {
+		t.Errorf("Hop 2: Action = %v, Request = %+v", traces[1].Action, traces[1].Request)
+	}
+}
@@ -0,0 +1,190 @@
+package onion
+
+import (
+	"crypto/ed25519"
+	"crypto/mlkem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// DefaultKeyEpoch is how long an onion key stays current
+const DefaultKeyEpoch = 24 * time.Hour
+
+// KeyRing holds a node's medium-term X25519 onion keys and the ML-KEM-768
+// keys used alongside them by version 3 packets. A fresh pair is
+// generated for every epoch and signed with the identity key; packets are
+// accepted for the current and previous epoch only, and older private keys
+// are wiped, so compromising the node later does not expose traffic
+// recorded more than one epoch earlier.
+type KeyRing struct {
+	identity    ed25519.PrivateKey
+	epochLength time.Duration
+
+	current  *epochKey
+	previous *epochKey
+
+	mu sync.RWMutex
+}
+
+// epochKey is the onion key pair and KEM key for one epoch
+type epochKey struct {
+	epoch      uint64
+	privateKey []byte
+	publicKey  []byte
+	signature  []byte
+
+	kemKey       *mlkem.DecapsulationKey768
+	kemPublicKey []byte
+	kemSignature []byte
+}
+
+// NewKeyRing creates a key ring and generates the key for the current epoch
+func NewKeyRing(identity ed25519.PrivateKey, epochLength time.Duration) (*KeyRing, error) {
+	if epochLength <= 0 {
+		epochLength = DefaultKeyEpoch
+	}
+	if epochLength < time.Second {
+		return nil, errors.New("key epoch must be at least one second")
+	}
+
+	k := &KeyRing{
+		identity:    identity,
+		epochLength: epochLength,
+	}
+	if _, err := k.Rotate(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// EpochLength returns how long each onion key stays current
+func (k *KeyRing) EpochLength() time.Duration {
+	return k.epochLength
+}
+
+// Epoch returns the epoch number containing t
+func (k *KeyRing) Epoch(t time.Time) uint64 {
+	return uint64(t.Unix()) / k.epochSecs()
+}
+
+// epochSecs returns the epoch length in whole seconds, as published
+func (k *KeyRing) epochSecs() uint64 {
+	return uint64(k.epochLength / time.Second)
+}
+
+// Rotate advances the ring to the epoch containing now, generating a new
+// key and wiping keys older than the previous epoch. It reports whether
+// the current key changed.
+func (k *KeyRing) Rotate(now time.Time) (bool, error) {
+	epoch := k.Epoch(now)
+
+	k.mu.RLock()
+	upToDate := k.current != nil && k.current.epoch >= epoch
+	k.mu.RUnlock()
+	if upToDate {
+		return false, nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.current != nil && k.current.epoch >= epoch {
+		return false, nil
+	}
+
+	publicKey, privateKey, err := common.X25519KeyPair()
+	if err != nil {
+		return false, fmt.Errorf("onion key generation failed: %w", err)
+	}
+	kemKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		return false, fmt.Errorf("KEM key generation failed: %w", err)
+	}
+	kemPublicKey := kemKey.EncapsulationKey().Bytes()
+	next := &epochKey{
+		epoch:        epoch,
+		privateKey:   privateKey,
+		publicKey:    publicKey,
+		signature:    common.SignOnionKey(k.identity, epoch, k.epochSecs(), publicKey),
+		kemKey:       kemKey,
+		kemPublicKey: kemPublicKey,
+		kemSignature: common.SignKEMKey(k.identity, epoch, kemPublicKey),
+	}
+
+	// The outgoing key stays usable for one more epoch if it is adjacent
+	k.previous.wipe()
+	k.previous = nil
+	if k.current != nil && k.current.epoch+1 == epoch {
+		k.previous = k.current
+	} else {
+		k.current.wipe()
+	}
+	k.current = next
+
+	return true, nil
+}
+
+// Publish sets the current onion key, KEM key, their epoch and
+// signatures on node
+func (k *KeyRing) Publish(node *common.NodeInfo) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	node.OnionKey = append([]byte(nil), k.current.publicKey...)
+	node.OnionKeyEpoch = k.current.epoch
+	node.OnionKeyEpochSecs = k.epochSecs()
+	node.OnionKeySignature = append([]byte(nil), k.current.signature...)
+	node.KEMKey = append([]byte(nil), k.current.kemPublicKey...)
+	node.KEMKeySignature = append([]byte(nil), k.current.kemSignature...)
+}
+
+// PublicKey returns the current onion public key
+func (k *KeyRing) PublicKey() []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return append([]byte(nil), k.current.publicKey...)
+}
+
+// KEMPublicKey returns the current ML-KEM-768 encapsulation key
+func (k *KeyRing) KEMPublicKey() []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return append([]byte(nil), k.current.kemPublicKey...)
+}
+
+// forEachKey calls fn with the private keys valid at now, current first,
+// until fn returns true. Keys must not be retained after fn returns.
+func (k *KeyRing) forEachKey(now time.Time, fn func(privateKey []byte, kemKey *mlkem.DecapsulationKey768) bool) error {
+	if _, err := k.Rotate(now); err != nil {
+		return err
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range []*epochKey{k.current, k.previous} {
+		if key != nil && fn(key.privateKey, key.kemKey) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// wipe overwrites the private key in memory. crypto/mlkem cannot
+// overwrite a decapsulation key, so the KEM key is only dropped.
+func (e *epochKey) wipe() {
+	if e == nil {
+		return
+	}
+	for i := range e.privateKey {
+		e.privateKey[i] = 0
+	}
+	e.kemKey = nil
+}
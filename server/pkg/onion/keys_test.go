@@ -0,0 +1,140 @@
+package onion
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// newKeyRingHop creates a router with a key ring and its directory entry
+func newKeyRingHop(t *testing.T, epochLength time.Duration) (*Router, *KeyRing, common.NodeInfo) {
+	t.Helper()
+
+	pub, priv, err := common.GenerateKeypair()
+	if err != nil {
+		t.Fatalf("Failed to generate keypair: %v", err)
+	}
+	keys, err := NewKeyRing(priv, epochLength)
+	if err != nil {
+		t.Fatalf("NewKeyRing failed: %v", err)
+	}
+
+	router := NewRouterWithConfig(priv, &RouterConfig{Keys: keys})
+	node := common.NodeInfo{
+		ID:        "node1",
+		PublicKey: pub,
+		Address:   "10.0.0.1",
+		Port:      9000,
+	}
+	keys.Publish(&node)
+
+	return router, keys, node
+}
+
+func TestKeyRing_RotateKeepsPreviousEpoch(t *testing.T) {
+	_, priv, _ := common.GenerateKeypair()
+	keys, err := NewKeyRing(priv, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKeyRing failed: %v", err)
+	}
+
+	now := time.Now()
+	first := keys.current
+	firstPrivate := first.privateKey
+
+	rotated, err := keys.Rotate(now)
+	if err != nil || rotated {
+		t.Fatalf("Rotate within the same epoch = %v, %v, want false, nil", rotated, err)
+	}
+
+	rotated, err = keys.Rotate(now.Add(time.Hour))
+	if err != nil || !rotated {
+		t.Fatalf("Rotate into the next epoch = %v, %v, want true, nil", rotated, err)
+	}
+	if keys.previous != first {
+		t.Fatal("Previous epoch key not retained")
+	}
+	if bytes.Equal(keys.PublicKey(), first.publicKey) {
+		t.Error("Public key unchanged after rotation")
+	}
+
+	keys.Rotate(now.Add(2 * time.Hour))
+	if keys.previous == first {
+		t.Error("Key two epochs old still retained")
+	}
+	if !bytes.Equal(firstPrivate, make([]byte, len(firstPrivate))) {
+		t.Error("Expired private key not wiped")
+	}
+}
+
+func TestKeyRing_GapWipesOldKeys(t *testing.T) {
+	_, priv, _ := common.GenerateKeypair()
+	keys, _ := NewKeyRing(priv, time.Hour)
+
+	first := keys.current
+	keys.Rotate(time.Now().Add(3 * time.Hour))
+
+	if keys.previous != nil {
+		t.Error("Non-adjacent key retained as previous")
+	}
+	if !bytes.Equal(first.privateKey, make([]byte, len(first.privateKey))) {
+		t.Error("Skipped epoch key not wiped")
+	}
+}
+
+func TestKeyRing_PublishedKeyVerifies(t *testing.T) {
+	_, keys, node := newKeyRingHop(t, time.Hour)
+
+	if node.OnionKeyEpoch != keys.Epoch(time.Now()) {
+		t.Errorf("OnionKeyEpoch = %d, want %d", node.OnionKeyEpoch, keys.Epoch(time.Now()))
+	}
+	if err := common.VerifyOnionKey(&node); err != nil {
+		t.Errorf("VerifyOnionKey failed: %v", err)
+	}
+	if err := common.VerifyKEMKey(&node); err != nil {
+		t.Errorf("VerifyKEMKey failed: %v", err)
+	}
+}
+
+func TestKeyRing_RouterAcceptsPreviousEpoch(t *testing.T) {
+	router, keys, node := newKeyRingHop(t, time.Hour)
+
+	packet, err := BuildPacket([]common.NodeInfo{node}, []byte("payload"), nil)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+	stale, err := BuildPacket([]common.NodeInfo{node}, []byte("payload"), nil)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	// One rotation later the packet is still accepted
+	keys.Rotate(time.Now().Add(time.Hour))
+	if _, err := router.ProcessPacket(packet); err != nil {
+		t.Fatalf("Packet for the previous epoch rejected: %v", err)
+	}
+
+	// Two rotations later its key is gone
+	keys.Rotate(time.Now().Add(2 * time.Hour))
+	if _, err := router.ProcessPacket(stale); err == nil {
+		t.Error("Expected packet two epochs old to be rejected, got nil")
+	}
+}
+
+func TestNewKeyRing_InvalidEpoch(t *testing.T) {
+	_, priv, _ := common.GenerateKeypair()
+
+	if _, err := NewKeyRing(priv, time.Millisecond); err == nil {
+		t.Error("Expected error for sub-second epoch, got nil")
+	}
+
+	keys, err := NewKeyRing(priv, 0)
+	if err != nil {
+		t.Fatalf("NewKeyRing failed: %v", err)
+	}
+	if keys.EpochLength() != DefaultKeyEpoch {
+		t.Errorf("EpochLength = %v, want %v", keys.EpochLength(), DefaultKeyEpoch)
+	}
+}
@@ -0,0 +1,377 @@
+package onion
+
+import (
+	"container/heap"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Mixing strategy names accepted by NewMixStrategy
+const (
+	MixNone    = "none"
+	MixPool    = "pool"
+	MixPoisson = "poisson"
+)
+
+// ErrMixFull is returned by Mixer.Submit when the mix is at capacity
+var ErrMixFull = errors.New("mix pool full")
+
+// MixStrategy decides when forwarded packets leave the node.
+// Strategies are not safe for concurrent use; Mixer serializes access.
+// Time is passed in explicitly so strategies can be driven by a fake clock.
+type MixStrategy interface {
+	// Add accepts a packet at time now
+	Add(decision *RoutingDecision, now time.Time)
+	// Release returns the packets due at time now, in output order
+	Release(now time.Time) []*RoutingDecision
+	// NextRelease reports when Release should next be called (zero if idle)
+	NextRelease() time.Time
+	// Len returns the number of packets held
+	Len() int
+}
+
+// MixConfig configures a mixing strategy
+type MixConfig struct {
+	Strategy  string        // MixNone, MixPool or MixPoisson
+	Interval  time.Duration // Pool flush interval (default 1s)
+	Retain    int           // Packets the pool keeps back at each flush
+	MeanDelay time.Duration // Mean Poisson mix delay (default 1s)
+}
+
+// NewMixStrategy creates the strategy described by config.
+// It returns nil for MixNone, meaning packets are not mixed.
+func NewMixStrategy(config *MixConfig) (MixStrategy, error) {
+	switch config.Strategy {
+	case "", MixNone:
+		return nil, nil
+	case MixPool:
+		return NewTimedPoolMix(config.Interval, config.Retain), nil
+	case MixPoisson:
+		return NewPoissonMix(config.MeanDelay), nil
+	default:
+		return nil, fmt.Errorf("unknown mixing strategy: %q", config.Strategy)
+	}
+}
+
+// newMixRand returns a generator seeded from crypto/rand; mixing decisions
+// must not be predictable by an observer
+func newMixRand() *rand.Rand {
+	var seed [32]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return rand.New(rand.NewChaCha8(seed))
+}
+
+// poolMaxDwellRounds is the number of rounds a packet can stay in a
+// timed pool mix before it is sent regardless of retain
+const poolMaxDwellRounds = 4
+
+// TimedPoolMix collects packets and, every interval, sends all but retain
+// randomly chosen packets in random order. With retain > 0 a packet may stay
+// in the pool across several rounds, so an observer cannot tell which round
+// an incoming packet left in. Packets held for poolMaxDwellRounds rounds
+// leave at the next flush, so retained packets do not wait for more
+// traffic forever.
+type TimedPoolMix struct {
+	interval  time.Duration
+	retain    int
+	maxDwell  time.Duration
+	pool      []pooledPacket
+	nextFlush time.Time
+	rng       *rand.Rand
+}
+
+// pooledPacket is a packet held by a timed pool mix
+type pooledPacket struct {
+	decision *RoutingDecision
+	added    time.Time
+}
+
+// NewTimedPoolMix creates a timed pool mix
+func NewTimedPoolMix(interval time.Duration, retain int) *TimedPoolMix {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if retain < 0 {
+		retain = 0
+	}
+
+	return &TimedPoolMix{
+		interval: interval,
+		retain:   retain,
+		maxDwell: poolMaxDwellRounds * interval,
+		rng:      newMixRand(),
+	}
+}
+
+// Add accepts a packet into the pool
+func (m *TimedPoolMix) Add(decision *RoutingDecision, now time.Time) {
+	m.pool = append(m.pool, pooledPacket{decision: decision, added: now})
+	if m.nextFlush.IsZero() {
+		m.nextFlush = now.Add(m.interval)
+	}
+}
+
+// Release flushes the pool once the round timer has expired
+func (m *TimedPoolMix) Release(now time.Time) []*RoutingDecision {
+	if m.nextFlush.IsZero() || now.Before(m.nextFlush) {
+		return nil
+	}
+
+	m.rng.Shuffle(len(m.pool), func(i, j int) {
+		m.pool[i], m.pool[j] = m.pool[j], m.pool[i]
+	})
+
+	// The first retain packets stay unless they have dwelt too long
+	var out []*RoutingDecision
+	kept := 0
+	for i, p := range m.pool {
+		if i < m.retain && now.Sub(p.added) < m.maxDwell {
+			m.pool[kept] = p
+			kept++
+			continue
+		}
+		out = append(out, p.decision)
+	}
+	clear(m.pool[kept:])
+	m.pool = m.pool[:kept]
+
+	if len(m.pool) > 0 {
+		m.nextFlush = now.Add(m.interval)
+	} else {
+		m.nextFlush = time.Time{}
+	}
+
+	return out
+}
+
+// NextRelease returns the end of the current round
+func (m *TimedPoolMix) NextRelease() time.Time {
+	return m.nextFlush
+}
+
+// Len returns the pool size
+func (m *TimedPoolMix) Len() int {
+	return len(m.pool)
+}
+
+// PoissonMix (Loopix-style stop-and-go mix) holds every packet for an
+// independent exponentially distributed delay. The memoryless delay means
+// the time a packet has already spent in the node says nothing about when
+// it will leave, so output order is decorrelated from input order.
+type PoissonMix struct {
+	meanDelay time.Duration
+	queue     mixQueue
+	seq       uint64
+	rng       *rand.Rand
+}
+
+// NewPoissonMix creates a Poisson mix with the given mean delay
+func NewPoissonMix(meanDelay time.Duration) *PoissonMix {
+	if meanDelay <= 0 {
+		meanDelay = time.Second
+	}
+
+	return &PoissonMix{
+		meanDelay: meanDelay,
+		rng:       newMixRand(),
+	}
+}
+
+// Add schedules a packet after an exponential delay
+func (m *PoissonMix) Add(decision *RoutingDecision, now time.Time) {
+	delay := time.Duration(m.rng.ExpFloat64() * float64(m.meanDelay))
+	m.seq++
+	heap.Push(&m.queue, &mixEntry{
+		decision:  decision,
+		releaseAt: now.Add(delay),
+		seq:       m.seq,
+	})
+}
+
+// Release returns every packet whose delay has elapsed
+func (m *PoissonMix) Release(now time.Time) []*RoutingDecision {
+	var out []*RoutingDecision
+	for m.queue.Len() > 0 && !m.queue[0].releaseAt.After(now) {
+		out = append(out, heap.Pop(&m.queue).(*mixEntry).decision)
+	}
+	return out
+}
+
+// NextRelease returns the release time of the earliest packet
+func (m *PoissonMix) NextRelease() time.Time {
+	if m.queue.Len() == 0 {
+		return time.Time{}
+	}
+	return m.queue[0].releaseAt
+}
+
+// Len returns the number of packets held
+func (m *PoissonMix) Len() int {
+	return m.queue.Len()
+}
+
+// Mixer runs a MixStrategy in the background, passing released packets to output
+type Mixer struct {
+	strategy MixStrategy
+	capacity int
+	output   func(*RoutingDecision)
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// Stats
+	packetsMixed    uint64
+	packetsReleased uint64
+	packetsDropped  uint64
+
+	mu sync.Mutex
+}
+
+// NewMixer creates a mixer holding at most capacity packets (unbounded if
+// capacity <= 0) and starts its release loop
+func NewMixer(strategy MixStrategy, capacity int, output func(*RoutingDecision)) *Mixer {
+	m := &Mixer{
+		strategy: strategy,
+		capacity: capacity,
+		output:   output,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	m.wg.Add(1)
+	go m.run()
+
+	return m
+}
+
+// Submit hands a forwarding decision to the mix.
+// It never blocks; ErrMixFull is returned when the mix is at capacity.
+func (m *Mixer) Submit(decision *RoutingDecision) error {
+	m.mu.Lock()
+	if m.capacity > 0 && m.strategy.Len() >= m.capacity {
+		m.packetsDropped++
+		m.mu.Unlock()
+		return ErrMixFull
+	}
+	m.strategy.Add(decision, time.Now())
+	m.packetsMixed++
+	m.mu.Unlock()
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Close stops the release loop. Packets still in the mix are discarded.
+func (m *Mixer) Close() error {
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+	m.wg.Wait()
+	return nil
+}
+
+// GetStats returns mixing statistics
+func (m *Mixer) GetStats() MixStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return MixStats{
+		PoolSize:        m.strategy.Len(),
+		PacketsMixed:    m.packetsMixed,
+		PacketsReleased: m.packetsReleased,
+		PacketsDropped:  m.packetsDropped,
+	}
+}
+
+// run releases packets as the strategy makes them due
+func (m *Mixer) run() {
+	defer m.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		m.mu.Lock()
+		released := m.strategy.Release(time.Now())
+		m.packetsReleased += uint64(len(released))
+		next := m.strategy.NextRelease()
+		m.mu.Unlock()
+
+		for _, decision := range released {
+			m.output(decision)
+		}
+
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-m.wake:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// MixStats contains mixing statistics
+type MixStats struct {
+	PoolSize        int
+	PacketsMixed    uint64
+	PacketsReleased uint64
+	PacketsDropped  uint64 // Rejected because the mix was full
+}
+
+// mixEntry is a packet scheduled for release by PoissonMix
+type mixEntry struct {
+	decision  *RoutingDecision
+	releaseAt time.Time
+	seq       uint64
+}
+
+// mixQueue is a min-heap of entries ordered by release time
+type mixQueue []*mixEntry
+
+func (q mixQueue) Len() int { return len(q) }
+
+func (q mixQueue) Less(i, j int) bool {
+	if q[i].releaseAt.Equal(q[j].releaseAt) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].releaseAt.Before(q[j].releaseAt)
+}
+
+func (q mixQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *mixQueue) Push(x interface{}) { *q = append(*q, x.(*mixEntry)) }
+
+func (q *mixQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
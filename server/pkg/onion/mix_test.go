@@ -0,0 +1,287 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for driving mix strategies
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1700000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// mixDecisions creates n forwarding decisions tagged by arrival order
+func mixDecisions(n int) []*RoutingDecision {
+	decisions := make([]*RoutingDecision, n)
+	for i := range decisions {
+		decisions[i] = &RoutingDecision{
+			Action:      ActionForward,
+			NextAddress: fmt.Sprintf("10.0.0.%d:9000", i),
+		}
+	}
+	return decisions
+}
+
+// inArrivalOrder reports whether out preserves the order of in
+func inArrivalOrder(in, out []*RoutingDecision) bool {
+	index := make(map[*RoutingDecision]int, len(in))
+	for i, d := range in {
+		index[d] = i
+	}
+	for i := 1; i < len(out); i++ {
+		if index[out[i]] < index[out[i-1]] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTimedPoolMix_HoldsUntilInterval(t *testing.T) {
+	clock := newFakeClock()
+	mix := NewTimedPoolMix(time.Second, 0)
+
+	in := mixDecisions(3)
+	for _, d := range in {
+		mix.Add(d, clock.Now())
+		clock.Advance(100 * time.Millisecond)
+	}
+
+	if out := mix.Release(clock.Now()); len(out) != 0 {
+		t.Fatalf("Released %d packets before the interval, want 0", len(out))
+	}
+	if want := time.Unix(1700000001, 0); !mix.NextRelease().Equal(want) {
+		t.Errorf("NextRelease = %v, want %v", mix.NextRelease(), want)
+	}
+
+	clock.Advance(700 * time.Millisecond)
+	out := mix.Release(clock.Now())
+	if len(out) != 3 {
+		t.Fatalf("Released %d packets, want 3", len(out))
+	}
+	if mix.Len() != 0 || !mix.NextRelease().IsZero() {
+		t.Errorf("Pool not drained: len = %d, next = %v", mix.Len(), mix.NextRelease())
+	}
+}
+
+func TestTimedPoolMix_Reorders(t *testing.T) {
+	clock := newFakeClock()
+	mix := NewTimedPoolMix(time.Second, 0)
+
+	in := mixDecisions(32)
+	for _, d := range in {
+		mix.Add(d, clock.Now())
+		clock.Advance(10 * time.Millisecond)
+	}
+
+	clock.Advance(time.Second)
+	out := mix.Release(clock.Now())
+	if len(out) != len(in) {
+		t.Fatalf("Released %d packets, want %d", len(out), len(in))
+	}
+
+	// A shuffle of 32 packets keeps arrival order with probability 1/32!
+	if inArrivalOrder(in, out) {
+		t.Error("Pool mix released packets in arrival order")
+	}
+}
+
+func TestTimedPoolMix_Retain(t *testing.T) {
+	clock := newFakeClock()
+	mix := NewTimedPoolMix(time.Second, 4)
+
+	for _, d := range mixDecisions(10) {
+		mix.Add(d, clock.Now())
+	}
+
+	clock.Advance(time.Second)
+	if out := mix.Release(clock.Now()); len(out) != 6 {
+		t.Fatalf("Released %d packets, want 6", len(out))
+	}
+	if mix.Len() != 4 {
+		t.Fatalf("Pool size = %d, want 4", mix.Len())
+	}
+
+	// Retained packets wait for the next round and are not flushed alone
+	clock.Advance(time.Second)
+	if out := mix.Release(clock.Now()); len(out) != 0 {
+		t.Errorf("Released %d packets from a pool at the retain size, want 0", len(out))
+	}
+
+	mix.Add(mixDecisions(1)[0], clock.Now())
+	clock.Advance(time.Second)
+	if out := mix.Release(clock.Now()); len(out) != 1 {
+		t.Errorf("Released %d packets, want 1", len(out))
+	}
+}
+
+func TestTimedPoolMix_MaxDwell(t *testing.T) {
+	clock := newFakeClock()
+	mix := NewTimedPoolMix(time.Second, 4)
+
+	for _, d := range mixDecisions(4) {
+		mix.Add(d, clock.Now())
+	}
+
+	// With no further traffic the pool stays at the retain size until
+	// its packets reach the maximum dwell time
+	for round := 1; round < poolMaxDwellRounds; round++ {
+		clock.Advance(time.Second)
+		if out := mix.Release(clock.Now()); len(out) != 0 {
+			t.Fatalf("Round %d: released %d packets, want 0", round, len(out))
+		}
+		if mix.NextRelease().IsZero() {
+			t.Fatalf("Round %d: no flush scheduled with %d packets held", round, mix.Len())
+		}
+	}
+
+	clock.Advance(time.Second)
+	if out := mix.Release(clock.Now()); len(out) != 4 {
+		t.Fatalf("Released %d packets after the maximum dwell time, want 4", len(out))
+	}
+	if mix.Len() != 0 || !mix.NextRelease().IsZero() {
+		t.Errorf("Pool not drained: len = %d, next = %v", mix.Len(), mix.NextRelease())
+	}
+}
+
+func TestPoissonMix_Reorders(t *testing.T) {
+	clock := newFakeClock()
+	mix := NewPoissonMix(time.Second)
+
+	in := mixDecisions(32)
+	for _, d := range in {
+		mix.Add(d, clock.Now())
+		clock.Advance(10 * time.Millisecond)
+	}
+
+	var out []*RoutingDecision
+	for mix.Len() > 0 {
+		next := mix.NextRelease()
+		if next.Before(clock.Now()) {
+			next = clock.Now()
+		}
+		clock.now = next
+		out = append(out, mix.Release(clock.Now())...)
+	}
+
+	if len(out) != len(in) {
+		t.Fatalf("Released %d packets, want %d", len(out), len(in))
+	}
+	if inArrivalOrder(in, out) {
+		t.Error("Poisson mix released packets in arrival order")
+	}
+}
+
+func TestPoissonMix_MeanDelay(t *testing.T) {
+	clock := newFakeClock()
+	mix := NewPoissonMix(100 * time.Millisecond)
+
+	const n = 2000
+	for _, d := range mixDecisions(n) {
+		mix.Add(d, clock.Now())
+	}
+
+	// Sum of exponential delays, measured by stepping the clock
+	var total time.Duration
+	start := clock.Now()
+	for mix.Len() > 0 {
+		clock.now = mix.NextRelease()
+		total += time.Duration(len(mix.Release(clock.Now()))) * clock.Now().Sub(start)
+	}
+
+	mean := total / n
+	if mean < 80*time.Millisecond || mean > 120*time.Millisecond {
+		t.Errorf("Mean delay = %v, want about 100ms", mean)
+	}
+}
+
+func TestNewMixStrategy(t *testing.T) {
+	testCases := []struct {
+		strategy string
+		wantNil  bool
+		wantErr  bool
+	}{
+		{"", true, false},
+		{MixNone, true, false},
+		{MixPool, false, false},
+		{MixPoisson, false, false},
+		{"threshold", true, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.strategy, func(t *testing.T) {
+			strategy, err := NewMixStrategy(&MixConfig{Strategy: tc.strategy})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if (strategy == nil) != tc.wantNil {
+				t.Errorf("Strategy = %v, wantNil %v", strategy, tc.wantNil)
+			}
+		})
+	}
+}
+
+func TestMixer_ReleasesToOutput(t *testing.T) {
+	var mu sync.Mutex
+	var out []*RoutingDecision
+
+	mixer := NewMixer(NewTimedPoolMix(20*time.Millisecond, 0), 0, func(d *RoutingDecision) {
+		mu.Lock()
+		out = append(out, d)
+		mu.Unlock()
+	})
+	defer mixer.Close()
+
+	for _, d := range mixDecisions(5) {
+		if err := mixer.Submit(d); err != nil {
+			t.Fatalf("Submit failed: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(out)
+		mu.Unlock()
+		if n == 5 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	stats := mixer.GetStats()
+	if stats.PacketsMixed != 5 || stats.PacketsReleased != 5 {
+		t.Errorf("Mixed = %d, released = %d, want 5 and 5", stats.PacketsMixed, stats.PacketsReleased)
+	}
+	if stats.PoolSize != 0 {
+		t.Errorf("Pool size = %d, want 0", stats.PoolSize)
+	}
+}
+
+func TestMixer_Full(t *testing.T) {
+	mixer := NewMixer(NewTimedPoolMix(time.Hour, 0), 2, func(*RoutingDecision) {})
+	defer mixer.Close()
+
+	in := mixDecisions(3)
+	mixer.Submit(in[0])
+	mixer.Submit(in[1])
+
+	if err := mixer.Submit(in[2]); !errors.Is(err, ErrMixFull) {
+		t.Errorf("Submit error = %v, want ErrMixFull", err)
+	}
+
+	stats := mixer.GetStats()
+	if stats.PoolSize != 2 || stats.PacketsDropped != 1 {
+		t.Errorf("Pool size = %d, dropped = %d, want 2 and 1", stats.PoolSize, stats.PacketsDropped)
+	}
+}
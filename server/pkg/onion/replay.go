@@ -0,0 +1,454 @@
+package onion
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replay filter defaults
+const (
+	DefaultReplayEpoch         = time.Hour
+	DefaultMaxPacketLifetime   = time.Hour
+	DefaultReplayCapacity      = 100000
+	DefaultReplayFalsePositive = 1e-6
+	DefaultReplayFlushInterval = 10 * time.Second
+	DefaultReplayMaxFilters    = 16
+)
+
+// replayKeyPrefix namespaces persisted filters in the store
+const replayKeyPrefix = "replay/"
+
+// ReplayStore persists replay filters across restarts.
+// swarm.Storage implements this interface.
+type ReplayStore interface {
+	Store(key string, value []byte) error
+	Retrieve(key string) ([]byte, error)
+	Delete(key string) error
+	List(prefix string) ([]string, error)
+}
+
+// ReplayConfig holds replay filter configuration
+type ReplayConfig struct {
+	Epoch             time.Duration // Length of one filter epoch (default 1h)
+	MaxPacketLifetime time.Duration // Longest packet expiry accepted (default 1h)
+	Capacity          int           // Expected tags per epoch (default 100000)
+	FalsePositiveRate float64       // Target rate at capacity (default 1e-6)
+	FlushInterval     time.Duration // How often filters are persisted (default 10s)
+	MaxFilters        int           // Filters per epoch; the last then fills past Capacity (default 16)
+}
+
+// ReplayFilter remembers the tags of processed packets in one Bloom filter
+// per epoch. Enough epochs are kept that a tag is remembered for at least
+// MaxPacketLifetime, and Router refuses packets whose expiry lies further
+// in the future, so every replay either hits the filter or has expired.
+//
+// An epoch that receives more than Capacity tags gets another filter
+// once its current one is full, so the false positive rate stays near
+// FalsePositiveRate; only memory grows. Once an epoch has MaxFilters,
+// its last filter takes further tags past Capacity instead: memory stays
+// bounded and replays are still caught, but more fresh packets are
+// refused as false positives.
+//
+// With a store, filters are loaded at startup and written back every
+// FlushInterval and on Close; a crash loses at most one interval of tags.
+type ReplayFilter struct {
+	config  ReplayConfig
+	store   ReplayStore
+	bits    int // Bits per filter
+	hashes  int // Hash functions per tag
+	retain  int64
+	filters map[int64][]*bloomFilter // Filters of each epoch, the last one filling
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// Stats
+	checks    uint64
+	hits      uint64
+	overflows uint64
+	saturated uint64
+
+	mu sync.Mutex
+}
+
+// bloomFilter is the set of tags seen in one epoch
+type bloomFilter struct {
+	words  []uint64
+	hashes int
+	count  uint64
+	dirty  bool
+}
+
+// NewReplayFilter creates a replay filter, loading persisted epochs from
+// store. store may be nil for a memory-only filter.
+func NewReplayFilter(store ReplayStore, config *ReplayConfig) (*ReplayFilter, error) {
+	cfg := ReplayConfig{}
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.Epoch <= 0 {
+		cfg.Epoch = DefaultReplayEpoch
+	}
+	if cfg.MaxPacketLifetime <= 0 {
+		cfg.MaxPacketLifetime = DefaultMaxPacketLifetime
+	}
+	if cfg.Capacity <= 0 {
+		cfg.Capacity = DefaultReplayCapacity
+	}
+	if cfg.FalsePositiveRate <= 0 || cfg.FalsePositiveRate >= 1 {
+		cfg.FalsePositiveRate = DefaultReplayFalsePositive
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultReplayFlushInterval
+	}
+	if cfg.MaxFilters <= 0 {
+		cfg.MaxFilters = DefaultReplayMaxFilters
+	}
+	if cfg.Epoch < time.Second {
+		return nil, errors.New("replay epoch must be at least one second")
+	}
+
+	// Standard Bloom filter sizing: m = -n ln p / (ln 2)^2, k = (m/n) ln 2
+	n := float64(cfg.Capacity)
+	bits := int(math.Ceil(-n * math.Log(cfg.FalsePositiveRate) / (math.Ln2 * math.Ln2)))
+	bits = (bits + 63) / 64 * 64
+	hashes := int(math.Round(float64(bits) / n * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	f := &ReplayFilter{
+		config:  cfg,
+		store:   store,
+		bits:    bits,
+		hashes:  hashes,
+		retain:  int64((cfg.MaxPacketLifetime + cfg.Epoch - 1) / cfg.Epoch),
+		filters: make(map[int64][]*bloomFilter),
+		done:    make(chan struct{}),
+	}
+
+	if store != nil {
+		if err := f.load(time.Now()); err != nil {
+			return nil, err
+		}
+		f.wg.Add(1)
+		go f.flushLoop()
+	}
+
+	return f, nil
+}
+
+// MaxPacketLifetime returns the longest packet expiry the filter covers
+func (f *ReplayFilter) MaxPacketLifetime() time.Duration {
+	return f.config.MaxPacketLifetime
+}
+
+// Seen reports whether tag was recorded within the replay window, and
+// records it if not. Tags must be uniformly random, at least 16 bytes.
+func (f *ReplayFilter) Seen(tag []byte, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current := f.epoch(now)
+	f.rotate(current)
+	f.checks++
+
+	for epoch, filters := range f.filters {
+		if epoch > current {
+			continue
+		}
+		for _, filter := range filters {
+			if filter.test(tag) {
+				f.hits++
+				return true
+			}
+		}
+	}
+
+	filters := f.filters[current]
+	full := len(filters) > 0 && filters[len(filters)-1].count >= uint64(f.config.Capacity)
+	if full && len(filters) >= f.config.MaxFilters {
+		f.saturated++
+	} else if len(filters) == 0 || full {
+		if full {
+			f.overflows++
+		}
+		filters = append(filters, &bloomFilter{
+			words:  make([]uint64, f.bits/64),
+			hashes: f.hashes,
+		})
+		f.filters[current] = filters
+	}
+	filters[len(filters)-1].add(tag)
+
+	return false
+}
+
+// Flush writes modified epoch filters to the store
+func (f *ReplayFilter) Flush() error {
+	if f.store == nil {
+		return nil
+	}
+
+	// Snapshot under the lock, write without it
+	f.mu.Lock()
+	snapshots := make(map[string][]byte)
+	for epoch, filters := range f.filters {
+		for i, filter := range filters {
+			if filter.dirty {
+				snapshots[replayFilterKey(epoch, i)] = filter.marshal()
+				filter.dirty = false
+			}
+		}
+	}
+	f.mu.Unlock()
+
+	for key, data := range snapshots {
+		if err := f.store.Store(key, data); err != nil {
+			return fmt.Errorf("failed to persist replay filter %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// Close stops background flushing and persists the filters
+func (f *ReplayFilter) Close() error {
+	select {
+	case <-f.done:
+		return nil
+	default:
+		close(f.done)
+	}
+	f.wg.Wait()
+
+	return f.Flush()
+}
+
+// GetStats returns replay filter statistics
+func (f *ReplayFilter) GetStats() ReplayStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stats := ReplayStats{
+		Checks:    f.checks,
+		Hits:      f.hits,
+		Overflows: f.overflows,
+		Saturated: f.saturated,
+		Epochs:    len(f.filters),
+	}
+	for _, filters := range f.filters {
+		for _, filter := range filters {
+			stats.Tags += filter.count
+			stats.MemoryBytes += uint64(len(filter.words) * 8)
+		}
+	}
+
+	return stats
+}
+
+// epoch returns the epoch number containing t
+func (f *ReplayFilter) epoch(t time.Time) int64 {
+	return t.Unix() / int64(f.config.Epoch/time.Second)
+}
+
+// rotate drops epochs that no longer overlap the replay window; callers must hold f.mu
+func (f *ReplayFilter) rotate(current int64) {
+	for epoch, filters := range f.filters {
+		if epoch < current-f.retain {
+			delete(f.filters, epoch)
+			if f.store == nil {
+				continue
+			}
+			for i := range filters {
+				if err := f.store.Delete(replayFilterKey(epoch, i)); err != nil {
+					log.Printf("Failed to delete replay epoch %d: %v", epoch, err)
+				}
+			}
+		}
+	}
+}
+
+// load restores persisted epochs still inside the replay window. A
+// filter missing from the middle of an epoch is logged and skipped; the
+// filters after it are renumbered so their keys stay contiguous.
+func (f *ReplayFilter) load(now time.Time) error {
+	keys, err := f.store.List(replayKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list replay epochs: %w", err)
+	}
+
+	// Filters are loaded in order, so each keeps its index and key
+	type filterKey struct {
+		key          string
+		epoch, index int64
+	}
+	var found []filterKey
+	current := f.epoch(now)
+	for _, key := range keys {
+		epochPart, indexPart, _ := strings.Cut(strings.TrimPrefix(key, replayKeyPrefix), ".")
+		epoch, err := strconv.ParseInt(epochPart, 10, 64)
+		if err != nil {
+			continue
+		}
+		var index int64
+		if indexPart != "" {
+			if index, err = strconv.ParseInt(indexPart, 10, 64); err != nil || index < 1 {
+				continue
+			}
+		}
+		if epoch < current-f.retain {
+			f.store.Delete(key)
+			continue
+		}
+		found = append(found, filterKey{key: key, epoch: epoch, index: index})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].epoch != found[j].epoch {
+			return found[i].epoch < found[j].epoch
+		}
+		return found[i].index < found[j].index
+	})
+
+	for _, k := range found {
+		data, err := f.store.Retrieve(k.key)
+		if err != nil {
+			return fmt.Errorf("failed to load replay epoch %d: %w", k.epoch, err)
+		}
+		filter, err := unmarshalBloomFilter(data)
+		if err != nil {
+			return fmt.Errorf("corrupt replay epoch %d: %w", k.epoch, err)
+		}
+
+		index := len(f.filters[k.epoch])
+		if int64(index) != k.index {
+			log.Printf("Replay epoch %d is missing filter %d; loading filter %d in its place", k.epoch, index, k.index)
+			if err := f.store.Store(replayFilterKey(k.epoch, index), data); err != nil {
+				log.Printf("Failed to renumber replay epoch %d filter %d: %v", k.epoch, k.index, err)
+				filter.dirty = true
+			} else if err := f.store.Delete(k.key); err != nil {
+				log.Printf("Failed to delete replay epoch %d filter %d: %v", k.epoch, k.index, err)
+			}
+		}
+		f.filters[k.epoch] = append(f.filters[k.epoch], filter)
+	}
+
+	return nil
+}
+
+// flushLoop persists filters every FlushInterval
+func (f *ReplayFilter) flushLoop() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(f.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.Flush(); err != nil {
+				log.Printf("Replay filter flush failed: %v", err)
+			}
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// replayKey returns the store key for the first filter of an epoch
+func replayKey(epoch int64) string {
+	return replayKeyPrefix + strconv.FormatInt(epoch, 10)
+}
+
+// replayFilterKey returns the store key for filter index of an epoch;
+// filters after the first are keyed <epoch>.<index>
+func replayFilterKey(epoch int64, index int) string {
+	if index == 0 {
+		return replayKey(epoch)
+	}
+	return replayKey(epoch) + "." + strconv.Itoa(index)
+}
+
+// positions yields the bit indexes for tag using double hashing
+func (b *bloomFilter) positions(tag []byte, fn func(word int, mask uint64) bool) {
+	h1 := binary.LittleEndian.Uint64(tag[0:8])
+	h2 := binary.LittleEndian.Uint64(tag[8:16]) | 1
+	m := uint64(len(b.words) * 64)
+
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if !fn(int(bit/64), 1<<(bit%64)) {
+			return
+		}
+	}
+}
+
+// test reports whether tag may be in the filter
+func (b *bloomFilter) test(tag []byte) bool {
+	found := true
+	b.positions(tag, func(word int, mask uint64) bool {
+		if b.words[word]&mask == 0 {
+			found = false
+		}
+		return found
+	})
+	return found
+}
+
+// add inserts tag into the filter
+func (b *bloomFilter) add(tag []byte) {
+	b.positions(tag, func(word int, mask uint64) bool {
+		b.words[word] |= mask
+		return true
+	})
+	b.count++
+	b.dirty = true
+}
+
+// marshal encodes the filter as hashes (1) ‖ count (8) ‖ words (little-endian)
+func (b *bloomFilter) marshal() []byte {
+	data := make([]byte, 9+len(b.words)*8)
+	data[0] = byte(b.hashes)
+	binary.BigEndian.PutUint64(data[1:9], b.count)
+	for i, word := range b.words {
+		binary.LittleEndian.PutUint64(data[9+i*8:], word)
+	}
+	return data
+}
+
+// unmarshalBloomFilter decodes a filter written by marshal
+func unmarshalBloomFilter(data []byte) (*bloomFilter, error) {
+	if len(data) < 9+8 || (len(data)-9)%8 != 0 || data[0] == 0 {
+		return nil, errors.New("invalid filter encoding")
+	}
+
+	b := &bloomFilter{
+		words:  make([]uint64, (len(data)-9)/8),
+		hashes: int(data[0]),
+		count:  binary.BigEndian.Uint64(data[1:9]),
+	}
+	for i := range b.words {
+		b.words[i] = binary.LittleEndian.Uint64(data[9+i*8:])
+	}
+
+	return b, nil
+}
+
+// ReplayStats contains replay filter statistics
+type ReplayStats struct {
+	Checks      uint64 // Packets checked
+	Hits        uint64 // Replays detected (including false positives)
+	Overflows   uint64 // Filters added because an epoch's filter reached Capacity
+	Saturated   uint64 // Tags added past Capacity because the epoch had MaxFilters
+	Tags        uint64 // Tags held across retained epochs
+	Epochs      int    // Epoch filters held
+	MemoryBytes uint64 // Filter memory
+}
@@ -0,0 +1,277 @@
+package onion
+
+import (
+	"crypto/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/swarm"
+)
+
+// randomTag returns a tag as Router derives them: 32 uniform bytes
+func randomTag(t *testing.T) []byte {
+	t.Helper()
+	tag := make([]byte, 32)
+	if _, err := rand.Read(tag); err != nil {
+		t.Fatalf("Failed to generate tag: %v", err)
+	}
+	return tag
+}
+
+func TestReplayFilter_DetectsReplay(t *testing.T) {
+	f, err := NewReplayFilter(nil, nil)
+	if err != nil {
+		t.Fatalf("NewReplayFilter failed: %v", err)
+	}
+
+	now := time.Now()
+	tag := randomTag(t)
+
+	if f.Seen(tag, now) {
+		t.Fatal("New tag reported as seen")
+	}
+	if !f.Seen(tag, now) {
+		t.Error("Replayed tag not detected")
+	}
+	if f.Seen(randomTag(t), now) {
+		t.Error("Distinct tag reported as seen")
+	}
+
+	stats := f.GetStats()
+	if stats.Checks != 3 || stats.Hits != 1 || stats.Tags != 2 {
+		t.Errorf("Checks = %d, hits = %d, tags = %d, want 3, 1 and 2", stats.Checks, stats.Hits, stats.Tags)
+	}
+	if stats.MemoryBytes == 0 || stats.Epochs != 1 {
+		t.Errorf("Memory = %d, epochs = %d, want nonzero and 1", stats.MemoryBytes, stats.Epochs)
+	}
+}
+
+func TestReplayFilter_WindowCoversLifetime(t *testing.T) {
+	f, err := NewReplayFilter(nil, &ReplayConfig{
+		Epoch:             time.Minute,
+		MaxPacketLifetime: 5 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewReplayFilter failed: %v", err)
+	}
+
+	// Record at the very end of an epoch
+	start := time.Unix(60*1000, 0)
+	seenAt := start.Add(59 * time.Second)
+	tag := randomTag(t)
+	f.Seen(tag, seenAt)
+
+	// Still remembered when the longest-lived packet would expire
+	if !f.Seen(tag, seenAt.Add(5*time.Minute)) {
+		t.Fatal("Tag forgotten before the maximum packet lifetime elapsed")
+	}
+
+	// Forgotten once its epoch leaves the window
+	other := randomTag(t)
+	f.Seen(other, start)
+	if f.Seen(other, start.Add(7*time.Minute)) {
+		t.Error("Tag still remembered after its epoch rotated out")
+	}
+	if epochs := f.GetStats().Epochs; epochs != 1 {
+		t.Errorf("Epochs = %d, want 1", epochs)
+	}
+}
+
+func TestReplayFilter_PersistsAcrossRestart(t *testing.T) {
+	store := swarm.NewMemoryStorage()
+
+	f, err := NewReplayFilter(store, nil)
+	if err != nil {
+		t.Fatalf("NewReplayFilter failed: %v", err)
+	}
+
+	tag := randomTag(t)
+	f.Seen(tag, time.Now())
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	restarted, err := NewReplayFilter(store, nil)
+	if err != nil {
+		t.Fatalf("NewReplayFilter after restart failed: %v", err)
+	}
+	defer restarted.Close()
+
+	if !restarted.Seen(tag, time.Now()) {
+		t.Error("Replay accepted after restart")
+	}
+}
+
+func TestReplayFilter_DiscardsStaleEpochs(t *testing.T) {
+	store := swarm.NewMemoryStorage()
+
+	old := &bloomFilter{words: make([]uint64, 4), hashes: 3}
+	store.Store(replayKey(1), old.marshal())
+	store.Store(replayKey(2), []byte("garbage"))
+
+	// The corrupt epoch is stale too, so it is dropped without being parsed
+	f, err := NewReplayFilter(store, nil)
+	if err != nil {
+		t.Fatalf("NewReplayFilter failed: %v", err)
+	}
+	defer f.Close()
+
+	keys, _ := store.List(replayKeyPrefix)
+	if len(keys) != 0 {
+		t.Errorf("Stale epochs left in store: %v", keys)
+	}
+}
+
+func TestReplayFilter_CorruptEpoch(t *testing.T) {
+	store := swarm.NewMemoryStorage()
+	f, _ := NewReplayFilter(nil, nil)
+
+	store.Store(replayKey(f.epoch(time.Now())), []byte("garbage"))
+
+	if _, err := NewReplayFilter(store, nil); err == nil {
+		t.Error("Expected error loading corrupt epoch, got nil")
+	}
+}
+
+func TestReplayFilter_FalsePositiveRate(t *testing.T) {
+	const capacity = 10000
+	f, err := NewReplayFilter(nil, &ReplayConfig{Capacity: capacity, FalsePositiveRate: 0.01})
+	if err != nil {
+		t.Fatalf("NewReplayFilter failed: %v", err)
+	}
+
+	now := time.Now()
+	for i := 0; i < capacity; i++ {
+		f.Seen(randomTag(t), now)
+	}
+
+	// Probe the filter directly; Seen would insert the probes
+	filter := f.filters[f.epoch(now)][0]
+	falsePositives := 0
+	for i := 0; i < capacity; i++ {
+		if filter.test(randomTag(t)) {
+			falsePositives++
+		}
+	}
+
+	if rate := float64(falsePositives) / capacity; rate > 0.02 {
+		t.Errorf("False positive rate = %.4f, want about 0.01", rate)
+	}
+}
+
+func TestReplayFilter_Overfilled(t *testing.T) {
+	const capacity = 1000
+	store := swarm.NewMemoryStorage()
+	f, err := NewReplayFilter(store, &ReplayConfig{Capacity: capacity, FalsePositiveRate: 0.001})
+	if err != nil {
+		t.Fatalf("NewReplayFilter failed: %v", err)
+	}
+
+	now := time.Now()
+	tags := make([][]byte, 0, 10*capacity)
+	for i := 0; i < 10*capacity; i++ {
+		tag := randomTag(t)
+		if !f.Seen(tag, now) {
+			tags = append(tags, tag)
+		}
+	}
+
+	stats := f.GetStats()
+	if stats.Overflows != 9 || stats.Epochs != 1 {
+		t.Errorf("Overflows = %d, epochs = %d, want 9 and 1", stats.Overflows, stats.Epochs)
+	}
+
+	// A single filter at ten times its capacity would refuse most fresh
+	// tags; each full filter adds about its target rate instead
+	rejected := 0
+	for i := 0; i < capacity; i++ {
+		if f.Seen(randomTag(t), now) {
+			rejected++
+		}
+	}
+	if rate := float64(rejected) / capacity; rate > 0.05 {
+		t.Errorf("Fresh tags rejected at rate %.4f, want about 0.01", rate)
+	}
+
+	// Every filter of the epoch survives a restart
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	restarted, err := NewReplayFilter(store, &ReplayConfig{Capacity: capacity, FalsePositiveRate: 0.001})
+	if err != nil {
+		t.Fatalf("NewReplayFilter after restart failed: %v", err)
+	}
+	defer restarted.Close()
+
+	for _, tag := range [][]byte{tags[0], tags[len(tags)/2], tags[len(tags)-1]} {
+		if !restarted.Seen(tag, now) {
+			t.Error("Replay accepted after restart")
+		}
+	}
+}
+
+func TestReplayFilter_MaxFilters(t *testing.T) {
+	const capacity = 100
+	f, err := NewReplayFilter(nil, &ReplayConfig{Capacity: capacity, MaxFilters: 2})
+	if err != nil {
+		t.Fatalf("NewReplayFilter failed: %v", err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 5*capacity; i++ {
+		f.Seen(randomTag(t), now)
+	}
+
+	stats := f.GetStats()
+	if stats.Overflows != 1 {
+		t.Errorf("Overflows = %d, want 1", stats.Overflows)
+	}
+	if want := uint64(2 * f.bits / 8); stats.MemoryBytes != want {
+		t.Errorf("MemoryBytes = %d, want %d", stats.MemoryBytes, want)
+	}
+	if stats.Saturated == 0 {
+		t.Error("Saturated = 0, want tags past capacity")
+	}
+}
+
+func TestReplayFilter_MissingFilter(t *testing.T) {
+	config := &ReplayConfig{Capacity: 10}
+	f, err := NewReplayFilter(nil, config)
+	if err != nil {
+		t.Fatalf("NewReplayFilter failed: %v", err)
+	}
+
+	// Fill three filters of the current epoch and persist only the first
+	// and the last
+	now := time.Now()
+	var tags [][]byte
+	for len(f.filters[f.epoch(now)]) < 3 {
+		tag := randomTag(t)
+		if !f.Seen(tag, now) {
+			tags = append(tags, tag)
+		}
+	}
+	epoch := f.epoch(now)
+	store := swarm.NewMemoryStorage()
+	store.Store(replayFilterKey(epoch, 0), f.filters[epoch][0].marshal())
+	store.Store(replayFilterKey(epoch, 2), f.filters[epoch][2].marshal())
+
+	restarted, err := NewReplayFilter(store, config)
+	if err != nil {
+		t.Fatalf("NewReplayFilter with a missing filter failed: %v", err)
+	}
+	defer restarted.Close()
+
+	if !restarted.Seen(tags[0], now) || !restarted.Seen(tags[len(tags)-1], now) {
+		t.Error("Replay accepted from a loaded filter")
+	}
+
+	// The last filter now has the key of the missing one
+	keys, _ := store.List(replayKeyPrefix)
+	sort.Strings(keys)
+	if want := []string{replayFilterKey(epoch, 0), replayFilterKey(epoch, 1)}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys = %v, want %v", keys, want)
+	}
+}
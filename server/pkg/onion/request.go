@@ -0,0 +1,274 @@
+package onion
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// RequestBuckets are the sizes request and response bodies are padded to,
+// so their length on the wire only reveals the bucket
+var RequestBuckets = []int{1 << 10, 16 << 10, 128 << 10, 768 << 10}
+
+// requestOverhead is the AEAD nonce and tag around a padded body
+const requestOverhead = chacha20poly1305.NonceSize + chacha20poly1305.Overhead
+
+// responseNonce is the ChaCha20 nonce for the per-hop response layers.
+// Each response key layers exactly one response, so a constant nonce is safe.
+var responseNonce [chacha20poly1305.NonceSize]byte
+
+// Request is a swarm API call carried through the onion to the final hop
+type Request struct {
+	Method string
+	Path   string // e.g. /v1/swarm/messages/{sessionID}
+	Body   []byte
+}
+
+// Response is the final hop's answer to a Request
+type Response struct {
+	Status int
+	Body   []byte
+}
+
+// RequestKeys are the secrets the sender keeps to read the response to
+// an onion request
+type RequestKeys struct {
+	HopKeys [][]byte // Per-hop response keys, in path order
+}
+
+// BuildRequest builds an onion request that carries req along path. The
+// packet is a normal header followed by the request body, padded to one of
+// RequestBuckets; it is posted to the first hop's /v1/onion/request
+// endpoint. Every hop relays it synchronously and the last one executes
+// it; the response comes back on the same connection and is read with
+// OpenResponse. Requests are not delayed or mixed.
+func BuildRequest(path []common.NodeInfo, req *Request, opts *BuildOptions) ([]byte, *RequestKeys, error) {
+	body, err := encodeRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header, hops, err := buildHeader(path, opts, common.RoutingFlagRequest, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	format, _ := lookupFormat(header[0])
+	if !format.layeredPayload {
+		return nil, nil, errors.New("onion requests require packet version 2 or later")
+	}
+
+	payload, err := sealBody(hops[len(hops)-1].encKey, body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("request encryption failed: %w", err)
+	}
+	keys := &RequestKeys{HopKeys: make([][]byte, len(hops))}
+	for i, hop := range hops {
+		if err := xorPayloadStream(hop.encKey, payload); err != nil {
+			return nil, nil, fmt.Errorf("request encryption failed: %w", err)
+		}
+		keys.HopKeys[i] = responseKey(hop.encKey)
+	}
+
+	return append(header, payload...), keys, nil
+}
+
+// ProcessRequest processes an onion request received on the request
+// endpoint or a peer link. A relaying hop gets ActionForward: it must post
+// NextPacket to the next hop's request endpoint and return the answer
+// through WrapResponse. The final hop gets ActionRequest and answers with
+// SealResponse. Delay is not applied to requests.
+func (r *Router) ProcessRequest(packet []byte) (*RoutingDecision, error) {
+	if len(packet) == 0 {
+		return nil, errors.New("empty request")
+	}
+	return r.process(packet, true)
+}
+
+// parseRequest parses an onion request laid out as format: the header is
+// followed by a padded body
+func (r *Router) parseRequest(data []byte, format *headerFormat) (*common.OnionPacket, error) {
+	size := len(data) - format.payloadOffset() - requestOverhead
+	if size < 0 {
+		return nil, fmt.Errorf("invalid request size: %d", len(data))
+	}
+	if err := common.CheckPadding(size, RequestBuckets); err != nil {
+		return nil, err
+	}
+	return splitPacket(data, format), nil
+}
+
+// SealResponse encrypts the final hop's response to the request in
+// decision. Responses too large for the biggest bucket are replaced by an
+// error response.
+func SealResponse(decision *RoutingDecision, resp *Response) ([]byte, error) {
+	body, err := encodeResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	return sealBody(decision.ResponseKey, body)
+}
+
+// WrapResponse adds this hop's layer to the response relayed from the
+// next hop, so it looks different on every link
+func WrapResponse(decision *RoutingDecision, response []byte) ([]byte, error) {
+	if err := common.CheckPadding(len(response)-requestOverhead, RequestBuckets); err != nil {
+		return nil, fmt.Errorf("invalid response from next hop: %w", err)
+	}
+
+	wrapped := append([]byte(nil), response...)
+	if err := xorStream(decision.ResponseKey, responseNonce[:], wrapped); err != nil {
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// OpenResponse removes the relaying hops' layers from the response to an
+// onion request and decrypts it
+func OpenResponse(keys *RequestKeys, response []byte) (*Response, error) {
+	if len(keys.HopKeys) == 0 {
+		return nil, errors.New("no response keys")
+	}
+
+	data := append([]byte(nil), response...)
+	last := len(keys.HopKeys) - 1
+	for _, key := range keys.HopKeys[:last] {
+		if err := xorStream(key, responseNonce[:], data); err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := openBody(keys.HopKeys[last], data)
+	if err != nil {
+		return nil, errors.New("response authentication failed")
+	}
+	return decodeResponse(body)
+}
+
+// responseKey derives the key a hop seals or layers the response with
+// from its payload key
+func responseKey(encKey []byte) []byte {
+	return common.ComputeHMAC(encKey, []byte("GhostTalk-response"))
+}
+
+// openRequest decodes the decrypted payload of a request at its final hop
+func openRequest(payload []byte) (*Request, error) {
+	data, err := common.UnpadBucket(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	req, err := decodeRequest(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	return req, nil
+}
+
+// Request body layout, before padding:
+//
+//	0       method length
+//	1:      method
+//	...     path length (2 bytes), path
+//	...     body
+func encodeRequest(req *Request) ([]byte, error) {
+	if req.Method == "" || len(req.Method) > 0xff {
+		return nil, fmt.Errorf("invalid method: %q", req.Method)
+	}
+	if len(req.Path) == 0 || req.Path[0] != '/' || len(req.Path) > 0xffff {
+		return nil, fmt.Errorf("invalid path: %q", req.Path)
+	}
+
+	data := make([]byte, 0, 1+len(req.Method)+2+len(req.Path)+len(req.Body))
+	data = append(data, byte(len(req.Method)))
+	data = append(data, req.Method...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(req.Path)))
+	data = append(data, req.Path...)
+	return append(data, req.Body...), nil
+}
+
+// decodeRequest parses a request body encoded by encodeRequest
+func decodeRequest(data []byte) (*Request, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0])+2 {
+		return nil, errors.New("request too short")
+	}
+	method := string(data[1 : 1+data[0]])
+	data = data[1+len(method):]
+
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+n {
+		return nil, errors.New("request too short")
+	}
+
+	return &Request{
+		Method: method,
+		Path:   string(data[2 : 2+n]),
+		Body:   data[2+n:],
+	}, nil
+}
+
+// encodeResponse encodes resp as status (2 bytes) and body. Bodies too
+// large for the biggest bucket, with room for a circuit cell's command
+// byte and the padding marker, become an error response.
+func encodeResponse(resp *Response) ([]byte, error) {
+	if resp.Status < 100 || resp.Status > 999 {
+		return nil, fmt.Errorf("invalid status: %d", resp.Status)
+	}
+
+	body := binary.BigEndian.AppendUint16(nil, uint16(resp.Status))
+	body = append(body, resp.Body...)
+	if len(body)+2 > RequestBuckets[len(RequestBuckets)-1] {
+		body = binary.BigEndian.AppendUint16(nil, 507)
+		body = append(body, "response too large"...)
+	}
+	return body, nil
+}
+
+// decodeResponse parses a response encoded by encodeResponse
+func decodeResponse(data []byte) (*Response, error) {
+	if len(data) < 2 {
+		return nil, errors.New("response too short")
+	}
+	return &Response{
+		Status: int(binary.BigEndian.Uint16(data)),
+		Body:   data[2:],
+	}, nil
+}
+
+// sealBody pads plaintext to a request bucket and seals it under key
+func sealBody(key, plaintext []byte) ([]byte, error) {
+	padded, err := common.PadToBucket(plaintext, RequestBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize, requestOverhead+len(padded))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, padded, nil), nil
+}
+
+// openBody opens a body sealed by sealBody and removes its padding
+func openBody(key, sealed []byte) ([]byte, error) {
+	if len(sealed) < requestOverhead {
+		return nil, errors.New("body too short")
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := sealed[:chacha20poly1305.NonceSize]
+	padded, err := aead.Open(nil, nonce, sealed[chacha20poly1305.NonceSize:], nil)
+	if err != nil {
+		return nil, err
+	}
+	return common.UnpadBucket(padded)
+}
@@ -0,0 +1,156 @@
+package onion
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+func TestRequest_ThreeHopRoundTrip(t *testing.T) {
+	routers, path := newTestPath(t, 3)
+
+	req := &Request{Method: "GET", Path: "/v1/swarm/messages/session123", Body: []byte("query")}
+	packet, keys, err := BuildRequest(path, req, nil)
+	if err != nil {
+		t.Fatalf("BuildRequest failed: %v", err)
+	}
+	if want := formatV2.payloadOffset() + RequestBuckets[0] + requestOverhead; len(packet) != want {
+		t.Errorf("Request length = %d, want %d", len(packet), want)
+	}
+
+	// Relays keep their decisions to wrap the response on the way back
+	var relays []*RoutingDecision
+	for i, router := range routers[:2] {
+		decision, err := router.ProcessRequest(packet)
+		if err != nil {
+			t.Fatalf("Hop %d: ProcessRequest failed: %v", i+1, err)
+		}
+		if decision.Action != ActionForward {
+			t.Fatalf("Hop %d: Action = %v, want ActionForward", i+1, decision.Action)
+		}
+		if len(decision.NextPacket) != len(packet) {
+			t.Errorf("Hop %d: next request length = %d, want %d", i+1, len(decision.NextPacket), len(packet))
+		}
+		relays = append(relays, decision)
+		packet = decision.NextPacket
+	}
+
+	decision, err := routers[2].ProcessRequest(packet)
+	if err != nil {
+		t.Fatalf("Hop 3: ProcessRequest failed: %v", err)
+	}
+	if decision.Action != ActionRequest {
+		t.Fatalf("Hop 3: Action = %v, want ActionRequest", decision.Action)
+	}
+	if decision.Request.Method != req.Method || decision.Request.Path != req.Path || !bytes.Equal(decision.Request.Body, req.Body) {
+		t.Errorf("Request = %+v, want %+v", decision.Request, req)
+	}
+
+	response, err := SealResponse(decision, &Response{Status: 200, Body: []byte("messages")})
+	if err != nil {
+		t.Fatalf("SealResponse failed: %v", err)
+	}
+	for i := len(relays) - 1; i >= 0; i-- {
+		wrapped, err := WrapResponse(relays[i], response)
+		if err != nil {
+			t.Fatalf("Hop %d: WrapResponse failed: %v", i+1, err)
+		}
+		if bytes.Equal(wrapped, response) {
+			t.Errorf("Hop %d: response unchanged while relaying", i+1)
+		}
+		response = wrapped
+	}
+
+	resp, err := OpenResponse(keys, response)
+	if err != nil {
+		t.Fatalf("OpenResponse failed: %v", err)
+	}
+	if resp.Status != 200 || string(resp.Body) != "messages" {
+		t.Errorf("Response = %d %q, want 200 %q", resp.Status, resp.Body, "messages")
+	}
+
+	if stats := routers[0].GetStats(); stats.Requests != 1 {
+		t.Errorf("Requests = %d, want 1", stats.Requests)
+	}
+}
+
+func TestRequest_TransportMismatch(t *testing.T) {
+	router, node := newTestHop(t, "node1", "10.0.0.1", 9000)
+	path := []common.NodeInfo{node}
+
+	// A packet posted as a request
+	packet, err := BuildPacket(path, []byte("hello"), nil)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+	if _, err := router.ProcessRequest(packet); err == nil {
+		t.Error("ProcessRequest accepted a packet")
+	}
+
+	// A request on the packet path, padded to the packet size
+	request, _, err := BuildRequest(path, &Request{Method: "GET", Path: "/v1/swarm/messages/s"}, nil)
+	if err != nil {
+		t.Fatalf("BuildRequest failed: %v", err)
+	}
+	padded := make([]byte, common.PacketSize)
+	copy(padded, request)
+	if _, err := router.ProcessPacket(padded); err == nil {
+		t.Error("ProcessPacket accepted a request")
+	}
+}
+
+func TestRequest_InvalidSize(t *testing.T) {
+	router, node := newTestHop(t, "node1", "10.0.0.1", 9000)
+
+	packet, _, err := BuildRequest([]common.NodeInfo{node}, &Request{Method: "GET", Path: "/v1/swarm/messages/s"}, nil)
+	if err != nil {
+		t.Fatalf("BuildRequest failed: %v", err)
+	}
+	if _, err := router.ProcessRequest(packet[:len(packet)-1]); !errors.Is(err, common.ErrUnpaddedContent) {
+		t.Errorf("ProcessRequest error = %v, want ErrUnpaddedContent", err)
+	}
+}
+
+func TestBuildRequest_InvalidInput(t *testing.T) {
+	_, path := newTestPath(t, 1)
+
+	testCases := map[string]struct {
+		req  *Request
+		opts *BuildOptions
+	}{
+		"version 1":     {&Request{Method: "GET", Path: "/v1/swarm/messages/s"}, &BuildOptions{Version: common.PacketVersion1}},
+		"no method":     {&Request{Path: "/v1/swarm/messages/s"}, nil},
+		"relative path": {&Request{Method: "GET", Path: "v1/swarm/messages/s"}, nil},
+		"too large":     {&Request{Method: "POST", Path: "/v1/swarm/messages", Body: make([]byte, 1<<20)}, nil},
+	}
+
+	for name, tc := range testCases {
+		if _, _, err := BuildRequest(path, tc.req, tc.opts); err == nil {
+			t.Errorf("%s: BuildRequest succeeded, want error", name)
+		}
+	}
+}
+
+func TestOpenResponse_Tampered(t *testing.T) {
+	routers, path := newTestPath(t, 1)
+
+	packet, keys, err := BuildRequest(path, &Request{Method: "GET", Path: "/v1/swarm/messages/s"}, nil)
+	if err != nil {
+		t.Fatalf("BuildRequest failed: %v", err)
+	}
+	decision, err := routers[0].ProcessRequest(packet)
+	if err != nil {
+		t.Fatalf("ProcessRequest failed: %v", err)
+	}
+	response, err := SealResponse(decision, &Response{Status: 404})
+	if err != nil {
+		t.Fatalf("SealResponse failed: %v", err)
+	}
+
+	response[len(response)-1] ^= 1
+	if _, err := OpenResponse(keys, response); err == nil {
+		t.Error("OpenResponse accepted a tampered response")
+	}
+}
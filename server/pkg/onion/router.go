@@ -2,208 +2,602 @@ package onion
 
 import (
 	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/mlkem"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"sync"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+	"golang.org/x/crypto/chacha20"
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 )
 
+// routingNonce is the fixed ChaCha20 nonce for routing blob keystreams.
+// Each hop key is used for exactly one routing blob, so a constant nonce is safe.
+var routingNonce [chacha20.NonceSize]byte
+
+// payloadNonce is the ChaCha20 nonce for the per-hop payload layer. It
+// differs from routingNonce so the two keystreams are independent.
+var payloadNonce = [chacha20.NonceSize]byte{0x01}
+
 // Router handles onion packet processing
 type Router struct {
 	privateKey ed25519.PrivateKey
 	publicKey  ed25519.PublicKey
 	
-	// Replay protection cache
-	seenHMACs sync.Map // map[string]time.Time
+	// Epoch onion keys (nil: static key derived from the identity key)
+	keys *KeyRing
+	
+	// Static X25519 onion key pair and ML-KEM key, derived once when
+	// there is no key ring
+	onionKey       []byte
+	onionPublicKey []byte
+	kemKey         *mlkem.DecapsulationKey768
+	
+	// Replay protection
+	replay *ReplayFilter
+	
+	// Resolves next hops addressed by node ID
+	resolver NodeResolver
+	
+	// Open circuits (nil: circuit cells are rejected)
+	circuits *CircuitTable
 	
-	// Stats
-	packetsProcessed uint64
-	packetsForwarded uint64
-	packetsDelivered uint64
-	packetsDropped   uint64
+	// Version 1 packets are accepted until then
+	v1Until time.Time
+	
+	// Goroutines ProcessBatch spreads a batch over
+	workers int
+	
+	// Per-hop delay policy; requested delays are clamped into it
+	minDelay time.Duration
+	maxDelay time.Duration
+	
+	// Stats, updated concurrently by ProcessBatch workers
+	packetsProcessed atomic.Uint64
+	packetsV1        atomic.Uint64
+	packetsV3        atomic.Uint64
+	packetsForwarded atomic.Uint64
+	packetsDelivered atomic.Uint64
+	packetsDropped   atomic.Uint64
+	packetsDummy     atomic.Uint64
+	requests         atomic.Uint64
+	delaysClamped    atomic.Uint64
+}
+
+// RouterConfig holds optional router settings
+type RouterConfig struct {
+	Keys    *KeyRing      // Rotating onion keys (default: static key derived from the identity key)
+	Replay  *ReplayFilter // Replay filter (default: memory-only with default settings)
+	V1Until time.Time     // Accept version 1 packets until then (default: reject them)
+	Workers int           // Concurrent goroutines per ProcessBatch call (default: one per CPU)
+	
+	// Per-hop delay bounds. Delays requested by senders are raised to
+	// MinDelay and cut to MaxDelay (default: 0 and no limit).
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	// Resolver looks up next hops addressed by node ID (default: such
+	// packets are dropped). directory.Service implements it.
+	Resolver NodeResolver
+
+	// Circuits holds the circuits open at this node (default: circuit
+	// mode disabled)
+	Circuits *CircuitTable
+}
+
+// NodeResolver finds the current address of a node by its identity key
+type NodeResolver interface {
+	// ResolveNode returns the node, or an error if it is unknown or unhealthy
+	ResolveNode(publicKey []byte) (*common.NodeInfo, error)
 }
 
 // NewRouter creates a new onion router
 func NewRouter(privateKey ed25519.PrivateKey) *Router {
+	return NewRouterWithConfig(privateKey, nil)
+}
+
+// NewRouterWithConfig creates a new onion router with the given settings
+func NewRouterWithConfig(privateKey ed25519.PrivateKey, config *RouterConfig) *Router {
 	publicKey := privateKey.Public().(ed25519.PublicKey)
 	
 	r := &Router{
 		privateKey: privateKey,
 		publicKey:  publicKey,
+		workers:    runtime.NumCPU(),
+	}
+	
+	if config != nil {
+		r.keys = config.Keys
+		r.v1Until = config.V1Until
+		r.resolver = config.Resolver
+		r.circuits = config.Circuits
+		if config.Workers > 0 {
+			r.workers = config.Workers
+		}
+		r.minDelay = config.MinDelay
+		r.maxDelay = config.MaxDelay
+	}
+	
+	if r.keys == nil {
+		r.onionKey = common.Ed25519PrivateKeyToCurve25519(privateKey)
+		r.onionPublicKey, _ = curve25519.X25519(r.onionKey, curve25519.Basepoint)
+		r.kemKey = staticKEMKey(privateKey)
 	}
 	
-	// Start cleanup goroutine for replay cache
-	go r.cleanupReplayCache()
+	if config != nil && config.Replay != nil {
+		r.replay = config.Replay
+	} else {
+		// A memory-only filter has nothing to load and cannot fail
+		r.replay, _ = NewReplayFilter(nil, nil)
+	}
 	
 	return r
 }
 
+// OnionPublicKey returns the X25519 public key senders use to build packets for this node
+func (r *Router) OnionPublicKey() []byte {
+	if r.keys != nil {
+		return r.keys.PublicKey()
+	}
+	return r.onionPublicKey
+}
+
+// KEMPublicKey returns the ML-KEM-768 encapsulation key senders use to
+// build version 3 packets for this node
+func (r *Router) KEMPublicKey() []byte {
+	if r.keys != nil {
+		return r.keys.KEMPublicKey()
+	}
+	return r.kemKey.EncapsulationKey().Bytes()
+}
+
+// Publish sets the keys senders need to reach this router on node: the
+// current epoch keys of its key ring, or without one its static KEM key,
+// signed for epoch 0 (senders derive the static onion key from the
+// identity key)
+func (r *Router) Publish(node *common.NodeInfo) {
+	if r.keys != nil {
+		r.keys.Publish(node)
+		return
+	}
+	node.KEMKey = r.kemKey.EncapsulationKey().Bytes()
+	node.KEMKeySignature = common.SignKEMKey(r.privateKey, node.OnionKeyEpoch, node.KEMKey)
+}
+
+// staticKEMKey derives the ML-KEM key of a router without a key ring from
+// its identity key
+func staticKEMKey(privateKey ed25519.PrivateKey) *mlkem.DecapsulationKey768 {
+	// HKDF-SHA256 can always fill a seed, and any seed of SeedSize bytes is valid
+	seed := make([]byte, mlkem.SeedSize)
+	io.ReadFull(hkdf.New(sha256.New, privateKey.Seed(), nil, []byte("GhostTalk-static-kem-key")), seed)
+	key, _ := mlkem.NewDecapsulationKey768(seed)
+	return key
+}
+
 // ProcessPacket processes an onion packet and returns routing decision
 func (r *Router) ProcessPacket(packet []byte) (*RoutingDecision, error) {
-	if len(packet) != common.PacketSize {
+	if len(packet) != common.PacketSize && len(packet) != common.PacketSizeLarge {
 		return nil, fmt.Errorf("invalid packet size: %d", len(packet))
 	}
-	
-	// Parse packet
-	onionPkt, err := r.parsePacket(packet)
-	if err != nil {
-		r.packetsDropped++
-		return nil, fmt.Errorf("parse error: %w", err)
-	}
-	
+	return r.process(packet, false)
+}
+
+// process processes a packet, or an onion request if request is set
+func (r *Router) process(packet []byte, request bool) (*RoutingDecision, error) {
 	// Check version
-	if onionPkt.Version != common.PacketVersion {
-		r.packetsDropped++
-		return nil, fmt.Errorf("unsupported version: 0x%02x", onionPkt.Version)
+	now := time.Now()
+	format, err := lookupFormat(packet[0])
+	if err != nil {
+		r.packetsDropped.Add(1)
+		return nil, err
 	}
-	
-	// Check replay (HMAC must be unique)
-	hmacKey := fmt.Sprintf("%x", onionPkt.HeaderHMAC)
-	if _, exists := r.seenHMACs.LoadOrStore(hmacKey, time.Now()); exists {
-		r.packetsDropped++
-		return nil, errors.New("replay detected")
+	if format == formatV1 && !now.Before(r.v1Until) {
+		r.packetsDropped.Add(1)
+		return nil, errors.New("version 1 packets are no longer accepted")
 	}
 	
-	// Derive shared secret using ECDH
-	// Convert Ed25519 private key to Curve25519 for ECDH
-	curve25519PrivKey := ed25519PrivateKeyToCurve25519(r.privateKey)
-	
-	sharedSecret, err := common.X25519ECDH(curve25519PrivKey, onionPkt.EphemeralKey)
+	l, err := r.openLayer(packet, format, request, now)
 	if err != nil {
-		r.packetsDropped++
-		return nil, fmt.Errorf("ECDH failed: %w", err)
+		r.packetsDropped.Add(1)
+		return nil, err
+	}
+	// Routing fields alias the buffer; nothing returned may keep them
+	defer putRoutingBuffer(l.routingInfo)
+	routing, encKey := l.routing, l.keys.encKey
+	
+	// Requests are answered on the connection they arrive on; on the
+	// packet path there is nobody to answer, and vice versa
+	if (routing.Flags&common.RoutingFlagRequest != 0) != request {
+		r.packetsDropped.Add(1)
+		return nil, errors.New("request flag does not match the transport")
 	}
 	
-	// Derive keys
-	encKey, hmacKeyBytes, blindingFactor, err := common.DeriveKeys(sharedSecret, "GhostTalk-v1")
-	if err != nil {
-		r.packetsDropped++
-		return nil, fmt.Errorf("key derivation failed: %w", err)
+	// Link padding from a neighbor ends here. It is discarded before the
+	// replay check, so constant-rate padding does not fill the filter.
+	if routing.AddressType == 0x00 && routing.Flags&common.RoutingFlagDummy != 0 {
+		r.packetsDummy.Add(1)
+		return &RoutingDecision{Action: ActionDrop}, nil
 	}
 	
-	// Verify HMAC
-	computedHMAC := common.ComputeHMAC(hmacKeyBytes, append(onionPkt.EphemeralKey, onionPkt.RoutingBlob...))
-	if !common.VerifyHMAC(onionPkt.HeaderHMAC, computedHMAC) {
-		r.packetsDropped++
-		return nil, errors.New("HMAC verification failed")
+	// Check replay. Only authenticated packets are recorded, so forged
+	// packets cannot fill the filter; the tag is derived from the shared
+	// secret, which the sender cannot vary for a given packet.
+	if r.replay.Seen(common.Hash256(l.keys.sharedSecret), now) {
+		r.packetsDropped.Add(1)
+		return nil, errors.New("replay detected")
 	}
 	
-	// Decrypt routing info
-	routingInfo, err := r.decryptRoutingBlob(encKey, onionPkt.RoutingBlob)
-	if err != nil {
-		r.packetsDropped++
-		return nil, fmt.Errorf("routing decryption failed: %w", err)
+	// Check expiry
+	if now.After(routing.Expiry) {
+		r.packetsDropped.Add(1)
+		return nil, errors.New("packet expired")
 	}
 	
-	// Parse routing info
-	routing, err := r.parseRoutingInfo(routingInfo)
-	if err != nil {
-		r.packetsDropped++
-		return nil, fmt.Errorf("routing parse failed: %w", err)
+	// Packets living longer than the replay window could be replayed after
+	// their tag is forgotten
+	if routing.Expiry.After(now.Add(r.replay.MaxPacketLifetime())) {
+		r.packetsDropped.Add(1)
+		return nil, errors.New("packet lifetime exceeds replay window")
 	}
 	
-	// Check expiry
-	if time.Now().After(routing.Expiry) {
-		r.packetsDropped++
-		return nil, errors.New("packet expired")
+	r.packetsProcessed.Add(1)
+	if request {
+		r.requests.Add(1)
+	}
+	switch format {
+	case formatV1:
+		r.packetsV1.Add(1)
+	case formatV3:
+		r.packetsV3.Add(1)
 	}
 	
-	r.packetsProcessed++
+	// Every hop peels a payload layer, so the payload looks different on
+	// each link. Reply packets (sent on a SURB) gain a layer instead; only
+	// the originator can remove them. Version 1 forward packets carry no
+	// per-hop layers.
+	reply := routing.Flags&common.RoutingFlagReply != 0
+	layered := reply || format.layeredPayload
+	delay := r.hopDelay(routing.Delay)
 	
 	// Determine action
 	if routing.AddressType == 0x00 {
-		// Final hop - deliver locally
-		r.packetsDelivered++
+		payload, err := l.peelPayload(layered)
+		if err != nil {
+			return nil, err
+		}
+		
+		if reply {
+			r.packetsDelivered.Add(1)
+			// Final hop of a reply - only the SURB's originator can remove the layers
+			return &RoutingDecision{
+				Action:  ActionDeliverReply,
+				Payload: payload,
+				SURBID:  append([]byte(nil), routing.SURBID...),
+				Delay:   delay,
+			}, nil
+		}
 		
-		// Decrypt payload
-		payload, err := r.decryptPayload(encKey, onionPkt.EncryptedPayload)
+		// Final hop - decrypt and deliver locally
+		payload, err = r.decryptPayload(encKey, payload)
 		if err != nil {
 			return nil, fmt.Errorf("payload decryption failed: %w", err)
 		}
+		r.packetsDelivered.Add(1)
+		
+		if request {
+			// Final hop of a request - execute it and seal the response
+			req, err := openRequest(payload)
+			if err != nil {
+				return nil, err
+			}
+			return &RoutingDecision{
+				Action:      ActionRequest,
+				Request:     req,
+				ResponseKey: responseKey(encKey),
+			}, nil
+		}
 		
 		return &RoutingDecision{
 			Action:  ActionDeliver,
 			Payload: payload,
-			Delay:   time.Duration(routing.Delay) * time.Millisecond,
+			Delay:   delay,
 		}, nil
 	}
 	
+	// Find the next hop; nodes addressed by ID are looked up now, so their
+	// current address is used and unknown or unhealthy nodes are refused
+	nextAddress, err := r.nextHopAddress(routing)
+	if err != nil {
+		r.packetsDropped.Add(1)
+		return nil, err
+	}
+	
 	// Forward to next hop
-	r.packetsForwarded++
+	r.packetsForwarded.Add(1)
 	
-	// Blind ephemeral key for next hop
-	nextEphemeralKey, err := common.BlindPublicKey(onionPkt.EphemeralKey, blindingFactor)
+	nextPacket, err := r.nextPacket(l, layered)
 	if err != nil {
-		return nil, fmt.Errorf("key blinding failed: %w", err)
+		return nil, err
 	}
 	
-	// Shift routing blob (remove our layer, pad with zeros)
-	nextRoutingBlob := make([]byte, common.RoutingBlobSize)
-	copy(nextRoutingBlob, routingInfo[common.PerHopRoutingSize:])
-	// Rest is already zeros
+	decision := &RoutingDecision{
+		Action:      ActionForward,
+		NextAddress: nextAddress,
+		NextPacket:  nextPacket,
+		Delay:       delay,
+	}
+	if request {
+		decision.Delay = 0
+		decision.ResponseKey = responseKey(encKey)
+	}
+	return decision, nil
+}
+
+// layer is one hop's view of a packet whose header it opened
+type layer struct {
+	format      *headerFormat
+	packet      *common.OnionPacket
+	keys        *headerKeys
+	routingInfo []byte // From the routing buffer pool; see putRoutingBuffer
+	routing     *common.RoutingInfo
+}
+
+// openLayer parses a packet laid out as format, finds the onion key it
+// was built for and decrypts this hop's routing info. The caller must
+// release l.routingInfo, which the routing fields alias.
+func (r *Router) openLayer(packet []byte, format *headerFormat, request bool, now time.Time) (*layer, error) {
+	if request && !format.layeredPayload {
+		return nil, errors.New("onion requests require packet version 2 or later")
+	}
 	
-	// Compute new HMAC for next hop
-	nextHMAC := common.ComputeHMAC(hmacKeyBytes, append(nextEphemeralKey, nextRoutingBlob...))
+	// Parse packet
+	var onionPkt *common.OnionPacket
+	var err error
+	if request {
+		onionPkt, err = r.parseRequest(packet, format)
+	} else {
+		onionPkt, err = r.parsePacket(packet, format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse error: %w", err)
+	}
+	
+	// Find the onion key the packet was built for and verify the HMAC
+	keys, err := r.openHeader(onionPkt, format, now)
+	if err != nil {
+		return nil, err
+	}
 	
-	// Reassemble packet
-	nextPacket := r.assemblePacket(nextEphemeralKey, nextHMAC, nextRoutingBlob, onionPkt.EncryptedPayload)
+	// Decrypt routing info
+	routingInfo, err := r.decryptRoutingBlob(keys.encKey, onionPkt.RoutingBlob, format)
+	if err != nil {
+		return nil, fmt.Errorf("routing decryption failed: %w", err)
+	}
 	
-	// Build next address
-	nextAddress := r.formatAddress(routing)
+	// Parse routing info
+	routing, err := format.parse(r, routingInfo)
+	if err != nil {
+		putRoutingBuffer(routingInfo)
+		return nil, fmt.Errorf("routing parse failed: %w", err)
+	}
 	
-	return &RoutingDecision{
-		Action:      ActionForward,
-		NextAddress: nextAddress,
-		NextPacket:  nextPacket,
-		Delay:       time.Duration(routing.Delay) * time.Millisecond,
+	return &layer{
+		format:      format,
+		packet:      onionPkt,
+		keys:        keys,
+		routingInfo: routingInfo,
+		routing:     routing,
 	}, nil
 }
 
-// parsePacket parses raw bytes into OnionPacket
-func (r *Router) parsePacket(data []byte) (*common.OnionPacket, error) {
-	if len(data) != common.PacketSize {
-		return nil, errors.New("invalid packet size")
+// peelPayload copies the payload out of the packet, so the caller's
+// buffer is never modified, and removes this hop's layer if it has one
+func (l *layer) peelPayload(layered bool) ([]byte, error) {
+	payload := make([]byte, len(l.packet.EncryptedPayload))
+	copy(payload, l.packet.EncryptedPayload)
+	if layered {
+		if err := xorPayloadStream(l.keys.encKey, payload); err != nil {
+			return nil, fmt.Errorf("payload layer failed: %w", err)
+		}
+	}
+	return payload, nil
+}
+
+// nextPacket builds the packet for the next hop
+func (r *Router) nextPacket(l *layer, layered bool) ([]byte, error) {
+	format := l.format
+	
+	// Blind ephemeral key for next hop
+	nextEphemeralKey, err := common.BlindPublicKey(l.packet.EphemeralKey, l.keys.blindingFactor)
+	if err != nil {
+		return nil, fmt.Errorf("key blinding failed: %w", err)
+	}
+	
+	// Reassemble packet: the routing blob is shifted past our layer (the
+	// sender's filler makes the tail valid), and the sender embedded the
+	// next hop's HMAC (and KEM ciphertext) in our routing info. The payload
+	// layer is peeled in the new packet.
+	nextRoutingBlob := l.routingInfo[format.hopSize : format.hopSize+format.blobSize]
+	nextPacket := r.assemblePacket(format, nextEphemeralKey, l.routing.HMAC, l.routing.KEMCiphertext, nextRoutingBlob, l.packet.EncryptedPayload)
+	if layered {
+		if err := xorPayloadStream(l.keys.encKey, nextPacket[format.payloadOffset():]); err != nil {
+			return nil, fmt.Errorf("payload layer failed: %w", err)
+		}
+	}
+	
+	return nextPacket, nil
+}
+
+// hopDelay applies the delay policy to the delay a sender requested, in milliseconds
+func (r *Router) hopDelay(requested uint16) time.Duration {
+	delay := time.Duration(requested) * time.Millisecond
+	switch {
+	case delay < r.minDelay:
+		delay = r.minDelay
+	case r.maxDelay > 0 && delay > r.maxDelay:
+		delay = r.maxDelay
+	default:
+		return delay
+	}
+	r.delaysClamped.Add(1)
+	return delay
+}
+
+// headerKeys are the per-packet secrets derived from a verified header
+type headerKeys struct {
+	sharedSecret   []byte
+	encKey         []byte
+	blindingFactor []byte
+}
+
+// openHeader performs ECDH (and, for version 3, ML-KEM decapsulation) with
+// each onion key valid at now and returns the keys for the first one under
+// which the header HMAC verifies
+func (r *Router) openHeader(pkt *common.OnionPacket, format *headerFormat, now time.Time) (*headerKeys, error) {
+	var keys *headerKeys
+	lastErr := errors.New("HMAC verification failed")
+	
+	try := func(privateKey []byte, kemKey *mlkem.DecapsulationKey768) bool {
+		sharedSecret, err := common.X25519ECDH(privateKey, pkt.EphemeralKey)
+		if err != nil {
+			lastErr = fmt.Errorf("ECDH failed: %w", err)
+			return false
+		}
+		
+		// A ciphertext for another key decapsulates to an unrelated
+		// secret, so the HMAC check below rejects it
+		if format.kemSize > 0 {
+			kemSecret, err := kemKey.Decapsulate(pkt.KEMCiphertext)
+			if err != nil {
+				lastErr = fmt.Errorf("KEM decapsulation failed: %w", err)
+				return false
+			}
+			sharedSecret = common.HybridSecret(sharedSecret, kemSecret, pkt.KEMCiphertext, pkt.EphemeralKey)
+		}
+		
+		encKey, hmacKey, blindingFactor, err := common.DeriveKeys(sharedSecret, format.keyInfo)
+		if err != nil {
+			lastErr = fmt.Errorf("key derivation failed: %w", err)
+			return false
+		}
+		
+		if !common.VerifyHMAC(pkt.HeaderHMAC, headerMAC(hmacKey, pkt.EphemeralKey, pkt.KEMCiphertext, pkt.RoutingBlob)) {
+			return false
+		}
+		
+		keys = &headerKeys{
+			sharedSecret:   sharedSecret,
+			encKey:         encKey,
+			blindingFactor: blindingFactor,
+		}
+		return true
+	}
+	
+	if r.keys != nil {
+		if err := r.keys.forEachKey(now, try); err != nil {
+			return nil, err
+		}
+	} else {
+		// Without a key ring the onion keys are derived from the identity key
+		try(r.onionKey, r.kemKey)
 	}
 	
+	if keys == nil {
+		return nil, lastErr
+	}
+	return keys, nil
+}
+
+// parsePacket parses raw bytes into OnionPacket laid out as format
+func (r *Router) parsePacket(data []byte, format *headerFormat) (*common.OnionPacket, error) {
+	if len(data) != format.packetSize {
+		return nil, fmt.Errorf("invalid size for version 0x%02x: %d", format.version, len(data))
+	}
+	return splitPacket(data, format), nil
+}
+
+// splitPacket slices a packet laid out as format into its fields. The
+// payload is whatever follows the header.
+func splitPacket(data []byte, format *headerFormat) *common.OnionPacket {
+	blobOffset := format.blobOffset()
 	pkt := &common.OnionPacket{
 		Version:          data[0],
 		EphemeralKey:     data[1:33],
 		HeaderHMAC:       data[33:65],
-		RoutingBlob:      data[65:680],
-		EncryptedPayload: data[680:1280],
+		RoutingBlob:      data[blobOffset : blobOffset+format.blobSize],
+		EncryptedPayload: data[format.payloadOffset():],
+	}
+	if format.kemSize > 0 {
+		pkt.KEMCiphertext = data[common.HeaderSize:blobOffset]
 	}
 	
-	return pkt, nil
+	return pkt
 }
 
-// decryptRoutingBlob decrypts the routing blob
-func (r *Router) decryptRoutingBlob(key, ciphertext []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.New(key)
-	if err != nil {
-		return nil, err
-	}
-	
-	// Use first 12 bytes of ciphertext as nonce
-	if len(ciphertext) < 12 {
-		return nil, errors.New("ciphertext too short")
+// decryptRoutingBlob peels this hop's layer off the routing blob.
+// The blob is extended with one hop's worth of zero bytes before
+// decryption, so the result holds our routing info followed by the full
+// blob for the next hop. The result comes from the routing buffer pool;
+// see putRoutingBuffer.
+func (r *Router) decryptRoutingBlob(key, ciphertext []byte, format *headerFormat) ([]byte, error) {
+	if len(ciphertext) != format.blobSize {
+		return nil, errors.New("invalid routing blob size")
 	}
 	
-	nonce := ciphertext[:12]
+	plaintext := getRoutingBuffer(format.blobSize + format.hopSize)
+	copy(plaintext, ciphertext)
+	clear(plaintext[format.blobSize:])
 	
-	// Decrypt (no AAD for routing blob)
-	plaintext, err := aead.Open(nil, nonce, ciphertext[12:], nil)
-	if err != nil {
+	if err := xorRoutingStream(key, plaintext); err != nil {
 		return nil, err
 	}
 	
 	return plaintext, nil
 }
 
-// decryptPayload decrypts the payload
+// headerMAC computes the header HMAC over the ephemeral key, KEM
+// ciphertext (nil before version 3) and routing blob, written in turn so
+// they need not be joined into a new buffer
+func headerMAC(key, ephemeralKey, kemCiphertext, routingBlob []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(ephemeralKey)
+	mac.Write(kemCiphertext)
+	mac.Write(routingBlob)
+	return mac.Sum(nil)
+}
+
+// xorRoutingStream XORs data in place with the routing keystream for key
+func xorRoutingStream(key, data []byte) error {
+	return xorStream(key, routingNonce[:], data)
+}
+
+// xorPayloadStream XORs a payload in place with the per-hop layer keystream for key
+func xorPayloadStream(key, data []byte) error {
+	return xorStream(key, payloadNonce[:], data)
+}
+
+// xorStream XORs data in place with the ChaCha20 keystream for key and nonce
+func xorStream(key, nonce, data []byte) error {
+	stream, err := chacha20.NewUnauthenticatedCipher(key, nonce)
+	if err != nil {
+		return err
+	}
+	stream.XORKeyStream(data, data)
+	return nil
+}
+
+// decryptPayload decrypts the payload in place; the plaintext overwrites ciphertext
 func (r *Router) decryptPayload(key, ciphertext []byte) ([]byte, error) {
 	aead, err := chacha20poly1305.New(key)
 	if err != nil {
@@ -216,7 +610,7 @@ func (r *Router) decryptPayload(key, ciphertext []byte) ([]byte, error) {
 	
 	nonce := ciphertext[:12]
 	
-	plaintext, err := aead.Open(nil, nonce, ciphertext[12:], nil)
+	plaintext, err := aead.Open(ciphertext[12:12], nonce, ciphertext[12:], nil)
 	if err != nil {
 		return nil, err
 	}
@@ -224,7 +618,7 @@ func (r *Router) decryptPayload(key, ciphertext []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
-// parseRoutingInfo parses routing information
+// parseRoutingInfo parses version 1 routing information
 func (r *Router) parseRoutingInfo(data []byte) (*common.RoutingInfo, error) {
 	if len(data) < 31 {
 		return nil, errors.New("routing info too short")
@@ -257,68 +651,80 @@ func (r *Router) parseRoutingInfo(data []byte) (*common.RoutingInfo, error) {
 		info.HMAC = data[29:61]
 	}
 	
+	// Flags, and the SURB ID a reply is delivered under
+	if len(data) >= 62+common.SURBIDSize {
+		info.Flags = data[61]
+		if info.AddressType == 0x00 && info.Flags&common.RoutingFlagReply != 0 {
+			info.SURBID = data[62 : 62+common.SURBIDSize]
+		}
+	}
+	
 	return info, nil
 }
 
+// nextHopAddress returns the host:port to forward to
+func (r *Router) nextHopAddress(routing *common.RoutingInfo) (string, error) {
+	if routing.AddressType != 0x20 {
+		return r.formatAddress(routing), nil
+	}
+	
+	return r.resolveAddress(routing.Address)
+}
+
+// resolveAddress returns the address of the node whose identity key is
+// publicKey. Nodes the directory does not know or holds unhealthy are
+// refused.
+func (r *Router) resolveAddress(publicKey []byte) (string, error) {
+	if r.resolver == nil {
+		return "", errors.New("node ID routing is not available")
+	}
+	node, err := r.resolver.ResolveNode(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("next hop %x: %w", publicKey[:8], err)
+	}
+	
+	return net.JoinHostPort(node.Address, strconv.Itoa(int(node.Port))), nil
+}
+
 // formatAddress formats routing info into address string
 func (r *Router) formatAddress(routing *common.RoutingInfo) string {
-	if routing.AddressType == 0x04 { // IPv4
-		return fmt.Sprintf("%d.%d.%d.%d:%d",
-			routing.Address[0], routing.Address[1],
-			routing.Address[2], routing.Address[3],
-			routing.Port)
-	} else if routing.AddressType == 0x06 { // IPv6
-		return fmt.Sprintf("[%x:%x:%x:%x:%x:%x:%x:%x]:%d",
-			binary.BigEndian.Uint16(routing.Address[0:2]),
-			binary.BigEndian.Uint16(routing.Address[2:4]),
-			binary.BigEndian.Uint16(routing.Address[4:6]),
-			binary.BigEndian.Uint16(routing.Address[6:8]),
-			binary.BigEndian.Uint16(routing.Address[8:10]),
-			binary.BigEndian.Uint16(routing.Address[10:12]),
-			binary.BigEndian.Uint16(routing.Address[12:14]),
-			binary.BigEndian.Uint16(routing.Address[14:16]),
-			routing.Port)
+	switch routing.AddressType {
+	case 0x04, 0x06: // IPv4, IPv6
+		return net.JoinHostPort(net.IP(routing.Address).String(), strconv.Itoa(int(routing.Port)))
 	}
 	return ""
 }
 
-// assemblePacket assembles a new packet for forwarding
-func (r *Router) assemblePacket(ephemeralKey, hmac, routingBlob, payload []byte) []byte {
-	packet := make([]byte, common.PacketSize)
-	packet[0] = common.PacketVersion
+// assemblePacket assembles a new packet for forwarding. The payload is
+// PayloadSize bytes, or a padded body for onion requests.
+func (r *Router) assemblePacket(format *headerFormat, ephemeralKey, hmac, kemCiphertext, routingBlob, payload []byte) []byte {
+	packet := make([]byte, format.payloadOffset()+len(payload))
+	packet[0] = format.version
 	copy(packet[1:33], ephemeralKey)
 	copy(packet[33:65], hmac)
-	copy(packet[65:680], routingBlob)
-	copy(packet[680:1280], payload)
+	copy(packet[common.HeaderSize:format.blobOffset()], kemCiphertext)
+	copy(packet[format.blobOffset():format.payloadOffset()], routingBlob)
+	copy(packet[format.payloadOffset():], payload)
 	return packet
 }
 
-// cleanupReplayCache periodically removes old entries
-func (r *Router) cleanupReplayCache() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
-	
-	for range ticker.C {
-		cutoff := time.Now().Add(-5 * time.Minute)
-		
-		r.seenHMACs.Range(func(key, value interface{}) bool {
-			if timestamp, ok := value.(time.Time); ok {
-				if timestamp.Before(cutoff) {
-					r.seenHMACs.Delete(key)
-				}
-			}
-			return true
-		})
-	}
+// ReplayStats returns replay filter statistics
+func (r *Router) ReplayStats() ReplayStats {
+	return r.replay.GetStats()
 }
 
 // GetStats returns router statistics
 func (r *Router) GetStats() Stats {
 	return Stats{
-		PacketsProcessed: r.packetsProcessed,
-		PacketsForwarded: r.packetsForwarded,
-		PacketsDelivered: r.packetsDelivered,
-		PacketsDropped:   r.packetsDropped,
+		PacketsProcessed: r.packetsProcessed.Load(),
+		PacketsForwarded: r.packetsForwarded.Load(),
+		PacketsDelivered: r.packetsDelivered.Load(),
+		PacketsDropped:   r.packetsDropped.Load(),
+		PacketsV1:        r.packetsV1.Load(),
+		PacketsV3:        r.packetsV3.Load(),
+		PacketsDummy:     r.packetsDummy.Load(),
+		Requests:         r.requests.Load(),
+		DelaysClamped:    r.delaysClamped.Load(),
 	}
 }
 
@@ -328,7 +734,14 @@ type RoutingDecision struct {
 	NextAddress string // For forwarding
 	NextPacket  []byte // For forwarding
 	Payload     []byte // For delivery
+	SURBID      []byte // For reply delivery
 	Delay       time.Duration
+	
+	// Onion requests only: the request to execute (ActionRequest), and
+	// the key sealing the response (ActionRequest) or layering it on its
+	// way back (ActionForward)
+	Request     *Request
+	ResponseKey []byte
 }
 
 // Action defines what to do with packet
@@ -337,6 +750,9 @@ type Action int
 const (
 	ActionForward Action = iota
 	ActionDeliver
+	ActionDeliverReply // Store the still-layered payload under SURBID for the originator
+	ActionDrop         // Link padding; nothing to do
+	ActionRequest      // Execute Request and answer with SealResponse
 )
 
 // Stats contains router statistics
@@ -345,15 +761,9 @@ type Stats struct {
 	PacketsForwarded uint64
 	PacketsDelivered uint64
 	PacketsDropped   uint64
-}
-
-// ed25519PrivateKeyToCurve25519 converts Ed25519 private key to Curve25519
-// This is a simplified conversion; production should use proper conversion
-func ed25519PrivateKeyToCurve25519(edPriv ed25519.PrivateKey) []byte {
-	// In production, use proper Ed25519->Curve25519 conversion
-	// For now, use the seed (first 32 bytes)
-	seed := edPriv.Seed()
-	curve25519Priv := make([]byte, 32)
-	copy(curve25519Priv, seed)
-	return curve25519Priv
+	PacketsV1        uint64 // Version 1 packets processed during the transition
+	PacketsV3        uint64 // Version 3 (post-quantum hybrid) packets processed
+	PacketsDummy     uint64 // Link padding packets discarded
+	Requests         uint64 // Onion requests relayed or executed
+	DelaysClamped    uint64 // Requested per-hop delays outside the delay policy
 }
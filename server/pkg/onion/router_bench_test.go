@@ -1,6 +1,7 @@
 package onion
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
@@ -46,7 +47,7 @@ func BenchmarkEd25519ToCurve25519(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = ed25519PrivateKeyToCurve25519(priv)
+		_ = common.Ed25519PrivateKeyToCurve25519(priv)
 	}
 }
 
@@ -84,3 +85,50 @@ func BenchmarkHopKeyDerivation(b *testing.B) {
 	}
 }
 
+
+// Benchmark concurrent forwarding through ProcessBatch. Every packet is
+// distinct (the replay filter rejects repeats), so batches are built with
+// the timer stopped.
+func BenchmarkProcessBatch(b *testing.B) {
+	const batchSize = 256
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			router, entry := newTestHop(b, "node1", "10.0.0.1", 9000)
+			router.workers = workers
+			_, exit := newTestHop(b, "node2", "10.0.0.2", 9001)
+			path := []common.NodeInfo{entry, exit}
+			payload := make([]byte, common.MessagePayloadSize)
+
+			batch := make([][]byte, 0, batchSize)
+			process := func() {
+				b.StartTimer()
+				for _, result := range router.ProcessBatch(batch) {
+					if result.Err != nil {
+						b.Fatalf("ProcessBatch failed: %v", result.Err)
+					}
+				}
+				b.StopTimer()
+				batch = batch[:0]
+			}
+
+			b.StopTimer()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				packet, err := BuildPacket(path, payload, nil)
+				if err != nil {
+					b.Fatalf("BuildPacket failed: %v", err)
+				}
+				batch = append(batch, packet)
+				if len(batch) == batchSize {
+					process()
+				}
+			}
+			if len(batch) > 0 {
+				process()
+			}
+
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package onion
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// SURBHeaderSize is the length of the pre-built header in a SURB
+	SURBHeaderSize = common.PacketSize - common.PayloadSize
+
+	// surbAddressSize is the encoded first hop: address type, address, port
+	surbAddressSize = 19
+
+	// SURBSize is the length of a serialized SURB
+	SURBSize = surbAddressSize + SURBHeaderSize + chacha20poly1305.KeySize
+)
+
+// SURB is a single-use reply block: a pre-built packet header for a path
+// back to the originator. Whoever holds it can send one reply without
+// learning the path or where the reply ends up. Each hop re-encrypts the
+// reply payload, so it looks different on every link.
+type SURB struct {
+	FirstHop   string // host:port of the first node on the reply path
+	Header     []byte // Version, ephemeral key, HMAC and routing blob
+	PayloadKey []byte // Key the replier seals the reply payload with
+}
+
+// SURBKeys are the secrets the originator keeps to read the reply to a SURB
+type SURBKeys struct {
+	ID         []byte   // The last hop stores the reply under this ID
+	PayloadKey []byte   // Same key as SURB.PayloadKey
+	HopKeys    [][]byte // Per-hop payload layer keys, in path order
+}
+
+// BuildSURB builds a reply block routed along path. The last node in path
+// stores the reply under keys.ID, where the originator collects it.
+func BuildSURB(path []common.NodeInfo, opts *BuildOptions) (*SURB, *SURBKeys, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("empty SURB path")
+	}
+	if opts != nil && opts.Version == common.PacketVersion3 {
+		return nil, nil, errors.New("SURBs use the standard packet size; version 3 is not supported")
+	}
+
+	firstHop := &common.RoutingInfo{}
+	if err := setNextHopAddress(firstHop, &path[0]); err != nil {
+		return nil, nil, err
+	}
+
+	id := make([]byte, common.SURBIDSize)
+	payloadKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(payloadKey); err != nil {
+		return nil, nil, err
+	}
+
+	header, hops, err := buildHeader(path, opts, common.RoutingFlagReply, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hopKeys := make([][]byte, len(hops))
+	for i, hop := range hops {
+		hopKeys[i] = hop.encKey
+	}
+
+	surb := &SURB{
+		FirstHop:   net.JoinHostPort(net.IP(firstHop.Address).String(), strconv.Itoa(int(firstHop.Port))),
+		Header:     header,
+		PayloadKey: payloadKey,
+	}
+	keys := &SURBKeys{
+		ID:         id,
+		PayloadKey: payloadKey,
+		HopKeys:    hopKeys,
+	}
+
+	return surb, keys, nil
+}
+
+// BuildReplyPacket seals payload under surb and returns the packet to send
+// to surb.FirstHop. Payloads shorter than MaxPayloadSize are zero-padded.
+func BuildReplyPacket(surb *SURB, payload []byte) ([]byte, error) {
+	if len(surb.Header) != SURBHeaderSize {
+		return nil, fmt.Errorf("invalid SURB header size: %d", len(surb.Header))
+	}
+	format, err := lookupFormat(surb.Header[0])
+	if err != nil {
+		return nil, err
+	}
+	if format.payloadOffset() != SURBHeaderSize {
+		return nil, fmt.Errorf("SURB header version 0x%02x does not use the standard packet size", format.version)
+	}
+	if len(payload) > MaxPayloadSize {
+		return nil, fmt.Errorf("payload too large: %d > %d", len(payload), MaxPayloadSize)
+	}
+
+	encryptedPayload, err := encryptPayload(surb.PayloadKey, payload)
+	if err != nil {
+		return nil, fmt.Errorf("payload encryption failed: %w", err)
+	}
+
+	packet := make([]byte, format.packetSize)
+	copy(packet, surb.Header)
+	copy(packet[format.payloadOffset():], encryptedPayload)
+
+	return packet, nil
+}
+
+// OpenReply removes the per-hop layers from a delivered reply payload and
+// decrypts it. The result is zero-padded to MaxPayloadSize.
+func OpenReply(keys *SURBKeys, payload []byte) ([]byte, error) {
+	if len(payload) != common.PayloadSize {
+		return nil, fmt.Errorf("invalid reply payload size: %d", len(payload))
+	}
+
+	data := make([]byte, common.PayloadSize)
+	copy(data, payload)
+	for i := len(keys.HopKeys) - 1; i >= 0; i-- {
+		if err := xorPayloadStream(keys.HopKeys[i], data); err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := chacha20poly1305.New(keys.PayloadKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := data[:chacha20poly1305.NonceSize]
+	plaintext, err := aead.Open(nil, nonce, data[chacha20poly1305.NonceSize:], nil)
+	if err != nil {
+		return nil, errors.New("reply authentication failed")
+	}
+
+	return plaintext, nil
+}
+
+// SURBDestination returns the swarm destination a reply to id is stored under
+func SURBDestination(id []byte) string {
+	return common.SURBDestinationPrefix + hex.EncodeToString(id)
+}
+
+// ReplyMessage wraps a delivered reply for storage in the swarm under
+// SURBDestination(decision.SURBID), where the originator polls for it
+func ReplyMessage(decision *RoutingDecision) *common.Message {
+	return &common.Message{
+		ID:               hex.EncodeToString(decision.SURBID),
+		DestinationID:    SURBDestination(decision.SURBID),
+		Timestamp:        time.Now(),
+		MessageType:      common.MessageTypeSURBReply,
+		EncryptedContent: decision.Payload,
+	}
+}
+
+// MarshalBinary encodes the SURB as first hop ‖ header ‖ payload key
+func (s *SURB) MarshalBinary() ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(s.FirstHop)
+	if err != nil {
+		return nil, fmt.Errorf("invalid first hop: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid first hop port: %w", err)
+	}
+	if len(s.Header) != SURBHeaderSize || len(s.PayloadKey) != chacha20poly1305.KeySize {
+		return nil, errors.New("incomplete SURB")
+	}
+
+	routing := &common.RoutingInfo{}
+	if err := setNextHopAddress(routing, &common.NodeInfo{Address: host, Port: uint16(port)}); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, SURBSize)
+	data[0] = routing.AddressType
+	copy(data[1:17], routing.Address)
+	binary.BigEndian.PutUint16(data[17:19], routing.Port)
+	copy(data[surbAddressSize:], s.Header)
+	copy(data[surbAddressSize+SURBHeaderSize:], s.PayloadKey)
+
+	return data, nil
+}
+
+// UnmarshalBinary decodes a SURB produced by MarshalBinary
+func (s *SURB) UnmarshalBinary(data []byte) error {
+	if len(data) != SURBSize {
+		return fmt.Errorf("invalid SURB size: %d", len(data))
+	}
+
+	var ip net.IP
+	switch data[0] {
+	case 0x04:
+		ip = net.IP(data[1:5])
+	case 0x06:
+		ip = net.IP(data[1:17])
+	default:
+		return fmt.Errorf("unknown address type: 0x%02x", data[0])
+	}
+	port := binary.BigEndian.Uint16(data[17:19])
+
+	s.FirstHop = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	s.Header = append([]byte(nil), data[surbAddressSize:surbAddressSize+SURBHeaderSize]...)
+	s.PayloadKey = append([]byte(nil), data[surbAddressSize+SURBHeaderSize:]...)
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package onion
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+func TestSURB_ThreeHopReply(t *testing.T) {
+	router1, node1 := newTestHop(t, "node1", "10.0.0.1", 9000)
+	router2, node2 := newTestHop(t, "node2", "10.0.0.2", 9001)
+	router3, node3 := newTestHop(t, "node3", "10.0.0.3", 9002)
+
+	surb, keys, err := BuildSURB([]common.NodeInfo{node1, node2, node3}, nil)
+	if err != nil {
+		t.Fatalf("BuildSURB failed: %v", err)
+	}
+	if surb.FirstHop != "10.0.0.1:9000" {
+		t.Errorf("FirstHop = %q, want %q", surb.FirstHop, "10.0.0.1:9000")
+	}
+
+	reply := []byte("delivered")
+	packet, err := BuildReplyPacket(surb, reply)
+	if err != nil {
+		t.Fatalf("BuildReplyPacket failed: %v", err)
+	}
+
+	for i, router := range []*Router{router1, router2} {
+		decision, err := router.ProcessPacket(packet)
+		if err != nil {
+			t.Fatalf("Hop %d: ProcessPacket failed: %v", i+1, err)
+		}
+		if decision.Action != ActionForward {
+			t.Fatalf("Hop %d: Action = %v, want ActionForward", i+1, decision.Action)
+		}
+
+		// Every hop re-encrypts the payload
+		if bytes.Equal(decision.NextPacket[680:], packet[680:]) {
+			t.Errorf("Hop %d: payload unchanged while forwarding a reply", i+1)
+		}
+		packet = decision.NextPacket
+	}
+
+	decision, err := router3.ProcessPacket(packet)
+	if err != nil {
+		t.Fatalf("Hop 3: ProcessPacket failed: %v", err)
+	}
+	if decision.Action != ActionDeliverReply {
+		t.Fatalf("Hop 3: Action = %v, want ActionDeliverReply", decision.Action)
+	}
+	if !bytes.Equal(decision.SURBID, keys.ID) {
+		t.Errorf("SURBID = %x, want %x", decision.SURBID, keys.ID)
+	}
+	if len(decision.Payload) != common.PayloadSize {
+		t.Fatalf("Payload length = %d, want %d", len(decision.Payload), common.PayloadSize)
+	}
+
+	plaintext, err := OpenReply(keys, decision.Payload)
+	if err != nil {
+		t.Fatalf("OpenReply failed: %v", err)
+	}
+	if !bytes.Equal(plaintext[:len(reply)], reply) {
+		t.Errorf("Reply = %q, want prefix %q", plaintext[:len(reply)], reply)
+	}
+}
+
+func TestSURB_SingleUse(t *testing.T) {
+	router, node := newTestHop(t, "node1", "10.0.0.1", 9000)
+
+	surb, _, err := BuildSURB([]common.NodeInfo{node}, nil)
+	if err != nil {
+		t.Fatalf("BuildSURB failed: %v", err)
+	}
+
+	first, _ := BuildReplyPacket(surb, []byte("first"))
+	second, _ := BuildReplyPacket(surb, []byte("second"))
+
+	if _, err := router.ProcessPacket(first); err != nil {
+		t.Fatalf("First reply failed: %v", err)
+	}
+	if _, err := router.ProcessPacket(second); err == nil {
+		t.Error("Expected second reply on the same SURB to be rejected, got nil")
+	}
+}
+
+func TestSURB_ForwardPacketUnaffected(t *testing.T) {
+	router, node := newTestHop(t, "node1", "10.0.0.1", 9000)
+
+	packet, err := BuildPacket([]common.NodeInfo{node}, []byte("payload"), nil)
+	if err != nil {
+		t.Fatalf("BuildPacket failed: %v", err)
+	}
+
+	decision, err := router.ProcessPacket(packet)
+	if err != nil {
+		t.Fatalf("ProcessPacket failed: %v", err)
+	}
+	if decision.Action != ActionDeliver || decision.SURBID != nil {
+		t.Errorf("Action = %v, SURBID = %x, want ActionDeliver without SURB ID", decision.Action, decision.SURBID)
+	}
+}
+
+func TestOpenReply_WrongKeys(t *testing.T) {
+	router, node := newTestHop(t, "node1", "10.0.0.1", 9000)
+
+	surb, keys, err := BuildSURB([]common.NodeInfo{node}, nil)
+	if err != nil {
+		t.Fatalf("BuildSURB failed: %v", err)
+	}
+	_, otherKeys, err := BuildSURB([]common.NodeInfo{node}, nil)
+	if err != nil {
+		t.Fatalf("BuildSURB failed: %v", err)
+	}
+
+	packet, _ := BuildReplyPacket(surb, []byte("reply"))
+	decision, err := router.ProcessPacket(packet)
+	if err != nil {
+		t.Fatalf("ProcessPacket failed: %v", err)
+	}
+
+	if _, err := OpenReply(otherKeys, decision.Payload); err == nil {
+		t.Error("Expected error opening reply with another SURB's keys, got nil")
+	}
+
+	tampered := append([]byte(nil), decision.Payload...)
+	tampered[50] ^= 0x01
+	if _, err := OpenReply(keys, tampered); err == nil {
+		t.Error("Expected error opening tampered reply, got nil")
+	}
+}
+
+func TestSURB_MarshalRoundTrip(t *testing.T) {
+	_, node1 := newTestHop(t, "node1", "2001:db8::1", 9000)
+	_, node2 := newTestHop(t, "node2", "10.0.0.2", 9001)
+
+	surb, _, err := BuildSURB([]common.NodeInfo{node1, node2}, nil)
+	if err != nil {
+		t.Fatalf("BuildSURB failed: %v", err)
+	}
+
+	data, err := surb.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+	if len(data) != SURBSize {
+		t.Fatalf("Encoded length = %d, want %d", len(data), SURBSize)
+	}
+
+	var decoded SURB
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+
+	if decoded.FirstHop != "[2001:db8::1]:9000" {
+		t.Errorf("FirstHop = %q, want %q", decoded.FirstHop, "[2001:db8::1]:9000")
+	}
+	if !bytes.Equal(decoded.Header, surb.Header) || !bytes.Equal(decoded.PayloadKey, surb.PayloadKey) {
+		t.Error("SURB changed across marshal round trip")
+	}
+
+	if err := decoded.UnmarshalBinary(data[:SURBSize-1]); err == nil {
+		t.Error("Expected error for truncated SURB, got nil")
+	}
+}
+
+func TestBuildSURB_InvalidInput(t *testing.T) {
+	_, node := newTestHop(t, "node1", "10.0.0.1", 9000)
+
+	hostname := node
+	hostname.Address = "node1.ghostnodes.network"
+
+	if _, _, err := BuildSURB(nil, nil); err == nil {
+		t.Error("Expected error for empty path, got nil")
+	}
+	if _, _, err := BuildSURB([]common.NodeInfo{hostname}, nil); err == nil {
+		t.Error("Expected error for hostname first hop, got nil")
+	}
+	if _, _, err := BuildSURB([]common.NodeInfo{node, node, node, node, node, node}, nil); err == nil {
+		t.Error("Expected error for path too long, got nil")
+	}
+	if _, _, err := BuildSURB([]common.NodeInfo{node}, &BuildOptions{Version: common.PacketVersion3}); err == nil {
+		t.Error("Expected error for a version 3 SURB, got nil")
+	}
+
+	surb, _, err := BuildSURB([]common.NodeInfo{node}, nil)
+	if err != nil {
+		t.Fatalf("BuildSURB failed: %v", err)
+	}
+	if _, err := BuildReplyPacket(surb, make([]byte, MaxPayloadSize+1)); err == nil {
+		t.Error("Expected error for oversized reply, got nil")
+	}
+
+	// The payload offset comes from the header's version
+	surb.Header[0] = common.PacketVersion3
+	if _, err := BuildReplyPacket(surb, nil); err == nil {
+		t.Error("Expected error for a version 3 SURB header, got nil")
+	}
+}
@@ -0,0 +1,262 @@
+package swarm
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// Reassembly defaults
+const (
+	DefaultReassemblyTimeout  = 2 * time.Minute
+	DefaultReassemblyMaxBytes = 16 << 20
+	DefaultMaxFragments       = 256
+)
+
+// Bookkeeping charged against MaxBytes besides fragment content, so that
+// empty fragments of fresh messages cannot fill memory for free
+const (
+	pendingMessageOverhead = 512 // Entry, header, map key and list element
+	partSlotOverhead       = 24  // Slice header per expected fragment
+)
+
+// ReassemblyConfig holds reassembly buffer configuration
+type ReassemblyConfig struct {
+	Timeout      time.Duration // How long an incomplete message is kept (default 2m)
+	MaxBytes     int           // Memory cap for buffered fragments and their bookkeeping (default 16 MiB)
+	MaxFragments int           // Largest fragment count accepted (default 256)
+}
+
+// Reassembler buffers message fragments delivered through onion packets
+// and stores each message in the swarm once all of its fragments arrived.
+// Incomplete messages are dropped after Timeout; when the buffer exceeds
+// MaxBytes the oldest incomplete messages are evicted first.
+type Reassembler struct {
+	store   *Store
+	config  ReassemblyConfig
+	pending map[string]*list.Element // By destination and message ID
+	order   *list.List               // Pending messages, oldest first
+	bytes   int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// Stats
+	completed uint64
+	expired   uint64
+	evicted   uint64
+
+	mu sync.Mutex
+}
+
+// pendingMessage is a partially received message
+type pendingMessage struct {
+	key       string
+	header    *common.Message // Fields shared by every fragment
+	parts     [][]byte
+	received  int
+	bytes     int // Content and bookkeeping charged against MaxBytes
+	firstSeen time.Time
+}
+
+// NewReassembler creates a reassembly buffer that stores completed
+// messages in store
+func NewReassembler(store *Store, config *ReassemblyConfig) *Reassembler {
+	cfg := ReassemblyConfig{}
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultReassemblyTimeout
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultReassemblyMaxBytes
+	}
+	if cfg.MaxFragments <= 0 {
+		cfg.MaxFragments = DefaultMaxFragments
+	}
+
+	r := &Reassembler{
+		store:   store,
+		config:  cfg,
+		pending: make(map[string]*list.Element),
+		order:   list.New(),
+		done:    make(chan struct{}),
+	}
+
+	r.wg.Add(1)
+	go r.expireLoop()
+
+	return r
+}
+
+// Add buffers fragment and stores the message once it is complete.
+// Whole messages (Total 1) are stored immediately. It reports whether a
+// message was stored.
+func (r *Reassembler) Add(fragment *common.Fragment) (bool, error) {
+	if fragment.Total == 1 {
+		return true, r.store.StoreMessage(fragment.Message)
+	}
+	if fragment.Total > r.config.MaxFragments {
+		return false, fmt.Errorf("too many fragments: %d > %d", fragment.Total, r.config.MaxFragments)
+	}
+	if fragment.Index < 0 || fragment.Index >= fragment.Total {
+		return false, fmt.Errorf("invalid fragment %d of %d", fragment.Index, fragment.Total)
+	}
+
+	complete, err := r.add(fragment, time.Now())
+	if err != nil || complete == nil {
+		return false, err
+	}
+
+	// The stamp, carried by the first fragment, covers the whole content
+	return true, r.store.StoreMessage(complete)
+}
+
+// add buffers fragment and returns the message if it completed it
+func (r *Reassembler) add(fragment *common.Fragment, now time.Time) (*common.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(now)
+
+	msg := fragment.Message
+	key := msg.DestinationID + "/" + msg.ID
+
+	var p *pendingMessage
+	if elem, ok := r.pending[key]; ok {
+		p = elem.Value.(*pendingMessage)
+		if len(p.parts) != fragment.Total || p.header.MessageType != msg.MessageType ||
+			!p.header.Timestamp.Equal(msg.Timestamp) {
+			return nil, errors.New("fragment does not match earlier fragments")
+		}
+	} else {
+		p = &pendingMessage{
+			key:       key,
+			header:    msg,
+			parts:     make([][]byte, fragment.Total),
+			bytes:     pendingOverhead(fragment.Total),
+			firstSeen: now,
+		}
+		r.pending[key] = r.order.PushBack(p)
+		r.bytes += p.bytes
+	}
+
+	// Duplicates (e.g. a retransmission) are ignored
+	if p.parts[fragment.Index] != nil {
+		return nil, nil
+	}
+	if fragment.Index == 0 {
+		p.header.PoW = msg.PoW
+	}
+	p.parts[fragment.Index] = msg.EncryptedContent
+	p.received++
+	p.bytes += len(msg.EncryptedContent)
+	r.bytes += len(msg.EncryptedContent)
+
+	if p.received < len(p.parts) {
+		r.evict()
+		return nil, nil
+	}
+
+	r.remove(r.pending[key])
+	r.completed++
+
+	content := make([]byte, 0, p.bytes-pendingOverhead(len(p.parts)))
+	for _, part := range p.parts {
+		content = append(content, part...)
+	}
+	complete := *p.header
+	complete.EncryptedContent = content
+
+	return &complete, nil
+}
+
+// pendingOverhead returns the bookkeeping charged for a message of parts fragments
+func pendingOverhead(parts int) int {
+	return pendingMessageOverhead + parts*partSlotOverhead
+}
+
+// Close stops the background expiry loop
+func (r *Reassembler) Close() {
+	select {
+	case <-r.done:
+		return
+	default:
+		close(r.done)
+	}
+	r.wg.Wait()
+}
+
+// GetStats returns reassembly statistics
+func (r *Reassembler) GetStats() ReassemblyStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return ReassemblyStats{
+		Pending:       len(r.pending),
+		BufferedBytes: r.bytes,
+		Completed:     r.completed,
+		Expired:       r.expired,
+		Evicted:       r.evicted,
+	}
+}
+
+// expire drops incomplete messages older than Timeout; callers must hold r.mu
+func (r *Reassembler) expire(now time.Time) {
+	for elem := r.order.Front(); elem != nil; elem = r.order.Front() {
+		if now.Sub(elem.Value.(*pendingMessage).firstSeen) < r.config.Timeout {
+			return
+		}
+		r.remove(elem)
+		r.expired++
+	}
+}
+
+// evict drops the oldest incomplete messages until the buffer fits in
+// MaxBytes; callers must hold r.mu
+func (r *Reassembler) evict() {
+	for r.bytes > r.config.MaxBytes && r.order.Len() > 0 {
+		r.remove(r.order.Front())
+		r.evicted++
+	}
+}
+
+// remove forgets a pending message; callers must hold r.mu
+func (r *Reassembler) remove(elem *list.Element) {
+	p := r.order.Remove(elem).(*pendingMessage)
+	delete(r.pending, p.key)
+	r.bytes -= p.bytes
+}
+
+// expireLoop drops timed-out messages even when no fragments arrive
+func (r *Reassembler) expireLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.config.Timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			r.expire(time.Now())
+			r.mu.Unlock()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// ReassemblyStats contains reassembly buffer statistics
+type ReassemblyStats struct {
+	Pending       int    // Incomplete messages buffered
+	BufferedBytes int    // Fragment content and bookkeeping buffered
+	Completed     uint64 // Messages reassembled and stored
+	Expired       uint64 // Incomplete messages dropped after the timeout
+	Evicted       uint64 // Incomplete messages dropped to stay under the memory cap
+}
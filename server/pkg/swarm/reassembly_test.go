@@ -0,0 +1,276 @@
+package swarm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// fragmentMessage splits a message with content of the given size into decoded fragments
+func fragmentMessage(t *testing.T, id string, size int) (*common.Message, []*common.Fragment) {
+	t.Helper()
+
+	msg := testFragmentedMessage(id, size)
+	return msg, decodeFragments(t, msg)
+}
+
+// testFragmentedMessage returns a message with content of the given size
+func testFragmentedMessage(id string, size int) *common.Message {
+	msg := &common.Message{
+		ID:               strings.Repeat(id, 64/len(id)),
+		DestinationID:    strings.Repeat("05", common.PayloadIDSize),
+		Timestamp:        time.UnixMilli(1760000000000),
+		MessageType:      common.MessageTypeAttachment,
+		EncryptedContent: make([]byte, size),
+	}
+	for i := range msg.EncryptedContent {
+		msg.EncryptedContent[i] = byte(i)
+	}
+	return msg
+}
+
+// decodeFragments encodes msg into onion payloads and decodes them again
+func decodeFragments(t *testing.T, msg *common.Message) []*common.Fragment {
+	t.Helper()
+
+	payloads, err := common.EncodeMessageFragments(msg)
+	if err != nil {
+		t.Fatalf("EncodeMessageFragments failed: %v", err)
+	}
+
+	fragments := make([]*common.Fragment, len(payloads))
+	for i, payload := range payloads {
+		if fragments[i], err = common.DecodeFragment(payload); err != nil {
+			t.Fatalf("DecodeFragment failed: %v", err)
+		}
+	}
+	return fragments
+}
+
+// newReassemblyStore returns a store accepting the content sizes used below
+func newReassemblyStore(t *testing.T) *Store {
+	t.Helper()
+
+	store := NewStore(NewMemoryStorage(), nil, 1, 14)
+	if err := store.SetPaddingBuckets([]int{100, 1000, 2000}); err != nil {
+		t.Fatalf("SetPaddingBuckets failed: %v", err)
+	}
+	return store
+}
+
+func TestReassembler_OutOfOrder(t *testing.T) {
+	store := newReassemblyStore(t)
+	r := NewReassembler(store, nil)
+	defer r.Close()
+
+	msg, fragments := fragmentMessage(t, "a1", 2000)
+	if len(fragments) != 5 {
+		t.Fatalf("Fragments = %d, want 5", len(fragments))
+	}
+
+	// Deliver in reverse, with a duplicate
+	order := []int{4, 3, 3, 2, 1, 0}
+	for n, i := range order {
+		stored, err := r.Add(fragments[i])
+		if err != nil {
+			t.Fatalf("Add fragment %d failed: %v", i, err)
+		}
+		if stored != (n == len(order)-1) {
+			t.Fatalf("Add fragment %d: stored = %v after %d of %d", i, stored, n+1, len(order))
+		}
+	}
+
+	messages, err := store.RetrieveMessages(msg.DestinationID)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("RetrieveMessages = %d messages, %v, want 1", len(messages), err)
+	}
+	if !bytes.Equal(messages[0].EncryptedContent, msg.EncryptedContent) || messages[0].ID != msg.ID {
+		t.Error("Reassembled message differs from the original")
+	}
+
+	stats := r.GetStats()
+	if stats.Completed != 1 || stats.Pending != 0 || stats.BufferedBytes != 0 {
+		t.Errorf("Stats = %+v, want one completed and nothing buffered", stats)
+	}
+}
+
+func TestReassembler_WholeMessageStoredDirectly(t *testing.T) {
+	store := newReassemblyStore(t)
+	r := NewReassembler(store, nil)
+	defer r.Close()
+
+	msg, fragments := fragmentMessage(t, "b2", 100)
+	if len(fragments) != 1 {
+		t.Fatalf("Fragments = %d, want 1", len(fragments))
+	}
+
+	if stored, err := r.Add(fragments[0]); err != nil || !stored {
+		t.Fatalf("Add = %v, %v, want true, nil", stored, err)
+	}
+	if messages, _ := store.RetrieveMessages(msg.DestinationID); len(messages) != 1 {
+		t.Errorf("Stored messages = %d, want 1", len(messages))
+	}
+}
+
+func TestReassembler_Timeout(t *testing.T) {
+	store := newReassemblyStore(t)
+	r := NewReassembler(store, &ReassemblyConfig{Timeout: time.Minute})
+	defer r.Close()
+
+	_, fragments := fragmentMessage(t, "c3", 1000)
+	start := time.Now()
+
+	if _, err := r.add(fragments[0], start); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	// The rest arrives too late; the set starts over and stays incomplete
+	if _, err := r.add(fragments[1], start.Add(2*time.Minute)); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	complete, err := r.add(fragments[2], start.Add(2*time.Minute))
+	if err != nil || complete != nil {
+		t.Fatalf("add = %v, %v, want incomplete after timeout", complete, err)
+	}
+
+	if stats := r.GetStats(); stats.Expired != 1 || stats.Pending != 1 {
+		t.Errorf("Expired = %d, pending = %d, want 1 and 1", stats.Expired, stats.Pending)
+	}
+}
+
+func TestReassembler_MemoryCap(t *testing.T) {
+	store := newReassemblyStore(t)
+	maxBytes := 2*common.MaxFragmentContentSize + pendingOverhead(3)
+	r := NewReassembler(store, &ReassemblyConfig{MaxBytes: maxBytes})
+	defer r.Close()
+
+	// Three fragments each, the last one short
+	_, first := fragmentMessage(t, "d4", 1000)
+	_, second := fragmentMessage(t, "e5", 1000)
+
+	r.Add(first[0])
+	r.Add(second[0])
+	r.Add(second[1])
+
+	stats := r.GetStats()
+	if stats.Evicted != 1 || stats.Pending != 1 {
+		t.Fatalf("Evicted = %d, pending = %d, want 1 and 1", stats.Evicted, stats.Pending)
+	}
+	if stats.BufferedBytes > maxBytes {
+		t.Errorf("BufferedBytes = %d exceeds cap", stats.BufferedBytes)
+	}
+
+	// The oldest set was dropped, the newer one can still complete
+	for _, fragment := range second[2:] {
+		if _, err := r.Add(fragment); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if stats := r.GetStats(); stats.Completed != 1 {
+		t.Errorf("Completed = %d, want 1", stats.Completed)
+	}
+}
+
+func TestReassembler_EmptyFragmentsCharged(t *testing.T) {
+	store := newReassemblyStore(t)
+	const maxBytes = 64 << 10
+	r := NewReassembler(store, &ReassemblyConfig{MaxBytes: maxBytes})
+	defer r.Close()
+
+	// Empty first fragments of fresh messages carry no content but each
+	// reserve a slot per expected fragment
+	for i := 0; i < 1000; i++ {
+		fragment := &common.Fragment{
+			Message: &common.Message{
+				ID:            fmt.Sprintf("%064x", i),
+				DestinationID: strings.Repeat("05", common.PayloadIDSize),
+				Timestamp:     time.UnixMilli(1760000000000),
+			},
+			Index: 0,
+			Total: DefaultMaxFragments,
+		}
+		if _, err := r.Add(fragment); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+
+	stats := r.GetStats()
+	if stats.BufferedBytes > maxBytes {
+		t.Errorf("BufferedBytes = %d exceeds cap", stats.BufferedBytes)
+	}
+	if want := maxBytes / pendingOverhead(DefaultMaxFragments); stats.Pending > want {
+		t.Errorf("Pending = %d, want at most %d", stats.Pending, want)
+	}
+	if stats.Evicted == 0 {
+		t.Error("No message evicted")
+	}
+}
+
+func TestReassembler_RejectsInconsistentFragments(t *testing.T) {
+	store := newReassemblyStore(t)
+	r := NewReassembler(store, &ReassemblyConfig{MaxFragments: 4})
+	defer r.Close()
+
+	_, fragments := fragmentMessage(t, "f6", 1000)
+	if _, err := r.Add(fragments[0]); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	mismatched := *fragments[1]
+	mismatched.Total = 4
+	if _, err := r.Add(&mismatched); err == nil {
+		t.Error("Expected error for fragment with a different total, got nil")
+	}
+
+	_, tooMany := fragmentMessage(t, "a7", 5*common.MaxFragmentContentSize)
+	if _, err := r.Add(tooMany[0]); err == nil {
+		t.Error("Expected error for fragment count above the limit, got nil")
+	}
+}
+
+func TestReassembler_PoW(t *testing.T) {
+	store := newReassemblyStore(t)
+	if err := store.SetPoWDifficulty(4); err != nil {
+		t.Fatalf("SetPoWDifficulty failed: %v", err)
+	}
+	r := NewReassembler(store, nil)
+	defer r.Close()
+
+	// Delivered messages pay like submitted ones
+	_, fragments := fragmentMessage(t, "c3", 100)
+	if stored, err := r.Add(fragments[0]); !errors.Is(err, common.ErrInsufficientPoW) {
+		t.Errorf("Unstamped message: Add = %v, %v, want ErrInsufficientPoW", stored, err)
+	}
+
+	// Payloads carry no TTL, so stamps are priced at the store's 14-day default
+	bits := common.PoWDifficulty(4, 14*24*time.Hour, 1000)
+	for _, size := range []int{100, 1000} {
+		msg := testFragmentedMessage("c4", size)
+		msg.ID = strings.Repeat(fmt.Sprintf("%02x", size%256), common.PayloadIDSize)
+		if err := common.MintPoW(msg, bits); err != nil {
+			t.Fatalf("MintPoW failed: %v", err)
+		}
+
+		// The first fragment carries the stamp for the whole content;
+		// deliver it last
+		fragments := decodeFragments(t, msg)
+		for i := len(fragments) - 1; i >= 0; i-- {
+			stored, err := r.Add(fragments[i])
+			if err != nil || stored != (i == 0) {
+				t.Fatalf("Size %d, fragment %d: Add = %v, %v", size, i, stored, err)
+			}
+		}
+	}
+
+	if messages, _ := store.RetrieveMessages(strings.Repeat("05", common.PayloadIDSize)); len(messages) != 2 {
+		t.Errorf("Stored messages = %d, want 2", len(messages))
+	}
+	if rejected := store.GetStats().RejectedPoW; rejected != 1 {
+		t.Errorf("RejectedPoW = %d, want 1", rejected)
+	}
+}
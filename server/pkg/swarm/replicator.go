@@ -0,0 +1,76 @@
+package swarm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Replicator sends replication writes and deletes to peer nodes.
+// *mtls.Client implements this interface.
+type Replicator interface {
+	ReplicateMessage(nodeAddress string, messageData []byte) error
+	DeleteMessage(nodeAddress, sessionID, messageID string) error
+}
+
+// httpReplicator sends each replication request over HTTPS
+type httpReplicator struct {
+	client *http.Client
+}
+
+// newHTTPReplicator creates the replicator a Store uses by default
+func newHTTPReplicator() *httpReplicator {
+	return &httpReplicator{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 10,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+	}
+}
+
+// ReplicateMessage posts a JSON-encoded message to the peer's replication endpoint
+func (r *httpReplicator) ReplicateMessage(nodeAddress string, messageData []byte) error {
+	endpoint := fmt.Sprintf("https://%s/v1/swarm/replicate", nodeAddress)
+
+	resp, err := r.client.Post(endpoint, "application/json", bytes.NewReader(messageData))
+	if err != nil {
+		return fmt.Errorf("failed to replicate message: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("replication failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// DeleteMessage deletes a replica from the peer
+func (r *httpReplicator) DeleteMessage(nodeAddress, sessionID, messageID string) error {
+	endpoint := fmt.Sprintf("https://%s/v1/swarm/replicate/%s/%s", nodeAddress,
+		url.PathEscape(sessionID), url.PathEscape(messageID))
+
+	req, err := http.NewRequest(http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete replica: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// 200 OK or 404 Not Found are both acceptable
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("replica deletion failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
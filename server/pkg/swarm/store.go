@@ -1,32 +1,41 @@
 package swarm
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
 )
 
+// ErrReservedForReplies is returned for messages that claim to be SURB
+// replies, or are addressed to a SURB destination, but were not delivered
+// as one by this node
+var ErrReservedForReplies = errors.New("SURB replies are stored only by the node that delivered them")
+
 // Store handles store-and-forward message storage with k-replication
 type Store struct {
 	storage      Storage
 	replicaPeers []string
 	replicaCount int
 	ttl          time.Duration
-	httpClient   *http.Client
+	buckets      []int // Accepted content sizes
+	powBits      int   // Base proof-of-work difficulty; 0 accepts unstamped messages
+	replicator   Replicator
 	
 	// Stats
 	messagesStored   uint64
 	messagesDelivered uint64
 	messagesExpired  uint64
+	bucketCounts     map[int]uint64
+	rejectedUnpadded uint64
+	rejectedPoW      uint64
 	
 	mu sync.RWMutex
 }
@@ -47,22 +56,99 @@ func NewStore(storage Storage, replicaPeers []string, replicaCount int, ttlDays
 		replicaPeers: replicaPeers,
 		replicaCount: replicaCount,
 		ttl:          time.Duration(ttlDays) * 24 * time.Hour,
-		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
-			Transport: &http.Transport{
-				MaxIdleConns:        100,
-				MaxIdleConnsPerHost: 10,
-				IdleConnTimeout:     90 * time.Second,
-			},
-		},
+		buckets:      common.DefaultPaddingBuckets,
+		bucketCounts: make(map[int]uint64),
+		replicator:   newHTTPReplicator(),
 	}
 }
 
-// StoreMessage stores a message for a recipient
+// SetReplicator replaces the HTTPS requests used to reach replica peers,
+// e.g. with an *mtls.Client that keeps persistent links
+func (s *Store) SetReplicator(r Replicator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	s.replicator = r
+}
+
+// SetPaddingBuckets replaces the content sizes StoreMessage accepts
+func (s *Store) SetPaddingBuckets(buckets []int) error {
+	if err := common.ValidatePaddingBuckets(buckets); err != nil {
+		return err
+	}
+	
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	s.buckets = append([]int(nil), buckets...)
+	return nil
+}
+
+// PaddingBuckets returns the content sizes StoreMessage accepts
+func (s *Store) PaddingBuckets() []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	
+	return append([]int(nil), s.buckets...)
+}
+
+// SetPoWDifficulty requires messages submitted to StoreMessage to carry
+// a proof-of-work stamp. bits is the base difficulty, raised for long
+// TTLs and large content as common.PoWDifficulty describes; 0 accepts
+// unstamped messages.
+func (s *Store) SetPoWDifficulty(bits int) error {
+	if bits < 0 || bits > common.MaxPoWBits {
+		return fmt.Errorf("difficulty must be 0-%d bits, got %d", common.MaxPoWBits, bits)
+	}
+	
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	s.powBits = bits
+	return nil
+}
+
+// StoreMessage stores a message for a recipient. Content must be padded
+// to one of the padding buckets so stored sizes reveal only the bucket.
+// With a proof-of-work difficulty set, msg must carry a stamp; messages
+// delivered through onion packets carry theirs in the payload. SURB
+// replies are refused with ErrReservedForReplies; see StoreReply.
 func (s *Store) StoreMessage(msg *common.Message) error {
+	if msg.MessageType == common.MessageTypeSURBReply || strings.HasPrefix(msg.DestinationID, common.SURBDestinationPrefix) {
+		return ErrReservedForReplies
+	}
+	
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	if s.powBits > 0 {
+		if err := s.verifyPoW(msg); err != nil {
+			s.rejectedPoW++
+			return err
+		}
+	}
+	
+	return s.storeAndReplicate(msg)
+}
+
+// StoreReply stores a SURB reply this node's router delivered, built
+// with onion.ReplyMessage. Its content is the layered reply payload, so
+// it is exactly one packet payload rather than padded to a bucket, and it
+// needs no stamp: its originator asked for it by handing out the SURB.
+func (s *Store) StoreReply(msg *common.Message) error {
+	if msg.MessageType != common.MessageTypeSURBReply || !strings.HasPrefix(msg.DestinationID, common.SURBDestinationPrefix) {
+		return errors.New("not a SURB reply")
+	}
+	
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	
+	return s.storeAndReplicate(msg)
+}
+
+// storeAndReplicate stores msg with the store's TTL and replica count and
+// replicates it. Caller must hold s.mu.
+func (s *Store) storeAndReplicate(msg *common.Message) error {
 	// Set TTL if not set
 	if msg.TTL.IsZero() {
 		msg.TTL = time.Now().Add(s.ttl)
@@ -71,24 +157,72 @@ func (s *Store) StoreMessage(msg *common.Message) error {
 	// Set replica count
 	msg.ReplicaCount = s.replicaCount
 	
+	data, err := s.storeLocal(msg)
+	if err != nil {
+		return err
+	}
+	
+	// Replicate to peers (async)
+	go s.replicateToPeers(msg.DestinationID, data, s.replicator)
+	
+	return nil
+}
+
+// StoreReplica stores a message replicated by a peer. It is not
+// replicated further.
+func (s *Store) StoreReplica(msg *common.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	if msg.TTL.IsZero() {
+		return errors.New("replica without TTL")
+	}
+	_, err := s.storeLocal(msg)
+	return err
+}
+
+// verifyPoW checks msg's stamp against the difficulty its TTL and size
+// call for. A zero TTL is priced at the store's default. Caller must hold s.mu.
+func (s *Store) verifyPoW(msg *common.Message) error {
+	lifetime := s.ttl
+	if !msg.TTL.IsZero() {
+		lifetime = time.Until(msg.TTL)
+	}
+	return common.VerifyPoW(msg, common.PoWDifficulty(s.powBits, lifetime, len(msg.EncryptedContent)))
+}
+
+// storeLocal checks padding and writes msg to storage, returning the
+// stored encoding. Caller must hold s.mu.
+func (s *Store) storeLocal(msg *common.Message) ([]byte, error) {
+	size := len(msg.EncryptedContent)
+	if msg.MessageType == common.MessageTypeSURBReply {
+		if size != common.PayloadSize {
+			s.rejectedUnpadded++
+			return nil, fmt.Errorf("%w: SURB reply of %d bytes, want %d", common.ErrUnpaddedContent, size, common.PayloadSize)
+		}
+	} else if err := common.CheckPadding(size, s.buckets); err != nil {
+		s.rejectedUnpadded++
+		return nil, err
+	}
+	
 	// Serialize message
 	data, err := json.Marshal(msg)
 	if err != nil {
-		return fmt.Errorf("marshal error: %w", err)
+		return nil, fmt.Errorf("marshal error: %w", err)
 	}
 	
 	// Store locally
 	key := s.messageKey(msg.DestinationID, msg.ID)
 	if err := s.storage.Store(key, data); err != nil {
-		return fmt.Errorf("storage error: %w", err)
+		return nil, fmt.Errorf("storage error: %w", err)
 	}
 	
 	s.messagesStored++
+	if msg.MessageType != common.MessageTypeSURBReply {
+		s.bucketCounts[size]++
+	}
 	
-	// Replicate to peers (async)
-	go s.replicateToPeers(msg)
-	
-	return nil
+	return data, nil
 }
 
 // RetrieveMessages retrieves all messages for a session ID
@@ -143,8 +277,20 @@ func (s *Store) DeleteMessage(sessionID, messageID string) error {
 	}
 	
 	// Delete from replicas (async)
-	go s.deleteFromPeers(sessionID, messageID)
+	go s.deleteFromPeers(sessionID, messageID, s.replicator)
+	
+	return nil
+}
+
+// DeleteReplica deletes a message at the request of the peer that
+// replicated it. Replicas are not asked to delete it again.
+func (s *Store) DeleteReplica(sessionID, messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	
+	if err := s.storage.Delete(s.messageKey(sessionID, messageID)); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
 	return nil
 }
 
@@ -187,10 +333,18 @@ func (s *Store) GetStats() Stats {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	
+	buckets := make(map[int]uint64, len(s.bucketCounts))
+	for size, count := range s.bucketCounts {
+		buckets[size] = count
+	}
+	
 	return Stats{
 		MessagesStored:    s.messagesStored,
 		MessagesDelivered: s.messagesDelivered,
 		MessagesExpired:   s.messagesExpired,
+		Buckets:           buckets,
+		RejectedUnpadded:  s.rejectedUnpadded,
+		RejectedPoW:       s.rejectedPoW,
 	}
 }
 
@@ -204,77 +358,26 @@ func (s *Store) sessionPrefix(sessionID string) string {
 	return fmt.Sprintf("messages/%s/", sessionID)
 }
 
-// replicateToPeers replicates message to peer nodes
-func (s *Store) replicateToPeers(msg *common.Message) {
+// replicateToPeers replicates an encoded message to peer nodes
+func (s *Store) replicateToPeers(sessionID string, data []byte, replicator Replicator) {
 	// Select k peers for replication using consistent hashing
-	peers := s.selectReplicationPeers(msg.DestinationID)
-	
-	// Serialize message for replication
-	data, err := json.Marshal(msg)
-	if err != nil {
-		// Log error but don't fail the operation
-		return
-	}
+	peers := s.selectReplicationPeers(sessionID)
 	
-	// Replicate to each peer
+	// Replicate to each peer; failures are not retried, the other
+	// replicas still hold the message
 	for _, peer := range peers {
-		go func(peerAddr string) {
-			url := fmt.Sprintf("https://%s/v1/swarm/replicate", peerAddr)
-			
-			// Create replication request
-			req, err := http.NewRequest("POST", url, bytes.NewReader(data))
-			if err != nil {
-				return
-			}
-			req.Header.Set("Content-Type", "application/json")
-			
-			// Send replication request
-			resp, err := s.httpClient.Do(req)
-			if err != nil {
-				// Log error but continue with other peers
-				return
-			}
-			defer resp.Body.Close()
-			
-			// Check response status
-			if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-				// Log warning but continue
-				return
-			}
-		}(peer)
+		go replicator.ReplicateMessage(peer, data)
 	}
 }
 
 // deleteFromPeers deletes message from replica nodes
-func (s *Store) deleteFromPeers(sessionID, messageID string) {
+func (s *Store) deleteFromPeers(sessionID, messageID string, replicator Replicator) {
 	// Select same peers that were used for replication
 	peers := s.selectReplicationPeers(sessionID)
 	
 	// Delete from each peer
 	for _, peer := range peers {
-		go func(peerAddr string) {
-			url := fmt.Sprintf("https://%s/v1/swarm/messages/%s/%s", peerAddr, sessionID, messageID)
-			
-			// Create delete request
-			req, err := http.NewRequest("DELETE", url, nil)
-			if err != nil {
-				return
-			}
-			
-			// Send delete request
-			resp, err := s.httpClient.Do(req)
-			if err != nil {
-				// Log error but continue with other peers
-				return
-			}
-			defer resp.Body.Close()
-			
-			// Check response status (200 OK or 404 Not Found are both acceptable)
-			if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
-				// Log warning but continue
-				return
-			}
-		}(peer)
+		go replicator.DeleteMessage(peer, sessionID, messageID)
 	}
 }
 
@@ -343,6 +446,9 @@ type Stats struct {
 	MessagesStored    uint64
 	MessagesDelivered uint64
 	MessagesExpired   uint64
+	Buckets           map[int]uint64 // Messages stored by padding bucket
+	RejectedUnpadded  uint64         // Messages rejected for an off-bucket size
+	RejectedPoW       uint64         // Messages rejected for a missing or insufficient stamp
 }
 
 // MemoryStorage is an in-memory storage implementation for testing
@@ -29,7 +29,7 @@ func BenchmarkStoreMessage(b *testing.B) {
 		DestinationID: "session_123",
 		Timestamp:     time.Now(),
 		MessageType:   1,
-		EncryptedContent: []byte("test payload"),
+		EncryptedContent: paddedContent("test payload"),
 		TTL:           time.Now().Add(7 * 24 * time.Hour),
 	}
 
@@ -53,7 +53,7 @@ func BenchmarkRetrieveMessages(b *testing.B) {
 			DestinationID: sessionID,
 			Timestamp:     time.Now(),
 			MessageType:   1,
-			EncryptedContent: []byte(fmt.Sprintf("payload %d", i)),
+			EncryptedContent: paddedContent(fmt.Sprintf("payload %d", i)),
 			TTL:           time.Now().Add(7 * 24 * time.Hour),
 		}
 		store.StoreMessage(msg)
@@ -83,7 +83,7 @@ func BenchmarkDeleteMessage(b *testing.B) {
 			DestinationID: sessionID,
 			Timestamp:     time.Now(),
 			MessageType:   1,
-			EncryptedContent: []byte("test"),
+			EncryptedContent: paddedContent("test"),
 			TTL:           time.Now().Add(7 * 24 * time.Hour),
 		}
 		store.StoreMessage(msg)
@@ -107,7 +107,7 @@ func BenchmarkConsistentHashing(b *testing.B) {
 			DestinationID: fmt.Sprintf("session_%d", i%1000),
 			Timestamp:     time.Now(),
 			MessageType:   1,
-			EncryptedContent: []byte("test"),
+			EncryptedContent: paddedContent("test"),
 			TTL:           time.Now().Add(7 * 24 * time.Hour),
 		}
 		store.StoreMessage(msg)
@@ -127,7 +127,7 @@ func BenchmarkCleanupExpired(b *testing.B) {
 			DestinationID: sessionID,
 			Timestamp:     expiredTime,
 			MessageType:   1,
-			EncryptedContent: []byte("expired"),
+			EncryptedContent: paddedContent("expired"),
 			TTL:           expiredTime,
 		}
 		store.StoreMessage(msg)
@@ -138,7 +138,7 @@ func BenchmarkCleanupExpired(b *testing.B) {
 			DestinationID: sessionID,
 			Timestamp:     time.Now(),
 			MessageType:   1,
-			EncryptedContent: []byte("valid"),
+			EncryptedContent: paddedContent("valid"),
 			TTL:           time.Now().Add(7 * 24 * time.Hour),
 		}
 		store.StoreMessage(msg)
@@ -177,7 +177,7 @@ func benchmarkRetrieveWithCount(b *testing.B, count int) {
 			DestinationID: sessionID,
 			Timestamp:     time.Now(),
 			MessageType:   1,
-			EncryptedContent: []byte(fmt.Sprintf("payload %d", i)),
+			EncryptedContent: paddedContent(fmt.Sprintf("payload %d", i)),
 			TTL:           time.Now().Add(7 * 24 * time.Hour),
 		}
 		store.StoreMessage(msg)
@@ -205,7 +205,7 @@ func BenchmarkStoreMessage_Concurrent(b *testing.B) {
 				DestinationID: fmt.Sprintf("session_%d", i%10),
 				Timestamp:     time.Now(),
 				MessageType:   1,
-				EncryptedContent: []byte(fmt.Sprintf("payload %d", i)),
+				EncryptedContent: paddedContent(fmt.Sprintf("payload %d", i)),
 				TTL:           time.Now().Add(7 * 24 * time.Hour),
 			}
 			if err := store.StoreMessage(msg); err != nil {
@@ -229,7 +229,7 @@ func BenchmarkRetrieveMessages_Concurrent(b *testing.B) {
 				DestinationID: sessionID,
 				Timestamp:     time.Now(),
 				MessageType:   1,
-				EncryptedContent: []byte("test"),
+				EncryptedContent: paddedContent("test"),
 				TTL:           time.Now().Add(7 * 24 * time.Hour),
 			}
 			store.StoreMessage(msg)
@@ -261,7 +261,7 @@ func BenchmarkMemoryStorage_Save(b *testing.B) {
 			DestinationID: "session_123",
 			Timestamp:     time.Now(),
 			MessageType:   1,
-			EncryptedContent: []byte("test"),
+			EncryptedContent: paddedContent("test"),
 			TTL:           time.Now().Add(7 * 24 * time.Hour),
 		}
 		if err := store.StoreMessage(msg); err != nil {
@@ -282,7 +282,7 @@ func BenchmarkMemoryStorage_Get(b *testing.B) {
 			DestinationID: sessionID,
 			Timestamp:     time.Now(),
 			MessageType:   1,
-			EncryptedContent: []byte("test"),
+			EncryptedContent: paddedContent("test"),
 			TTL:           time.Now().Add(7 * 24 * time.Hour),
 		}
 		store.StoreMessage(msg)
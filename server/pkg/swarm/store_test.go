@@ -1,12 +1,23 @@
 package swarm
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
 )
 
+// paddedContent pads s to the smallest default padding bucket
+func paddedContent(s string) []byte {
+	padded, err := common.PadToBucket([]byte(s), common.DefaultPaddingBuckets)
+	if err != nil {
+		panic(err)
+	}
+	return padded
+}
+
 func TestNewStore(t *testing.T) {
 	storage := NewMemoryStorage()
 	peers := []string{"peer1:9000", "peer2:9000", "peer3:9000"}
@@ -34,9 +45,10 @@ func TestStoreMessage(t *testing.T) {
 	store := NewStore(storage, peers, 2, 14)
 
 	msg := &common.Message{
-		ID:            "msg1",
-		DestinationID: "session123",
-		Timestamp:     time.Now(),
+		ID:               "msg1",
+		DestinationID:    "session123",
+		Timestamp:        time.Now(),
+		EncryptedContent: paddedContent("content"),
 	}
 
 	err := store.StoreMessage(msg)
@@ -58,14 +70,16 @@ func TestRetrieveMessages(t *testing.T) {
 
 	sessionID := "session123"
 	msg1 := &common.Message{
-		ID:            "msg1",
-		DestinationID: sessionID,
-		Timestamp:     time.Now(),
+		ID:               "msg1",
+		DestinationID:    sessionID,
+		Timestamp:        time.Now(),
+		EncryptedContent: paddedContent("content"),
 	}
 	msg2 := &common.Message{
-		ID:            "msg2",
-		DestinationID: sessionID,
-		Timestamp:     time.Now(),
+		ID:               "msg2",
+		DestinationID:    sessionID,
+		Timestamp:        time.Now(),
+		EncryptedContent: paddedContent("content"),
 	}
 
 	// Store messages
@@ -94,9 +108,10 @@ func TestDeleteMessage(t *testing.T) {
 
 	sessionID := "session123"
 	msg := &common.Message{
-		ID:            "msg1",
-		DestinationID: sessionID,
-		Timestamp:     time.Now(),
+		ID:               "msg1",
+		DestinationID:    sessionID,
+		Timestamp:        time.Now(),
+		EncryptedContent: paddedContent("content"),
 	}
 
 	// Store message
@@ -219,10 +234,11 @@ func TestExpiredMessages(t *testing.T) {
 	
 	// Create an expired message
 	expiredMsg := &common.Message{
-		ID:            "msg1",
-		DestinationID: sessionID,
-		Timestamp:     time.Now(),
-		TTL:           time.Now().Add(-1 * time.Hour), // Already expired
+		ID:               "msg1",
+		DestinationID:    sessionID,
+		Timestamp:        time.Now(),
+		EncryptedContent: paddedContent("content"),
+		TTL:              time.Now().Add(-1 * time.Hour), // Already expired
 	}
 
 	// Store expired message
@@ -256,17 +272,19 @@ func TestCleanupExpired(t *testing.T) {
 	sessionID := "session123"
 	
 	validMsg := &common.Message{
-		ID:            "msg1",
-		DestinationID: sessionID,
-		Timestamp:     time.Now(),
-		TTL:           time.Now().Add(1 * time.Hour), // Valid for 1 hour
+		ID:               "msg1",
+		DestinationID:    sessionID,
+		Timestamp:        time.Now(),
+		EncryptedContent: paddedContent("content"),
+		TTL:              time.Now().Add(1 * time.Hour), // Valid for 1 hour
 	}
 	
 	expiredMsg := &common.Message{
-		ID:            "msg2",
-		DestinationID: sessionID,
-		Timestamp:     time.Now(),
-		TTL:           time.Now().Add(-1 * time.Hour), // Already expired
+		ID:               "msg2",
+		DestinationID:    sessionID,
+		Timestamp:        time.Now(),
+		EncryptedContent: paddedContent("content"),
+		TTL:              time.Now().Add(-1 * time.Hour), // Already expired
 	}
 
 	// Store both messages
@@ -352,3 +370,281 @@ func TestMemoryStorage(t *testing.T) {
 		t.Error("Expected error when retrieving deleted key")
 	}
 }
+
+func TestStoreMessage_PaddingBuckets(t *testing.T) {
+	store := NewStore(NewMemoryStorage(), nil, 1, 14)
+
+	for i, size := range common.DefaultPaddingBuckets {
+		msg := &common.Message{
+			ID:               fmt.Sprintf("padded%d", i),
+			DestinationID:    "session123",
+			Timestamp:        time.Now(),
+			EncryptedContent: make([]byte, size),
+		}
+		if err := store.StoreMessage(msg); err != nil {
+			t.Errorf("Size %d: StoreMessage failed: %v", size, err)
+		}
+	}
+
+	for _, size := range []int{0, 1, 511, 513, 4095, 64<<10 + 1} {
+		msg := &common.Message{
+			ID:               "unpadded",
+			DestinationID:    "session123",
+			Timestamp:        time.Now(),
+			EncryptedContent: make([]byte, size),
+		}
+		if err := store.StoreMessage(msg); !errors.Is(err, common.ErrUnpaddedContent) {
+			t.Errorf("Size %d: StoreMessage = %v, want ErrUnpaddedContent", size, err)
+		}
+	}
+
+	// SURB replies carry exactly one packet payload
+	reply := &common.Message{
+		ID:               "reply",
+		DestinationID:    common.SURBDestinationPrefix + "reply",
+		Timestamp:        time.Now(),
+		MessageType:      common.MessageTypeSURBReply,
+		EncryptedContent: make([]byte, common.PayloadSize),
+	}
+	if err := store.StoreReply(reply); err != nil {
+		t.Errorf("StoreReply failed: %v", err)
+	}
+	reply.EncryptedContent = make([]byte, 512)
+	if err := store.StoreReply(reply); !errors.Is(err, common.ErrUnpaddedContent) {
+		t.Errorf("StoreReply(short reply) = %v, want ErrUnpaddedContent", err)
+	}
+
+	stats := store.GetStats()
+	if stats.RejectedUnpadded != 7 {
+		t.Errorf("RejectedUnpadded = %d, want 7", stats.RejectedUnpadded)
+	}
+	if len(stats.Buckets) != len(common.DefaultPaddingBuckets) {
+		t.Errorf("Buckets = %v, want one message in each default bucket", stats.Buckets)
+	}
+	for _, size := range common.DefaultPaddingBuckets {
+		if stats.Buckets[size] != 1 {
+			t.Errorf("Buckets[%d] = %d, want 1", size, stats.Buckets[size])
+		}
+	}
+}
+
+func TestSetPaddingBuckets(t *testing.T) {
+	store := NewStore(NewMemoryStorage(), nil, 1, 14)
+
+	for _, buckets := range [][]int{nil, {0, 512}, {4096, 512}, {512, 512}} {
+		if err := store.SetPaddingBuckets(buckets); err == nil {
+			t.Errorf("SetPaddingBuckets(%v) succeeded, want error", buckets)
+		}
+	}
+
+	if err := store.SetPaddingBuckets([]int{256, 1024}); err != nil {
+		t.Fatalf("SetPaddingBuckets failed: %v", err)
+	}
+	msg := &common.Message{
+		ID:               "msg1",
+		DestinationID:    "session123",
+		Timestamp:        time.Now(),
+		EncryptedContent: make([]byte, 256),
+	}
+	if err := store.StoreMessage(msg); err != nil {
+		t.Errorf("StoreMessage failed: %v", err)
+	}
+	msg.EncryptedContent = make([]byte, 512)
+	if err := store.StoreMessage(msg); err == nil {
+		t.Error("StoreMessage accepted a size outside the configured buckets")
+	}
+}
+
+// recordingReplicator records replication requests sent to peers
+type recordingReplicator struct {
+	calls chan string
+}
+
+func (r *recordingReplicator) ReplicateMessage(nodeAddress string, messageData []byte) error {
+	r.calls <- "replicate " + nodeAddress
+	return nil
+}
+
+func (r *recordingReplicator) DeleteMessage(nodeAddress, sessionID, messageID string) error {
+	r.calls <- "delete " + nodeAddress + " " + sessionID + "/" + messageID
+	return nil
+}
+
+func TestReplication(t *testing.T) {
+	replicator := &recordingReplicator{calls: make(chan string, 10)}
+	store := NewStore(NewMemoryStorage(), []string{"peer1:9000"}, 1, 14)
+	store.SetReplicator(replicator)
+
+	expectCall := func(want string) {
+		t.Helper()
+		select {
+		case got := <-replicator.calls:
+			if got != want {
+				t.Errorf("Expected %q, got %q", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %q, got nothing", want)
+		}
+	}
+
+	msg := &common.Message{
+		ID:               "msg1",
+		DestinationID:    "session123",
+		EncryptedContent: paddedContent("content"),
+	}
+	if err := store.StoreMessage(msg); err != nil {
+		t.Fatalf("StoreMessage failed: %v", err)
+	}
+	expectCall("replicate peer1:9000")
+
+	if err := store.DeleteMessage("session123", "msg1"); err != nil {
+		t.Fatalf("DeleteMessage failed: %v", err)
+	}
+	expectCall("delete peer1:9000 session123/msg1")
+
+	// Replicas are stored and deleted locally without further replication
+	replica := &common.Message{
+		ID:               "msg2",
+		DestinationID:    "session123",
+		TTL:              time.Now().Add(time.Hour),
+		EncryptedContent: paddedContent("content"),
+	}
+	if err := store.StoreReplica(replica); err != nil {
+		t.Fatalf("StoreReplica failed: %v", err)
+	}
+	messages, err := store.RetrieveMessages("session123")
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("Expected the replica to be stored, got %d messages (%v)", len(messages), err)
+	}
+	if err := store.DeleteReplica("session123", "msg2"); err != nil {
+		t.Fatalf("DeleteReplica failed: %v", err)
+	}
+
+	select {
+	case call := <-replicator.calls:
+		t.Errorf("Replica was sent on: %s", call)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Replicas must be padded and carry their TTL
+	if err := store.StoreReplica(&common.Message{ID: "msg3", DestinationID: "session123",
+		TTL: time.Now().Add(time.Hour), EncryptedContent: []byte("short")}); !errors.Is(err, common.ErrUnpaddedContent) {
+		t.Errorf("Expected ErrUnpaddedContent, got %v", err)
+	}
+	if err := store.StoreReplica(&common.Message{ID: "msg4", DestinationID: "session123",
+		EncryptedContent: paddedContent("content")}); err == nil {
+		t.Error("Expected error for replica without TTL")
+	}
+}
+
+func TestStoreMessage_PoW(t *testing.T) {
+	store := NewStore(NewMemoryStorage(), nil, 1, 14)
+	if err := store.SetPoWDifficulty(8); err != nil {
+		t.Fatalf("SetPoWDifficulty failed: %v", err)
+	}
+
+	newMessage := func(id string, ttl time.Duration) *common.Message {
+		return &common.Message{
+			ID:               id,
+			DestinationID:    "session123",
+			TTL:              time.Now().Add(ttl),
+			EncryptedContent: paddedContent("content"),
+		}
+	}
+
+	// A day's TTL costs the base difficulty
+	msg := newMessage("msg1", time.Hour)
+	if err := store.StoreMessage(msg); !errors.Is(err, common.ErrInsufficientPoW) {
+		t.Errorf("Unstamped message: StoreMessage = %v, want ErrInsufficientPoW", err)
+	}
+	if err := common.MintPoW(msg, 8); err != nil {
+		t.Fatalf("MintPoW failed: %v", err)
+	}
+	if err := store.StoreMessage(msg); err != nil {
+		t.Errorf("Stamped message: StoreMessage failed: %v", err)
+	}
+
+	// A week's TTL costs three more bits
+	msg = newMessage("msg2", 7*24*time.Hour)
+	if err := common.MintPoW(msg, 8); err != nil {
+		t.Fatalf("MintPoW failed: %v", err)
+	}
+	if err := store.StoreMessage(msg); !errors.Is(err, common.ErrInsufficientPoW) {
+		t.Errorf("Under-stamped message: StoreMessage = %v, want ErrInsufficientPoW", err)
+	}
+	if err := common.MintPoW(msg, 11); err != nil {
+		t.Fatalf("MintPoW failed: %v", err)
+	}
+	if err := store.StoreMessage(msg); err != nil {
+		t.Errorf("Stamped message: StoreMessage failed: %v", err)
+	}
+
+	// A zero TTL is priced at the store's 14-day default
+	msg = newMessage("msg3", 0)
+	msg.TTL = time.Time{}
+	if err := common.MintPoW(msg, 12); err != nil {
+		t.Fatalf("MintPoW failed: %v", err)
+	}
+	if err := store.StoreMessage(msg); err != nil {
+		t.Errorf("Stamped message without TTL: StoreMessage failed: %v", err)
+	}
+
+	// Replicas were checked by the node that accepted them
+	if err := store.StoreReplica(newMessage("msg4", time.Hour)); err != nil {
+		t.Errorf("Unstamped replica: StoreReplica failed: %v", err)
+	}
+
+	if rejected := store.GetStats().RejectedPoW; rejected != 2 {
+		t.Errorf("RejectedPoW = %d, want 2", rejected)
+	}
+
+	if err := store.SetPoWDifficulty(-1); err == nil {
+		t.Error("SetPoWDifficulty(-1) succeeded, want error")
+	}
+}
+
+func TestStoreMessage_SURBReplyReserved(t *testing.T) {
+	store := NewStore(NewMemoryStorage(), nil, 1, 14)
+	if err := store.SetPoWDifficulty(8); err != nil {
+		t.Fatalf("SetPoWDifficulty failed: %v", err)
+	}
+
+	// Clients cannot claim the reply type to skip proof of work and padding
+	msg := &common.Message{
+		ID:               "fake-reply",
+		DestinationID:    "session123",
+		Timestamp:        time.Now(),
+		MessageType:      common.MessageTypeSURBReply,
+		EncryptedContent: make([]byte, common.PayloadSize),
+	}
+	if err := store.StoreMessage(msg); !errors.Is(err, ErrReservedForReplies) {
+		t.Errorf("StoreMessage(SURB reply type) = %v, want ErrReservedForReplies", err)
+	}
+
+	// nor write into a reply mailbox
+	msg.MessageType = common.MessageTypeText
+	msg.DestinationID = common.SURBDestinationPrefix + "00112233"
+	msg.EncryptedContent = paddedContent("content")
+	if err := common.MintPoW(msg, 8); err != nil {
+		t.Fatalf("MintPoW failed: %v", err)
+	}
+	if err := store.StoreMessage(msg); !errors.Is(err, ErrReservedForReplies) {
+		t.Errorf("StoreMessage(SURB destination) = %v, want ErrReservedForReplies", err)
+	}
+
+	// StoreReply takes only replies under a SURB destination
+	msg.MessageType = common.MessageTypeSURBReply
+	msg.DestinationID = "session123"
+	msg.EncryptedContent = make([]byte, common.PayloadSize)
+	if err := store.StoreReply(msg); err == nil {
+		t.Error("StoreReply accepted a reply outside a SURB destination")
+	}
+	msg.DestinationID = common.SURBDestinationPrefix + "00112233"
+	if err := store.StoreReply(msg); err != nil {
+		t.Errorf("StoreReply failed: %v", err)
+	}
+
+	if stored := store.GetStats().MessagesStored; stored != 1 {
+		t.Errorf("MessagesStored = %d, want 1", stored)
+	}
+}
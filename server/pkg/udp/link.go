@@ -0,0 +1,161 @@
+// Package udp carries onion packets between nodes as single UDP datagrams.
+// Each datagram is sealed with a link key derived from the sending and
+// receiving nodes' identity keys, so only registered nodes can inject
+// packets and observers see nothing beyond the fixed datagram size.
+package udp
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Datagram layout:
+//
+//	0       version (DatagramVersion)
+//	1:33    sender identity key (Ed25519)
+//	33:57   nonce (random, XChaCha20-Poly1305)
+//	57:     onion packet sealed with the link key, then the 16-byte tag
+//
+// The version and sender key are authenticated as associated data.
+const (
+	DatagramVersion = 0x01
+
+	datagramHeaderSize = 1 + ed25519.PublicKeySize + chacha20poly1305.NonceSizeX
+
+	// DatagramSize is the size of every datagram (1353 bytes), below the
+	// 1452 bytes of UDP payload an IPv6 packet carries on a 1500-byte MTU
+	DatagramSize = datagramHeaderSize + common.PacketSize + chacha20poly1305.Overhead
+)
+
+// linkKeyInfo labels link keys so they never match keys derived for other uses
+const linkKeyInfo = "GhostTalk-link-v1"
+
+// link seals and opens datagrams exchanged with peer nodes. Keys come from
+// static X25519 ECDH between the two identity keys, one per direction, and
+// are cached per peer. Link keys are long-lived; forward secrecy for the
+// traffic itself comes from the onion layers inside.
+type link struct {
+	publicKey ed25519.PublicKey
+	curveKey  []byte
+
+	aeads map[linkKeyID]cipher.AEAD
+	mu    sync.Mutex
+}
+
+// linkKeyID identifies the key for one direction of a link
+type linkKeyID struct {
+	peer     [ed25519.PublicKeySize]byte
+	outbound bool
+}
+
+// newLink creates the link state for a node's identity key
+func newLink(identity ed25519.PrivateKey) *link {
+	return &link{
+		publicKey: identity.Public().(ed25519.PublicKey),
+		curveKey:  common.Ed25519PrivateKeyToCurve25519(identity),
+		aeads:     make(map[linkKeyID]cipher.AEAD),
+	}
+}
+
+// aead returns the cipher for traffic to peer (outbound) or from it
+func (l *link) aead(peer ed25519.PublicKey, outbound bool) (cipher.AEAD, error) {
+	if len(peer) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid peer key")
+	}
+	id := linkKeyID{outbound: outbound}
+	copy(id.peer[:], peer)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if aead, ok := l.aeads[id]; ok {
+		return aead, nil
+	}
+
+	peerCurve, err := common.Ed25519PublicKeyToCurve25519(peer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer key: %w", err)
+	}
+	shared, err := common.X25519ECDH(l.curveKey, peerCurve)
+	if err != nil {
+		return nil, fmt.Errorf("ECDH failed: %w", err)
+	}
+
+	// Both ends bind the key to the direction: sender key, then receiver key
+	from, to := l.publicKey, peer
+	if !outbound {
+		from, to = peer, l.publicKey
+	}
+	info := make([]byte, 0, 2*ed25519.PublicKeySize)
+	info = append(info, from...)
+	info = append(info, to...)
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, []byte(linkKeyInfo), info), key); err != nil {
+		return nil, fmt.Errorf("key derivation failed: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	l.aeads[id] = aead
+	return aead, nil
+}
+
+// seal wraps an onion packet in a datagram for peer
+func (l *link) seal(peer ed25519.PublicKey, packet []byte) ([]byte, error) {
+	if len(packet) != common.PacketSize {
+		return nil, fmt.Errorf("invalid packet size: %d", len(packet))
+	}
+	aead, err := l.aead(peer, true)
+	if err != nil {
+		return nil, err
+	}
+
+	datagram := make([]byte, datagramHeaderSize, DatagramSize)
+	datagram[0] = DatagramVersion
+	copy(datagram[1:33], l.publicKey)
+	nonce := datagram[33:datagramHeaderSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("nonce generation failed: %w", err)
+	}
+
+	return aead.Seal(datagram, nonce, packet, datagram[:33]), nil
+}
+
+// senderKey returns the identity key a datagram claims to come from
+func senderKey(datagram []byte) (ed25519.PublicKey, error) {
+	if len(datagram) != DatagramSize {
+		return nil, fmt.Errorf("invalid datagram size: %d", len(datagram))
+	}
+	if datagram[0] != DatagramVersion {
+		return nil, fmt.Errorf("unsupported datagram version: 0x%02x", datagram[0])
+	}
+	return ed25519.PublicKey(datagram[1:33]), nil
+}
+
+// open authenticates a datagram from peer and returns the onion packet
+func (l *link) open(peer ed25519.PublicKey, datagram []byte) ([]byte, error) {
+	aead, err := l.aead(peer, false)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := datagram[33:datagramHeaderSize]
+	packet, err := aead.Open(nil, nonce, datagram[datagramHeaderSize:], datagram[:33])
+	if err != nil {
+		return nil, errors.New("datagram authentication failed")
+	}
+	return packet, nil
+}
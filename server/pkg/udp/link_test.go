@@ -0,0 +1,96 @@
+package udp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+func newTestIdentity(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	return pub, priv
+}
+
+func newTestPacket(t *testing.T) []byte {
+	t.Helper()
+
+	packet := make([]byte, common.PacketSize)
+	if _, err := rand.Read(packet); err != nil {
+		t.Fatalf("Failed to generate packet: %v", err)
+	}
+	return packet
+}
+
+func TestLink_RoundTrip(t *testing.T) {
+	alicePub, alice := newTestIdentity(t)
+	bobPub, bob := newTestIdentity(t)
+	packet := newTestPacket(t)
+
+	datagram, err := newLink(alice).seal(bobPub, packet)
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+	if len(datagram) != DatagramSize {
+		t.Fatalf("Datagram size = %d, want %d", len(datagram), DatagramSize)
+	}
+	if bytes.Contains(datagram, packet[:64]) {
+		t.Error("Datagram contains the packet in the clear")
+	}
+
+	sender, err := senderKey(datagram)
+	if err != nil || !sender.Equal(alicePub) {
+		t.Fatalf("senderKey = %x, %v, want %x", sender, err, alicePub)
+	}
+	opened, err := newLink(bob).open(alicePub, datagram)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if !bytes.Equal(opened, packet) {
+		t.Error("Packet changed across the link")
+	}
+}
+
+func TestLink_Rejects(t *testing.T) {
+	alicePub, alice := newTestIdentity(t)
+	bobPub, bob := newTestIdentity(t)
+	_, carol := newTestIdentity(t)
+
+	datagram, err := newLink(alice).seal(bobPub, newTestPacket(t))
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+
+	// Only the intended receiver can open it
+	if _, err := newLink(carol).open(alicePub, datagram); err == nil {
+		t.Error("Third node opened a datagram sealed for another")
+	}
+
+	// Keys are bound to the direction, so reflecting a datagram fails
+	if _, err := newLink(alice).open(bobPub, datagram); err == nil {
+		t.Error("Datagram reflected to its sender was accepted")
+	}
+
+	// Any modification, including of the claimed sender, fails
+	for _, offset := range []int{0, 5, 40, datagramHeaderSize + 10, DatagramSize - 1} {
+		tampered := append([]byte(nil), datagram...)
+		tampered[offset] ^= 0x01
+		if _, err := newLink(bob).open(alicePub, tampered); err == nil {
+			t.Errorf("Datagram modified at byte %d was accepted", offset)
+		}
+	}
+
+	if _, err := senderKey(datagram[:DatagramSize-1]); err == nil {
+		t.Error("Truncated datagram accepted")
+	}
+	if _, err := newLink(alice).seal(bobPub, make([]byte, 100)); err == nil {
+		t.Error("Sealed a packet of the wrong size")
+	}
+}
@@ -0,0 +1,154 @@
+package udp
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// PeerResolver looks up registered nodes. directory.Service implements it.
+type PeerResolver interface {
+	// ResolveNode returns the node with an identity key, or an error if it is unknown or unhealthy
+	ResolveNode(publicKey []byte) (*common.NodeInfo, error)
+
+	// ResolveAddress returns the node listening on host:port, or an error if there is none
+	ResolveAddress(address string) (*common.NodeInfo, error)
+}
+
+// Handler is called with each onion packet received from a peer. It may be
+// called concurrently from several readers.
+type Handler func(packet []byte, peer *common.NodeInfo)
+
+// ListenerConfig holds optional listener settings
+type ListenerConfig struct {
+	Readers int // Goroutines reading and opening datagrams (default: one per CPU)
+}
+
+// Listener receives onion packets from peer nodes over UDP. Datagrams from
+// senders that are not registered in the directory, or that fail
+// authentication, are dropped without a response.
+type Listener struct {
+	conn    *net.UDPConn
+	link    *link
+	peers   PeerResolver
+	handler Handler
+	wg      sync.WaitGroup
+
+	// Stats
+	received atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// Listen starts receiving datagrams on address (host:port). Packets from
+// authenticated peers are passed to handler.
+func Listen(address string, identity ed25519.PrivateKey, peers PeerResolver, handler Handler, config *ListenerConfig) (*Listener, error) {
+	if peers == nil {
+		return nil, errors.New("peer resolver required")
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	readers := runtime.NumCPU()
+	if config != nil && config.Readers > 0 {
+		readers = config.Readers
+	}
+
+	l := &Listener{
+		conn:    conn,
+		link:    newLink(identity),
+		peers:   peers,
+		handler: handler,
+	}
+
+	l.wg.Add(readers)
+	for i := 0; i < readers; i++ {
+		go l.readLoop()
+	}
+
+	return l, nil
+}
+
+// Addr returns the address the listener is bound to
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Close stops the listener and waits for its readers to finish
+func (l *Listener) Close() error {
+	err := l.conn.Close()
+	l.wg.Wait()
+	return err
+}
+
+// GetStats returns listener statistics
+func (l *Listener) GetStats() ListenerStats {
+	return ListenerStats{
+		Received: l.received.Load(),
+		Rejected: l.rejected.Load(),
+	}
+}
+
+// readLoop reads datagrams until the socket is closed
+func (l *Listener) readLoop() {
+	defer l.wg.Done()
+
+	// One byte more than a datagram, so oversized datagrams are detected
+	buf := make([]byte, DatagramSize+1)
+	for {
+		n, _, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		packet, peer, err := l.open(buf[:n])
+		if err != nil {
+			l.rejected.Add(1)
+			continue
+		}
+
+		l.received.Add(1)
+		l.handler(packet, peer)
+	}
+}
+
+// open checks that a datagram comes from a registered peer and authenticates it.
+// The directory is consulted first, so unknown senders cost no ECDH.
+func (l *Listener) open(datagram []byte) ([]byte, *common.NodeInfo, error) {
+	sender, err := senderKey(datagram)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	peer, err := l.peers.ResolveNode(sender)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unknown sender: %w", err)
+	}
+
+	packet, err := l.link.open(peer.PublicKey, datagram)
+	if err != nil {
+		return nil, nil, err
+	}
+	return packet, peer, nil
+}
+
+// ListenerStats contains UDP listener statistics
+type ListenerStats struct {
+	Received uint64 // Packets accepted from peers
+	Rejected uint64 // Datagrams dropped: malformed, unknown sender or failed authentication
+}
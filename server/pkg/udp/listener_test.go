@@ -0,0 +1,254 @@
+package udp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+)
+
+// fakePeers is a directory of test nodes
+type fakePeers struct {
+	nodes []*common.NodeInfo
+	mu    sync.Mutex
+}
+
+func (f *fakePeers) add(node *common.NodeInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes = append(f.nodes, node)
+}
+
+func (f *fakePeers) ResolveNode(publicKey []byte) (*common.NodeInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, node := range f.nodes {
+		if bytes.Equal(node.PublicKey, publicKey) {
+			return node, nil
+		}
+	}
+	return nil, errors.New("node not found")
+}
+
+func (f *fakePeers) ResolveAddress(address string) (*common.NodeInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, node := range f.nodes {
+		if net.JoinHostPort(node.Address, strconv.Itoa(int(node.Port))) == address {
+			return node, nil
+		}
+	}
+	return nil, errors.New("node not found")
+}
+
+// fakeFallback records packets sent through the fallback path
+type fakeFallback struct {
+	addresses []string
+}
+
+func (f *fakeFallback) ForwardPacket(nodeAddress string, packet []byte) error {
+	f.addresses = append(f.addresses, nodeAddress)
+	return nil
+}
+
+// received collects packets delivered by a listener
+type received struct {
+	packets chan []byte
+	peers   chan *common.NodeInfo
+}
+
+func newReceived() *received {
+	return &received{packets: make(chan []byte, 16), peers: make(chan *common.NodeInfo, 16)}
+}
+
+func (r *received) handle(packet []byte, peer *common.NodeInfo) {
+	r.packets <- packet
+	r.peers <- peer
+}
+
+// startListener starts a listener for a new node on a loopback port and registers it in peers
+func startListener(t *testing.T, peers *fakePeers, handler Handler) (*Listener, *common.NodeInfo) {
+	t.Helper()
+
+	pub, priv := newTestIdentity(t)
+	l, err := Listen("127.0.0.1:0", priv, peers, handler, &ListenerConfig{Readers: 2})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	node := &common.NodeInfo{
+		ID:        "receiver",
+		PublicKey: pub,
+		Address:   "127.0.0.1",
+		Port:      9000,
+		UDPPort:   uint16(l.Addr().(*net.UDPAddr).Port),
+	}
+	peers.add(node)
+	return l, node
+}
+
+func TestSender_DeliversToListener(t *testing.T) {
+	peers := &fakePeers{}
+	got := newReceived()
+	l, _ := startListener(t, peers, got.handle)
+
+	senderPub, senderKey := newTestIdentity(t)
+	peers.add(&common.NodeInfo{ID: "sender", PublicKey: senderPub, Address: "127.0.0.1", Port: 9001})
+
+	s, err := NewSender(senderKey, peers, nil)
+	if err != nil {
+		t.Fatalf("NewSender failed: %v", err)
+	}
+	defer s.Close()
+
+	packet := newTestPacket(t)
+	if err := s.ForwardPacket("127.0.0.1:9000", packet); err != nil {
+		t.Fatalf("ForwardPacket failed: %v", err)
+	}
+
+	select {
+	case delivered := <-got.packets:
+		if !bytes.Equal(delivered, packet) {
+			t.Error("Delivered packet differs from the one sent")
+		}
+		if peer := <-got.peers; peer.ID != "sender" {
+			t.Errorf("Peer = %s, want sender", peer.ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Packet was not delivered")
+	}
+
+	if stats := s.GetStats(); stats.Sent != 1 || stats.Fallbacks != 0 {
+		t.Errorf("Sender stats = %+v, want one sent", stats)
+	}
+	if stats := l.GetStats(); stats.Received != 1 {
+		t.Errorf("Listener received = %d, want 1", stats.Received)
+	}
+}
+
+func TestListener_RejectsUnknownSender(t *testing.T) {
+	peers := &fakePeers{}
+	got := newReceived()
+	l, receiver := startListener(t, peers, got.handle)
+
+	// The sender is not registered, so the listener drops its datagrams
+	_, stranger := newTestIdentity(t)
+	datagram, err := newLink(stranger).seal(receiver.PublicKey, newTestPacket(t))
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer conn.Close()
+	for _, d := range [][]byte{datagram, datagram[:100], make([]byte, DatagramSize)} {
+		if _, err := conn.Write(d); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for l.GetStats().Rejected < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := l.GetStats(); stats.Rejected != 3 || stats.Received != 0 {
+		t.Errorf("Listener stats = %+v, want 3 rejected", stats)
+	}
+	if len(got.packets) != 0 {
+		t.Error("Packet from an unknown sender was delivered")
+	}
+}
+
+func TestSender_FallsBackWithoutUDPPort(t *testing.T) {
+	_, senderKey := newTestIdentity(t)
+	httpsOnlyPub, _ := newTestIdentity(t)
+	peers := &fakePeers{nodes: []*common.NodeInfo{
+		{ID: "https-only", PublicKey: httpsOnlyPub, Address: "127.0.0.1", Port: 9002},
+	}}
+	fallback := &fakeFallback{}
+
+	s, err := NewSender(senderKey, peers, fallback)
+	if err != nil {
+		t.Fatalf("NewSender failed: %v", err)
+	}
+	defer s.Close()
+
+	for _, address := range []string{"127.0.0.1:9002", "10.9.9.9:9000"} {
+		if err := s.ForwardPacket(address, newTestPacket(t)); err != nil {
+			t.Errorf("ForwardPacket(%s) failed: %v", address, err)
+		}
+	}
+	if len(fallback.addresses) != 2 || s.GetStats().Fallbacks != 2 {
+		t.Errorf("Fallback sends = %v, want both packets", fallback.addresses)
+	}
+
+	// Version 3 packets are too large for a datagram, even to a UDP peer
+	_, udpNode := startListener(t, peers, newReceived().handle)
+	large := make([]byte, common.PacketSizeLarge)
+	if err := s.ForwardPacket(net.JoinHostPort(udpNode.Address, strconv.Itoa(int(udpNode.Port))), large); err != nil {
+		t.Errorf("ForwardPacket of a large packet failed: %v", err)
+	}
+	if len(fallback.addresses) != 3 || s.GetStats().Fallbacks != 3 {
+		t.Errorf("Fallback sends = %v, want the large packet too", fallback.addresses)
+	}
+
+	noFallback, err := NewSender(senderKey, peers, nil)
+	if err != nil {
+		t.Fatalf("NewSender failed: %v", err)
+	}
+	defer noFallback.Close()
+	if err := noFallback.ForwardPacket("127.0.0.1:9002", newTestPacket(t)); err == nil {
+		t.Error("Expected error without a UDP endpoint or fallback, got nil")
+	}
+}
+
+func TestListener_ConcurrentSenders(t *testing.T) {
+	peers := &fakePeers{}
+	got := newReceived()
+	got.packets = make(chan []byte, 64)
+	got.peers = make(chan *common.NodeInfo, 64)
+	startListener(t, peers, got.handle)
+
+	const senders, perSender = 4, 8
+	sendersList := make([]*Sender, senders)
+	for i := range sendersList {
+		pub, priv := newTestIdentity(t)
+		peers.add(&common.NodeInfo{ID: "sender", PublicKey: pub})
+		s, err := NewSender(priv, peers, nil)
+		if err != nil {
+			t.Fatalf("NewSender failed: %v", err)
+		}
+		defer s.Close()
+		sendersList[i] = s
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range sendersList {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perSender; j++ {
+				if err := s.ForwardPacket("127.0.0.1:9000", make([]byte, common.PacketSize)); err != nil {
+					t.Errorf("ForwardPacket failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for n := 0; n < senders*perSender; n++ {
+		select {
+		case <-got.packets:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Received %d of %d packets", n, senders*perSender)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package udp
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/forwarder"
+)
+
+// Sender forwards onion packets as UDP datagrams to peers that publish a
+// UDP port, and through a fallback sender (HTTPS) to all others. Packets
+// of the large size class do not fit in a datagram and always take the
+// fallback. It implements forwarder.Sender.
+type Sender struct {
+	conn     *net.UDPConn
+	link     *link
+	peers    PeerResolver
+	fallback forwarder.Sender
+
+	// Stats
+	sent      atomic.Uint64
+	fallbacks atomic.Uint64
+}
+
+// NewSender creates a UDP sender. Next hops are looked up by address in
+// peers; those without a UDP port are sent through fallback, which may be
+// nil to refuse them.
+func NewSender(identity ed25519.PrivateKey, peers PeerResolver, fallback forwarder.Sender) (*Sender, error) {
+	if peers == nil {
+		return nil, errors.New("peer resolver required")
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sender{
+		conn:     conn,
+		link:     newLink(identity),
+		peers:    peers,
+		fallback: fallback,
+	}, nil
+}
+
+// ForwardPacket sends packet to the node at nodeAddress (host:port of its HTTPS endpoint)
+func (s *Sender) ForwardPacket(nodeAddress string, packet []byte) error {
+	node, err := s.peers.ResolveAddress(nodeAddress)
+	if err != nil || node.UDPPort == 0 || len(packet) != common.PacketSize {
+		if s.fallback == nil {
+			return fmt.Errorf("no UDP endpoint for %s", nodeAddress)
+		}
+		s.fallbacks.Add(1)
+		return s.fallback.ForwardPacket(nodeAddress, packet)
+	}
+
+	datagram, err := s.link.seal(node.PublicKey, packet)
+	if err != nil {
+		return err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(node.Address, strconv.Itoa(int(node.UDPPort))))
+	if err != nil {
+		return fmt.Errorf("invalid UDP address: %w", err)
+	}
+	if _, err := s.conn.WriteToUDP(datagram, addr); err != nil {
+		return fmt.Errorf("send failed: %w", err)
+	}
+
+	s.sent.Add(1)
+	return nil
+}
+
+// Close releases the sender's socket
+func (s *Sender) Close() error {
+	return s.conn.Close()
+}
+
+// GetStats returns sender statistics
+func (s *Sender) GetStats() SenderStats {
+	return SenderStats{
+		Sent:      s.sent.Load(),
+		Fallbacks: s.fallbacks.Load(),
+	}
+}
+
+// SenderStats contains UDP sender statistics
+type SenderStats struct {
+	Sent      uint64 // Packets sent as datagrams
+	Fallbacks uint64 // Packets handed to the fallback sender
+}
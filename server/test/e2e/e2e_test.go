@@ -3,28 +3,39 @@ package e2e
 import (
 	"bytes"
 	"crypto/ed25519"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/common"
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/directory"
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/forwarder"
+	"github.com/montana2ab/GhostTalketnodes/server/pkg/mtls"
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/onion"
 	"github.com/montana2ab/GhostTalketnodes/server/pkg/swarm"
 )
 
 // TestNode represents a test service node
 type TestNode struct {
-	ID         string
-	PrivateKey ed25519.PrivateKey
-	Router     *onion.Router
-	Swarm      *swarm.Store
-	Directory  *directory.Service
-	Server     *httptest.Server
+	ID          string
+	PrivateKey  ed25519.PrivateKey
+	KeyRing     *onion.KeyRing
+	Router      *onion.Router
+	Swarm       *swarm.Store
+	Reassembler *swarm.Reassembler
+	Circuits    *onion.CircuitTable
+	Directory   *directory.Service
+	Forwarder   *forwarder.Forwarder
+	Server      *httptest.Server
 }
 
 // SetupTestNode creates a test node for E2E testing
@@ -36,10 +47,15 @@ func SetupTestNode(t *testing.T, id string) *TestNode {
 	}
 
 	// Initialize components
-	router := onion.NewRouter(priv)
+	keyRing, err := onion.NewKeyRing(priv, 0)
+	if err != nil {
+		t.Fatalf("Failed to create key ring: %v", err)
+	}
+	directoryService := directory.NewService(priv)
+	circuits := onion.NewCircuitTable(nil)
+	router := onion.NewRouterWithConfig(priv, &onion.RouterConfig{Keys: keyRing, Resolver: directoryService, Circuits: circuits})
 	storage := swarm.NewMemoryStorage()
 	swarmStore := swarm.NewStore(storage, []string{}, 3, 14)
-	directoryService := directory.NewService(priv)
 
 	// Create HTTP server
 	r := mux.NewRouter()
@@ -47,13 +63,19 @@ func SetupTestNode(t *testing.T, id string) *TestNode {
 	node := &TestNode{
 		ID:         id,
 		PrivateKey: priv,
+		KeyRing:    keyRing,
 		Router:     router,
-		Swarm:      swarmStore,
-		Directory:  directoryService,
+		Swarm:       swarmStore,
+		Reassembler: swarm.NewReassembler(swarmStore, nil),
+		Circuits:    circuits,
+		Directory:   directoryService,
+		Forwarder:  forwarder.NewForwarder(forwarder.NewHTTPSender("http", 5*time.Second), nil),
 	}
 
 	// Register handlers
 	r.HandleFunc("/v1/onion", node.handleOnionPacket).Methods("POST")
+	r.HandleFunc("/v1/onion/request", node.handleOnionRequest).Methods("POST")
+	r.HandleFunc("/v1/onion/circuit", node.handleOnionCell).Methods("POST")
 	r.HandleFunc("/v1/swarm/messages/{sessionID}", node.handleRetrieveMessages).Methods("GET")
 	r.HandleFunc("/v1/swarm/messages", node.handleStoreMessage).Methods("POST")
 	r.HandleFunc("/health", node.handleHealth).Methods("GET")
@@ -64,9 +86,8 @@ func SetupTestNode(t *testing.T, id string) *TestNode {
 }
 
 func (n *TestNode) handleOnionPacket(w http.ResponseWriter, r *http.Request) {
-	packet := make([]byte, common.PacketSize)
-	_, err := r.Body.Read(packet)
-	if err != nil && err.Error() != "EOF" {
+	packet, err := io.ReadAll(r.Body)
+	if err != nil {
 		http.Error(w, "Failed to read packet", http.StatusBadRequest)
 		return
 	}
@@ -80,16 +101,121 @@ func (n *TestNode) handleOnionPacket(w http.ResponseWriter, r *http.Request) {
 
 	switch decision.Action {
 	case onion.ActionDeliver:
-		var msg common.Message
-		if err := json.Unmarshal(decision.Payload, &msg); err == nil {
-			n.Swarm.StoreMessage(&msg)
+		if fragment, err := common.DecodeFragment(decision.Payload); err == nil {
+			n.Reassembler.Add(fragment)
 		}
 		w.WriteHeader(http.StatusOK)
+	case onion.ActionDeliverReply:
+		n.Swarm.StoreReply(onion.ReplyMessage(decision))
+		w.WriteHeader(http.StatusOK)
+	case onion.ActionDrop:
+		w.WriteHeader(http.StatusOK)
 	case onion.ActionForward:
+		if err := n.Forwarder.Enqueue(decision.NextAddress, decision.NextPacket, decision.Delay); err != nil {
+			http.Error(w, "Forwarding queue full", http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusAccepted)
 	}
 }
 
+func (n *TestNode) handleOnionRequest(w http.ResponseWriter, r *http.Request) {
+	packet, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	decision, err := n.Router.ProcessRequest(packet)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var response []byte
+	switch decision.Action {
+	case onion.ActionForward:
+		relayed, err := forwarder.NewHTTPSender("http", 5*time.Second).SendRequest(decision.NextAddress, decision.NextPacket)
+		if err != nil {
+			http.Error(w, "Next hop unreachable", http.StatusBadGateway)
+			return
+		}
+		response, err = onion.WrapResponse(decision, relayed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	case onion.ActionRequest:
+		// Execute against this node's own API
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(decision.Request.Method, decision.Request.Path, bytes.NewReader(decision.Request.Body))
+		n.Server.Config.Handler.ServeHTTP(recorder, req)
+		response, err = onion.SealResponse(decision, &onion.Response{
+			Status: recorder.Code,
+			Body:   recorder.Body.Bytes(),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Write(response)
+}
+
+func (n *TestNode) handleOnionCell(w http.ResponseWriter, r *http.Request) {
+	cell, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read cell", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	decision, err := n.Router.ProcessCell(mtls.RemoteHost(r.RemoteAddr), cell)
+	if err != nil {
+		http.Error(w, "Invalid cell", http.StatusBadRequest)
+		return
+	}
+
+	sender := forwarder.NewHTTPSender("http", 5*time.Second)
+	answer := decision.Reply
+	switch decision.Action {
+	case onion.CellForward:
+		relayed, err := sender.SendCell(decision.NextAddress, decision.NextCell)
+		if err == nil {
+			answer, err = decision.Wrap(relayed)
+		}
+		if err != nil {
+			http.Error(w, "Next hop unreachable", http.StatusBadGateway)
+			return
+		}
+	case onion.CellExtend:
+		created, err := sender.SendCell(decision.NextAddress, decision.NextCell)
+		if err == nil {
+			answer, err = decision.Extended(created)
+		}
+		if err != nil {
+			http.Error(w, "Next hop unreachable", http.StatusBadGateway)
+			return
+		}
+	case onion.CellRequest:
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(decision.Request.Method, decision.Request.Path, bytes.NewReader(decision.Request.Body))
+		n.Server.Config.Handler.ServeHTTP(recorder, req)
+		answer, err = decision.Respond(&onion.Response{
+			Status: recorder.Code,
+			Body:   recorder.Body.Bytes(),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Write(answer)
+}
+
 func (n *TestNode) handleStoreMessage(w http.ResponseWriter, r *http.Request) {
 	var msg common.Message
 	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
@@ -127,9 +253,87 @@ func (n *TestNode) handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 func (n *TestNode) Close() {
+	if n.Forwarder != nil {
+		n.Forwarder.Close()
+	}
 	if n.Server != nil {
 		n.Server.Close()
 	}
+	if n.Reassembler != nil {
+		n.Reassembler.Close()
+	}
+	if n.Circuits != nil {
+		n.Circuits.Close()
+	}
+}
+
+// testPayloadID derives a hex-encoded 32-byte ID, as onion payloads carry them, from a readable name
+func testPayloadID(name string) string {
+	return hex.EncodeToString(common.Hash256([]byte(name)))
+}
+
+// NodeInfo returns the directory entry clients would use to route through this node
+func (n *TestNode) NodeInfo(t *testing.T) common.NodeInfo {
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(n.Server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Failed to parse server address: %v", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatalf("Failed to parse server port: %v", err)
+	}
+
+	node := common.NodeInfo{
+		ID:        n.ID,
+		PublicKey: n.PrivateKey.Public().(ed25519.PublicKey),
+		Address:   host,
+		Port:      uint16(port),
+	}
+	n.KeyRing.Publish(&node)
+	common.SignRegistration(n.PrivateKey, &node)
+
+	return node
+}
+
+// sendOnionMessage sends msg over path as one packet per fragment and
+// returns the entry node's status, which must be the same for every packet
+func sendOnionMessage(t *testing.T, entryURL string, path []common.NodeInfo, msg *common.Message, opts *onion.BuildOptions) int {
+	t.Helper()
+
+	payloads, err := common.EncodeMessageFragments(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode payload: %v", err)
+	}
+
+	status := 0
+	for _, payload := range payloads {
+		packet, err := onion.BuildPacket(path, payload, opts)
+		if err != nil {
+			t.Fatalf("Failed to build packet: %v", err)
+		}
+
+		resp, err := http.Post(entryURL+"/v1/onion", "application/octet-stream", bytes.NewReader(packet))
+		if err != nil {
+			t.Fatalf("Failed to send packet: %v", err)
+		}
+		resp.Body.Close()
+
+		if status != 0 && resp.StatusCode != status {
+			t.Fatalf("Status changed from %d to %d between fragments", status, resp.StatusCode)
+		}
+		status = resp.StatusCode
+	}
+
+	return status
+}
+
+// paddedContent pads s to the smallest default padding bucket
+func paddedContent(s string) []byte {
+	padded, err := common.PadToBucket([]byte(s), common.DefaultPaddingBuckets)
+	if err != nil {
+		panic(err)
+	}
+	return padded
 }
 
 // TestMessageStoreAndRetrieve tests basic store and forward functionality
@@ -143,7 +347,7 @@ func TestMessageStoreAndRetrieve(t *testing.T) {
 		DestinationID:    "destination-session-id",
 		Timestamp:        time.Now(),
 		MessageType:      common.MessageTypeText,
-		EncryptedContent: []byte("encrypted content"),
+		EncryptedContent: paddedContent("encrypted content"),
 		TTL:              time.Now().Add(24 * time.Hour),
 		ReplicaCount:     1,
 	}
@@ -211,7 +415,7 @@ func TestMultiNodeCoordination(t *testing.T) {
 		DestinationID:    "test-session-id",
 		Timestamp:        time.Now(),
 		MessageType:      common.MessageTypeText,
-		EncryptedContent: []byte("test message"),
+		EncryptedContent: paddedContent("test message"),
 		TTL:              time.Now().Add(24 * time.Hour),
 		ReplicaCount:     3,
 	}
@@ -284,7 +488,7 @@ func TestMessageExpiration(t *testing.T) {
 		DestinationID:    "test-session",
 		Timestamp:        time.Now(),
 		MessageType:      common.MessageTypeText,
-		EncryptedContent: []byte("will expire"),
+		EncryptedContent: paddedContent("will expire"),
 		TTL:              time.Now().Add(100 * time.Millisecond), // Short TTL
 		ReplicaCount:     1,
 	}
@@ -305,9 +509,12 @@ func TestMessageExpiration(t *testing.T) {
 	node.Swarm.CleanupExpired()
 
 	// Try to retrieve - should be empty or not found
-	resp, _ = http.Get(
+	resp, err := http.Get(
 		fmt.Sprintf("%s/v1/swarm/messages/%s", node.Server.URL, msg.DestinationID),
 	)
+	if err != nil {
+		t.Fatalf("Failed to retrieve messages: %v", err)
+	}
 	defer resp.Body.Close()
 
 	var messages []*common.Message
@@ -335,7 +542,7 @@ func TestConcurrentMessageStorage(t *testing.T) {
 				DestinationID:    "concurrent-session",
 				Timestamp:        time.Now(),
 				MessageType:      common.MessageTypeText,
-				EncryptedContent: []byte(fmt.Sprintf("message %d", id)),
+				EncryptedContent: paddedContent(fmt.Sprintf("message %d", id)),
 				TTL:              time.Now().Add(24 * time.Hour),
 				ReplicaCount:     1,
 			}
@@ -375,6 +582,420 @@ func TestConcurrentMessageStorage(t *testing.T) {
 	}
 }
 
+// TestOnionDelivery tests delivering a message through a real onion packet
+func TestOnionDelivery(t *testing.T) {
+	node := SetupTestNode(t, "node1")
+	defer node.Close()
+
+	msg := &common.Message{
+		ID:               testPayloadID("msg-onion-001"),
+		DestinationID:    testPayloadID("onion-session"),
+		Timestamp:        time.Now(),
+		MessageType:      common.MessageTypeText,
+		EncryptedContent: paddedContent("onion routed"),
+		TTL:              time.Now().Add(24 * time.Hour),
+	}
+
+	// Clients learn the signed onion key from the bootstrap set
+	info := &common.NodeInfo{
+		ID:        node.ID,
+		PublicKey: node.PrivateKey.Public().(ed25519.PublicKey),
+		Address:   "127.0.0.1",
+	}
+	node.KeyRing.Publish(info)
+	common.SignRegistration(node.PrivateKey, info)
+	if err := node.Directory.RegisterNode(info); err != nil {
+		t.Fatalf("Failed to register node: %v", err)
+	}
+
+	bootstrap, err := node.Directory.GetBootstrapSet()
+	if err != nil {
+		t.Fatalf("Failed to get bootstrap set: %v", err)
+	}
+
+	status := sendOnionMessage(t, node.Server.URL, bootstrap.Nodes, msg, nil)
+
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+
+	messages, err := node.Swarm.RetrieveMessages(msg.DestinationID)
+	if err != nil {
+		t.Fatalf("Failed to retrieve messages: %v", err)
+	}
+
+	if len(messages) != 1 || messages[0].ID != msg.ID {
+		t.Errorf("Expected delivered message %s, got %v", msg.ID, messages)
+	}
+}
+
+// TestOnionThreeHopDelivery tests a packet forwarded across three nodes
+func TestOnionThreeHopDelivery(t *testing.T) {
+	node1 := SetupTestNode(t, "node1")
+	node2 := SetupTestNode(t, "node2")
+	node3 := SetupTestNode(t, "node3")
+	defer node1.Close()
+	defer node2.Close()
+	defer node3.Close()
+
+	msg := &common.Message{
+		ID:               testPayloadID("msg-onion-3hop"),
+		DestinationID:    testPayloadID("onion-3hop-session"),
+		Timestamp:        time.Now(),
+		MessageType:      common.MessageTypeText,
+		EncryptedContent: paddedContent("three hops"),
+		TTL:              time.Now().Add(24 * time.Hour),
+	}
+
+	path := []common.NodeInfo{node1.NodeInfo(t), node2.NodeInfo(t), node3.NodeInfo(t)}
+	status := sendOnionMessage(t, node1.Server.URL, path, msg, nil)
+
+	// The entry node accepts immediately and forwards asynchronously
+	if status != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", status)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		messages, err := node3.Swarm.RetrieveMessages(msg.DestinationID)
+		if err == nil && len(messages) == 1 && messages[0].ID == msg.ID {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("Message was not delivered at the exit node")
+}
+
+// TestOnionRouteByNodeID forwards by node ID, resolving each next hop in the forwarding node's directory
+func TestOnionRouteByNodeID(t *testing.T) {
+	node1 := SetupTestNode(t, "node1")
+	node2 := SetupTestNode(t, "node2")
+	node3 := SetupTestNode(t, "node3")
+	defer node1.Close()
+	defer node2.Close()
+	defer node3.Close()
+
+	info2, info3 := node2.NodeInfo(t), node3.NodeInfo(t)
+	if err := node1.Directory.RegisterNode(&info2); err != nil {
+		t.Fatalf("Failed to register node2: %v", err)
+	}
+	if err := node2.Directory.RegisterNode(&info3); err != nil {
+		t.Fatalf("Failed to register node3: %v", err)
+	}
+
+	msg := &common.Message{
+		ID:               testPayloadID("msg-onion-node-id"),
+		DestinationID:    testPayloadID("onion-node-id-session"),
+		Timestamp:        time.Now(),
+		MessageType:      common.MessageTypeText,
+		EncryptedContent: paddedContent("routed by node ID"),
+		TTL:              time.Now().Add(24 * time.Hour),
+	}
+
+	// Only the entry node needs a reachable address
+	path := []common.NodeInfo{node1.NodeInfo(t), info2, info3}
+	path[1].Address = "node2.invalid"
+	path[2].Address = "node3.invalid"
+
+	status := sendOnionMessage(t, node1.Server.URL, path, msg, &onion.BuildOptions{RouteByNodeID: true})
+
+	if status != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", status)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		messages, err := node3.Swarm.RetrieveMessages(msg.DestinationID)
+		if err == nil && len(messages) == 1 && messages[0].ID == msg.ID {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("Message was not delivered at the exit node")
+}
+
+// TestOnionFragmentedDelivery sends a message too large for one packet as
+// several packets and checks it is stored once reassembled
+func TestOnionFragmentedDelivery(t *testing.T) {
+	node := SetupTestNode(t, "node1")
+	defer node.Close()
+
+	msg := &common.Message{
+		ID:               testPayloadID("msg-onion-fragmented"),
+		DestinationID:    testPayloadID("onion-fragmented-session"),
+		Timestamp:        time.Now(),
+		MessageType:      common.MessageTypeAttachment,
+		EncryptedContent: paddedContent(strings.Repeat("attachment ", 200)),
+		TTL:              time.Now().Add(24 * time.Hour),
+	}
+	payloads, err := common.EncodeMessageFragments(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode fragments: %v", err)
+	}
+	if len(payloads) < 2 {
+		t.Fatalf("Expected several fragments, got %d", len(payloads))
+	}
+
+	path := []common.NodeInfo{node.NodeInfo(t)}
+	for i := len(payloads) - 1; i >= 0; i-- {
+		if messages, _ := node.Swarm.RetrieveMessages(msg.DestinationID); len(messages) != 0 {
+			t.Fatalf("Message stored before fragment %d arrived", i)
+		}
+
+		packet, err := onion.BuildPacket(path, payloads[i], nil)
+		if err != nil {
+			t.Fatalf("Failed to build packet: %v", err)
+		}
+		resp, err := http.Post(
+			fmt.Sprintf("%s/v1/onion", node.Server.URL),
+			"application/octet-stream",
+			bytes.NewReader(packet),
+		)
+		if err != nil {
+			t.Fatalf("Failed to send packet: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+	}
+
+	messages, err := node.Swarm.RetrieveMessages(msg.DestinationID)
+	if err != nil {
+		t.Fatalf("Failed to retrieve messages: %v", err)
+	}
+	if len(messages) != 1 || !bytes.Equal(messages[0].EncryptedContent, msg.EncryptedContent) {
+		t.Errorf("Expected reassembled message %s, got %d messages", msg.ID, len(messages))
+	}
+}
+
+// TestOnionSURBReply sends a reply on a SURB and collects it at the last hop
+func TestOnionSURBReply(t *testing.T) {
+	node1 := SetupTestNode(t, "node1")
+	node2 := SetupTestNode(t, "node2")
+	node3 := SetupTestNode(t, "node3")
+	defer node1.Close()
+	defer node2.Close()
+	defer node3.Close()
+
+	// The originator builds the SURB and keeps the keys
+	path := []common.NodeInfo{node1.NodeInfo(t), node2.NodeInfo(t), node3.NodeInfo(t)}
+	surb, keys, err := onion.BuildSURB(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to build SURB: %v", err)
+	}
+	encoded, err := surb.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to encode SURB: %v", err)
+	}
+
+	// The recipient replies without knowing the path
+	var received onion.SURB
+	if err := received.UnmarshalBinary(encoded); err != nil {
+		t.Fatalf("Failed to decode SURB: %v", err)
+	}
+	packet, err := onion.BuildReplyPacket(&received, []byte("delivery receipt"))
+	if err != nil {
+		t.Fatalf("Failed to build reply: %v", err)
+	}
+
+	resp, err := http.Post(
+		fmt.Sprintf("http://%s/v1/onion", received.FirstHop),
+		"application/octet-stream",
+		bytes.NewReader(packet),
+	)
+	if err != nil {
+		t.Fatalf("Failed to send reply: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		messages, err := node3.Swarm.RetrieveMessages(onion.SURBDestination(keys.ID))
+		if err == nil && len(messages) == 1 {
+			plaintext, err := onion.OpenReply(keys, messages[0].EncryptedContent)
+			if err != nil {
+				t.Fatalf("Failed to open reply: %v", err)
+			}
+			if got := string(bytes.TrimRight(plaintext, "\x00")); got != "delivery receipt" {
+				t.Errorf("Reply = %q, want %q", got, "delivery receipt")
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("Reply was not delivered at the last hop")
+}
+
+func TestOnionRequestRetrieve(t *testing.T) {
+	node1 := SetupTestNode(t, "node1")
+	node2 := SetupTestNode(t, "node2")
+	node3 := SetupTestNode(t, "node3")
+	defer node1.Close()
+	defer node2.Close()
+	defer node3.Close()
+
+	msg := &common.Message{
+		ID:               "msg-request",
+		DestinationID:    "session-request",
+		EncryptedContent: paddedContent("stored for an anonymous fetch"),
+		Timestamp:        time.Now(),
+	}
+	if err := node3.Swarm.StoreMessage(msg); err != nil {
+		t.Fatalf("Failed to store message: %v", err)
+	}
+
+	// Node 3 answers without learning who asked
+	path := []common.NodeInfo{node1.NodeInfo(t), node2.NodeInfo(t), node3.NodeInfo(t)}
+	packet, keys, err := onion.BuildRequest(path, &onion.Request{
+		Method: "GET",
+		Path:   "/v1/swarm/messages/session-request",
+	}, nil)
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+
+	resp, err := http.Post(node1.Server.URL+"/v1/onion/request", "application/octet-stream", bytes.NewReader(packet))
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	sealed, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	response, err := onion.OpenResponse(keys, sealed)
+	if err != nil {
+		t.Fatalf("Failed to open response: %v", err)
+	}
+	if response.Status != http.StatusOK {
+		t.Fatalf("Response status = %d, want 200", response.Status)
+	}
+	var messages []*common.Message
+	if err := json.Unmarshal(response.Body, &messages); err != nil {
+		t.Fatalf("Failed to decode messages: %v", err)
+	}
+	if len(messages) != 1 || messages[0].ID != msg.ID {
+		t.Errorf("Retrieved %d messages, want %s", len(messages), msg.ID)
+	}
+}
+
+// TestCircuitRetrieve builds a circuit once and fetches over it repeatedly
+func TestCircuitRetrieve(t *testing.T) {
+	node1 := SetupTestNode(t, "node1")
+	node2 := SetupTestNode(t, "node2")
+	node3 := SetupTestNode(t, "node3")
+	defer node1.Close()
+	defer node2.Close()
+	defer node3.Close()
+
+	msg := &common.Message{
+		ID:               "msg-circuit",
+		DestinationID:    "session-circuit",
+		EncryptedContent: paddedContent("stored for a circuit fetch"),
+		Timestamp:        time.Now(),
+	}
+	if err := node3.Swarm.StoreMessage(msg); err != nil {
+		t.Fatalf("Failed to store message: %v", err)
+	}
+
+	// Each hop extends the circuit to a node from its directory
+	path := []common.NodeInfo{node1.NodeInfo(t), node2.NodeInfo(t), node3.NodeInfo(t)}
+	if err := node1.Directory.RegisterNode(&path[1]); err != nil {
+		t.Fatalf("Failed to register node2: %v", err)
+	}
+	if err := node2.Directory.RegisterNode(&path[2]); err != nil {
+		t.Fatalf("Failed to register node3: %v", err)
+	}
+	
+	sender := forwarder.NewHTTPSender("http", 5*time.Second)
+	circuit, err := onion.BuildCircuit(path, sender.SendCell)
+	if err != nil {
+		t.Fatalf("Failed to build circuit: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		cell, err := circuit.Request(&onion.Request{Method: "GET", Path: "/v1/swarm/messages/session-circuit"})
+		if err != nil {
+			t.Fatalf("Failed to build request cell: %v", err)
+		}
+		answer, err := sender.SendCell(circuit.FirstHop(), cell)
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		response, err := circuit.OpenResponse(answer)
+		if err != nil {
+			t.Fatalf("Failed to open response: %v", err)
+		}
+
+		var messages []*common.Message
+		if err := json.Unmarshal(response.Body, &messages); err != nil {
+			t.Fatalf("Failed to decode messages: %v", err)
+		}
+		if response.Status != http.StatusOK || len(messages) != 1 || messages[0].ID != msg.ID {
+			t.Errorf("Request %d: status %d, %d messages", i, response.Status, len(messages))
+		}
+	}
+
+	if _, err := sender.SendCell(circuit.FirstHop(), circuit.Destroy()); err != nil {
+		t.Fatalf("Failed to destroy circuit: %v", err)
+	}
+	for _, node := range []*TestNode{node1, node2, node3} {
+		if open := node.Circuits.GetStats().Open; open != 0 {
+			t.Errorf("%s: %d circuits open after destroy", node.ID, open)
+		}
+	}
+}
+
+// TestDirectoryRegistrationProvesKey tests that registrations must be signed
+// by the node's identity key and cannot take over another node's entry
+func TestDirectoryRegistrationProvesKey(t *testing.T) {
+	node1 := SetupTestNode(t, "node1")
+	node2 := SetupTestNode(t, "node2")
+	defer node1.Close()
+	defer node2.Close()
+
+	info1, info2 := node1.NodeInfo(t), node2.NodeInfo(t)
+	if err := node1.Directory.RegisterNode(&info1); err != nil {
+		t.Fatalf("Failed to register node1: %v", err)
+	}
+
+	unsigned := info2
+	unsigned.Signature = nil
+	if err := node1.Directory.RegisterNode(&unsigned); err == nil {
+		t.Error("Unsigned registration accepted")
+	}
+
+	// Even signed by its holder, an identity key stays bound to one node ID
+	stolenKey := info1
+	stolenKey.ID = "node2"
+	common.SignRegistration(node1.PrivateKey, &stolenKey)
+	if err := node1.Directory.RegisterNode(&stolenKey); err == nil {
+		t.Error("Identity key registered under a second node ID")
+	}
+
+	// node2's key under node1's ID
+	hijack := info2
+	hijack.ID = "node1"
+	common.SignRegistration(node2.PrivateKey, &hijack)
+	if err := node1.Directory.RegisterNode(&hijack); err == nil {
+		t.Error("Node ID taken over with another identity key")
+	}
+
+	if resolved, err := node1.Directory.ResolveNode(info1.PublicKey); err != nil || resolved.Address != info1.Address {
+		t.Errorf("ResolveNode = %v, %v, want node1's entry", resolved, err)
+	}
+}
+
 // TestInvalidPacket tests handling of invalid onion packets
 func TestInvalidPacket(t *testing.T) {
 	node := SetupTestNode(t, "node1")
@@ -431,7 +1052,7 @@ func TestMessageTypes(t *testing.T) {
 				DestinationID:    "type-test-session",
 				Timestamp:        time.Now(),
 				MessageType:      mt.msgType,
-				EncryptedContent: []byte("test content"),
+				EncryptedContent: paddedContent("test content"),
 				TTL:              time.Now().Add(24 * time.Hour),
 				ReplicaCount:     1,
 			}